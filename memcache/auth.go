@@ -0,0 +1,85 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "bufio"
+    "bytes"
+    "errors"
+    "fmt"
+)
+
+// ErrAuthFailed is returned when a server rejects the credentials set
+// with SetAuth.
+var ErrAuthFailed = errors.New("memcache: authentication failed")
+
+// authKey is the key sent with the credentials. The server ignores it.
+const authKey = "auth"
+
+// credentials are the username and password set with SetAuth.
+type credentials struct {
+    username, password string
+}
+
+// SetAuth makes the client authenticate each new connection with the
+// given username and password before using it, as servers started
+// with SASL and an auth file (memcached 1.5.15 or later with -Y, and
+// hosted services built on it) require of text protocol clients. The
+// credentials are sent in the clear, as with SASL PLAIN.
+//
+// Connections authenticated with earlier credentials are not reused:
+// idle ones are closed at once, those in use when they are released
+// and those shared by Multiplex once their outstanding requests are
+// answered, so later operations run on connections authenticated with
+// the new credentials. An empty username turns authentication off.
+func (c *Client) SetAuth(username, password string) {
+    c.lk.Lock()
+    c.creds = nil
+    if username != "" {
+        c.creds = &credentials{username, password}
+    }
+    c.authGen++
+    var idle []*conn
+    for key, freelist := range c.freeconn {
+        idle = append(idle, freelist...)
+        delete(c.freeconn, key)
+    }
+    c.lk.Unlock()
+
+    for _, cn := range idle {
+        cn.close("credentials changed")
+    }
+    c.drainMuxConns()
+}
+
+// authenticate sends creds on a new connection. With text protocol
+// authentication, the first command on a connection must be a set
+// whose data is the username and password separated by a space.
+func (creds *credentials) authenticate(rw *bufio.ReadWriter) error {
+    data := creds.username + " " + creds.password
+    line, err := writeReadLine(rw, "set %s 0 0 %d\r\n%s\r\n", authKey, len(data), data)
+    if err != nil {
+        return err
+    }
+    switch {
+    case bytes.Equal(line, resultStored):
+        return nil
+    case bytes.HasPrefix(line, resultClientErrorPrefix):
+        return ErrAuthFailed
+    }
+    return fmt.Errorf("memcache: unexpected response line from authentication: %q", line)
+}
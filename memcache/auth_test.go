@@ -0,0 +1,134 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "bufio"
+    "io"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+)
+
+// authServer returns a fake server requiring text protocol
+// authentication as "user" with password "secret". setValid changes
+// the accepted "username password" pair.
+func authServer(t *testing.T) (fs *fakeServer, setValid func(string)) {
+    fs = newFakeServer(t)
+    var mu sync.Mutex
+    valid := "user secret"
+    authed := make(map[*bufio.ReadWriter]bool)
+    fs.handler = func(line string, rw *bufio.ReadWriter) bool {
+        mu.Lock()
+        defer mu.Unlock()
+        if authed[rw] {
+            return false
+        }
+        f := strings.Fields(line)
+        if len(f) != 5 || f[0] != "set" {
+            rw.WriteString("CLIENT_ERROR unauthenticated\r\n")
+            return true
+        }
+        size, _ := strconv.Atoi(f[4])
+        buf := make([]byte, size+2)
+        io.ReadFull(rw, buf)
+        if string(buf[:size]) != valid {
+            rw.WriteString("CLIENT_ERROR authentication failure\r\n")
+            return true
+        }
+        authed[rw] = true
+        rw.WriteString("STORED\r\n")
+        return true
+    }
+    return fs, func(s string) {
+        mu.Lock()
+        defer mu.Unlock()
+        valid = s
+    }
+}
+
+func TestSetAuth(t *testing.T) {
+    fs, setValid := authServer(t)
+    c := New(fs.Addr())
+
+    if err := c.Set(&Item{Key: "k", Value: []byte("v")}); err == nil {
+        t.Fatal("Set without credentials succeeded")
+    }
+
+    c.SetAuth("user", "wrong")
+    if err := c.Set(&Item{Key: "k", Value: []byte("v")}); err != ErrAuthFailed {
+        t.Fatalf("Set with wrong credentials = %v, want ErrAuthFailed", err)
+    }
+
+    c.SetAuth("user", "secret")
+    if err := c.Set(&Item{Key: "k", Value: []byte("v")}); err != nil {
+        t.Fatalf("Set with credentials = %v", err)
+    }
+    if it, err := c.Get("k"); err != nil || string(it.Value) != "v" {
+        t.Fatalf("Get = %v, %v; want v", it, err)
+    }
+    dials := fs.numDials()
+
+    // The pooled connection is reused until the credentials change.
+    if _, err := c.Get("k"); err != nil {
+        t.Fatal(err)
+    }
+    if n := fs.numDials(); n != dials {
+        t.Errorf("Get dialed %d new connections, want 0", n-dials)
+    }
+
+    setValid("user rotated")
+    c.SetAuth("user", "rotated")
+    if _, err := c.Get("k"); err != nil {
+        t.Fatalf("Get after rotating credentials = %v", err)
+    }
+    if n := fs.numDials(); n != dials+1 {
+        t.Errorf("Get after rotating credentials dialed %d new connections, want 1", n-dials)
+    }
+}
+
+func TestSetAuthMultiplex(t *testing.T) {
+    fs, setValid := authServer(t)
+    c := New(fs.Addr())
+    c.Multiplex = true
+
+    if _, err := c.Get("k"); err == nil || err == ErrCacheMiss {
+        t.Fatalf("Get without credentials = %v, want an error", err)
+    }
+    c.SetAuth("user", "secret")
+    if _, err := c.Get("k"); err != ErrCacheMiss {
+        t.Fatalf("multiplexed Get with credentials = %v, want ErrCacheMiss", err)
+    }
+    dials := fs.numDials()
+    if _, err := c.Get("k"); err != ErrCacheMiss {
+        t.Fatal(err)
+    }
+    if d := fs.numDials(); d != dials {
+        t.Errorf("multiplexed connection redialed with unchanged credentials")
+    }
+
+    // New credentials retire the authenticated connection.
+    setValid("user other")
+    c.SetAuth("user", "other")
+    if _, err := c.Get("k"); err != ErrCacheMiss {
+        t.Fatalf("multiplexed Get after SetAuth = %v, want ErrCacheMiss", err)
+    }
+    if d := fs.numDials(); d != dials+1 {
+        t.Errorf("SetAuth led to %d new dials, want 1", d-dials)
+    }
+}
@@ -0,0 +1,275 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "net"
+    "strings"
+    "sync"
+    "sync/atomic"
+)
+
+// ErrWrongServer is returned by ReadThenWrite for keys that are not
+// stored on the same server as the first key read.
+var ErrWrongServer = errors.New("memcache: key is on a different server")
+
+// Batch is a list of operations to be sent together. Operations for
+// the same server are written to a single connection and flushed once,
+// then their responses are read back in the order they were queued.
+//
+// A Batch is not safe for concurrent use.
+type Batch struct {
+    c   *Client
+    ops []batchOp
+}
+
+// batchOp is one queued operation. write writes the command without
+// flushing; read consumes its response line(s) and returns the
+// operation's result.
+type batchOp struct {
+    key   string
+    check func() error // if non-nil, validates the op before any write
+    write func(w *bufio.Writer) error
+    read  func(r *bufio.Reader) error
+}
+
+// NewBatch returns an empty Batch that runs its operations with c.
+func (c *Client) NewBatch() *Batch {
+    return &Batch{c: c}
+}
+
+// Len returns the number of queued operations.
+func (b *Batch) Len() int {
+    return len(b.ops)
+}
+
+func (b *Batch) storage(verb string, item *Item) *Batch {
+    b.ops = append(b.ops, batchOp{
+        key: item.Key,
+        check: func() error {
+            return b.c.checkFlags(verb, item.Flags)
+        },
+        write: func(w *bufio.Writer) error {
+            return b.c.writeStorage(w, verb, item)
+        },
+        read: func(r *bufio.Reader) error {
+            line, err := readLine(r)
+            if err != nil {
+                return err
+            }
+            return storeResult(verb, line)
+        },
+    })
+    return b
+}
+
+// Set queues an unconditional write of item.
+func (b *Batch) Set(item *Item) *Batch {
+    return b.storage("set", item)
+}
+
+// Add queues a write of item that succeeds only if its key is absent.
+func (b *Batch) Add(item *Item) *Batch {
+    return b.storage("add", item)
+}
+
+// CompareAndSwap queues a compare-and-swap of an item previously
+// returned by Get.
+func (b *Batch) CompareAndSwap(item *Item) *Batch {
+    return b.storage("cas", item)
+}
+
+// Delete queues the deletion of key.
+func (b *Batch) Delete(key string) *Batch {
+    b.ops = append(b.ops, batchOp{
+        key: key,
+        write: func(w *bufio.Writer) error {
+            atomic.AddUint64(&b.c.metrics.deletes, 1)
+            _, err := fmt.Fprintf(w, "delete %s\r\n", key)
+            return err
+        },
+        read: func(r *bufio.Reader) error {
+            line, err := readLine(r)
+            if err != nil {
+                return err
+            }
+            return expectResult(line, resultDeleted)
+        },
+    })
+    return b
+}
+
+// Exec sends every queued operation and returns one result per
+// operation, in the order they were queued. Operations for different
+// servers run concurrently. If a connection fails, every operation for
+// that server that had not yet completed reports the failure.
+//
+// The Batch is left unchanged and may be executed again.
+func (b *Batch) Exec() []error {
+    results := make([]error, len(b.ops))
+    opMap := make(map[net.Addr][]int)
+    for i, op := range b.ops {
+        if err := b.c.checkOp(op); err != nil {
+            results[i] = err
+            continue
+        }
+        addr, err := b.c.selector.PickServer(op.key)
+        if err != nil {
+            results[i] = err
+            continue
+        }
+        opMap[addr] = append(opMap[addr], i)
+    }
+
+    var wg sync.WaitGroup
+    for addr, idx := range opMap {
+        wg.Add(1)
+        go func(addr net.Addr, idx []int) {
+            defer wg.Done()
+            b.execOnAddr(addr, idx, results)
+        }(addr, idx)
+    }
+    wg.Wait()
+    return results
+}
+
+// checkOp returns the error op fails with before anything is written.
+func (c *Client) checkOp(op batchOp) error {
+    if !c.validKey(op.key) {
+        return ErrMalformedKey
+    }
+    if op.check != nil {
+        return op.check()
+    }
+    return nil
+}
+
+func (b *Batch) execOnAddr(addr net.Addr, idx []int, results []error) {
+    done := 0
+    err := b.c.withAddrRwWrite(addr, func(rw *bufio.ReadWriter) (err error) {
+        done, err = b.execOnConn(rw, idx, results)
+        return err
+    })
+    if err != nil {
+        for _, i := range idx[done:] {
+            results[i] = err
+        }
+    }
+}
+
+// execOnConn runs the operations idx over rw, storing their results,
+// and returns how many completed before any connection failure.
+func (b *Batch) execOnConn(rw *bufio.ReadWriter, idx []int, results []error) (done int, err error) {
+    for _, i := range idx {
+        if err := b.ops[i].write(rw.Writer); err != nil {
+            return 0, err
+        }
+    }
+    if err := rw.Flush(); err != nil {
+        return 0, err
+    }
+    for _, i := range idx {
+        err := b.ops[i].read(rw.Reader)
+        if err != nil && !resumableError(err) {
+            return done, err
+        }
+        results[i] = err
+        done++
+    }
+    return done, nil
+}
+
+// ReadThenWrite gets the items for keys, then calls decide with those
+// found and a Batch on which to queue writes that depend on them. The
+// writes are sent over the same connection as the read, which is held
+// throughout, so no other operation of this client can use it in
+// between. All keys, read or written, must be stored on the same
+// server as the first key read; writes for other keys fail with
+// ErrWrongServer.
+//
+// ReadThenWrite returns one result per queued write, as Batch.Exec
+// does, and the error of the read, if any. If the read fails, decide
+// is not called.
+func (c *Client) ReadThenWrite(keys []string, decide func(items map[string]*Item, b *Batch)) ([]error, error) {
+    if len(keys) == 0 {
+        return nil, nil
+    }
+    var addr net.Addr
+    for _, key := range keys {
+        if !c.validKey(key) {
+            return nil, ErrMalformedKey
+        }
+        a, err := c.selector.PickServer(key)
+        if err != nil {
+            return nil, err
+        }
+        if addr == nil {
+            addr = a
+        } else if a.String() != addr.String() {
+            return nil, ErrWrongServer
+        }
+    }
+
+    var results []error
+    var idx []int
+    done := 0
+    err := c.withAddrRwWrite(addr, func(rw *bufio.ReadWriter) (err error) {
+        if _, err := fmt.Fprintf(rw, "gets %s\r\n", strings.Join(keys, " ")); err != nil {
+            return err
+        }
+        if err := rw.Flush(); err != nil {
+            return err
+        }
+        items := make(map[string]*Item)
+        if err := c.parseGetResponse(rw.Reader, len(keys), func(it *Item) { items[it.Key] = it }); err != nil {
+            return err
+        }
+
+        b := c.NewBatch()
+        decide(items, b)
+        results = make([]error, len(b.ops))
+        for i, op := range b.ops {
+            if err := c.checkOp(op); err != nil {
+                results[i] = err
+                continue
+            }
+            a, err := c.selector.PickServer(op.key)
+            switch {
+            case err != nil:
+                results[i] = err
+            case a.String() != addr.String():
+                results[i] = ErrWrongServer
+            default:
+                idx = append(idx, i)
+            }
+        }
+        done, err = b.execOnConn(rw, idx, results)
+        return err
+    })
+    if err != nil && results == nil {
+        return nil, err
+    }
+    if err != nil {
+        for _, i := range idx[done:] {
+            results[i] = err
+        }
+    }
+    return results, nil
+}
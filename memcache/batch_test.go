@@ -0,0 +1,104 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "net"
+    "strings"
+    "testing"
+)
+
+func TestBatchDeleteThenSet(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    if err := c.Set(&Item{Key: "old", Value: []byte("stale")}); err != nil {
+        t.Fatal(err)
+    }
+
+    results := c.NewBatch().
+        Delete("old").
+        Set(&Item{Key: "new", Value: []byte("fresh")}).
+        Delete("missing").
+        Add(&Item{Key: "new", Value: []byte("dup")}).
+        Exec()
+
+    want := []error{nil, nil, ErrCacheMiss, ErrNotStored}
+    if len(results) != len(want) {
+        t.Fatalf("got %d results, want %d", len(results), len(want))
+    }
+    for i := range want {
+        if results[i] != want[i] {
+            t.Errorf("result %d = %v, want %v", i, results[i], want[i])
+        }
+    }
+    if _, err := c.Get("old"); err != ErrCacheMiss {
+        t.Errorf("Get(old) = %v, want ErrCacheMiss", err)
+    }
+    if it, err := c.Get("new"); err != nil || string(it.Value) != "fresh" {
+        t.Errorf("Get(new) = %v, %v; want fresh", it, err)
+    }
+    if n := fs.numDials(); n != 1 {
+        t.Errorf("batch used %d connections, want 1", n)
+    }
+}
+
+func TestBatchMalformedKey(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    results := c.NewBatch().Delete("bad key").Set(&Item{Key: "ok", Value: []byte("v")}).Exec()
+    if results[0] != ErrMalformedKey || results[1] != nil {
+        t.Errorf("results = %v, want [ErrMalformedKey <nil>]", results)
+    }
+}
+
+func TestReadThenWrite(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    if err := c.Set(&Item{Key: "stock", Value: []byte("3")}); err != nil {
+        t.Fatal(err)
+    }
+    closed := 0
+    c.OnConnClose = func(net.Addr, string) { closed++ }
+
+    results, err := c.ReadThenWrite([]string{"stock", "reserved"}, func(items map[string]*Item, b *Batch) {
+        if items["stock"] != nil && items["reserved"] == nil {
+            b.Add(&Item{Key: "reserved", Value: items["stock"].Value})
+        }
+    })
+    if err != nil || len(results) != 1 || results[0] != nil {
+        t.Fatalf("ReadThenWrite = %v, %v; want one successful write", results, err)
+    }
+    if it, err := c.Get("reserved"); err != nil || string(it.Value) != "3" {
+        t.Errorf("Get(reserved) = %v, %v; want 3", it, err)
+    }
+
+    results, err = c.ReadThenWrite([]string{"stock", "reserved"}, func(items map[string]*Item, b *Batch) {
+        if items["reserved"] == nil {
+            t.Error("second read missed the reserved item")
+        }
+    })
+    if err != nil || len(results) != 0 {
+        t.Errorf("ReadThenWrite without writes = %v, %v", results, err)
+    }
+    if n := fs.numDials(); n != 1 || closed != 0 {
+        t.Errorf("used %d connections and closed %d, want one kept open", n, closed)
+    }
+    want := []string{"set stock 0 0 1", "gets stock reserved", "add reserved 0 0 1"}
+    if got := fs.commands(); strings.Join(got[:3], "|") != strings.Join(want, "|") {
+        t.Errorf("commands = %q, want %q first", got, want)
+    }
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    // defaultBigChunkSize is used when BigChunkSize is zero.
+    defaultBigChunkSize = 1000 * 1000
+
+    // defaultMaxBigSize bounds the values GetBig assembles when
+    // MaxReadValueSize is zero.
+    defaultMaxBigSize = 1 << 30
+)
+
+// bigChunkKey returns the key of the i'th chunk of generation gen of
+// the big value stored under key.
+func bigChunkKey(key, gen string, i int) string {
+    return key + "#" + gen + "#" + strconv.Itoa(i)
+}
+
+// bigManifest is what SetBig stores under the key of a big value.
+type bigManifest struct {
+    n, size int
+    gen     string
+}
+
+// parseBigManifest parses the manifest m stored under key.
+func parseBigManifest(key string, m []byte) (bigManifest, error) {
+    var bm bigManifest
+    f := strings.Fields(string(m))
+    if len(f) == 3 {
+        var err1, err2 error
+        bm.n, err1 = strconv.Atoi(f[0])
+        bm.size, err2 = strconv.Atoi(f[1])
+        bm.gen = f[2]
+        if err1 == nil && err2 == nil && bm.n >= 0 && bm.size >= 0 {
+            return bm, nil
+        }
+    }
+    return bm, fmt.Errorf("memcache: %q does not hold a SetBig manifest", key)
+}
+
+// SetBig stores a value that may exceed the server's maximum item
+// size. The value is split into chunks of at most BigChunkSize bytes,
+// stored under keys of the form "key#gen#0", "key#gen#1" and so on, and
+// a manifest recording the number of chunks, the total size and the
+// generation gen is stored under key itself once all the chunks are.
+// Each call writes a new generation, so a SetBig that fails partway
+// leaves the previous value intact; the chunks of the value it
+// replaces are deleted once the new manifest is stored. The chunks may
+// land on different servers. The value must be read back with GetBig.
+func (c *Client) SetBig(key string, value []byte, exp int32) error {
+    chunkSize := c.BigChunkSize
+    if chunkSize <= 0 {
+        chunkSize = defaultBigChunkSize
+    }
+    n := (len(value) + chunkSize - 1) / chunkSize
+    gen := strconv.FormatInt(time.Now().UnixNano(), 36)
+    if !c.validKey(key) || !c.validKey(bigChunkKey(key, gen, n)) {
+        return ErrMalformedKey
+    }
+    var old *bigManifest
+    if it, err := c.Get(key); err == nil {
+        if bm, err := parseBigManifest(key, it.Value); err == nil {
+            old = &bm
+        }
+    }
+    for i := 0; i < n; i++ {
+        end := (i + 1) * chunkSize
+        if end > len(value) {
+            end = len(value)
+        }
+        chunk := &Item{Key: bigChunkKey(key, gen, i), Value: value[i*chunkSize : end], Expiration: exp}
+        if err := c.Set(chunk); err != nil {
+            return err
+        }
+    }
+    manifest := fmt.Sprintf("%d %d %s", n, len(value), gen)
+    if err := c.Set(&Item{Key: key, Value: []byte(manifest), Expiration: exp}); err != nil {
+        return err
+    }
+    if old != nil && old.gen != gen {
+        keys := make([]string, old.n)
+        for i := range keys {
+            keys[i] = bigChunkKey(key, old.gen, i)
+        }
+        c.DeleteMulti(keys)
+    }
+    return nil
+}
+
+// GetBig returns a value stored by SetBig. ErrCacheMiss is returned if
+// the manifest or any of the chunks is missing, or if the chunks do not
+// add up to the size the manifest records. A manifest recording a size
+// above MaxReadValueSize, or 1GiB if that is zero, or more chunks than
+// BigChunkSize allows for its size, is rejected with an error.
+func (c *Client) GetBig(key string) ([]byte, error) {
+    it, err := c.Get(key)
+    if err != nil {
+        return nil, err
+    }
+    bm, err := parseBigManifest(key, it.Value)
+    if err != nil {
+        return nil, err
+    }
+    chunkSize := c.BigChunkSize
+    if chunkSize <= 0 {
+        chunkSize = defaultBigChunkSize
+    }
+    limit := c.MaxReadValueSize
+    if limit <= 0 {
+        limit = defaultMaxBigSize
+    }
+    // Every chunk holds at least one byte and at most chunkSize.
+    if bm.size > limit || bm.n > bm.size || int64(bm.size) > int64(bm.n)*int64(chunkSize) {
+        return nil, fmt.Errorf("memcache: SetBig manifest of %q records %d chunks of %d bytes in all, beyond the limits", key, bm.n, bm.size)
+    }
+    keys := make([]string, bm.n)
+    for i := range keys {
+        keys[i] = bigChunkKey(key, bm.gen, i)
+    }
+    chunks, err := c.GetMulti(keys)
+    if err != nil {
+        return nil, err
+    }
+    var value []byte
+    for _, k := range keys {
+        chunk, ok := chunks[k]
+        if !ok || len(value)+len(chunk.Value) > bm.size {
+            return nil, ErrCacheMiss
+        }
+        value = append(value, chunk.Value...)
+    }
+    if len(value) != bm.size {
+        return nil, ErrCacheMiss
+    }
+    return value, nil
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "bytes"
+    "testing"
+)
+
+func TestSetGetBig(t *testing.T) {
+    fs1, fs2 := newFakeServer(t), newFakeServer(t)
+    fs1.maxValueSize, fs2.maxValueSize = 100, 100
+    c := New(fs1.Addr(), fs2.Addr())
+    c.BigChunkSize = 100
+
+    value := make([]byte, 450)
+    for i := range value {
+        value[i] = byte(i)
+    }
+    if err := c.Set(&Item{Key: "big", Value: value}); err == nil {
+        t.Fatal("Set of oversize value succeeded; test server should reject it")
+    }
+    if err := c.SetBig("big", value, 0); err != nil {
+        t.Fatalf("SetBig = %v", err)
+    }
+    got, err := c.GetBig("big")
+    if err != nil {
+        t.Fatalf("GetBig = %v", err)
+    }
+    if !bytes.Equal(got, value) {
+        t.Errorf("GetBig returned %d bytes differing from the %d stored", len(got), len(value))
+    }
+    bm := bigManifestOf(t, c, "big")
+    if it, err := c.Get(bigChunkKey("big", bm.gen, 4)); err != nil || len(it.Value) != 50 {
+        t.Errorf("last chunk = %v, %v; want 50 bytes", it, err)
+    }
+
+    if err := c.Delete(bigChunkKey("big", bm.gen, 2)); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := c.GetBig("big"); err != ErrCacheMiss {
+        t.Errorf("GetBig with a missing chunk = %v, want ErrCacheMiss", err)
+    }
+    if _, err := c.GetBig("nothing"); err != ErrCacheMiss {
+        t.Errorf("GetBig(nothing) = %v, want ErrCacheMiss", err)
+    }
+}
+
+func bigManifestOf(t *testing.T, c *Client, key string) bigManifest {
+    t.Helper()
+    it, err := c.Get(key)
+    if err != nil {
+        t.Fatalf("Get(%q) = %v", key, err)
+    }
+    bm, err := parseBigManifest(key, it.Value)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return bm
+}
+
+func TestSetBigKeepsOldValueOnFailure(t *testing.T) {
+    fs := newFakeServer(t)
+    fs.maxValueSize = 100
+    c := New(fs.Addr())
+    c.BigChunkSize = 100
+
+    old := bytes.Repeat([]byte("a"), 250)
+    if err := c.SetBig("big", old, 0); err != nil {
+        t.Fatal(err)
+    }
+    oldGen := bigManifestOf(t, c, "big").gen
+
+    // Chunks too large for the server fail after the first is written.
+    c.BigChunkSize = 200
+    if err := c.SetBig("big", bytes.Repeat([]byte("b"), 150), 0); err == nil {
+        t.Fatal("SetBig with oversize chunks succeeded")
+    }
+    if got, err := c.GetBig("big"); err != nil || !bytes.Equal(got, old) {
+        t.Errorf("GetBig after a failed SetBig = %d bytes, %v; want the old value", len(got), err)
+    }
+
+    c.BigChunkSize = 100
+    if err := c.SetBig("big", bytes.Repeat([]byte("c"), 150), 0); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := c.Get(bigChunkKey("big", oldGen, 0)); err != ErrCacheMiss {
+        t.Errorf("chunk of the replaced value = %v, want ErrCacheMiss", err)
+    }
+}
+
+func TestGetBigRejectsBadManifest(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    c.BigChunkSize = 100
+    for _, m := range []string{
+        "0 9223372036854775807 g",
+        "9223372036854775807 9223372036854775807 g",
+        "1 500 g",
+        "5 3 g",
+        "2 100",
+    } {
+        if err := c.Set(&Item{Key: "big", Value: []byte(m)}); err != nil {
+            t.Fatal(err)
+        }
+        if _, err := c.GetBig("big"); err == nil || err == ErrCacheMiss {
+            t.Errorf("GetBig with manifest %q = %v, want a manifest error", m, err)
+        }
+    }
+}
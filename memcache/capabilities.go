@@ -0,0 +1,212 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "bufio"
+    "bytes"
+    "fmt"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+var resultVersionPrefix = []byte("VERSION ")
+
+// Capabilities describes which optional features a server supports,
+// as derived from its version and settings.
+type Capabilities struct {
+    // Version is the version string the server reported.
+    Version string
+
+    // SupportsMeta reports support for the meta commands (mg, ms, md,
+    // ma), added in memcached 1.6.0.
+    SupportsMeta bool
+
+    // SupportsSASL reports that the server was started with SASL
+    // authentication enabled.
+    SupportsSASL bool
+
+    // SupportsTouch reports support for the touch command, added in
+    // memcached 1.4.8.
+    SupportsTouch bool
+
+    // SupportsGAT reports support for the gat and gats commands, added
+    // in memcached 1.5.3.
+    SupportsGAT bool
+
+    // SupportsCAS reports that CAS ids are enabled on the server.
+    SupportsCAS bool
+
+    // SupportsDelayedDelete reports support for a lock time in the
+    // delete command, which memcached dropped in 1.4.0.
+    SupportsDelayedDelete bool
+}
+
+// Capabilities queries the server at addr for its version and settings
+// and reports the features it supports. The result also refreshes the
+// client's cached capabilities for addr.
+func (c *Client) Capabilities(addr net.Addr) (Capabilities, error) {
+    caps, err := c.queryCapabilities(addr)
+    if err != nil {
+        return caps, err
+    }
+    c.capsLk.Lock()
+    defer c.capsLk.Unlock()
+    if c.caps == nil {
+        c.caps = make(map[string]cachedCapabilities)
+    }
+    c.caps[addr.String()] = cachedCapabilities{caps: caps, fetched: time.Now()}
+    return caps, nil
+}
+
+// cachedCapabilities is a server's capabilities and when they were
+// queried.
+type cachedCapabilities struct {
+    caps    Capabilities
+    fetched time.Time
+}
+
+// cachedCapabilities returns the capabilities of the server at addr,
+// querying it only if they are not cached or older than
+// CapabilitiesTTL.
+func (c *Client) cachedCapabilities(addr net.Addr) (Capabilities, error) {
+    ttl := c.CapabilitiesTTL
+    if ttl <= 0 {
+        ttl = defaultCapabilitiesTTL
+    }
+    c.capsLk.Lock()
+    cc, ok := c.caps[addr.String()]
+    c.capsLk.Unlock()
+    if ok && time.Since(cc.fetched) < ttl {
+        return cc.caps, nil
+    }
+    return c.Capabilities(addr)
+}
+
+// forgetCapabilities drops the cached capabilities of the server at
+// addr.
+func (c *Client) forgetCapabilities(addr net.Addr) {
+    c.capsLk.Lock()
+    defer c.capsLk.Unlock()
+    delete(c.caps, addr.String())
+}
+
+func (c *Client) queryCapabilities(addr net.Addr) (Capabilities, error) {
+    var caps Capabilities
+    version, err := c.VersionFromAddr(addr)
+    if err != nil {
+        return caps, err
+    }
+    settings, err := c.StatsSettings(addr)
+    if err != nil {
+        return caps, err
+    }
+    caps.Version = version
+    caps.SupportsMeta = versionAtLeast(version, 1, 6, 0)
+    caps.SupportsTouch = versionAtLeast(version, 1, 4, 8)
+    caps.SupportsGAT = versionAtLeast(version, 1, 5, 3)
+    caps.SupportsDelayedDelete = supportsDelayedDelete(version)
+    caps.SupportsSASL = settings.AuthEnabledSasl
+    caps.SupportsCAS = settings.CasEnabled
+    return caps, nil
+}
+
+// Version asks every server for its version, concurrently, and returns
+// the version strings keyed by server address. If some servers fail,
+// the map holds the versions of the others and one of the errors is
+// returned.
+func (c *Client) Version() (map[string]string, error) {
+    addrs, err := c.selector.GetServers()
+    if err != nil {
+        return nil, err
+    }
+    seen := make(map[string]bool, len(addrs))
+    var lk sync.Mutex
+    versions := make(map[string]string)
+    var lastErr error
+    var wg sync.WaitGroup
+    for _, addr := range addrs {
+        if seen[addr.String()] {
+            continue
+        }
+        seen[addr.String()] = true
+        wg.Add(1)
+        go func(addr net.Addr) {
+            defer wg.Done()
+            v, err := c.VersionFromAddr(addr)
+            lk.Lock()
+            defer lk.Unlock()
+            if err != nil {
+                lastErr = err
+            } else {
+                versions[addr.String()] = v
+            }
+        }(addr)
+    }
+    wg.Wait()
+    return versions, lastErr
+}
+
+// VersionFromAddr returns the version string reported by the server
+// at addr.
+func (c *Client) VersionFromAddr(addr net.Addr) (string, error) {
+    var version string
+    err := c.withAddrRw(addr, func(rw *bufio.ReadWriter) error {
+        line, err := writeReadLine(rw, "version\r\n")
+        if err != nil {
+            return err
+        }
+        if !bytes.HasPrefix(line, resultVersionPrefix) || !bytes.HasSuffix(line, crlf) {
+            return fmt.Errorf("memcache: unexpected response line from version: %q", line)
+        }
+        version = string(line[len(resultVersionPrefix) : len(line)-2])
+        return nil
+    })
+    return version, err
+}
+
+// supportsDelayedDelete reports whether a server of the given version
+// accepts "delete <key> <time>".
+func supportsDelayedDelete(version string) bool {
+    return !versionAtLeast(version, 1, 4, 0)
+}
+
+// versionAtLeast reports whether the dotted version string v is at
+// least major.minor.patch. Trailing non-numeric parts of each
+// component, as in "1.6.21-rc1", are ignored.
+func versionAtLeast(v string, major, minor, patch int) bool {
+    want := []int{major, minor, patch}
+    parts := strings.SplitN(v, ".", 3)
+    for i, w := range want {
+        got := 0
+        if i < len(parts) {
+            p := parts[i]
+            end := 0
+            for end < len(p) && p[end] >= '0' && p[end] <= '9' {
+                end++
+            }
+            got, _ = strconv.Atoi(p[:end])
+        }
+        if got != w {
+            return got > w
+        }
+    }
+    return true
+}
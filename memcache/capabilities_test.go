@@ -0,0 +1,145 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "testing"
+)
+
+func TestVersionAtLeast(t *testing.T) {
+    tests := []struct {
+        v    string
+        want bool
+    }{
+        {"1.6.0", true},
+        {"1.6.21", true},
+        {"1.10.0", true},
+        {"2.0", true},
+        {"1.5.22", false},
+        {"1.6", true},
+        {"1.6.0-rc1", true},
+        {"1.4.15", false},
+        {"garbage", false},
+    }
+    for _, tt := range tests {
+        if got := versionAtLeast(tt.v, 1, 6, 0); got != tt.want {
+            t.Errorf("versionAtLeast(%q, 1.6.0) = %v, want %v", tt.v, got, tt.want)
+        }
+    }
+}
+
+func TestCapabilities(t *testing.T) {
+    fs := newFakeServer(t)
+    fs.version = "1.5.10"
+    fs.stats = map[string][]string{
+        "settings": {"maxbytes 67108864", "cas_enabled yes", "auth_enabled_sasl no"},
+    }
+    c := New(fs.Addr())
+    addr, _ := c.selector.PickServer("")
+
+    caps, err := c.Capabilities(addr)
+    if err != nil {
+        t.Fatalf("Capabilities: %v", err)
+    }
+    want := Capabilities{
+        Version:       "1.5.10",
+        SupportsMeta:  false,
+        SupportsSASL:  false,
+        SupportsTouch: true,
+        SupportsGAT:   true,
+        SupportsCAS:   true,
+    }
+    if caps != want {
+        t.Errorf("Capabilities = %+v, want %+v", caps, want)
+    }
+
+    fs.mu.Lock()
+    fs.version = "1.6.21"
+    fs.stats["settings"] = []string{"cas_enabled no", "auth_enabled_sasl yes"}
+    fs.mu.Unlock()
+    caps, err = c.Capabilities(addr)
+    if err != nil {
+        t.Fatalf("Capabilities: %v", err)
+    }
+    if !caps.SupportsMeta || !caps.SupportsSASL || caps.SupportsCAS {
+        t.Errorf("Capabilities = %+v, want meta and SASL without CAS", caps)
+    }
+}
+
+func TestCapabilitiesCached(t *testing.T) {
+    fs := newFakeServer(t)
+    fs.version = "1.2.8"
+    c := New(fs.Addr())
+    versions := func() int {
+        n := 0
+        for _, cmd := range fs.commands() {
+            if cmd == "version" {
+                n++
+            }
+        }
+        return n
+    }
+
+    for i := 0; i < 3; i++ {
+        if err := c.DeleteWithDelay("k", 5); err != ErrCacheMiss {
+            t.Fatalf("DeleteWithDelay = %v, want ErrCacheMiss", err)
+        }
+    }
+    if n := versions(); n != 1 {
+        t.Errorf("capabilities queried %d times, want once", n)
+    }
+
+    // Drop the server's side of the pooled connection, as a restart
+    // would; the next operation fails and forgets the capabilities.
+    fs.mu.Lock()
+    for _, nc := range fs.conns {
+        nc.Close()
+    }
+    fs.mu.Unlock()
+    if err := c.DeleteWithDelay("k", 5); err == nil || err == ErrCacheMiss {
+        t.Fatalf("DeleteWithDelay over a dropped connection = %v, want a connection error", err)
+    }
+    if err := c.DeleteWithDelay("k", 5); err != ErrCacheMiss {
+        t.Fatalf("DeleteWithDelay after reconnect = %v, want ErrCacheMiss", err)
+    }
+    if n := versions(); n != 2 {
+        t.Errorf("capabilities queried %d times, want twice after a reconnect", n)
+    }
+}
+
+func TestVersion(t *testing.T) {
+    fs1, fs2, down := newFakeServer(t), newFakeServer(t), newFakeServer(t)
+    fs1.version = "1.6.21"
+    fs2.version = "1.4.5"
+    c := New(fs1.Addr(), fs2.Addr())
+    versions, err := c.Version()
+    if err != nil {
+        t.Fatalf("Version = %v", err)
+    }
+    want := map[string]string{fs1.Addr(): "1.6.21", fs2.Addr(): "1.4.5"}
+    if len(versions) != len(want) || versions[fs1.Addr()] != want[fs1.Addr()] || versions[fs2.Addr()] != want[fs2.Addr()] {
+        t.Errorf("Version = %v, want %v", versions, want)
+    }
+
+    downAddr := down.Addr()
+    down.Close()
+    c = New(fs1.Addr(), downAddr)
+    versions, err = c.Version()
+    if err == nil || len(versions) != 1 || versions[fs1.Addr()] != "1.6.21" {
+        t.Errorf("Version with a server down = %v, %v; want the live server's version and an error", versions, err)
+    }
+}
@@ -0,0 +1,302 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "bytes"
+    "encoding"
+    "encoding/gob"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "reflect"
+    "strings"
+)
+
+var (
+    // ErrNilCodec is returned by GetObject, SetObject and
+    // CompareAndSwapObject when they are given a nil Codec.
+    ErrNilCodec = errors.New("memcache: nil Codec")
+
+    // ErrNilObject is returned by SetObject and CompareAndSwapObject
+    // when the item's Object is nil.
+    ErrNilObject = errors.New("memcache: item has a nil Object")
+)
+
+// Codec converts between an Item's Object and the bytes stored as its
+// Value.
+type Codec interface {
+    // Marshal encodes item.Object.
+    Marshal(item *Item) ([]byte, error)
+
+    // Unmarshal decodes data into item.Object. If Object is a non-nil
+    // pointer the value is decoded into what it points to; otherwise a
+    // new value is decoded and stored in Object.
+    Unmarshal(data []byte, item *Item) error
+}
+
+var (
+    // GobCodec encodes objects with encoding/gob. The concrete type is
+    // recorded alongside the value so that it can be decoded into a
+    // nil Object, which requires types other than the basic ones to be
+    // registered with gob.Register.
+    GobCodec Codec = gobCodec{}
+
+    // JSONCodec encodes objects with encoding/json. Decoding into a nil
+    // Object yields the generic values json.Unmarshal produces for an
+    // interface{}.
+    JSONCodec Codec = jsonCodec{}
+)
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(item *Item) ([]byte, error) {
+    var buf bytes.Buffer
+    if err := gob.NewEncoder(&buf).Encode(&item.Object); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, item *Item) error {
+    var v interface{}
+    if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v); err != nil {
+        return err
+    }
+    if item.Object == nil {
+        item.Object = v
+        return nil
+    }
+    dst := reflect.ValueOf(item.Object)
+    if dst.Kind() != reflect.Ptr || dst.IsNil() {
+        return fmt.Errorf("memcache: cannot decode into non-pointer Object of type %T", item.Object)
+    }
+    src := reflect.ValueOf(v)
+    if v == nil || !src.Type().AssignableTo(dst.Elem().Type()) {
+        return fmt.Errorf("memcache: cannot decode %T into Object of type %T", v, item.Object)
+    }
+    dst.Elem().Set(src)
+    return nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(item *Item) ([]byte, error) {
+    return json.Marshal(item.Object)
+}
+
+func (jsonCodec) Unmarshal(data []byte, item *Item) error {
+    if item.Object != nil {
+        return json.Unmarshal(data, item.Object)
+    }
+    var v interface{}
+    if err := json.Unmarshal(data, &v); err != nil {
+        return err
+    }
+    item.Object = v
+    return nil
+}
+
+// GetObject fetches the item for key and decodes its value into the
+// returned item's Object with codec. The item keeps its CAS id, so it
+// can be changed and passed to CompareAndSwapObject.
+func (c *Client) GetObject(key string, codec Codec) (*Item, error) {
+    if codec == nil {
+        return nil, ErrNilCodec
+    }
+    it, err := c.Get(key)
+    if err != nil {
+        return nil, err
+    }
+    if err := codec.Unmarshal(it.Value, it); err != nil {
+        return nil, err
+    }
+    return it, nil
+}
+
+// SetObject encodes item.Object with codec into item.Value and writes
+// the item unconditionally.
+func (c *Client) SetObject(item *Item, codec Codec) error {
+    if err := marshalObject(item, codec); err != nil {
+        return err
+    }
+    return c.Set(item)
+}
+
+// CompareAndSwapObject encodes item.Object with codec into item.Value
+// and writes the item with CompareAndSwap. item should have been
+// returned by GetObject.
+func (c *Client) CompareAndSwapObject(item *Item, codec Codec) error {
+    if err := marshalObject(item, codec); err != nil {
+        return err
+    }
+    return c.CompareAndSwap(item)
+}
+
+// CodecClient is a view of a Client that encodes items' Objects with a
+// Codec on writes and decodes values into Objects on reads, so callers
+// can store structured values without handling Item.Value themselves.
+type CodecClient struct {
+    c     *Client
+    codec Codec
+}
+
+// WithCodec returns a view of c that encodes Objects with codec.
+func (c *Client) WithCodec(codec Codec) *CodecClient {
+    return &CodecClient{c: c, codec: codec}
+}
+
+// Get fetches the item for key and decodes its value into v, which
+// should be a pointer, and which becomes the item's Object. If v is
+// nil, a new value is decoded into the Object as Codec.Unmarshal
+// describes. ErrCacheMiss is returned for a cache miss.
+func (cc *CodecClient) Get(key string, v interface{}) (*Item, error) {
+    if cc.codec == nil {
+        return nil, ErrNilCodec
+    }
+    it, err := cc.c.Get(key)
+    if err != nil {
+        return nil, err
+    }
+    it.Object = v
+    if err := cc.codec.Unmarshal(it.Value, it); err != nil {
+        return nil, err
+    }
+    return it, nil
+}
+
+// Set encodes item.Object into item.Value and writes the item
+// unconditionally.
+func (cc *CodecClient) Set(item *Item) error {
+    return cc.c.SetObject(item, cc.codec)
+}
+
+// Add encodes item.Object into item.Value and writes the item if no
+// value already exists for its key.
+func (cc *CodecClient) Add(item *Item) error {
+    if err := marshalObject(item, cc.codec); err != nil {
+        return err
+    }
+    return cc.c.Add(item)
+}
+
+// CompareAndSwap encodes item.Object into item.Value and writes the
+// item, which should have been returned by Get, if it has not been
+// modified since.
+func (cc *CodecClient) CompareAndSwap(item *Item) error {
+    return cc.c.CompareAndSwapObject(item, cc.codec)
+}
+
+func marshalObject(item *Item, codec Codec) error {
+    if codec == nil {
+        return ErrNilCodec
+    }
+    if item.Object == nil {
+        return ErrNilObject
+    }
+    value, err := codec.Marshal(item)
+    if err != nil {
+        return err
+    }
+    item.Value = value
+    return nil
+}
+
+// SetMarshaler writes the binary encoding of m under key,
+// unconditionally, with the given expiration. It suits values such as
+// time.Time that already implement encoding.BinaryMarshaler.
+func (c *Client) SetMarshaler(key string, m encoding.BinaryMarshaler, exp int32) error {
+    value, err := m.MarshalBinary()
+    if err != nil {
+        return err
+    }
+    return c.Set(&Item{Key: key, Value: value, Expiration: exp})
+}
+
+// GetUnmarshaler fetches the item for key and decodes its value into u.
+// ErrCacheMiss is returned, and u left untouched, if the item is not
+// present.
+func (c *Client) GetUnmarshaler(key string, u encoding.BinaryUnmarshaler) error {
+    it, err := c.Get(key)
+    if err != nil {
+        return err
+    }
+    return u.UnmarshalBinary(it.Value)
+}
+
+// ContentTypeOpaque is the content type SetTyped records for values
+// whose content type it does not know, and that GetTyped reports for
+// items whose flags name no known content type.
+const ContentTypeOpaque = "application/octet-stream"
+
+// contentTypeMask selects the bits of an item's flags that SetTyped
+// uses to record the content type.
+const contentTypeMask = 0xff
+
+// contentTypeFlags maps the content types known to SetTyped to the
+// flag values that record them. The values must never change, as they
+// are stored alongside cached items.
+var contentTypeFlags = map[string]uint32{
+    ContentTypeOpaque:        0,
+    "text/plain":             1,
+    "text/html":              2,
+    "application/json":       3,
+    "application/xml":        4,
+    "application/x-protobuf": 5,
+    "application/msgpack":    6,
+    "image/png":              7,
+    "image/jpeg":             8,
+    "image/gif":              9,
+    "text/css":               10,
+    "application/javascript": 11,
+}
+
+var flagContentTypes = make(map[uint32]string)
+
+func init() {
+    for ct, f := range contentTypeFlags {
+        flagContentTypes[f] = ct
+    }
+}
+
+// SetTyped writes value under key, unconditionally, recording its
+// content type in the item's flags so that GetTyped can return it.
+// Parameters such as "; charset=utf-8" are not recorded, and content
+// types outside the small built-in set are recorded as
+// ContentTypeOpaque.
+func (c *Client) SetTyped(key string, value []byte, contentType string, exp int32) error {
+    mediaType := contentType
+    if i := strings.IndexByte(mediaType, ';'); i >= 0 {
+        mediaType = mediaType[:i]
+    }
+    flags := contentTypeFlags[strings.ToLower(strings.TrimSpace(mediaType))]
+    return c.Set(&Item{Key: key, Value: value, Flags: flags, Expiration: exp})
+}
+
+// GetTyped fetches the item for key, returning its value and the
+// content type recorded by SetTyped.
+func (c *Client) GetTyped(key string) (value []byte, contentType string, err error) {
+    it, err := c.Get(key)
+    if err != nil {
+        return nil, "", err
+    }
+    contentType, ok := flagContentTypes[it.Flags&contentTypeMask]
+    if !ok {
+        contentType = ContentTypeOpaque
+    }
+    return it.Value, contentType, nil
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "encoding/gob"
+    "testing"
+    "time"
+)
+
+func TestMarshalerRoundTrip(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+
+    want := time.Date(2013, time.March, 14, 15, 9, 26, 535897932, time.FixedZone("X", 3600))
+    if err := c.SetMarshaler("when", want, 60); err != nil {
+        t.Fatalf("SetMarshaler: %v", err)
+    }
+    var got time.Time
+    if err := c.GetUnmarshaler("when", &got); err != nil {
+        t.Fatalf("GetUnmarshaler: %v", err)
+    }
+    if !got.Equal(want) {
+        t.Errorf("round trip = %v, want %v", got, want)
+    }
+    if _, off := got.Zone(); off != 3600 {
+        t.Errorf("round trip lost zone offset: got %d", off)
+    }
+
+    untouched := time.Unix(42, 0)
+    got = untouched
+    if err := c.GetUnmarshaler("missing", &got); err != ErrCacheMiss {
+        t.Errorf("GetUnmarshaler(missing) = %v, want ErrCacheMiss", err)
+    }
+    if !got.Equal(untouched) {
+        t.Errorf("GetUnmarshaler modified its argument on a miss")
+    }
+}
+
+func TestTypedRoundTrip(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+
+    tests := []struct {
+        key, contentType, want string
+    }{
+        {"json", "application/json", "application/json"},
+        {"html", "text/html; charset=utf-8", "text/html"},
+        {"upper", "Image/PNG", "image/png"},
+        {"unknown", "application/x-made-up", ContentTypeOpaque},
+    }
+    for _, tt := range tests {
+        value := []byte("value of " + tt.key)
+        if err := c.SetTyped(tt.key, value, tt.contentType, 0); err != nil {
+            t.Fatalf("SetTyped(%q): %v", tt.key, err)
+        }
+        got, ct, err := c.GetTyped(tt.key)
+        if err != nil {
+            t.Fatalf("GetTyped(%q): %v", tt.key, err)
+        }
+        if string(got) != string(value) {
+            t.Errorf("GetTyped(%q) value = %q, want %q", tt.key, got, value)
+        }
+        if ct != tt.want {
+            t.Errorf("GetTyped(%q) content type = %q, want %q", tt.key, ct, tt.want)
+        }
+    }
+    if _, _, err := c.GetTyped("missing"); err != ErrCacheMiss {
+        t.Errorf("GetTyped(missing) = %v, want ErrCacheMiss", err)
+    }
+}
+
+type codecPoint struct {
+    X, Y int
+}
+
+func init() {
+    gob.Register(codecPoint{})
+}
+
+func TestObjectRoundTrip(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+
+    for name, codec := range map[string]Codec{"gob": GobCodec, "json": JSONCodec} {
+        key := "point-" + name
+        if err := c.SetObject(&Item{Key: key, Object: codecPoint{1, 2}}, codec); err != nil {
+            t.Fatalf("%s: SetObject: %v", name, err)
+        }
+
+        var p codecPoint
+        it, err := c.Get(key)
+        if err != nil {
+            t.Fatal(err)
+        }
+        it.Object = &p
+        if err := codec.Unmarshal(it.Value, it); err != nil || p != (codecPoint{1, 2}) {
+            t.Errorf("%s: Unmarshal into pointer = %+v, %v", name, p, err)
+        }
+
+        it, err = c.GetObject(key, codec)
+        if err != nil {
+            t.Fatalf("%s: GetObject: %v", name, err)
+        }
+        switch o := it.Object.(type) {
+        case codecPoint:
+            if o != (codecPoint{1, 2}) {
+                t.Errorf("%s: GetObject = %+v", name, o)
+            }
+        case map[string]interface{}:
+            if o["X"] != 1.0 || o["Y"] != 2.0 {
+                t.Errorf("%s: GetObject = %v", name, o)
+            }
+        default:
+            t.Errorf("%s: GetObject returned Object of type %T", name, o)
+        }
+
+        // The item keeps its CAS id through the object path.
+        it.Object = codecPoint{3, 4}
+        if err := c.CompareAndSwapObject(it, codec); err != nil {
+            t.Errorf("%s: CompareAndSwapObject = %v", name, err)
+        }
+        if err := c.CompareAndSwapObject(it, codec); err != ErrCASConflict {
+            t.Errorf("%s: second CompareAndSwapObject = %v, want ErrCASConflict", name, err)
+        }
+    }
+}
+
+func TestObjectErrors(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    if err := c.SetObject(&Item{Key: "k"}, JSONCodec); err != ErrNilObject {
+        t.Errorf("SetObject with nil Object = %v, want ErrNilObject", err)
+    }
+    if err := c.SetObject(&Item{Key: "k", Object: 1}, nil); err != ErrNilCodec {
+        t.Errorf("SetObject with nil Codec = %v, want ErrNilCodec", err)
+    }
+    if _, err := c.GetObject("k", nil); err != ErrNilCodec {
+        t.Errorf("GetObject with nil Codec = %v, want ErrNilCodec", err)
+    }
+    if n := len(fs.commands()); n != 0 {
+        t.Errorf("%d commands sent, want none", n)
+    }
+}
+
+func TestCodecClient(t *testing.T) {
+    fs := newFakeServer(t)
+    cc := New(fs.Addr()).WithCodec(JSONCodec)
+
+    if err := cc.Set(&Item{Key: "p", Object: codecPoint{1, 2}}); err != nil {
+        t.Fatalf("Set: %v", err)
+    }
+    if err := cc.Add(&Item{Key: "p", Object: codecPoint{9, 9}}); err != ErrNotStored {
+        t.Errorf("Add of an existing key = %v, want ErrNotStored", err)
+    }
+    var p codecPoint
+    it, err := cc.Get("p", &p)
+    if err != nil || p != (codecPoint{1, 2}) || it.Object != &p {
+        t.Fatalf("Get = %+v, %v; want {1 2} decoded into the argument", p, err)
+    }
+    p.X = 5
+    if err := cc.CompareAndSwap(it); err != nil {
+        t.Fatalf("CompareAndSwap: %v", err)
+    }
+    var q codecPoint
+    if _, err := cc.Get("p", &q); err != nil || q != (codecPoint{5, 2}) {
+        t.Errorf("Get after CompareAndSwap = %+v, %v; want {5 2}", q, err)
+    }
+    if _, err := cc.Get("missing", &q); err != ErrCacheMiss {
+        t.Errorf("Get(missing) = %v, want ErrCacheMiss", err)
+    }
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "bufio"
+    "strconv"
+)
+
+// The append functions below encode the commands sent on hot paths
+// without going through fmt. Callers append into the spare capacity of
+// the connection's bufio.Writer, obtained with AvailableBuffer, so that
+// encoding a command that fits in the buffer does not allocate.
+
+// appendGetCommand appends "<verb> <key>*\r\n" to b.
+func appendGetCommand(b []byte, verb string, keys []string) []byte {
+    b = append(b, verb...)
+    for _, key := range keys {
+        b = append(b, ' ')
+        b = append(b, key...)
+    }
+    return append(b, "\r\n"...)
+}
+
+// appendStorageCommand appends the command line of a storage command
+// for item whose data block is size bytes long, including its CRLF,
+// to b. exp is the expiration time to send.
+func appendStorageCommand(b []byte, verb string, item *Item, flags uint32, exp int32, size int) []byte {
+    b = append(b, verb...)
+    b = append(b, ' ')
+    b = append(b, item.Key...)
+    b = append(b, ' ')
+    b = strconv.AppendUint(b, uint64(flags), 10)
+    b = append(b, ' ')
+    b = strconv.AppendInt(b, int64(exp), 10)
+    b = append(b, ' ')
+    b = strconv.AppendInt(b, int64(size), 10)
+    if verb == "cas" {
+        b = append(b, ' ')
+        b = strconv.AppendUint(b, item.casid, 10)
+    }
+    return append(b, "\r\n"...)
+}
+
+// appendKeyCommand appends "<verb> <key>\r\n" to b.
+func appendKeyCommand(b []byte, verb, key string) []byte {
+    b = append(b, verb...)
+    b = append(b, ' ')
+    b = append(b, key...)
+    return append(b, "\r\n"...)
+}
+
+// appendIncrDecrCommand appends "<verb> <key> <delta>\r\n" to b.
+func appendIncrDecrCommand(b []byte, verb, key string, delta uint64) []byte {
+    b = append(b, verb...)
+    b = append(b, ' ')
+    b = append(b, key...)
+    b = append(b, ' ')
+    b = strconv.AppendUint(b, delta, 10)
+    return append(b, "\r\n"...)
+}
+
+// appendTouchCommand appends "touch <key> <exp>\r\n" to b.
+func appendTouchCommand(b []byte, key string, exp int32) []byte {
+    b = append(b, "touch "...)
+    b = append(b, key...)
+    b = append(b, ' ')
+    b = strconv.AppendInt(b, int64(exp), 10)
+    return append(b, "\r\n"...)
+}
+
+// writeCommand writes the encoded command cmd to rw, flushes it and
+// reads the response line.
+func writeCommand(rw *bufio.ReadWriter, cmd []byte) ([]byte, error) {
+    if _, err := rw.Write(cmd); err != nil {
+        return nil, err
+    }
+    if err := rw.Flush(); err != nil {
+        return nil, err
+    }
+    return readLine(rw.Reader)
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "math"
+    "strings"
+    "testing"
+)
+
+func TestCommandEncodingMatchesFprintf(t *testing.T) {
+    item := &Item{Key: "user:42", casid: math.MaxUint64}
+    tests := []struct {
+        got, want string
+    }{
+        {string(appendGetCommand(nil, "gets", []string{"a"})), fmt.Sprintf("%s %s\r\n", "gets", "a")},
+        {string(appendGetCommand(nil, "get", []string{"a", "b", "c"})), fmt.Sprintf("%s %s\r\n", "get", strings.Join([]string{"a", "b", "c"}, " "))},
+        {string(appendStorageCommand(nil, "set", item, 0, 0, 0)), fmt.Sprintf("%s %s %d %d %d\r\n", "set", item.Key, uint32(0), int32(0), 0)},
+        {string(appendStorageCommand(nil, "add", item, math.MaxUint32, -1, 1<<20)), fmt.Sprintf("%s %s %d %d %d\r\n", "add", item.Key, uint32(math.MaxUint32), int32(-1), 1<<20)},
+        {string(appendStorageCommand(nil, "cas", item, 7, math.MaxInt32, 12)), fmt.Sprintf("%s %s %d %d %d %d\r\n", "cas", item.Key, uint32(7), int32(math.MaxInt32), 12, item.casid)},
+        {string(appendKeyCommand(nil, "delete", "k")), fmt.Sprintf("delete %s\r\n", "k")},
+        {string(appendIncrDecrCommand(nil, "incr", "n", 0)), fmt.Sprintf("%s %s %d\r\n", "incr", "n", uint64(0))},
+        {string(appendIncrDecrCommand(nil, "decr", "n", math.MaxUint64)), fmt.Sprintf("%s %s %d\r\n", "decr", "n", uint64(math.MaxUint64))},
+    }
+    for _, tt := range tests {
+        if tt.got != tt.want {
+            t.Errorf("encoded %q, want %q", tt.got, tt.want)
+        }
+    }
+}
+
+func BenchmarkEncodeSetCommand(b *testing.B) {
+    item := &Item{Key: "user:profile:123456", Flags: 42, Expiration: 3600}
+    w := bufio.NewWriter(io.Discard)
+    b.Run("Fprintf", func(b *testing.B) {
+        b.ReportAllocs()
+        for i := 0; i < b.N; i++ {
+            fmt.Fprintf(w, "%s %s %d %d %d\r\n", "set", item.Key, item.Flags, item.Expiration, 1024)
+        }
+    })
+    b.Run("Append", func(b *testing.B) {
+        b.ReportAllocs()
+        for i := 0; i < b.N; i++ {
+            w.Write(appendStorageCommand(w.AvailableBuffer(), "set", item, item.Flags, item.Expiration, 1024))
+        }
+    })
+}
+
+func BenchmarkEncodeGetCommand(b *testing.B) {
+    keys := []string{"user:profile:123456"}
+    w := bufio.NewWriter(io.Discard)
+    b.Run("Fprintf", func(b *testing.B) {
+        b.ReportAllocs()
+        for i := 0; i < b.N; i++ {
+            fmt.Fprintf(w, "%s %s\r\n", "gets", strings.Join(keys, " "))
+        }
+    })
+    b.Run("Append", func(b *testing.B) {
+        b.ReportAllocs()
+        for i := 0; i < b.N; i++ {
+            w.Write(appendGetCommand(w.AvailableBuffer(), "gets", keys))
+        }
+    })
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "bytes"
+    "compress/flate"
+    "compress/gzip"
+    "compress/zlib"
+    "errors"
+    "fmt"
+    "io"
+)
+
+// Compression is a value compression algorithm. Its value is the bit
+// pattern recorded in the flags of items it compressed.
+type Compression uint32
+
+// The supported compression algorithms.
+const (
+    CompressionNone    Compression = 0
+    CompressionGzip    Compression = 1 << 28
+    CompressionZlib    Compression = 2 << 28
+    CompressionDeflate Compression = 3 << 28
+)
+
+// FlagCompressionMask selects the bits of Item.Flags reserved for
+// recording how a value was compressed. Applications should not use
+// these bits for their own flags.
+const FlagCompressionMask uint32 = 0xf << 28
+
+// ErrReservedFlags is returned when an item whose flags use the bits of
+// FlagCompressionMask is written with compression enabled.
+var ErrReservedFlags = errors.New("memcache: item flags use the bits reserved for compression")
+
+// checkFlags returns ErrReservedFlags if an item with flags cannot be
+// written with the storage command verb. Pipelined writers call it for
+// every item before writing any, as a failure halfway through leaves
+// the connection out of step.
+func (c *Client) checkFlags(verb string, flags uint32) error {
+    if c.Compression != CompressionNone && verb != "append" && verb != "prepend" && flags&FlagCompressionMask != 0 {
+        return ErrReservedFlags
+    }
+    return nil
+}
+
+func (a Compression) String() string {
+    switch a {
+    case CompressionNone:
+        return "none"
+    case CompressionGzip:
+        return "gzip"
+    case CompressionZlib:
+        return "zlib"
+    case CompressionDeflate:
+        return "deflate"
+    }
+    return fmt.Sprintf("Compression(%#x)", uint32(a))
+}
+
+// compress compresses value with the client's algorithm and records
+// the algorithm in the returned flags.
+func (c *Client) compress(value []byte, flags uint32) ([]byte, uint32, error) {
+    if c.Compression == CompressionNone {
+        return value, flags, nil
+    }
+    if flags&FlagCompressionMask != 0 {
+        return nil, 0, ErrReservedFlags
+    }
+    var buf bytes.Buffer
+    var w io.WriteCloser
+    switch c.Compression {
+    case CompressionGzip:
+        w = gzip.NewWriter(&buf)
+    case CompressionZlib:
+        w = zlib.NewWriter(&buf)
+    case CompressionDeflate:
+        w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+    default:
+        return nil, 0, fmt.Errorf("memcache: unknown compression %v", c.Compression)
+    }
+    if _, err := w.Write(value); err != nil {
+        return nil, 0, err
+    }
+    if err := w.Close(); err != nil {
+        return nil, 0, err
+    }
+    return buf.Bytes(), flags | uint32(c.Compression), nil
+}
+
+// decompresses reports whether values read are to be decompressed.
+func (c *Client) decompresses() bool {
+    return c.Compression != CompressionNone || c.Decompress
+}
+
+// defaultMaxDecompressedSize bounds decompressed values when
+// MaxReadValueSize is not set.
+const defaultMaxDecompressedSize = 64 << 20
+
+// decompressItem decompresses it.Value according to the algorithm
+// recorded in it.Flags, and clears the record from the flags. A value
+// that decompresses to more than MaxReadValueSize bytes, or 64MB if
+// that is not set, fails with ErrResponseTooLarge.
+func (c *Client) decompressItem(it *Item) error {
+    alg := Compression(it.Flags & FlagCompressionMask)
+    if alg == CompressionNone {
+        return nil
+    }
+    var r io.ReadCloser
+    var err error
+    switch alg {
+    case CompressionGzip:
+        r, err = gzip.NewReader(bytes.NewReader(it.Value))
+    case CompressionZlib:
+        r, err = zlib.NewReader(bytes.NewReader(it.Value))
+    case CompressionDeflate:
+        r = flate.NewReader(bytes.NewReader(it.Value))
+    default:
+        return fmt.Errorf("memcache: item %q has unknown compression %v", it.Key, alg)
+    }
+    if err != nil {
+        return fmt.Errorf("memcache: decompressing %q: %v", it.Key, err)
+    }
+    defer r.Close()
+    limit := c.MaxReadValueSize
+    if limit <= 0 {
+        limit = defaultMaxDecompressedSize
+    }
+    value, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+    if err != nil {
+        return fmt.Errorf("memcache: decompressing %q: %v", it.Key, err)
+    }
+    if len(value) > limit {
+        return fmt.Errorf("%w: %q decompresses to more than %d bytes", ErrResponseTooLarge, it.Key, limit)
+    }
+    it.Value = value
+    it.Flags &^= FlagCompressionMask
+    return nil
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "bytes"
+    "errors"
+    "testing"
+)
+
+var compressions = []Compression{CompressionNone, CompressionGzip, CompressionZlib, CompressionDeflate}
+
+func TestCompressionRoundTrip(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    value := bytes.Repeat([]byte("compressible "), 1000)
+
+    for _, alg := range compressions {
+        c.Compression = alg
+        key := "v-" + alg.String()
+        if err := c.Set(&Item{Key: key, Value: value, Flags: 42}); err != nil {
+            t.Fatalf("%v: Set: %v", alg, err)
+        }
+        fs.mu.Lock()
+        stored := fs.items[key]
+        fs.mu.Unlock()
+        if g, e := Compression(stored.flags&FlagCompressionMask), alg; g != e {
+            t.Errorf("%v: stored compression bits = %v", alg, g)
+        }
+        if alg != CompressionNone && len(stored.value) >= len(value) {
+            t.Errorf("%v: stored %d bytes for a %d byte value", alg, len(stored.value), len(value))
+        }
+        it, err := c.Get(key)
+        if err != nil {
+            t.Fatalf("%v: Get: %v", alg, err)
+        }
+        if !bytes.Equal(it.Value, value) {
+            t.Errorf("%v: round trip changed the value", alg)
+        }
+        if it.Flags != 42 {
+            t.Errorf("%v: Get flags = %#x, want 42", alg, it.Flags)
+        }
+    }
+}
+
+func TestCompressionCrossAlgorithm(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    value := bytes.Repeat([]byte("xyz"), 500)
+
+    for _, alg := range compressions {
+        c.Compression = alg
+        if err := c.Set(&Item{Key: "k-" + alg.String(), Value: value}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    // Whatever the client's current setting, each value is decoded with
+    // the algorithm recorded when it was stored.
+    c.Decompress = true
+    for _, reader := range compressions {
+        c.Compression = reader
+        keys := make([]string, len(compressions))
+        for i, alg := range compressions {
+            keys[i] = "k-" + alg.String()
+        }
+        m, err := c.GetMulti(keys)
+        if err != nil {
+            t.Fatalf("reader %v: GetMulti: %v", reader, err)
+        }
+        for _, key := range keys {
+            if it := m[key]; it == nil || !bytes.Equal(it.Value, value) {
+                t.Errorf("reader %v: %s decoded incorrectly", reader, key)
+            }
+        }
+    }
+}
+
+func TestDecompressionIsOptIn(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    // Flags written by an application that predates compression, with
+    // bits set that now record a compression algorithm.
+    flags := uint32(CompressionGzip) | 7
+    if err := c.Set(&Item{Key: "k", Value: []byte("raw"), Flags: flags}); err != nil {
+        t.Fatal(err)
+    }
+    it, err := c.Get("k")
+    if err != nil {
+        t.Fatalf("Get without compression = %v", err)
+    }
+    if string(it.Value) != "raw" || it.Flags != flags {
+        t.Errorf("Get without compression = %q, flags %#x; want the raw item", it.Value, it.Flags)
+    }
+
+    c.Decompress = true
+    if _, err := c.Get("k"); err == nil {
+        t.Errorf("Get with Decompress of a value that is not gzip succeeded")
+    }
+}
+
+func TestCompressionReservedFlags(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    c.Compression = CompressionGzip
+    it := &Item{Key: "k", Value: []byte("v"), Flags: 1 << 30}
+    if err := c.Set(it); err != ErrReservedFlags {
+        t.Errorf("Set with reserved flag bits = %v, want ErrReservedFlags", err)
+    }
+    if cmds := fs.commands(); len(cmds) != 0 {
+        t.Errorf("rejected Set sent %q", cmds)
+    }
+    it.Flags = 1
+    if err := c.Set(it); err != nil {
+        t.Fatalf("Set = %v", err)
+    }
+    if n := fs.numDials(); n != 1 {
+        t.Errorf("rejected Set cost the connection: %d dials, want 1", n)
+    }
+}
+
+func TestPipelinedReservedFlags(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    c.Compression = CompressionGzip
+    bad := &Item{Key: "b", Value: []byte("v"), Flags: 1 << 30}
+
+    results, err := c.SetMulti([]*Item{{Key: "a", Value: []byte("v")}, bad})
+    if err != ErrReservedFlags || results["a"] != nil || results["b"] != ErrReservedFlags {
+        t.Errorf("SetMulti = %v, %v; want a stored and b rejected", results, err)
+    }
+    for i, err := range c.NewBatch().Set(&Item{Key: "c", Value: []byte("v")}).Set(bad).Exec() {
+        if want := []error{nil, ErrReservedFlags}[i]; err != want {
+            t.Errorf("Batch result %d = %v, want %v", i, err, want)
+        }
+    }
+    if errs := c.RefreshOrSet([]*Item{{Key: "d", Value: []byte("v")}, bad}, 60); len(errs) != 1 || errs["b"] != ErrReservedFlags {
+        t.Errorf("RefreshOrSet = %v, want only b rejected", errs)
+    }
+
+    // The connection must not be left with unread responses.
+    if err := c.Set(&Item{Key: "x", Value: []byte("x")}); err != nil {
+        t.Fatalf("Set after pipelined rejections = %v", err)
+    }
+    for _, key := range []string{"a", "c", "d", "x"} {
+        if _, err := c.Get(key); err != nil {
+            t.Errorf("Get(%q) = %v", key, err)
+        }
+    }
+}
+
+func TestDecompressionLimit(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    c.Compression = CompressionGzip
+    if err := c.Set(&Item{Key: "k", Value: make([]byte, 1<<20)}); err != nil {
+        t.Fatal(err)
+    }
+    c.MaxReadValueSize = 1 << 16
+    if _, err := c.Get("k"); !errors.Is(err, ErrResponseTooLarge) {
+        t.Errorf("Get of a value decompressing past MaxReadValueSize = %v, want ErrResponseTooLarge", err)
+    }
+    c.MaxReadValueSize = 1 << 20
+    if it, err := c.Get("k"); err != nil || len(it.Value) != 1<<20 {
+        t.Errorf("Get of a value within MaxReadValueSize = %v", err)
+    }
+}
+
+func TestGetRangeCompressed(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    c.Compression = CompressionZlib
+    value := bytes.Repeat([]byte("0123456789"), 100)
+    if err := c.Set(&Item{Key: "k", Value: value}); err != nil {
+        t.Fatal(err)
+    }
+    got, err := c.GetRange("k", 995, 5)
+    if err != nil || string(got) != "56789" {
+        t.Errorf("GetRange of compressed value = %q, %v; want %q", got, err, "56789")
+    }
+    if _, err := c.GetRange("k", 999, 2); err != ErrInvalidRange {
+        t.Errorf("GetRange past the decompressed end = %v, want ErrInvalidRange", err)
+    }
+}
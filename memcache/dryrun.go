@@ -0,0 +1,279 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "errors"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Logger is the interface Client logs through. *log.Logger
+// satisfies it.
+type Logger interface {
+    Printf(format string, v ...interface{})
+}
+
+// errNoDryRunReply is returned when a reply is read from a dryRunConn
+// that has none to give.
+var errNoDryRunReply = errors.New("memcache: no reply to read in dry run")
+
+// dryRunReplies holds the response a server would send on success to
+// each command that dryRunConn answers itself.
+var dryRunReplies = map[string]string{
+    "set":       "STORED",
+    "add":       "STORED",
+    "replace":   "STORED",
+    "append":    "STORED",
+    "prepend":   "STORED",
+    "cas":       "STORED",
+    "delete":    "DELETED",
+    "incr":      "0",
+    "decr":      "0",
+    "touch":     "TOUCHED",
+    "gat":       "END",
+    "gats":      "END",
+    "flush_all": "OK",
+    "verbosity": "OK",
+    "stats":     "RESET",
+    "mg":        "EN",
+    "ms":        "HD",
+    "md":        "HD",
+    "ma":        "HD",
+    "mn":        "MN",
+}
+
+// dryRunConn stands in for the connection to addr of a write under
+// DryRun. Each command that would change the server is logged and
+// answered as if it had succeeded: storage commands are stored,
+// deletes delete, counters become 0 and touching reads miss. Plain
+// reads, such as the gets of ReadThenWrite, are passed on to a real
+// connection, taken from the pool when first needed.
+type dryRunConn struct {
+    c    *Client
+    ctx  context.Context
+    addr net.Addr
+
+    in        []byte       // written bytes not yet parsed
+    skip      int          // bytes of a data block still to discard
+    forwarded bool         // whether the last command was passed on
+    out       bytes.Buffer // replies not yet read
+
+    mu            sync.Mutex // guards the fields below
+    real          *conn
+    readDeadline  time.Time
+    writeDeadline time.Time
+}
+
+// newDryRunConn returns a conn whose commands go through a dryRunConn
+// for addr, along with the dryRunConn.
+func (c *Client) newDryRunConn(ctx context.Context, addr net.Addr) (*conn, *dryRunConn) {
+    dc := &dryRunConn{c: c, ctx: ctx, addr: addr}
+    return &conn{
+        nc:   dc,
+        addr: addr,
+        rw:   bufio.NewReadWriter(bufio.NewReader(dc), bufio.NewWriter(dc)),
+        c:    c,
+    }, dc
+}
+
+func (dc *dryRunConn) Write(p []byte) (int, error) {
+    dc.in = append(dc.in, p...)
+    for {
+        if dc.skip > 0 {
+            n := min(dc.skip, len(dc.in))
+            dc.skip -= n
+            dc.in = dc.in[n:]
+            if dc.skip > 0 {
+                break
+            }
+        }
+        i := bytes.Index(dc.in, crlf)
+        if i < 0 {
+            break
+        }
+        line := dc.in[:i]
+        dc.in = dc.in[i+len(crlf):]
+        if err := dc.command(line); err != nil {
+            return len(p), err
+        }
+    }
+    return len(p), nil
+}
+
+// command handles one command line written to dc.
+func (dc *dryRunConn) command(line []byte) error {
+    fields := strings.Fields(string(line))
+    if len(fields) == 0 {
+        dc.out.WriteString("ERROR\r\n")
+        return nil
+    }
+    verb := fields[0]
+    switch {
+    case verb == "get" || verb == "gets" || verb == "version",
+        verb == "stats" && (len(fields) == 1 || fields[1] != "reset"),
+        verb == "mn" && dc.forwarded:
+        dc.forwarded = true
+        return dc.forward(line)
+    }
+    dc.forwarded = false
+
+    switch verb {
+    case "set", "add", "replace", "append", "prepend", "cas", "ms":
+        i := 4
+        if verb == "ms" {
+            i = 2
+        }
+        if len(fields) > i {
+            n, err := strconv.Atoi(fields[i])
+            if err == nil && n >= 0 {
+                dc.skip = n + len(crlf)
+            }
+        }
+    }
+    if dc.c.Logger != nil {
+        dc.c.Logger.Printf("memcache: dry run to %s: %s", dc.addr, line)
+    }
+
+    flags := fields[min(2, len(fields)):]
+    reply, ok := dryRunReplies[verb]
+    switch {
+    case !ok:
+        reply = "ERROR"
+    case fields[len(fields)-1] == "noreply":
+        return nil
+    case verb == "ma" && hasField(flags, "v"):
+        reply = "VA 1\r\n0"
+    case strings.HasPrefix(verb, "m") && hasField(flags, "q"):
+        // Quiet mode suppresses the replies of successful meta commands.
+        return nil
+    }
+    dc.out.WriteString(reply)
+    dc.out.Write(crlf)
+    return nil
+}
+
+// hasField reports whether fields contains f.
+func hasField(fields []string, f string) bool {
+    for _, s := range fields {
+        if s == f {
+            return true
+        }
+    }
+    return false
+}
+
+// forward sends line to the server over the real connection.
+func (dc *dryRunConn) forward(line []byte) error {
+    cn, err := dc.server()
+    if err != nil {
+        return err
+    }
+    _, err = cn.nc.Write(append(append([]byte(nil), line...), crlf...))
+    return err
+}
+
+// server returns the real connection to the server, getting one if
+// dc has none yet.
+func (dc *dryRunConn) server() (*conn, error) {
+    dc.mu.Lock()
+    defer dc.mu.Unlock()
+    if dc.real != nil {
+        return dc.real, nil
+    }
+    cn, err := dc.c.getConn(dc.ctx, dc.addr)
+    if err != nil {
+        return nil, err
+    }
+    if !dc.readDeadline.IsZero() {
+        cn.nc.SetReadDeadline(dc.readDeadline)
+    }
+    if !dc.writeDeadline.IsZero() {
+        cn.nc.SetWriteDeadline(dc.writeDeadline)
+    }
+    dc.real = cn
+    return cn, nil
+}
+
+// Read returns the replies to the commands dc answered itself, then
+// those the server sends to the commands passed on.
+func (dc *dryRunConn) Read(p []byte) (int, error) {
+    if dc.out.Len() > 0 {
+        return dc.out.Read(p)
+    }
+    dc.mu.Lock()
+    cn := dc.real
+    dc.mu.Unlock()
+    if cn == nil {
+        return 0, errNoDryRunReply
+    }
+    return cn.nc.Read(p)
+}
+
+// release returns the real connection, if any, to the pool, or closes
+// it if *err is not resumable.
+func (dc *dryRunConn) release(err *error) {
+    dc.mu.Lock()
+    defer dc.mu.Unlock()
+    if dc.real != nil {
+        dc.real.condRelease(err)
+        dc.real = nil
+    }
+}
+
+func (dc *dryRunConn) Close() error {
+    return nil
+}
+
+func (dc *dryRunConn) LocalAddr() net.Addr {
+    return nil
+}
+
+func (dc *dryRunConn) RemoteAddr() net.Addr {
+    return dc.addr
+}
+
+func (dc *dryRunConn) SetDeadline(t time.Time) error {
+    dc.SetReadDeadline(t)
+    return dc.SetWriteDeadline(t)
+}
+
+func (dc *dryRunConn) SetReadDeadline(t time.Time) error {
+    dc.mu.Lock()
+    defer dc.mu.Unlock()
+    dc.readDeadline = t
+    if dc.real != nil {
+        return dc.real.nc.SetReadDeadline(t)
+    }
+    return nil
+}
+
+func (dc *dryRunConn) SetWriteDeadline(t time.Time) error {
+    dc.mu.Lock()
+    defer dc.mu.Unlock()
+    dc.writeDeadline = t
+    if dc.real != nil {
+        return dc.real.nc.SetWriteDeadline(t)
+    }
+    return nil
+}
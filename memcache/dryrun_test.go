@@ -0,0 +1,210 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "fmt"
+    "testing"
+)
+
+type recordingLogger []string
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+    *l = append(*l, fmt.Sprintf(format, v...))
+}
+
+func TestDryRun(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    c.DryRun = true
+    var logged recordingLogger
+    c.Logger = &logged
+
+    if err := c.Delete("foo"); err != nil {
+        t.Fatalf("Delete = %v, want nil", err)
+    }
+    if err := c.Set(&Item{Key: "bar", Value: []byte("value"), Expiration: 60}); err != nil {
+        t.Fatalf("Set = %v, want nil", err)
+    }
+    if n, err := c.Increment("n", 2); n != 0 || err != nil {
+        t.Fatalf("Increment = %d, %v; want 0, nil", n, err)
+    }
+    if d := fs.numDials(); d != 0 {
+        t.Errorf("dry run dialed the server %d times", d)
+    }
+
+    want := []string{
+        "memcache: dry run to " + fs.Addr() + ": delete foo",
+        "memcache: dry run to " + fs.Addr() + ": set bar 0 60 5",
+        "memcache: dry run to " + fs.Addr() + ": incr n 2",
+    }
+    if len(logged) != len(want) {
+        t.Fatalf("logged %q, want %q", logged, want)
+    }
+    for i := range want {
+        if logged[i] != want[i] {
+            t.Errorf("log line %d = %q, want %q", i, logged[i], want[i])
+        }
+    }
+}
+
+func TestDryRunSendsNoWrites(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    c.DryRun = true
+    addr, err := c.selector.PickServer("k")
+    if err != nil {
+        t.Fatal(err)
+    }
+    item := func() *Item { return &Item{Key: "k", Value: []byte("v")} }
+
+    mutators := []struct {
+        name string
+        fn   func() error
+    }{
+        {"Set", func() error { return c.Set(item()) }},
+        {"Add", func() error { return c.Add(item()) }},
+        {"Replace", func() error { return c.Replace(item()) }},
+        {"Append", func() error { return c.Append(item()) }},
+        {"Prepend", func() error { return c.Prepend(item()) }},
+        {"CompareAndSwap", func() error { return c.CompareAndSwap(item()) }},
+        {"AppendCAS", func() error { return c.AppendCAS(item()) }},
+        {"PrependCAS", func() error { return c.PrependCAS(item()) }},
+        {"SetMulti", func() error {
+            _, err := c.SetMulti([]*Item{item()})
+            return err
+        }},
+        {"SetSameValue", func() error { return c.SetSameValue([]string{"k"}, []byte("v"), 0, 0)["k"] }},
+        {"SetReplicated", func() error { return c.SetReplicated(item(), 1) }},
+        {"RefreshOrSet", func() error { return c.RefreshOrSet([]*Item{item()}, 60)["k"] }},
+        {"Delete", func() error { return c.Delete("k") }},
+        {"DeleteMulti", func() error {
+            _, err := c.DeleteMulti([]string{"k"})
+            return err
+        }},
+        {"Sweep", func() error {
+            kept, dropped := c.Sweep([]string{"a"}, []string{"b"}, 60)
+            if kept["a"] != nil {
+                return kept["a"]
+            }
+            return dropped["b"]
+        }},
+        {"Touch", func() error { return c.Touch("k", 60) }},
+        {"GetAndTouch", func() error {
+            if _, err := c.GetAndTouch("k", 60); err != ErrCacheMiss {
+                return fmt.Errorf("got %v, want ErrCacheMiss", err)
+            }
+            return nil
+        }},
+        {"GetAndTouchMulti", func() error {
+            _, err := c.GetAndTouchMulti([]string{"k"}, 60)
+            return err
+        }},
+        {"Increment", func() error {
+            _, err := c.Increment("k", 1)
+            return err
+        }},
+        {"Decrement", func() error {
+            _, err := c.Decrement("k", 1)
+            return err
+        }},
+        {"IncrementMulti", func() error {
+            _, errs := c.IncrementMulti(map[string]uint64{"k": 1})
+            return errs["k"]
+        }},
+        {"FlushAll", func() error { return c.FlushAll(0) }},
+        {"Batch.Exec", func() error {
+            for _, err := range c.NewBatch().Set(item()).Add(item()).Delete("k").Exec() {
+                if err != nil {
+                    return err
+                }
+            }
+            return nil
+        }},
+        {"MetaGet with Touch", func() error {
+            if _, err := c.MetaGet("k", MetaGetFlags{Touch: 60}); err != ErrCacheMiss {
+                return fmt.Errorf("got %v, want ErrCacheMiss", err)
+            }
+            return nil
+        }},
+        {"MetaSet", func() error { return c.MetaSet(item(), MetaSetFlags{}) }},
+        {"MetaDelete", func() error { return c.MetaDelete("k", MetaDeleteFlags{}) }},
+        {"MetaArithmetic", func() error {
+            _, err := c.MetaArithmetic("k", MetaArithmeticFlags{Delta: 1})
+            return err
+        }},
+        {"StatsReset", func() error { return c.StatsReset(addr) }},
+    }
+    for _, m := range mutators {
+        if err := m.fn(); err != nil {
+            t.Errorf("%s = %v, want nil", m.name, err)
+        }
+        if cmds := fs.commands(); len(cmds) != 0 {
+            t.Fatalf("%s under DryRun sent %q", m.name, cmds)
+        }
+    }
+    if d := fs.numDials(); d != 0 {
+        t.Errorf("dry run dialed the server %d times", d)
+    }
+}
+
+func TestDryRunPassesReadsOn(t *testing.T) {
+    fs := newFakeServer(t)
+    fs.mu.Lock()
+    fs.items["k"] = &fakeItem{value: []byte("old")}
+    fs.mu.Unlock()
+    c := New(fs.Addr())
+    c.DryRun = true
+    var logged recordingLogger
+    c.Logger = &logged
+
+    var read []byte
+    results, err := c.ReadThenWrite([]string{"k"}, func(items map[string]*Item, b *Batch) {
+        if it := items["k"]; it != nil {
+            read = it.Value
+        }
+        b.Set(&Item{Key: "k", Value: []byte("new")})
+    })
+    if err != nil || len(results) != 1 || results[0] != nil {
+        t.Fatalf("ReadThenWrite = %v, %v; want [nil], nil", results, err)
+    }
+    if string(read) != "old" {
+        t.Errorf("ReadThenWrite read %q, want %q", read, "old")
+    }
+    addr, err := c.selector.PickServer("k")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := c.StatsResetSnapshot(addr); err != nil {
+        t.Fatalf("StatsResetSnapshot = %v", err)
+    }
+
+    wantCmds := []string{"gets k", "stats"}
+    if cmds := fs.commands(); fmt.Sprint(cmds) != fmt.Sprint(wantCmds) {
+        t.Errorf("server got %q, want %q", cmds, wantCmds)
+    }
+    wantLog := []string{
+        "memcache: dry run to " + fs.Addr() + ": set k 0 0 3",
+        "memcache: dry run to " + fs.Addr() + ": stats reset",
+    }
+    if fmt.Sprint(logged) != fmt.Sprint(wantLog) {
+        t.Errorf("logged %q, want %q", logged, wantLog)
+    }
+    if got := string(fs.items["k"].value); got != "old" {
+        t.Errorf("server value = %q, want %q", got, "old")
+    }
+}
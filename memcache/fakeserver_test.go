@@ -0,0 +1,532 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// fakeServer is an in-memory server speaking enough of the memcached
+// text protocol to exercise the client without a real memcached.
+type fakeServer struct {
+    ln net.Listener
+
+    // handler, if set, is offered every command line first. It returns
+    // true if it wrote the response itself.
+    handler func(line string, rw *bufio.ReadWriter) bool
+
+    // hangup makes the server close the connection after handler has
+    // written a response.
+    hangup bool
+
+    // maxValueSize, if non-zero, makes storage commands for larger
+    // values fail with a SERVER_ERROR.
+    maxValueSize int
+
+    // version is reported by the version command; "1.6.21" if empty.
+    version string
+
+    // stats maps a stats subcommand ("" for plain stats) to the
+    // "name value" pairs to report for it. "stats reset" clears the
+    // plain stats.
+    stats map[string][]string
+
+    mu    sync.Mutex
+    items map[string]*fakeItem
+    cas   uint64
+    cmds  []string
+    dials int
+    conns []net.Conn
+}
+
+type fakeItem struct {
+    value []byte
+    flags uint32
+    exp   int32
+    cas   uint64
+    setAt time.Time
+
+    // fetched records whether a meta get has returned the item, and
+    // stale whether a meta delete has invalidated it.
+    fetched bool
+    stale   bool
+}
+
+// ttl returns the item's remaining time to live in seconds, or -1 if
+// it never expires.
+func (it *fakeItem) ttl() int64 {
+    switch {
+    case it.exp == 0:
+        return -1
+    case it.exp > 30*24*60*60:
+        return int64(it.exp) - time.Now().Unix()
+    }
+    return int64(it.exp) - int64(time.Since(it.setAt)/time.Second)
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+    return newFakeServerOn(t, "tcp", "127.0.0.1:0")
+}
+
+// newFakeServerOn is newFakeServer listening on the given network and
+// address, such as a Unix domain socket.
+func newFakeServerOn(t *testing.T, network, addr string) *fakeServer {
+    ln, err := net.Listen(network, addr)
+    if err != nil {
+        t.Fatalf("fake server listen: %v", err)
+    }
+    fs := &fakeServer{ln: ln, items: make(map[string]*fakeItem)}
+    go fs.serve()
+    t.Cleanup(fs.Close)
+    return fs
+}
+
+func (fs *fakeServer) Addr() string {
+    return fs.ln.Addr().String()
+}
+
+func (fs *fakeServer) Close() {
+    fs.ln.Close()
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    for _, nc := range fs.conns {
+        nc.Close()
+    }
+}
+
+// commands returns the command lines received so far, without the
+// trailing CRLF.
+func (fs *fakeServer) commands() []string {
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    return append([]string(nil), fs.cmds...)
+}
+
+func (fs *fakeServer) numDials() int {
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    return fs.dials
+}
+
+func (fs *fakeServer) serve() {
+    for {
+        nc, err := fs.ln.Accept()
+        if err != nil {
+            return
+        }
+        fs.mu.Lock()
+        fs.dials++
+        fs.conns = append(fs.conns, nc)
+        fs.mu.Unlock()
+        go fs.serveConn(nc)
+    }
+}
+
+func (fs *fakeServer) serveConn(nc net.Conn) {
+    defer nc.Close()
+    rw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+    for {
+        line, err := rw.ReadString('\n')
+        if err != nil {
+            return
+        }
+        line = strings.TrimRight(line, "\r\n")
+        fs.mu.Lock()
+        fs.cmds = append(fs.cmds, line)
+        fs.mu.Unlock()
+        if fs.handler != nil && fs.handler(line, rw) {
+            rw.Flush()
+            if fs.hangup {
+                return
+            }
+            continue
+        }
+        if err := fs.handle(line, rw); err != nil {
+            return
+        }
+        if err := rw.Flush(); err != nil {
+            return
+        }
+    }
+}
+
+func (fs *fakeServer) handle(line string, rw *bufio.ReadWriter) error {
+    f := strings.Fields(line)
+    if len(f) == 0 {
+        _, err := rw.WriteString("ERROR\r\n")
+        return err
+    }
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    switch f[0] {
+    case "get", "gets":
+        for _, key := range f[1:] {
+            it, ok := fs.items[key]
+            if !ok {
+                continue
+            }
+            if f[0] == "gets" {
+                fmt.Fprintf(rw, "VALUE %s %d %d %d\r\n", key, it.flags, len(it.value), it.cas)
+            } else {
+                fmt.Fprintf(rw, "VALUE %s %d %d\r\n", key, it.flags, len(it.value))
+            }
+            rw.Write(it.value)
+            rw.WriteString("\r\n")
+        }
+        rw.WriteString("END\r\n")
+    case "gat", "gats":
+        exp, _ := strconv.ParseInt(f[1], 10, 32)
+        for _, key := range f[2:] {
+            it, ok := fs.items[key]
+            if !ok {
+                continue
+            }
+            it.exp, it.setAt = int32(exp), time.Now()
+            if f[0] == "gats" {
+                fmt.Fprintf(rw, "VALUE %s %d %d %d\r\n", key, it.flags, len(it.value), it.cas)
+            } else {
+                fmt.Fprintf(rw, "VALUE %s %d %d\r\n", key, it.flags, len(it.value))
+            }
+            rw.Write(it.value)
+            rw.WriteString("\r\n")
+        }
+        rw.WriteString("END\r\n")
+    case "set", "add", "replace", "append", "prepend", "cas":
+        if len(f) < 5 {
+            rw.WriteString("ERROR\r\n")
+            return nil
+        }
+        flags, _ := strconv.ParseUint(f[2], 10, 32)
+        exp, _ := strconv.ParseInt(f[3], 10, 32)
+        size, _ := strconv.Atoi(f[4])
+        buf := make([]byte, size+2)
+        if _, err := io.ReadFull(rw, buf); err != nil {
+            return err
+        }
+        value := buf[:size]
+        if fs.maxValueSize > 0 && size > fs.maxValueSize {
+            rw.WriteString("SERVER_ERROR object too large for cache\r\n")
+            return nil
+        }
+        old, exists := fs.items[f[1]]
+        switch {
+        case f[0] == "add" && exists,
+            (f[0] == "replace" || f[0] == "append" || f[0] == "prepend") && !exists:
+            rw.WriteString("NOT_STORED\r\n")
+            return nil
+        case f[0] == "cas" && !exists:
+            rw.WriteString("NOT_FOUND\r\n")
+            return nil
+        case f[0] == "cas":
+            cas, _ := strconv.ParseUint(f[5], 10, 64)
+            if cas != old.cas {
+                rw.WriteString("EXISTS\r\n")
+                return nil
+            }
+        case f[0] == "append":
+            value = append(append([]byte(nil), old.value...), value...)
+            flags, exp = uint64(old.flags), int64(old.exp)
+        case f[0] == "prepend":
+            value = append(append([]byte(nil), value...), old.value...)
+            flags, exp = uint64(old.flags), int64(old.exp)
+        }
+        fs.cas++
+        fs.items[f[1]] = &fakeItem{value: value, flags: uint32(flags), exp: int32(exp), cas: fs.cas, setAt: time.Now()}
+        rw.WriteString("STORED\r\n")
+    case "delete":
+        if _, ok := fs.items[f[1]]; !ok {
+            rw.WriteString("NOT_FOUND\r\n")
+            return nil
+        }
+        delete(fs.items, f[1])
+        rw.WriteString("DELETED\r\n")
+    case "touch":
+        it, ok := fs.items[f[1]]
+        if !ok {
+            rw.WriteString("NOT_FOUND\r\n")
+            return nil
+        }
+        exp, _ := strconv.ParseInt(f[2], 10, 32)
+        it.exp, it.setAt = int32(exp), time.Now()
+        rw.WriteString("TOUCHED\r\n")
+    case "incr", "decr":
+        it, ok := fs.items[f[1]]
+        if !ok {
+            rw.WriteString("NOT_FOUND\r\n")
+            return nil
+        }
+        n, err := strconv.ParseUint(string(it.value), 10, 64)
+        if err != nil {
+            rw.WriteString("CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+            return nil
+        }
+        delta, _ := strconv.ParseUint(f[2], 10, 64)
+        if f[0] == "incr" {
+            n += delta
+        } else if delta > n {
+            n = 0
+        } else {
+            n -= delta
+        }
+        fs.cas++
+        it.value = []byte(strconv.FormatUint(n, 10))
+        it.cas = fs.cas
+        fmt.Fprintf(rw, "%d\r\n", n)
+    case "mn":
+        rw.WriteString("MN\r\n")
+    case "mg":
+        it, ok := fs.items[f[1]]
+        var ret []string
+        if !ok {
+            quiet, opaque, vivify := false, "", ""
+            for _, fl := range f[2:] {
+                switch fl[0] {
+                case 'q':
+                    quiet = true
+                case 'O':
+                    opaque = " " + fl
+                case 'N':
+                    vivify = fl[1:]
+                }
+            }
+            if vivify == "" {
+                if !quiet {
+                    rw.WriteString("EN" + opaque + "\r\n")
+                }
+                return nil
+            }
+            exp, _ := strconv.ParseInt(vivify, 10, 32)
+            fs.cas++
+            it = &fakeItem{exp: int32(exp), cas: fs.cas, setAt: time.Now()}
+            fs.items[f[1]] = it
+            ret = append(ret, "W")
+        }
+        value := false
+        for _, fl := range f[2:] {
+            switch fl[0] {
+            case 'v':
+                value = true
+            case 'T':
+                n, _ := strconv.ParseInt(fl[1:], 10, 32)
+                it.exp, it.setAt = int32(n), time.Now()
+            case 'h':
+                if it.fetched {
+                    ret = append(ret, "h1")
+                } else {
+                    ret = append(ret, "h0")
+                }
+            case 'l':
+                ret = append(ret, "l0")
+            case 't':
+                ret = append(ret, fmt.Sprintf("t%d", it.ttl()))
+            case 'c':
+                ret = append(ret, fmt.Sprintf("c%d", it.cas))
+            case 'f':
+                ret = append(ret, fmt.Sprintf("f%d", it.flags))
+            case 's':
+                ret = append(ret, fmt.Sprintf("s%d", len(it.value)))
+            case 'k':
+                ret = append(ret, "k"+f[1])
+            case 'O':
+                ret = append(ret, fl)
+            }
+        }
+        if it.stale {
+            ret = append(ret, "X")
+        }
+        if value {
+            fmt.Fprintf(rw, "VA %d", len(it.value))
+        } else {
+            rw.WriteString("HD")
+        }
+        for _, r := range ret {
+            rw.WriteString(" " + r)
+        }
+        rw.WriteString("\r\n")
+        if value {
+            rw.Write(it.value)
+            rw.WriteString("\r\n")
+        }
+        it.fetched = true
+    case "ms":
+        if len(f) < 3 {
+            rw.WriteString("CLIENT_ERROR bad command line format\r\n")
+            return nil
+        }
+        size, _ := strconv.Atoi(f[2])
+        buf := make([]byte, size+2)
+        if _, err := io.ReadFull(rw, buf); err != nil {
+            return err
+        }
+        value := buf[:size]
+        mode, cas, hasCAS := byte('S'), uint64(0), false
+        var flags uint32
+        var exp int32
+        retCAS := false
+        for _, fl := range f[3:] {
+            switch fl[0] {
+            case 'c':
+                retCAS = true
+            case 'M':
+                mode = fl[1]
+            case 'C':
+                cas, _ = strconv.ParseUint(fl[1:], 10, 64)
+                hasCAS = true
+            case 'F':
+                n, _ := strconv.ParseUint(fl[1:], 10, 32)
+                flags = uint32(n)
+            case 'T':
+                n, _ := strconv.ParseInt(fl[1:], 10, 32)
+                exp = int32(n)
+            }
+        }
+        old, exists := fs.items[f[1]]
+        switch {
+        case hasCAS && !exists:
+            rw.WriteString("NF\r\n")
+            return nil
+        case hasCAS && cas != old.cas:
+            rw.WriteString("EX\r\n")
+            return nil
+        case mode == 'E' && exists,
+            (mode == 'A' || mode == 'P' || mode == 'R') && !exists:
+            rw.WriteString("NS\r\n")
+            return nil
+        case mode == 'A':
+            value = append(append([]byte(nil), old.value...), value...)
+            flags, exp = old.flags, old.exp
+        case mode == 'P':
+            value = append(append([]byte(nil), value...), old.value...)
+            flags, exp = old.flags, old.exp
+        }
+        fs.cas++
+        fs.items[f[1]] = &fakeItem{value: value, flags: flags, exp: exp, cas: fs.cas, setAt: time.Now()}
+        if retCAS {
+            fmt.Fprintf(rw, "HD c%d\r\n", fs.cas)
+        } else {
+            rw.WriteString("HD\r\n")
+        }
+    case "md":
+        it, ok := fs.items[f[1]]
+        if !ok {
+            rw.WriteString("NF\r\n")
+            return nil
+        }
+        invalidate := false
+        for _, fl := range f[2:] {
+            switch fl[0] {
+            case 'C':
+                if cas, _ := strconv.ParseUint(fl[1:], 10, 64); cas != it.cas {
+                    rw.WriteString("EX\r\n")
+                    return nil
+                }
+            case 'I':
+                invalidate = true
+            case 'T':
+                n, _ := strconv.ParseInt(fl[1:], 10, 32)
+                it.exp, it.setAt = int32(n), time.Now()
+            }
+        }
+        if invalidate {
+            it.stale = true
+        } else {
+            delete(fs.items, f[1])
+        }
+        rw.WriteString("HD\r\n")
+    case "ma":
+        delta, decr, vivify, initial := uint64(1), false, "", uint64(0)
+        var cas uint64
+        for _, fl := range f[2:] {
+            switch fl[0] {
+            case 'D':
+                delta, _ = strconv.ParseUint(fl[1:], 10, 64)
+            case 'M':
+                decr = fl[1] == 'D' || fl[1] == '-'
+            case 'N':
+                vivify = fl[1:]
+            case 'J':
+                initial, _ = strconv.ParseUint(fl[1:], 10, 64)
+            case 'C':
+                cas, _ = strconv.ParseUint(fl[1:], 10, 64)
+            }
+        }
+        it, ok := fs.items[f[1]]
+        if !ok {
+            if vivify == "" {
+                rw.WriteString("NF\r\n")
+                return nil
+            }
+            exp, _ := strconv.ParseInt(vivify, 10, 32)
+            fs.cas++
+            v := []byte(strconv.FormatUint(initial, 10))
+            fs.items[f[1]] = &fakeItem{value: v, exp: int32(exp), cas: fs.cas, setAt: time.Now()}
+            fmt.Fprintf(rw, "VA %d\r\n%s\r\n", len(v), v)
+            return nil
+        }
+        if cas != 0 && cas != it.cas {
+            rw.WriteString("EX\r\n")
+            return nil
+        }
+        n, err := strconv.ParseUint(string(it.value), 10, 64)
+        if err != nil {
+            rw.WriteString("CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+            return nil
+        }
+        if !decr {
+            n += delta
+        } else if delta > n {
+            n = 0
+        } else {
+            n -= delta
+        }
+        fs.cas++
+        it.value = []byte(strconv.FormatUint(n, 10))
+        it.cas = fs.cas
+        fmt.Fprintf(rw, "VA %d\r\n%s\r\n", len(it.value), it.value)
+    case "flush_all":
+        fs.items = make(map[string]*fakeItem)
+        rw.WriteString("OK\r\n")
+    case "version":
+        v := fs.version
+        if v == "" {
+            v = "1.6.21"
+        }
+        rw.WriteString("VERSION " + v + "\r\n")
+    case "stats":
+        sub := strings.Join(f[1:], " ")
+        if sub == "reset" {
+            delete(fs.stats, "")
+            rw.WriteString("RESET\r\n")
+            return nil
+        }
+        for _, stat := range fs.stats[sub] {
+            rw.WriteString("STAT " + stat + "\r\n")
+        }
+        rw.WriteString("END\r\n")
+    default:
+        rw.WriteString("ERROR\r\n")
+    }
+    return nil
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "errors"
+    "net"
+    "sort"
+    "time"
+)
+
+// defaultDeadRetryInterval is used when DeadRetryInterval is zero.
+const defaultDeadRetryInterval = 10 * time.Second
+
+// failureStats holds the consecutive failures of one server.
+type failureStats struct {
+    addr    net.Addr
+    n       int
+    ejected bool
+}
+
+// serverFailure reports whether err shows the server to be unreachable
+// or broken, as opposed to a cache-level error or a caller giving up.
+func serverFailure(err error) bool {
+    if err == nil || resumableError(err) || err == ErrClientClosed {
+        return false
+    }
+    var oe *net.OpError
+    return IsRetryable(err) || errors.As(err, &oe)
+}
+
+// recordHealth records the outcome of an operation on addr, and ejects
+// addr from selection once FailureLimit operations in a row have
+// failed.
+func (c *Client) recordHealth(addr net.Addr, err error) {
+    hs, ok := c.selector.(HealthSelector)
+    if !ok {
+        return
+    }
+    failed := serverFailure(err)
+    if !failed && err != nil {
+        return
+    }
+    key := addr.String()
+    c.healthLk.Lock()
+    fs := c.failures[key]
+    if !failed {
+        if fs != nil && !fs.ejected {
+            delete(c.failures, key)
+        }
+        c.healthLk.Unlock()
+        return
+    }
+    if c.failures == nil {
+        c.failures = make(map[string]*failureStats)
+    }
+    if fs == nil {
+        fs = &failureStats{addr: addr}
+        c.failures[key] = fs
+    }
+    fs.n++
+    eject := !fs.ejected && fs.n >= c.FailureLimit
+    if eject {
+        fs.ejected = true
+    }
+    c.healthLk.Unlock()
+
+    if eject {
+        hs.MarkDown(addr)
+        go c.probeDead(hs, addr)
+    }
+}
+
+// probeDead sends a version command to the ejected server addr every
+// DeadRetryInterval, and returns it to selection once one succeeds,
+// unless MaxLatency still has it ejected. It stops probing, and
+// forgets addr, once addr is no longer one of the selector's servers.
+func (c *Client) probeDead(hs HealthSelector, addr net.Addr) {
+    interval := c.DeadRetryInterval
+    if interval <= 0 {
+        interval = defaultDeadRetryInterval
+    }
+    for {
+        time.Sleep(interval)
+        if !c.selected(addr) {
+            break
+        }
+        _, err := c.VersionFromAddr(addr)
+        if err == ErrClientClosed {
+            return
+        }
+        if err == nil {
+            break
+        }
+    }
+    c.healthLk.Lock()
+    delete(c.failures, addr.String())
+    c.healthLk.Unlock()
+    if !c.latencyEjected(addr) {
+        hs.MarkUp(addr)
+    }
+}
+
+// healthEjected reports whether FailureLimit has addr ejected.
+func (c *Client) healthEjected(addr net.Addr) bool {
+    c.healthLk.Lock()
+    defer c.healthLk.Unlock()
+    fs := c.failures[addr.String()]
+    return fs != nil && fs.ejected
+}
+
+// selected reports whether addr is one of the selector's servers.
+func (c *Client) selected(addr net.Addr) bool {
+    addrs, err := c.selector.GetServers()
+    if err != nil {
+        return false
+    }
+    for _, a := range addrs {
+        if a.String() == addr.String() {
+            return true
+        }
+    }
+    return false
+}
+
+// EjectedServers returns the addresses of the servers currently taken
+// out of selection by FailureLimit.
+func (c *Client) EjectedServers() []net.Addr {
+    c.healthLk.Lock()
+    defer c.healthLk.Unlock()
+    var addrs []net.Addr
+    for _, fs := range c.failures {
+        if fs.ejected {
+            addrs = append(addrs, fs.addr)
+        }
+    }
+    sort.Slice(addrs, func(i, j int) bool { return addrs[i].String() < addrs[j].String() })
+    return addrs
+}
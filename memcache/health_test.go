@@ -0,0 +1,151 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "bufio"
+    "fmt"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func TestFailureEjection(t *testing.T) {
+    live := newFakeServer(t)
+    dead := newFakeServer(t)
+    dead.hangup = true
+    var down int32 = 1
+    dead.handler = func(line string, rw *bufio.ReadWriter) bool {
+        return atomic.LoadInt32(&down) != 0
+    }
+    ss := new(ServerList)
+    if err := ss.SetServers(live.Addr(), dead.Addr()); err != nil {
+        t.Fatal(err)
+    }
+    c := NewFromSelector(ss)
+    c.FailureLimit = 3
+    c.DeadRetryInterval = 10 * time.Millisecond
+
+    var key string
+    for i := 0; ; i++ {
+        key = fmt.Sprintf("key%d", i)
+        if addr, _ := ss.PickServer(key); addr.String() == dead.Addr() {
+            break
+        }
+    }
+
+    for i := 0; i < c.FailureLimit; i++ {
+        if _, err := c.Get(key); err == nil || err == ErrCacheMiss {
+            t.Fatalf("Get from dead server = %v, want a network error", err)
+        }
+        if ejected := c.EjectedServers(); len(ejected) != 0 && i < c.FailureLimit-1 {
+            t.Fatalf("server ejected after %d failures, want %d", i+1, c.FailureLimit)
+        }
+    }
+    if ejected := c.EjectedServers(); len(ejected) != 1 || ejected[0].String() != dead.Addr() {
+        t.Fatalf("EjectedServers = %v, want [%s]", ejected, dead.Addr())
+    }
+    if err := c.Set(&Item{Key: key, Value: []byte("v")}); err != nil {
+        t.Fatalf("Set of dead server's key = %v, want it served by the live server", err)
+    }
+    live.mu.Lock()
+    _, ok := live.items[key]
+    live.mu.Unlock()
+    if !ok {
+        t.Errorf("Set of dead server's key did not reach the live server")
+    }
+
+    atomic.StoreInt32(&down, 0)
+    waitFor(t, func() bool {
+        addr, _ := ss.PickServer(key)
+        return addr.String() == dead.Addr()
+    })
+    if ejected := c.EjectedServers(); len(ejected) != 0 {
+        t.Errorf("EjectedServers after recovery = %v, want none", ejected)
+    }
+}
+
+func TestFailureEjectionResetsOnSuccess(t *testing.T) {
+    fs := newFakeServer(t)
+    fs.hangup = true
+    var drops int32
+    fs.handler = func(line string, rw *bufio.ReadWriter) bool {
+        return atomic.AddInt32(&drops, -1) >= 0
+    }
+    ss := new(ServerList)
+    if err := ss.SetServers(fs.Addr()); err != nil {
+        t.Fatal(err)
+    }
+    c := NewFromSelector(ss)
+    c.FailureLimit = 2
+
+    for i := 0; i < 3; i++ {
+        atomic.StoreInt32(&drops, 1)
+        if _, err := c.Get("k"); err == ErrCacheMiss {
+            t.Fatalf("Get = %v, want a network error", err)
+        }
+        if _, err := c.Get("k"); err != ErrCacheMiss {
+            t.Fatalf("Get = %v, want ErrCacheMiss", err)
+        }
+    }
+    if ejected := c.EjectedServers(); len(ejected) != 0 {
+        t.Errorf("EjectedServers = %v after failures separated by successes, want none", ejected)
+    }
+}
+
+func TestProbeStopsForRemovedServer(t *testing.T) {
+    live := newFakeServer(t)
+    dead := newFakeServer(t)
+    dead.hangup = true
+    dead.handler = func(line string, rw *bufio.ReadWriter) bool { return true }
+    ss := new(ServerList)
+    if err := ss.SetServers(live.Addr(), dead.Addr()); err != nil {
+        t.Fatal(err)
+    }
+    c := NewFromSelector(ss)
+    c.FailureLimit = 1
+    c.DeadRetryInterval = 5 * time.Millisecond
+
+    var key string
+    for i := 0; ; i++ {
+        key = fmt.Sprintf("key%d", i)
+        if addr, _ := ss.PickServer(key); addr.String() == dead.Addr() {
+            break
+        }
+    }
+    if _, err := c.Get(key); err == nil || err == ErrCacheMiss {
+        t.Fatalf("Get from dead server = %v, want a network error", err)
+    }
+    waitFor(t, func() bool {
+        for _, cmd := range dead.commands() {
+            if cmd == "version" {
+                return true
+            }
+        }
+        return false
+    })
+
+    if err := ss.SetServers(live.Addr()); err != nil {
+        t.Fatal(err)
+    }
+    waitFor(t, func() bool { return len(c.EjectedServers()) == 0 })
+    n := len(dead.commands())
+    time.Sleep(10 * c.DeadRetryInterval)
+    if got := len(dead.commands()); got != n {
+        t.Errorf("removed server probed %d more times", got-n)
+    }
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "crypto/md5"
+    "encoding/binary"
+    "fmt"
+    "math"
+    "net"
+    "sort"
+    "strings"
+    "sync"
+)
+
+// DefaultKetamaPoints is the number of points a KetamaSelector gives
+// each server of average weight, as libmemcached does.
+const DefaultKetamaPoints = 160
+
+// KetamaServer is a server and its weight for a KetamaSelector.
+type KetamaServer struct {
+    // Addr is the server's "host:port" or Unix socket path. It is
+    // hashed as written, so it should match the name other clients
+    // sharing the servers use.
+    Addr string
+
+    // Weight is the server's share of the keys relative to the other
+    // servers. Zero or negative means 1.
+    Weight int
+}
+
+// KetamaSelector is a ServerSelector using consistent hashing: each
+// server owns points on a ring of 32-bit hashes, in proportion to its
+// weight, and a key is stored on the server owning the first point at
+// or after the key's hash. Adding or removing a server thus only moves
+// the keys of the points it gains or loses.
+//
+// The ring is built like libmemcached's weighted ketama continuum,
+// with MD5 as the hash, so that keys map to the same servers as in
+// other clients using it. Its zero value is usable.
+type KetamaSelector struct {
+    // Points is the number of points given to a server of average
+    // weight. If zero or negative, DefaultKetamaPoints is used. It
+    // must be set before the servers.
+    Points int
+
+    lk     sync.RWMutex
+    addrs  []net.Addr
+    points []ketamaPoint
+}
+
+type ketamaPoint struct {
+    hash uint32
+    addr net.Addr
+}
+
+// SetServers sets the servers, all with the same weight, and is
+// threadsafe. If any of the server names fail to resolve, an error is
+// returned and no changes are made.
+func (ks *KetamaSelector) SetServers(servers ...string) error {
+    weighted := make([]KetamaServer, len(servers))
+    for i, server := range servers {
+        weighted[i] = KetamaServer{Addr: server, Weight: 1}
+    }
+    return ks.SetWeightedServers(weighted...)
+}
+
+// SetWeightedServers sets the servers and their weights, and is
+// threadsafe. If any of the server names fail to resolve, an error is
+// returned and no changes are made.
+func (ks *KetamaSelector) SetWeightedServers(servers ...KetamaServer) error {
+    names := make([]string, len(servers))
+    total := 0
+    for i, s := range servers {
+        names[i] = s.Addr
+        total += ketamaWeight(s.Weight)
+    }
+    naddr, err := resolveServers(names)
+    if err != nil {
+        return err
+    }
+    perServer := ks.Points
+    if perServer <= 0 {
+        perServer = DefaultKetamaPoints
+    }
+
+    var points []ketamaPoint
+    for i, s := range servers {
+        // The float32 arithmetic matches libmemcached's, so that the
+        // number of points is the same.
+        pct := float32(ketamaWeight(s.Weight)) / float32(total)
+        n := int(math.Floor(float64(pct*float32(perServer)/4*float32(len(servers))+0.0000000001))) * 4
+        name := ketamaName(s.Addr)
+        for j := 0; j < n/4; j++ {
+            digest := md5.Sum([]byte(fmt.Sprintf("%s-%d", name, j)))
+            for k := 0; k < 4; k++ {
+                points = append(points, ketamaPoint{
+                    hash: binary.LittleEndian.Uint32(digest[4*k:]),
+                    addr: naddr[i],
+                })
+            }
+        }
+    }
+    sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+
+    ks.lk.Lock()
+    defer ks.lk.Unlock()
+    ks.addrs = naddr
+    ks.points = points
+    return nil
+}
+
+func ketamaWeight(w int) int {
+    if w <= 0 {
+        return 1
+    }
+    return w
+}
+
+// ketamaName returns the name under which libmemcached hashes a
+// server's points: its host alone on the default port, and its host
+// and port otherwise.
+func ketamaName(server string) string {
+    if strings.Contains(server, "/") {
+        return server
+    }
+    host, port, err := net.SplitHostPort(server)
+    if err != nil || port != "11211" {
+        return server
+    }
+    return host
+}
+
+// ketamaHash is libmemcached's MD5 hash of a key.
+func ketamaHash(key string) uint32 {
+    digest := md5.Sum([]byte(key))
+    return binary.LittleEndian.Uint32(digest[:4])
+}
+
+func (ks *KetamaSelector) PickServer(key string) (net.Addr, error) {
+    ks.lk.RLock()
+    defer ks.lk.RUnlock()
+    if len(ks.points) == 0 {
+        return nil, ErrNoServers
+    }
+    if len(ks.addrs) == 1 {
+        return ks.addrs[0], nil
+    }
+    h := ketamaHash(key)
+    i := sort.Search(len(ks.points), func(i int) bool { return ks.points[i].hash >= h })
+    if i == len(ks.points) {
+        i = 0
+    }
+    return ks.points[i].addr, nil
+}
+
+func (ks *KetamaSelector) GetServers() ([]net.Addr, error) {
+    ks.lk.RLock()
+    defer ks.lk.RUnlock()
+    return ks.addrs, nil
+}
+
+// Ring returns the KetamaSelector's points for diagnostics, in
+// ascending order of Hash.
+func (ks *KetamaSelector) Ring() []RingPoint {
+    ks.lk.RLock()
+    defer ks.lk.RUnlock()
+    points := make([]RingPoint, len(ks.points))
+    for i, p := range ks.points {
+        points[i] = RingPoint{Hash: p.hash, Addr: p.addr}
+    }
+    return points
+}
+
+// PreviewKeys reports the server each of the given keys would be
+// stored on, keyed by key. Keys that cannot be placed are omitted.
+func (ks *KetamaSelector) PreviewKeys(keys []string) map[string]string {
+    return previewKeys(ks, keys)
+}
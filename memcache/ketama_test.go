@@ -0,0 +1,111 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "crypto/md5"
+    "encoding/binary"
+    "fmt"
+    "testing"
+)
+
+func TestKetamaRing(t *testing.T) {
+    var ks KetamaSelector
+    if err := ks.SetServers("10.0.1.1:11211", "10.0.1.2:11212"); err != nil {
+        t.Fatal(err)
+    }
+    ring := ks.Ring()
+    if len(ring) != 2*DefaultKetamaPoints {
+        t.Fatalf("ring has %d points, want %d", len(ring), 2*DefaultKetamaPoints)
+    }
+    for i := 1; i < len(ring); i++ {
+        if ring[i].Hash < ring[i-1].Hash {
+            t.Fatalf("ring not sorted at %d", i)
+        }
+    }
+
+    // Servers on the default port are hashed by host alone, others by
+    // host and port, as libmemcached does.
+    for _, name := range []string{"10.0.1.1-0", "10.0.1.2:11212-0"} {
+        digest := md5.Sum([]byte(name))
+        want := binary.LittleEndian.Uint32(digest[:4])
+        found := false
+        for _, p := range ring {
+            found = found || p.Hash == want
+        }
+        if !found {
+            t.Errorf("ring has no point for %q", name)
+        }
+    }
+}
+
+func TestKetamaMovesFewKeys(t *testing.T) {
+    servers := []string{"10.0.1.1:11211", "10.0.1.2:11211", "10.0.1.3:11211"}
+    var before, after KetamaSelector
+    if err := before.SetServers(servers...); err != nil {
+        t.Fatal(err)
+    }
+    if err := after.SetServers(append(servers, "10.0.1.4:11211")...); err != nil {
+        t.Fatal(err)
+    }
+    const n = 10000
+    moved := 0
+    for i := 0; i < n; i++ {
+        key := fmt.Sprintf("key%d", i)
+        a, _ := before.PickServer(key)
+        b, _ := after.PickServer(key)
+        if a.String() != b.String() {
+            moved++
+            if b.String() != "10.0.1.4:11211" {
+                t.Fatalf("%s moved from %s to %s, not to the new server", key, a, b)
+            }
+        }
+    }
+    if moved < n/8 || moved > n*3/8 {
+        t.Errorf("adding a fourth server moved %d of %d keys, want about a quarter", moved, n)
+    }
+}
+
+func TestKetamaWeights(t *testing.T) {
+    var ks KetamaSelector
+    err := ks.SetWeightedServers(
+        KetamaServer{Addr: "10.0.1.1:11211", Weight: 3},
+        KetamaServer{Addr: "10.0.1.2:11211", Weight: 1},
+    )
+    if err != nil {
+        t.Fatal(err)
+    }
+    const n = 10000
+    heavy := 0
+    for i := 0; i < n; i++ {
+        addr, err := ks.PickServer(fmt.Sprintf("key%d", i))
+        if err != nil {
+            t.Fatal(err)
+        }
+        if addr.String() == "10.0.1.1:11211" {
+            heavy++
+        }
+    }
+    if heavy < n*65/100 || heavy > n*85/100 {
+        t.Errorf("server of weight 3 got %d of %d keys, want about three quarters", heavy, n)
+    }
+
+    var empty KetamaSelector
+    if _, err := empty.PickServer("k"); err != ErrNoServers {
+        t.Errorf("PickServer without servers = %v, want ErrNoServers", err)
+    }
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "net"
+    "sort"
+    "time"
+)
+
+const (
+    // latencyWindow is the number of recent operations per server whose
+    // latency is considered for MaxLatency.
+    latencyWindow = 100
+
+    // latencyMinSamples is the number of operations a server must have
+    // served before its latency is judged.
+    latencyMinSamples = 20
+
+    // defaultLatencyProbeInterval is used when LatencyProbeInterval
+    // is zero.
+    defaultLatencyProbeInterval = time.Second
+)
+
+// latencyStats holds the recent latencies of one server.
+type latencyStats struct {
+    samples [latencyWindow]time.Duration
+    n       int // number of valid samples
+    next    int // index of the next sample to overwrite
+    ejected bool
+}
+
+func (ls *latencyStats) add(d time.Duration) {
+    ls.samples[ls.next] = d
+    ls.next = (ls.next + 1) % latencyWindow
+    if ls.n < latencyWindow {
+        ls.n++
+    }
+}
+
+// p99 returns the 99th percentile of the recorded latencies.
+func (ls *latencyStats) p99() time.Duration {
+    sorted := make([]time.Duration, ls.n)
+    copy(sorted, ls.samples[:ls.n])
+    sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+    return sorted[(ls.n*99+99)/100-1]
+}
+
+// recordLatency records that an operation on addr started at start has
+// just finished, and ejects addr from selection if that pushes its p99
+// latency over MaxLatency.
+func (c *Client) recordLatency(addr net.Addr, start time.Time) {
+    d := time.Since(start)
+    hs, ok := c.selector.(HealthSelector)
+    if !ok {
+        return
+    }
+    key := addr.String()
+    c.latLk.Lock()
+    if c.latency == nil {
+        c.latency = make(map[string]*latencyStats)
+    }
+    ls := c.latency[key]
+    if ls == nil {
+        ls = new(latencyStats)
+        c.latency[key] = ls
+    }
+    ls.add(d)
+    eject := !ls.ejected && ls.n >= latencyMinSamples && ls.p99() > c.MaxLatency
+    if eject {
+        ls.ejected = true
+    }
+    c.latLk.Unlock()
+
+    if eject {
+        hs.MarkDown(addr)
+        go c.probeLatency(hs, addr)
+    }
+}
+
+// probeLatency periodically times a version command against the
+// ejected server addr, and returns it to selection with a fresh latency
+// window once one completes within MaxLatency, unless FailureLimit
+// still has it ejected. It stops probing, and forgets addr, once addr
+// is no longer one of the selector's servers.
+func (c *Client) probeLatency(hs HealthSelector, addr net.Addr) {
+    interval := c.LatencyProbeInterval
+    if interval <= 0 {
+        interval = defaultLatencyProbeInterval
+    }
+    for {
+        time.Sleep(interval)
+        if !c.selected(addr) {
+            break
+        }
+        start := time.Now()
+        _, err := c.VersionFromAddr(addr)
+        if err == ErrClientClosed {
+            return
+        }
+        if err == nil && time.Since(start) <= c.MaxLatency {
+            break
+        }
+    }
+    c.latLk.Lock()
+    delete(c.latency, addr.String())
+    c.latLk.Unlock()
+    if !c.healthEjected(addr) {
+        hs.MarkUp(addr)
+    }
+}
+
+// latencyEjected reports whether MaxLatency has addr ejected.
+func (c *Client) latencyEjected(addr net.Addr) bool {
+    c.latLk.Lock()
+    defer c.latLk.Unlock()
+    ls := c.latency[addr.String()]
+    return ls != nil && ls.ejected
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "net"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func TestLatencyEjection(t *testing.T) {
+    c, ss, fast, slow, key, heal := latencyEjectedServer(t)
+    if err := c.Set(&Item{Key: key, Value: []byte("v")}); err != nil {
+        t.Fatal(err)
+    }
+    fast.mu.Lock()
+    _, ok := fast.items[key]
+    fast.mu.Unlock()
+    if !ok {
+        t.Errorf("Set of slow server's key did not reach the fast server")
+    }
+
+    heal()
+    deadline := time.Now().Add(2 * time.Second)
+    for {
+        if addr, _ := ss.PickServer(key); addr.String() == slow.Addr() {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatal("slow server was not returned to selection after it recovered")
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+}
+
+// latencyEjectedServer returns a client whose selector has a fast and
+// a slow server, with the slow one ejected by MaxLatency, and a key
+// that hashes to the slow one. The slow server is fast once heal is
+// called.
+func latencyEjectedServer(t *testing.T) (c *Client, ss *ServerList, fast, slow *fakeServer, key string, heal func()) {
+    fast = newFakeServer(t)
+    slow = newFakeServer(t)
+    var delay int32 = 1
+    slow.handler = func(line string, rw *bufio.ReadWriter) bool {
+        if atomic.LoadInt32(&delay) != 0 {
+            time.Sleep(20 * time.Millisecond)
+        }
+        return false
+    }
+    ss = new(ServerList)
+    if err := ss.SetServers(fast.Addr(), slow.Addr()); err != nil {
+        t.Fatal(err)
+    }
+    c = NewFromSelector(ss)
+    c.MaxLatency = 10 * time.Millisecond
+    c.LatencyProbeInterval = 10 * time.Millisecond
+    for i := 0; ; i++ {
+        key = fmt.Sprintf("key%d", i)
+        if addr, _ := ss.PickServer(key); addr.String() == slow.Addr() {
+            break
+        }
+    }
+    for i := 0; i < latencyMinSamples; i++ {
+        c.Get(key)
+    }
+    if addr, _ := ss.PickServer(key); addr.String() != fast.Addr() {
+        t.Fatalf("slow server's key routed to %v after it was slow, want %v", addr, fast.Addr())
+    }
+    return c, ss, fast, slow, key, func() { atomic.StoreInt32(&delay, 0) }
+}
+
+func TestLatencyRecoveryKeepsHealthEjection(t *testing.T) {
+    c, ss, fast, slow, key, heal := latencyEjectedServer(t)
+    c.FailureLimit = 1
+    c.DeadRetryInterval = time.Hour
+    addr, err := net.ResolveTCPAddr("tcp", slow.Addr())
+    if err != nil {
+        t.Fatal(err)
+    }
+    c.recordHealth(addr, &net.OpError{Op: "read", Err: errors.New("connection reset")})
+
+    heal()
+    waitFor(t, func() bool { return !c.latencyEjected(addr) })
+    if got, _ := ss.PickServer(key); got.String() != fast.Addr() {
+        t.Errorf("key routed to %v once latency recovered, want %v while FailureLimit has it ejected", got, fast.Addr())
+    }
+}
+
+func TestLatencyProbeStopsForRemovedServer(t *testing.T) {
+    c, ss, fast, slow, _, _ := latencyEjectedServer(t)
+    if err := ss.SetServers(fast.Addr()); err != nil {
+        t.Fatal(err)
+    }
+    addr, err := net.ResolveTCPAddr("tcp", slow.Addr())
+    if err != nil {
+        t.Fatal(err)
+    }
+    waitFor(t, func() bool { return !c.latencyEjected(addr) })
+    n := len(slow.commands())
+    time.Sleep(10 * c.LatencyProbeInterval)
+    if got := len(slow.commands()); got != n {
+        t.Errorf("removed server probed %d more times", got-n)
+    }
+}
+
+func TestServerListMarkDown(t *testing.T) {
+    ss := new(ServerList)
+    if err := ss.SetServers("127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"); err != nil {
+        t.Fatal(err)
+    }
+    down, _ := ss.PickServer("k")
+    ss.MarkDown(down)
+    for i := 0; i < 100; i++ {
+        key := fmt.Sprintf("k%d", i)
+        if addr, _ := ss.PickServer(key); addr.String() == down.String() {
+            t.Fatalf("PickServer(%q) = down server %v", key, addr)
+        }
+    }
+    ss.MarkUp(down)
+    if addr, _ := ss.PickServer("k"); addr.String() != down.String() {
+        t.Errorf("PickServer(k) after MarkUp = %v, want %v", addr, down)
+    }
+}
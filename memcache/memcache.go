@@ -20,16 +20,21 @@ package memcache
 import (
     "bufio"
     "bytes"
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
     "errors"
     "fmt"
     "io"
-    "io/ioutil"
     "net"
 
     "reflect"
+    "sort"
     "strconv"
     "strings"
     "sync"
+    "sync/atomic"
+    "syscall"
     "time"
 )
 
@@ -53,6 +58,11 @@ var (
     // ErrServer means that a server error occurred.
     ErrServerError = errors.New("memcache: server error")
 
+    // ErrServerBusy means that the server, typically a proxy under
+    // overload, answered with a temporary failure. The request may be
+    // retried after a delay; see Client.BusyRetries.
+    ErrServerBusy = errors.New("memcache: server busy, retry later")
+
     // ErrNoStats means that no statistics were available.
     ErrNoStats = errors.New("memcache: no statistics available")
 
@@ -64,17 +74,83 @@ var (
     // ErrNoServers is returned when no servers are configured or available.
     ErrNoServers = errors.New("memcache: no servers configured or available")
 
+    // ErrDuplicateServer is returned by ServerList.SetServersStrict when
+    // the same server address is listed more than once.
+    ErrDuplicateServer = errors.New("memcache: duplicate server address")
+
     // ErrInvalidStatsKey is returned when trying to set key not defined in the
     // GeneralStats/SettingsStats/ItemStats/SlabStats struct.
     ErrInvalidStatsKey = errors.New("memcache: try to set invalid key in status structs")
+
+    // ErrResponseTooLong is returned when a server response runs on
+    // for longer than any valid response could without its terminator.
+    ErrResponseTooLong = errors.New("memcache: response too long or missing terminator")
+
+    // ErrResponseTooLarge is returned when a server announces a value
+    // larger than Client.MaxReadValueSize.
+    ErrResponseTooLarge = errors.New("memcache: value in response too large")
+
+    // ErrUnexpectedEOF is returned when the server closes the
+    // connection before sending a complete response.
+    ErrUnexpectedEOF = errors.New("memcache: server closed connection mid-response")
+
+    // ErrAcquireTimeout is returned when no connection to a server
+    // became available within Client.AcquireTimeout.
+    ErrAcquireTimeout = errors.New("memcache: timed out waiting for a connection")
+
+    // ErrProtocol is returned when a server response is well formed but
+    // does not answer the request, such as an item for a key that was
+    // not asked for. See Client.StrictProtocol.
+    ErrProtocol = errors.New("memcache: response does not match request")
+
+    // ErrInvalidRange is returned by GetRange when the requested range
+    // does not lie within the item's value.
+    ErrInvalidRange = errors.New("memcache: range out of bounds of value")
+
+    // ErrWriteVerifyFailed means that the server accepted a write but,
+    // with VerifyWrites set, reading the item back did not return the
+    // value written.
+    ErrWriteVerifyFailed = errors.New("memcache: written value could not be read back")
+
+    // ErrNotSupported means that the server does not support the
+    // requested operation.
+    ErrNotSupported = errors.New("memcache: operation not supported by server")
+
+    // ErrClientClosed is returned by operations started after Shutdown.
+    ErrClientClosed = errors.New("memcache: client is shut down")
 )
 
 // DefaultTimeout is the default socket read/write timeout.
 const DefaultTimeout = time.Duration(100) * time.Millisecond
 
+// NoExpiration may be used as an Item's Expiration to store it without
+// an expiration time even if the Client has a DefaultExpiration.
+const NoExpiration = int32(-2)
+
 const (
     buffered            = 8 // arbitrary buffered channel size, for readability
-    maxIdleConnsPerAddr = 2 // TODO(bradfitz): make this configurable?
+    maxIdleConnsPerAddr = 2 // default for Client.MaxIdleConns
+
+    // maxStatsLines bounds the number of lines read from a single stats
+    // response, so a server that never sends END cannot keep the client
+    // reading forever.
+    maxStatsLines = 1 << 16
+
+    // maxStatsQueries bounds the number of servers StatsMulti queries
+    // at once.
+    maxStatsQueries = 16
+
+    // defaultBusyBackoff is used when BusyBackoff is zero.
+    defaultBusyBackoff = 100 * time.Millisecond
+
+    // defaultRetryBackoff is used when RetryBackoff is zero.
+    defaultRetryBackoff = 100 * time.Millisecond
+
+    // maxRetryBackoff bounds the doubling of RetryBackoff.
+    maxRetryBackoff = 5 * time.Second
+
+    // defaultCapabilitiesTTL is used when CapabilitiesTTL is zero.
+    defaultCapabilitiesTTL = 10 * time.Minute
 )
 
 // resumableError returns true if err is only a protocol-level cache error.
@@ -83,14 +159,55 @@ const (
 // connection, unless it was just a cache error.
 func resumableError(err error) bool {
     switch err {
-    case ErrCacheMiss, ErrCASConflict, ErrNotStored, ErrMalformedKey:
+    case ErrCacheMiss, ErrCASConflict, ErrNotStored, ErrMalformedKey, ErrInvalidRange, ErrServerBusy:
+        return true
+    }
+    return false
+}
+
+// IsCacheMiss reports whether err is, or wraps, ErrCacheMiss.
+func IsCacheMiss(err error) bool {
+    return errors.Is(err, ErrCacheMiss)
+}
+
+// IsCASConflict reports whether err is, or wraps, ErrCASConflict.
+func IsCASConflict(err error) bool {
+    return errors.Is(err, ErrCASConflict)
+}
+
+// IsNotStored reports whether err is, or wraps, ErrNotStored.
+func IsNotStored(err error) bool {
+    return errors.Is(err, ErrNotStored)
+}
+
+// IsTimeout reports whether err is, or wraps, a connect timeout or a
+// network error that timed out.
+func IsTimeout(err error) bool {
+    var cte *ConnectTimeoutError
+    if errors.As(err, &cte) {
+        return true
+    }
+    var ne net.Error
+    return errors.As(err, &ne) && ne.Timeout()
+}
+
+// IsRetryable reports whether err is a transient network error, such
+// as a timeout, a connection reset or a connection closed by the
+// server, after which an operation may succeed if retried on another
+// connection. Errors from a done context are not retryable.
+func IsRetryable(err error) bool {
+    switch {
+    case err == nil, errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+        return false
+    case IsTimeout(err), errors.Is(err, ErrUnexpectedEOF), errors.Is(err, io.EOF),
+        errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
         return true
     }
     return false
 }
 
 func legalKey(key string) bool {
-    if len(key) > 250 {
+    if len(key) > maxKeyLength {
         return false
     }
     for i := 0; i < len(key); i++ {
@@ -101,6 +218,30 @@ func legalKey(key string) bool {
     return true
 }
 
+// maxKeyLength is the longest key memcached accepts.
+const maxKeyLength = 250
+
+// TruncateKey shortens a key that is too long for memcached while
+// keeping it readable: a key longer than 250 bytes is replaced by its
+// first n bytes, a "#" and the hex SHA-256 of the whole key, so keys
+// sharing a long prefix still map to distinct keys. n is lowered as
+// needed to keep the result within 250 bytes. Shorter keys are
+// returned unchanged.
+func TruncateKey(key string, n int) string {
+    if len(key) <= maxKeyLength {
+        return key
+    }
+    sum := sha256.Sum256([]byte(key))
+    suffix := "#" + hex.EncodeToString(sum[:])
+    if max := maxKeyLength - len(suffix); n > max {
+        n = max
+    }
+    if n < 0 {
+        n = 0
+    }
+    return key[:n] + suffix
+}
+
 var (
     crlf            = []byte("\r\n")
     space           = []byte(" ")
@@ -110,14 +251,27 @@ var (
     resultExists    = []byte("EXISTS\r\n")
     resultNotFound  = []byte("NOT_FOUND\r\n")
     resultDeleted   = []byte("DELETED\r\n")
+    resultTouched   = []byte("TOUCHED\r\n")
     resultEnd       = []byte("END\r\n")
+    resultReset     = []byte("RESET\r\n")
+    resultOK        = []byte("OK\r\n")
 
     resultClientErrorPrefix = []byte("CLIENT_ERROR ")
+    resultServerErrorPrefix = []byte("SERVER_ERROR ")
+    resultTemporaryFailure  = []byte("temporary failure")
 )
 
+// validKey reports whether key may be sent to the server: it is legal,
+// or the client does not check keys.
+func (c *Client) validKey(key string) bool {
+    return c.SkipKeyValidation || legalKey(key)
+}
+
 // New returns a memcache client using the provided server(s)
 // with equal weight. If a server is listed multiple times,
-// it gets a proportional amount of weight.
+// it gets a proportional amount of weight. A server is either a TCP
+// "host:port" or the path of a Unix domain socket, optionally written
+// as "unix:///path".
 func New(server ...string) *Client {
     ss := new(ServerList)
     ss.SetServers(server...)
@@ -126,20 +280,305 @@ func New(server ...string) *Client {
 
 // NewFromSelector returns a new Client using the provided ServerSelector.
 func NewFromSelector(ss ServerSelector) *Client {
-    return &Client{selector: ss}
+    c := &Client{selector: ss}
+    if ws, ok := ss.(WatchableSelector); ok {
+        ws.Watch(c.serversChanged)
+    }
+    return c
+}
+
+func (c *Client) serversChanged(added, removed []string) {
+    if c.OnServersChanged != nil {
+        c.OnServersChanged(added, removed)
+    }
 }
 
 // Client is a memcache client.
 // It is safe for unlocked use by multiple concurrent goroutines.
 type Client struct {
-    // Timeout specifies the socket read/write timeout.
-    // If zero, DefaultTimeout is used.
+    // Timeout specifies the socket read/write timeout, and the connect
+    // timeout. If zero, DefaultTimeout is used.
     Timeout time.Duration
 
+    // ConnectTimeout, ReadTimeout and WriteTimeout, if non-zero,
+    // override Timeout for dialing servers, for reading responses and
+    // for writing commands respectively.
+    ConnectTimeout time.Duration
+    ReadTimeout    time.Duration
+    WriteTimeout   time.Duration
+
+    // Compression selects the algorithm used to compress values written
+    // by Set, Add, CompareAndSwap and SetSameValue. The algorithm is
+    // recorded in the item's flags, so values are decompressed correctly
+    // on Get, even after Compression is changed to another algorithm.
+    // Values are decompressed only while Compression or Decompress is
+    // set: without them, the flag bits that record the algorithm are
+    // left to the application.
+    Compression Compression
+
+    // Decompress makes Get decompress values whose flags record a
+    // compression algorithm even while Compression is CompressionNone,
+    // for instance after compression has been turned off.
+    Decompress bool
+
+    // StaleOnError, if positive, keeps the last value seen by Get or
+    // stored by Set, Add or CompareAndSwap for up to that many keys.
+    // When Get then fails because a server cannot be reached or errs,
+    // the kept value is returned instead, with Item.Stale set and a
+    // nil error. This favors availability over correctness.
+    StaleOnError int
+
+    // VerifyWrites makes Set, Add and CompareAndSwap read the item back
+    // after the server accepts it, returning ErrWriteVerifyFailed if
+    // the value is missing or differs, e.g. because it was evicted at
+    // once. This costs an extra round trip per write.
+    VerifyWrites bool
+
+    // MaxLatency, if positive, takes a server out of selection while
+    // the 99th percentile latency of its recent operations exceeds it,
+    // so that its keys are served by the other servers rather than by a
+    // server that is up but slow. This requires a selector implementing
+    // HealthSelector, such as ServerList. An ejected server is probed
+    // every LatencyProbeInterval, or every second if that is zero, and
+    // put back once a probe completes within MaxLatency.
+    MaxLatency           time.Duration
+    LatencyProbeInterval time.Duration
+
+    // FailureLimit, if positive, takes a server out of selection once
+    // that many operations on it in a row have failed to connect or
+    // with a network error, so that its keys are served by the other
+    // servers rather than each timing out against a dead one. Like
+    // MaxLatency, this requires a selector implementing HealthSelector.
+    // An ejected server is probed every DeadRetryInterval, or every 10
+    // seconds if that is zero, and put back once a probe succeeds.
+    FailureLimit      int
+    DeadRetryInterval time.Duration
+
+    // BigChunkSize is the largest chunk SetBig splits values into.
+    // It must fit within the server's maximum item size along with the
+    // item's overhead. If zero, 1000000 bytes is used, which suits the
+    // default 1MB maximum.
+    BigChunkSize int
+
+    // BusyRetries is the number of times a storage or delete command
+    // answered with ErrServerBusy is retried, waiting BusyBackoff, or
+    // 100ms if that is zero, before each retry. By default such
+    // commands are not retried.
+    BusyRetries int
+    BusyBackoff time.Duration
+
+    // MaxRetries is the number of times an operation that failed with
+    // a transient network error is retried, waiting RetryBackoff, or
+    // 100ms if that is zero, before the first retry and twice as long
+    // before each further one, up to 5s. The wait ends early, failing
+    // the operation, if its context is done. The connection that
+    // failed is closed, so each retry uses another. By default
+    // operations are not retried. A command whose response was lost
+    // may have been executed, so a retried Increment, Append or the
+    // like can take effect twice.
+    MaxRetries   int
+    RetryBackoff time.Duration
+
+    // RetryableError, if non-nil, decides which errors MaxRetries
+    // applies to, in place of IsRetryable.
+    RetryableError func(error) bool
+
+    // SkipKeyValidation disables the client's own check that keys are
+    // at most 250 bytes of printable ASCII, for proxies and servers
+    // that accept other keys. Keys are then sent as given and the
+    // server decides whether they are valid. A key containing
+    // whitespace or a line break still cannot be sent intact and will
+    // corrupt the command.
+    SkipKeyValidation bool
+
+    // DefaultExpiration is used in place of an Item's Expiration when
+    // the latter is zero. Use NoExpiration to store an item without an
+    // expiration time regardless of this setting.
+    DefaultExpiration int32
+
+    // MaxOpenConns limits the number of connections, idle or in use,
+    // that may be open to a single server at once. When the limit is
+    // reached, callers block until a connection is released and are
+    // served in the order they started waiting.
+    // If zero or negative, the number of connections is unlimited.
+    MaxOpenConns int
+
+    // MaxIdleConns is the number of idle connections kept open to each
+    // server for reuse; connections released beyond it are closed.
+    // If zero or negative, 2 are kept.
+    MaxIdleConns int
+
+    // IdleConnTimeout, if positive, is how long a connection may sit
+    // idle in the pool before it is closed, so that connections left
+    // over from a burst of traffic do not stay open indefinitely.
+    // A background goroutine closes them while any are idle.
+    IdleConnTimeout time.Duration
+
+    // MaxConcurrentDials limits the number of connections being dialed
+    // to a single server at once. Callers that would exceed it wait for
+    // an existing connection to be released instead, which keeps a burst
+    // of requests from flooding a cold server with connects.
+    // If zero or negative, dials are not limited.
+    MaxConcurrentDials int
+
+    // AcquireTimeout, if positive, bounds how long an operation waits
+    // for a connection when MaxOpenConns or MaxConcurrentDials keeps it
+    // from dialing a new one. Operations that wait longer fail with
+    // ErrAcquireTimeout, which unlike an I/O timeout means the request
+    // was never sent. Timeout still bounds the operation itself.
+    AcquireTimeout time.Duration
+
+    // CapabilitiesTTL is how long the capabilities of a server, which
+    // some operations consult to choose how to talk to it, are cached
+    // before being queried again. A connection error on a server also
+    // drops its cached capabilities, in case it was restarted with a
+    // different version. If zero, 10 minutes is used.
+    CapabilitiesTTL time.Duration
+
+    // DisableCAS makes Get and GetMulti issue the plain get command
+    // rather than gets, saving the server from sending each item's CAS
+    // id. Items fetched this way cannot be used with CompareAndSwap.
+    DisableCAS bool
+
+    // LenientLineEndings makes Get and GetMulti accept values that are
+    // terminated by a bare "\n" instead of "\r\n", as sent by some
+    // buggy proxies. By default such responses are rejected as corrupt.
+    LenientLineEndings bool
+
+    // StrictProtocol makes Get and GetMulti check that every item a
+    // server returns is for one of the keys sent to it, and fail with
+    // ErrProtocol otherwise. This catches misconfigured proxies that
+    // would otherwise corrupt the result. It is off by default as it
+    // costs a map per request.
+    StrictProtocol bool
+
+    // MaxReadValueSize, if positive, is the largest value Get and
+    // GetMulti will read. A response announcing a larger value fails
+    // with ErrResponseTooLarge before any of it is read, and its
+    // connection is closed, so a corrupt or hostile response cannot
+    // make the client allocate without bound. It also bounds the size
+    // compressed values may decompress to, which is 64MB if it is not
+    // set.
+    MaxReadValueSize int
+
+    // MissingEndTimeout, if positive, lets Get and GetMulti work with
+    // servers and proxies that omit the END line after the values of a
+    // get response. Once at least one value has been read, if no
+    // further data arrives within MissingEndTimeout the response is
+    // taken to be complete and the connection, on which the END might
+    // still arrive, is closed rather than reused. The tradeoff is that
+    // a server that is merely that slow to send the rest of a response
+    // has it cut short, with the remaining keys reported as misses. A
+    // response with no values at all still waits for the full Timeout.
+    // It has no effect with Multiplex.
+    MissingEndTimeout time.Duration
+
+    // SingleFlight makes concurrent Get calls for the same key share a
+    // single request to the server, so a burst of callers asking for a
+    // missing key costs one round trip rather than one each. Each caller
+    // receives its own copy of the result. GetMulti is not affected.
+    SingleFlight bool
+
+    // Multiplex makes Get and GetMulti share a single connection per
+    // server rather than using a connection from the pool for each
+    // request. Requests are pipelined on it and responses are matched
+    // to them in order, which saves connection setup and round trips
+    // for latency-bound workloads, at the cost of head-of-line
+    // blocking: a large or slow response delays all those behind it.
+    // An I/O or protocol error closes the shared connection and fails
+    // every request waiting on it; the next request dials a new one.
+    // Other operations still use the pool.
+    Multiplex bool
+
+    // MaxPipelineDepth, if positive, limits the number of requests
+    // awaiting their response on a connection shared by Multiplex.
+    // Further requests block until earlier responses have been read,
+    // or fail with ErrAcquireTimeout once AcquireTimeout passes. If
+    // zero, up to 256 requests may be outstanding.
+    MaxPipelineDepth int
+
+    // WrapConn, if non-nil, is applied to every newly dialed connection
+    // before it is used, e.g. to count bytes or trace I/O. All reads,
+    // writes, deadlines and closes then go through the returned conn.
+    WrapConn func(net.Conn) net.Conn
+
+    // DialFunc, if non-nil, is used to open connections in place of a
+    // net.Dialer, e.g. to go through a SOCKS proxy or SSH tunnel. The
+    // context it is given expires after Timeout and is canceled if the
+    // operation needing the connection is; DialFunc must honor it.
+    DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+    // OnDial, if non-nil, is called after every attempt to dial a
+    // server with the outcome of the attempt and how long it took.
+    OnDial func(addr net.Addr, err error, d time.Duration)
+
+    // OnConnClose, if non-nil, is called whenever the client closes a
+    // connection, with a short description of why it was closed.
+    OnConnClose func(addr net.Addr, reason string)
+
+    // RefreshAhead, if non-nil, makes Get refresh items close to
+    // expiring: after a hit, the item's remaining time to live is read
+    // in the background, which requires a server that supports the
+    // meta protocol, and if it is below the threshold a fresh item is
+    // loaded and stored. The hit is returned at once either way. Only
+    // one refresh runs per key at a time.
+    RefreshAhead *RefreshAhead
+
+    // OnServersChanged, if non-nil, is called whenever the selector's
+    // set of servers changes, with the sorted addresses that were
+    // added and removed. It requires a WatchableSelector, such as
+    // ServerList.
+    OnServersChanged func(added, removed []string)
+
+    // DryRun makes every command that would change a server, from Set
+    // and Delete to FlushAll and the meta commands, be logged to Logger
+    // instead of sent, and be answered as if it had succeeded.
+    // Increment and Decrement then report a new value of 0, and
+    // GetAndTouch and GetAndTouchMulti report misses. Reads are
+    // unaffected.
+    DryRun bool
+
+    // Logger, if non-nil, receives the commands skipped under DryRun.
+    Logger Logger
+
     selector ServerSelector
 
     lk       sync.Mutex
     freeconn map[string][]*conn
+    numOpen  map[string]int
+    dialing  map[string]int
+    connReqs map[string][]chan connRequest
+    conns    map[*conn]bool // every open conn, idle or in use
+    creds    *credentials   // set by SetAuth
+    authGen  int            // bumped by SetAuth
+    reaping  bool           // reapIdle is running
+    closed   bool
+    drained  chan struct{} // closed once Shutdown has no conns left
+
+    flightLk sync.Mutex
+    flights  map[string]*flight
+
+    stale staleCache
+
+    latLk   sync.Mutex
+    latency map[string]*latencyStats
+
+    healthLk sync.Mutex
+    failures map[string]*failureStats
+
+    muxLk    sync.Mutex
+    muxConns map[string]*muxConn
+    muxDials map[string]*muxDial
+
+    metrics clientMetrics
+
+    refresher refresher
+
+    capsLk sync.Mutex
+    caps   map[string]cachedCapabilities
+
+    mwLk       sync.RWMutex
+    middleware []Middleware
 }
 
 // Item is an item to be got or stored in a memcached server.
@@ -162,10 +601,42 @@ type Item struct {
     // Zero means the Item has no expiration time.
     Expiration int32
 
+    // Stale is set on items returned by Get from the client's local
+    // store because the server failed. See Client.StaleOnError.
+    Stale bool
+
     // Compare and swap ID.
     casid uint64
 }
 
+// NewItemWithCAS returns an item carrying the given CAS id, such as one
+// read back with UnmarshalCAS, so that an item fetched by one process
+// can be passed to CompareAndSwap by another.
+func NewItemWithCAS(key string, value []byte, cas uint64) *Item {
+    return &Item{Key: key, Value: value, casid: cas}
+}
+
+// CAS returns the item's CAS id, or 0 if it has none.
+func (it *Item) CAS() uint64 {
+    return it.casid
+}
+
+// MarshalCAS returns the item's CAS id encoded as decimal text, for
+// passing along with the item across a process boundary.
+func (it *Item) MarshalCAS() []byte {
+    return strconv.AppendUint(nil, it.casid, 10)
+}
+
+// UnmarshalCAS sets the item's CAS id from the output of MarshalCAS.
+func (it *Item) UnmarshalCAS(b []byte) error {
+    cas, err := strconv.ParseUint(string(b), 10, 64)
+    if err != nil {
+        return fmt.Errorf("memcache: invalid CAS id %q", b)
+    }
+    it.casid = cas
+    return nil
+}
+
 // GeneralStats is a struct to represent statistics info retrieve from server.
 // https://github.com/memcached/memcached/blob/master/doc/protocol.txt#L424
 type GeneralStats struct {
@@ -418,12 +889,39 @@ func (s *SlabStats) Set(key string, value []byte) error {
     return nil
 }
 
+// StatKV is one line of a stats response.
+type StatKV struct {
+    Key   string
+    Value []byte
+}
+
 // conn is a connection to a server.
 type conn struct {
     nc   net.Conn
     rw   *bufio.ReadWriter
     addr net.Addr
     c    *Client
+
+    // readDeadline and writeDeadline are the deadlines last set on nc.
+    readDeadline, writeDeadline time.Time
+
+    // created is when nc was dialed.
+    created time.Time
+
+    // authGen is the client's authGen when nc was authenticated.
+    authGen int
+
+    // idleSince is when the conn was last put in the free pool.
+    idleSince time.Time
+}
+
+// connRequest is handed to a goroutine waiting for a connection to a
+// server whose MaxOpenConns limit has been reached. A nil cn means the
+// waiter has been granted a free slot and should dial a new connection,
+// unless err is set.
+type connRequest struct {
+    cn  *conn
+    err error
 }
 
 // release returns this connection back to the client's free pool
@@ -431,8 +929,71 @@ func (cn *conn) release() {
     cn.c.putFreeConn(cn.addr, cn)
 }
 
+// close closes the underlying network connection and frees its slot
+// in the client's open connection count. The reason is reported to
+// the client's OnConnClose hook.
+func (cn *conn) close(reason string) {
+    cn.nc.Close()
+    if cn.c.OnConnClose != nil {
+        cn.c.OnConnClose(cn.addr, reason)
+    }
+    cn.c.connClosed(cn.addr, cn)
+}
+
+// setDeadline sets the connection's read and write deadlines to t.
+func (cn *conn) setDeadline(t time.Time) {
+    cn.nc.SetDeadline(t)
+    cn.readDeadline, cn.writeDeadline = t, t
+}
+
+// limitDeadline brings the connection's read and write deadlines
+// forward to t if they are later.
+func (cn *conn) limitDeadline(t time.Time) {
+    if t.Before(cn.readDeadline) {
+        cn.nc.SetReadDeadline(t)
+        cn.readDeadline = t
+    }
+    if t.Before(cn.writeDeadline) {
+        cn.nc.SetWriteDeadline(t)
+        cn.writeDeadline = t
+    }
+}
+
+// extendDeadline pushes the connection's read and write deadlines out
+// to the client's read and write timeouts from now. Since SetDeadline
+// is a system call, it is skipped when the current deadline is later
+// than the new one would be by less than a tenth of the timeout: the
+// connection then times out at most that much early, and a burst of
+// operations on one connection costs one SetDeadline rather than one
+// each. When the two timeouts are equal, both deadlines are set with a
+// single SetDeadline.
 func (cn *conn) extendDeadline() {
-    cn.nc.SetDeadline(time.Now().Add(cn.c.netTimeout()))
+    now := time.Now()
+    rt, wt := cn.c.readTimeout(), cn.c.writeTimeout()
+    rd, wd := now.Add(rt), now.Add(wt)
+    extendRead := !closeDeadline(cn.readDeadline, rd, rt)
+    extendWrite := !closeDeadline(cn.writeDeadline, wd, wt)
+    if rt == wt {
+        if extendRead || extendWrite {
+            cn.setDeadline(rd)
+        }
+        return
+    }
+    if extendRead {
+        cn.nc.SetReadDeadline(rd)
+        cn.readDeadline = rd
+    }
+    if extendWrite {
+        cn.nc.SetWriteDeadline(wd)
+        cn.writeDeadline = wd
+    }
+}
+
+// closeDeadline reports whether the current deadline cur is later than
+// next by less than a tenth of timeout, so need not be moved to next.
+func closeDeadline(cur, next time.Time, timeout time.Duration) bool {
+    d := next.Sub(cur)
+    return d >= 0 && d < timeout/10
 }
 
 // condRelease releases this connection if the error pointed to by err
@@ -443,27 +1004,87 @@ func (cn *conn) condRelease(err *error) {
     if *err == nil || resumableError(*err) {
         cn.release()
     } else {
-        cn.nc.Close()
+        cn.c.forgetCapabilities(cn.addr)
+        cn.close("error: " + (*err).Error())
     }
 }
 
 func (c *Client) putFreeConn(addr net.Addr, cn *conn) {
     c.lk.Lock()
-    defer c.lk.Unlock()
+    if c.closed {
+        c.lk.Unlock()
+        cn.close("client shut down")
+        return
+    }
+    if cn.authGen != c.authGen {
+        c.lk.Unlock()
+        cn.close("credentials changed")
+        return
+    }
+    if c.handOffLocked(addr.String(), connRequest{cn: cn}) {
+        c.lk.Unlock()
+        return
+    }
     if c.freeconn == nil {
         c.freeconn = make(map[string][]*conn)
     }
     freelist := c.freeconn[addr.String()]
-    if len(freelist) >= maxIdleConnsPerAddr {
-        cn.nc.Close()
+    if len(freelist) >= c.maxIdleConns() {
+        c.lk.Unlock()
+        cn.close("idle pool full")
         return
     }
+    cn.idleSince = time.Now()
     c.freeconn[addr.String()] = append(freelist, cn)
+    if c.IdleConnTimeout > 0 && !c.reaping {
+        c.reaping = true
+        go c.reapIdle(c.IdleConnTimeout)
+    }
+    c.lk.Unlock()
+}
+
+// reapIdle closes connections that have been idle for longer than
+// timeout, checking every timeout/2, until the pool is empty.
+func (c *Client) reapIdle(timeout time.Duration) {
+    for {
+        time.Sleep(timeout / 2)
+        cutoff := time.Now().Add(-timeout)
+        var expired []*conn
+        c.lk.Lock()
+        idle := 0
+        for key, freelist := range c.freeconn {
+            // Free lists are ordered from the longest idle.
+            n := 0
+            for n < len(freelist) && freelist[n].idleSince.Before(cutoff) {
+                n++
+            }
+            expired = append(expired, freelist[:n]...)
+            c.freeconn[key] = append(freelist[:0], freelist[n:]...)
+            clear(freelist[len(freelist)-n:])
+            idle += len(freelist) - n
+        }
+        done := idle == 0 || c.closed
+        if done {
+            c.reaping = false
+        }
+        c.lk.Unlock()
+
+        for _, cn := range expired {
+            cn.close("idle timeout")
+        }
+        if done {
+            return
+        }
+    }
 }
 
 func (c *Client) getFreeConn(addr net.Addr) (cn *conn, ok bool) {
     c.lk.Lock()
     defer c.lk.Unlock()
+    return c.getFreeConnLocked(addr)
+}
+
+func (c *Client) getFreeConnLocked(addr net.Addr) (cn *conn, ok bool) {
     if c.freeconn == nil {
         return nil, false
     }
@@ -476,6 +1097,220 @@ func (c *Client) getFreeConn(addr net.Addr) (cn *conn, ok bool) {
     return cn, true
 }
 
+// connClosed records that a connection to addr, cn if it was ever
+// established, has gone away. If a goroutine is waiting for a
+// connection to addr, the freed slot is passed on to it so that it may
+// dial, unless MaxConcurrentDials dials are already in progress; the
+// waiter is then served by one of those instead.
+func (c *Client) connClosed(addr net.Addr, cn *conn) {
+    key := addr.String()
+    c.lk.Lock()
+    defer c.lk.Unlock()
+    delete(c.conns, cn)
+    if c.dialAllowedLocked(key) && c.handOffLocked(key, connRequest{}) {
+        c.dialing[key]++
+        return
+    }
+    c.numOpen[key]--
+    if c.closed && c.numOpen[key] == 0 {
+        delete(c.numOpen, key)
+        if len(c.numOpen) == 0 {
+            close(c.drained)
+        }
+    }
+}
+
+// dialAllowedLocked reports whether MaxConcurrentDials permits another
+// dial to the server with the given key. c.lk must be held.
+func (c *Client) dialAllowedLocked(key string) bool {
+    return c.MaxConcurrentDials <= 0 || c.dialing[key] < c.MaxConcurrentDials
+}
+
+// dialDone records that a dial to addr has finished.
+func (c *Client) dialDone(addr net.Addr) {
+    c.lk.Lock()
+    defer c.lk.Unlock()
+    c.dialing[addr.String()]--
+}
+
+// handOffLocked passes req to the longest waiting goroutine for key,
+// if any. It reports whether there was a waiter. c.lk must be held.
+func (c *Client) handOffLocked(key string, req connRequest) bool {
+    reqs := c.connReqs[key]
+    if len(reqs) == 0 {
+        return false
+    }
+    ch := reqs[0]
+    copy(reqs, reqs[1:])
+    reqs[len(reqs)-1] = nil
+    c.connReqs[key] = reqs[:len(reqs)-1]
+    ch <- req // buffered; never blocks
+    return true
+}
+
+// acquireConn returns an idle connection to addr if one is available.
+// Otherwise it reserves a slot for a new connection, waiting in FIFO
+// order for one to free up if MaxOpenConns has been reached or for a
+// connection to be released if MaxConcurrentDials dials are already
+// in progress. A nil conn with a nil error means the caller holds a
+// slot and must dial, then call dialDone.
+func (c *Client) acquireConn(ctx context.Context, addr net.Addr) (*conn, error) {
+    key := addr.String()
+    c.lk.Lock()
+    if c.closed {
+        c.lk.Unlock()
+        return nil, ErrClientClosed
+    }
+    if cn, ok := c.getFreeConnLocked(addr); ok {
+        c.lk.Unlock()
+        return cn, nil
+    }
+    if c.numOpen == nil {
+        c.numOpen = make(map[string]int)
+        c.dialing = make(map[string]int)
+    }
+    if (c.MaxOpenConns <= 0 || c.numOpen[key] < c.MaxOpenConns) &&
+        c.dialAllowedLocked(key) && len(c.connReqs[key]) == 0 {
+        c.numOpen[key]++
+        c.dialing[key]++
+        c.lk.Unlock()
+        return nil, nil
+    }
+    if c.connReqs == nil {
+        c.connReqs = make(map[string][]chan connRequest)
+    }
+    ch := make(chan connRequest, 1)
+    c.connReqs[key] = append(c.connReqs[key], ch)
+    c.lk.Unlock()
+
+    var timeout <-chan time.Time
+    if c.AcquireTimeout > 0 {
+        t := time.NewTimer(c.AcquireTimeout)
+        defer t.Stop()
+        timeout = t.C
+    }
+    var err error
+    select {
+    case req := <-ch:
+        return req.cn, req.err
+    case <-ctx.Done():
+        err = ctx.Err()
+    case <-timeout:
+        err = ErrAcquireTimeout
+    }
+
+    c.lk.Lock()
+    reqs := c.connReqs[key]
+    for i, r := range reqs {
+        if r == ch {
+            c.connReqs[key] = append(reqs[:i], reqs[i+1:]...)
+            c.lk.Unlock()
+            return nil, err
+        }
+    }
+    c.lk.Unlock()
+    // We were served concurrently with the cancellation; give back
+    // whatever we were handed so the next waiter can have it.
+    if req := <-ch; req.cn != nil {
+        req.cn.release()
+    } else if req.err == nil {
+        c.dialDone(addr)
+        c.connClosed(addr, nil)
+    }
+    return nil, err
+}
+
+// Shutdown gracefully shuts the client down. Operations started after
+// Shutdown fail with ErrClientClosed, as do those waiting for a
+// connection. Idle connections are closed at once, and Shutdown then
+// waits for in-flight operations to finish and close theirs. If ctx is
+// done first, the remaining connections are closed under the
+// operations using them and ctx's error is returned. Connections shared
+// by Multiplex are closed when Shutdown returns.
+func (c *Client) Shutdown(ctx context.Context) error {
+    defer c.closeMuxConns()
+    c.lk.Lock()
+    if !c.closed {
+        c.closed = true
+        c.drained = make(chan struct{})
+        for key, reqs := range c.connReqs {
+            for _, ch := range reqs {
+                ch <- connRequest{err: ErrClientClosed}
+            }
+            delete(c.connReqs, key)
+        }
+        for key, n := range c.numOpen {
+            if n == 0 {
+                delete(c.numOpen, key)
+            }
+        }
+        if len(c.numOpen) == 0 {
+            close(c.drained)
+        }
+    }
+    var idle []*conn
+    for key, freelist := range c.freeconn {
+        idle = append(idle, freelist...)
+        delete(c.freeconn, key)
+    }
+    drained := c.drained
+    c.lk.Unlock()
+
+    for _, cn := range idle {
+        cn.close("client shut down")
+    }
+    c.drainMuxConns()
+    select {
+    case <-drained:
+        return nil
+    case <-ctx.Done():
+    }
+    c.lk.Lock()
+    for cn := range c.conns {
+        cn.nc.Close()
+    }
+    c.lk.Unlock()
+    return ctx.Err()
+}
+
+// ConnInfo describes an open connection to a server.
+type ConnInfo struct {
+    // LocalAddr and RemoteAddr are the connection's local and remote
+    // network addresses.
+    LocalAddr, RemoteAddr net.Addr
+
+    // Age is how long ago the connection was dialed.
+    Age time.Duration
+}
+
+// ConnInfo reports the connections the client holds open to addr,
+// idle or in use, for diagnosing problems such as source port
+// exhaustion. The result is in no particular order.
+func (c *Client) ConnInfo(addr net.Addr) []ConnInfo {
+    now := time.Now()
+    c.lk.Lock()
+    defer c.lk.Unlock()
+    var infos []ConnInfo
+    for cn := range c.conns {
+        if cn.addr.String() != addr.String() {
+            continue
+        }
+        infos = append(infos, ConnInfo{
+            LocalAddr:  cn.nc.LocalAddr(),
+            RemoteAddr: cn.nc.RemoteAddr(),
+            Age:        now.Sub(cn.created),
+        })
+    }
+    return infos
+}
+
+func (c *Client) maxIdleConns() int {
+    if c.MaxIdleConns > 0 {
+        return c.MaxIdleConns
+    }
+    return maxIdleConnsPerAddr
+}
+
 func (c *Client) netTimeout() time.Duration {
     if c.Timeout != 0 {
         return c.Timeout
@@ -483,6 +1318,27 @@ func (c *Client) netTimeout() time.Duration {
     return DefaultTimeout
 }
 
+func (c *Client) connectTimeout() time.Duration {
+    if c.ConnectTimeout != 0 {
+        return c.ConnectTimeout
+    }
+    return c.netTimeout()
+}
+
+func (c *Client) readTimeout() time.Duration {
+    if c.ReadTimeout != 0 {
+        return c.ReadTimeout
+    }
+    return c.netTimeout()
+}
+
+func (c *Client) writeTimeout() time.Duration {
+    if c.WriteTimeout != 0 {
+        return c.WriteTimeout
+    }
+    return c.netTimeout()
+}
+
 // ConnectTimeoutError is the error type used when it takes
 // too long to connect to the desired host. This level of
 // detail can generally be ignored.
@@ -494,271 +1350,1575 @@ func (cte *ConnectTimeoutError) Error() string {
     return "memcache: connect timeout to " + cte.Addr.String()
 }
 
-func (c *Client) dial(addr net.Addr) (net.Conn, error) {
-    type connError struct {
-        cn  net.Conn
-        err error
+// Timeout always returns true; it lets ConnectTimeoutError satisfy net.Error.
+func (cte *ConnectTimeoutError) Timeout() bool {
+    return true
+}
+
+// Temporary always returns true.
+func (cte *ConnectTimeoutError) Temporary() bool {
+    return true
+}
+
+func (c *Client) dial(ctx context.Context, addr net.Addr) (nc net.Conn, err error) {
+    defer func(start time.Time) {
+        d := time.Since(start)
+        c.metrics.dialDone(err, d)
+        if c.OnDial != nil {
+            c.OnDial(addr, err, d)
+        }
+    }(time.Now())
+    dialCtx, cancel := context.WithTimeout(ctx, c.connectTimeout())
+    defer cancel()
+    dialFunc := c.DialFunc
+    if dialFunc == nil {
+        var d net.Dialer
+        dialFunc = d.DialContext
     }
-    ch := make(chan connError)
-    go func() {
-        nc, err := net.Dial(addr.Network(), addr.String())
-        ch <- connError{nc, err}
-    }()
-    select {
-    case ce := <-ch:
-        return ce.cn, ce.err
-    case <-time.After(c.netTimeout()):
-        // Too slow. Fall through.
+    nc, err = dialFunc(dialCtx, addr.Network(), addr.String())
+    if err == nil {
+        return nc, nil
     }
-    // Close the conn if it does end up finally coming in
-    go func() {
-        ce := <-ch
-        if ce.err == nil {
-            ce.cn.Close()
-        }
-    }()
-    return nil, &ConnectTimeoutError{addr}
+    switch {
+    case ctx.Err() != nil:
+        return nil, ctx.Err()
+    case dialCtx.Err() != nil:
+        // Too slow.
+        return nil, &ConnectTimeoutError{addr}
+    }
+    return nil, err
 }
 
-func (c *Client) getConn(addr net.Addr) (*conn, error) {
-    cn, ok := c.getFreeConn(addr)
-    if ok {
+func (c *Client) getConn(ctx context.Context, addr net.Addr) (*conn, error) {
+    cn, err := c.acquireConn(ctx, addr)
+    if err != nil {
+        return nil, err
+    }
+    if cn != nil {
         cn.extendDeadline()
         return cn, nil
     }
-    nc, err := c.dial(addr)
+    nc, err := c.dial(ctx, addr)
+    c.dialDone(addr)
     if err != nil {
+        c.forgetCapabilities(addr)
+        c.connClosed(addr, nil)
         return nil, err
     }
+    if c.WrapConn != nil {
+        nc = c.WrapConn(nc)
+    }
     cn = &conn{
         nc:   nc,
         addr: addr,
         rw:   bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc)),
         c:    c,
+
+        created: time.Now(),
+    }
+    c.lk.Lock()
+    if c.closed {
+        c.lk.Unlock()
+        cn.close("client shut down")
+        return nil, ErrClientClosed
     }
+    if c.conns == nil {
+        c.conns = make(map[*conn]bool)
+    }
+    c.conns[cn] = true
+    creds := c.creds
+    cn.authGen = c.authGen
+    c.lk.Unlock()
     cn.extendDeadline()
+    if creds != nil {
+        if err := creds.authenticate(cn.rw); err != nil {
+            cn.close("authentication failed")
+            return nil, err
+        }
+    }
     return cn, nil
 }
 
 func (c *Client) onItem(item *Item, fn func(*Client, *bufio.ReadWriter, *Item) error) error {
+    return c.onItemContext(context.Background(), item, fn)
+}
+
+func (c *Client) onItemContext(ctx context.Context, item *Item, fn func(*Client, *bufio.ReadWriter, *Item) error) error {
     addr, err := c.selector.PickServer(item.Key)
     if err != nil {
         return err
     }
-    cn, err := c.getConn(addr)
-    if err != nil {
-        return err
-    }
-    defer cn.condRelease(&err)
-    if err = fn(c, cn.rw, item); err != nil {
-        return err
-    }
-    return nil
+    return c.retry(ctx, func() error {
+        return c.withAddrRwOpts(addr, &getOptions{ctx: ctx, write: true}, func(rw *bufio.ReadWriter) error {
+            return fn(c, rw, item)
+        })
+    })
 }
 
-// Get gets the item for the given key. ErrCacheMiss is returned for a
-// memcache cache miss. The key must be at most 250 bytes in length.
-func (c *Client) Get(key string) (item *Item, err error) {
-    err = c.withKeyAddr(key, func(addr net.Addr) error {
-        return c.getFromAddr(addr, []string{key}, func(it *Item) { item = it })
-    })
-    if err == nil && item == nil {
-        err = ErrCacheMiss
+// retry calls fn, calling it again after BusyBackoff, up to BusyRetries
+// times, for as long as it fails with ErrServerBusy, and after a
+// doubling RetryBackoff, up to MaxRetries times, for as long as it
+// fails with a retryable error. If ctx is done while waiting, its error
+// is returned.
+func (c *Client) retry(ctx context.Context, fn func() error) error {
+    var busy, transient int
+    for {
+        err := fn()
+        var wait time.Duration
+        switch {
+        case err == nil:
+            return nil
+        case err == ErrServerBusy && busy < c.BusyRetries:
+            busy++
+            wait = c.BusyBackoff
+            if wait <= 0 {
+                wait = defaultBusyBackoff
+            }
+        case transient < c.MaxRetries && c.retryable(err):
+            wait = retryBackoff(c.RetryBackoff, transient)
+            transient++
+        default:
+            return err
+        }
+        t := time.NewTimer(wait)
+        select {
+        case <-t.C:
+        case <-ctx.Done():
+            t.Stop()
+            return ctx.Err()
+        }
     }
-    return
 }
 
-func (c *Client) withKeyAddr(key string, fn func(net.Addr) error) (err error) {
-    if !legalKey(key) {
-        return ErrMalformedKey
+// retryBackoff returns the wait before retry n+1 of an operation that
+// failed with a retryable error: base, or defaultRetryBackoff if that
+// is zero, doubled n times but not beyond maxRetryBackoff.
+func retryBackoff(base time.Duration, n int) time.Duration {
+    wait := base
+    if wait <= 0 {
+        wait = defaultRetryBackoff
     }
-    addr, err := c.selector.PickServer(key)
-    if err != nil {
-        return err
+    for i := 0; i < n && wait < maxRetryBackoff; i++ {
+        wait = min(2*wait, maxRetryBackoff)
     }
-    return fn(addr)
+    return wait
 }
 
-func (c *Client) withAddrRw(addr net.Addr, fn func(*bufio.ReadWriter) error) (err error) {
-    cn, err := c.getConn(addr)
-    if err != nil {
-        return err
+func (c *Client) retryable(err error) bool {
+    if c.RetryableError != nil {
+        return c.RetryableError(err)
     }
-    defer cn.condRelease(&err)
-    return fn(cn.rw)
+    return IsRetryable(err)
 }
 
-func (c *Client) withKeyRw(key string, fn func(*bufio.ReadWriter) error) error {
-    return c.withKeyAddr(key, func(addr net.Addr) error {
-        return c.withAddrRw(addr, fn)
+// storeOp runs the storage command verb for item through the
+// middleware chain.
+func (c *Client) storeOp(ctx context.Context, verb string, item *Item, fn func(*Client, *bufio.ReadWriter, *Item) error) error {
+    return c.intercept(&Op{Name: verb, Key: item.Key, Item: item}, func(op *Op) error {
+        return c.store(ctx, verb, op.Item, fn)
     })
 }
 
-func (c *Client) getFromAddr(addr net.Addr, keys []string, cb func(*Item)) error {
-    return c.withAddrRw(addr, func(rw *bufio.ReadWriter) error {
-        if _, err := fmt.Fprintf(rw, "gets %s\r\n", strings.Join(keys, " ")); err != nil {
-            return err
+// store runs a storage command for item and, on success, verifies it
+// if VerifyWrites is set and remembers it for StaleOnError. After an
+// append or prepend, item only holds part of the value, so it is
+// neither verified nor remembered. Under DryRun, nothing was stored to
+// verify or remember.
+func (c *Client) store(ctx context.Context, verb string, item *Item, fn func(*Client, *bufio.ReadWriter, *Item) error) error {
+    if err := c.checkFlags(verb, item.Flags); err != nil {
+        return err
+    }
+    if err := c.onItemContext(ctx, item, fn); err != nil || c.DryRun {
+        return err
+    }
+    if verb == "append" || verb == "prepend" {
+        c.rememberStale(item.Key, nil)
+        return nil
+    }
+    if c.VerifyWrites {
+        got, err := c.get(item.Key, nil)
+        if err == ErrCacheMiss || err == nil && !bytes.Equal(got.Value, item.Value) {
+            return ErrWriteVerifyFailed
+        }
+        if err != nil {
+            return err
+        }
+    }
+    c.rememberStale(item.Key, item)
+    return nil
+}
+
+// Get gets the item for the given key. ErrCacheMiss is returned for a
+// memcache cache miss. The key must be at most 250 bytes in length.
+// Options, if any, override the client's settings for this call; a
+// call with options does not share its request under SingleFlight.
+func (c *Client) Get(key string, opts ...GetOption) (*Item, error) {
+    return c.GetContext(context.Background(), key, opts...)
+}
+
+// GetContext is like Get, but gives up when ctx is done, whether it is
+// dialing, waiting for a connection or waiting for the server,
+// returning ctx's error. A call with a cancelable context does not
+// share its request under SingleFlight.
+func (c *Client) GetContext(ctx context.Context, key string, opts ...GetOption) (*Item, error) {
+    op := &Op{Name: "get", Key: key}
+    err := c.intercept(op, func(op *Op) (err error) {
+        op.Item, err = c.getStaleOnError(ctx, op.Key, opts)
+        return err
+    })
+    return op.Item, err
+}
+
+// GetWithCAS is like Get, but also returns the item's CAS id, as
+// Item.CAS would. The CAS id is fetched even if DisableCAS is set.
+func (c *Client) GetWithCAS(key string) (item *Item, cas uint64, err error) {
+    item, err = c.Get(key, func(o *getOptions) { o.noCAS = false })
+    if err != nil {
+        return nil, 0, err
+    }
+    return item, item.casid, nil
+}
+
+func (c *Client) getStaleOnError(ctx context.Context, key string, opts []GetOption) (item *Item, err error) {
+    if c.SingleFlight && len(opts) == 0 && ctx.Done() == nil {
+        item, err = c.getSingleFlight(key)
+    } else {
+        item, err = c.get(key, c.getOptionsContext(ctx, opts))
+    }
+    switch {
+    case err == nil:
+        c.rememberStale(key, item)
+        c.refreshAhead(key)
+    case err == ErrCacheMiss:
+        c.rememberStale(key, nil)
+    default:
+        if it, ok := c.staleOnError(key, err); ok {
+            return it, nil
+        }
+    }
+    return item, err
+}
+
+func (c *Client) get(key string, o *getOptions) (item *Item, err error) {
+    err = c.withReadKeyAddr(key, func(addr net.Addr) error {
+        return c.retry(o.context(), func() error {
+            return c.getFromAddr(addr, []string{key}, o, func(it *Item) { item = it })
+        })
+    })
+    if err == nil && item == nil {
+        err = ErrCacheMiss
+    }
+    return
+}
+
+// flight is a Get in progress that other callers asking for the same
+// key wait on instead of issuing their own request.
+type flight struct {
+    done    chan struct{}
+    item    *Item
+    err     error
+    waiters int // callers waiting on done; guarded by flightLk
+}
+
+// getSingleFlight performs a Get, sharing the result with any
+// concurrent getSingleFlight calls for the same key. Every caller gets
+// its own copy of the item.
+func (c *Client) getSingleFlight(key string) (*Item, error) {
+    c.flightLk.Lock()
+    f, ok := c.flights[key]
+    if !ok {
+        if c.flights == nil {
+            c.flights = make(map[string]*flight)
+        }
+        f = &flight{done: make(chan struct{})}
+        c.flights[key] = f
+    } else {
+        f.waiters++
+    }
+    c.flightLk.Unlock()
+
+    if ok {
+        <-f.done
+    } else {
+        f.item, f.err = c.get(key, nil)
+        c.flightLk.Lock()
+        delete(c.flights, key)
+        c.flightLk.Unlock()
+        close(f.done)
+    }
+    if f.item == nil {
+        return nil, f.err
+    }
+    it := *f.item
+    it.Value = append([]byte(nil), f.item.Value...)
+    return &it, f.err
+}
+
+func (c *Client) withKeyAddr(key string, fn func(net.Addr) error) (err error) {
+    if !c.validKey(key) {
+        return ErrMalformedKey
+    }
+    addr, err := c.selector.PickServer(key)
+    if err != nil {
+        return err
+    }
+    return fn(addr)
+}
+
+// withReadKeyAddr is withKeyAddr for reads, which a RoleSelector may
+// send to different servers than writes.
+func (c *Client) withReadKeyAddr(key string, fn func(net.Addr) error) (err error) {
+    if !c.validKey(key) {
+        return ErrMalformedKey
+    }
+    addr, err := c.pickReadServer(key)
+    if err != nil {
+        return err
+    }
+    return fn(addr)
+}
+
+// pickReadServer returns the server to read key from.
+func (c *Client) pickReadServer(key string) (net.Addr, error) {
+    if rs, ok := c.selector.(RoleSelector); ok {
+        return rs.PickReadServer(key)
+    }
+    return c.selector.PickServer(key)
+}
+
+func (c *Client) withAddrRw(addr net.Addr, fn func(*bufio.ReadWriter) error) (err error) {
+    return c.withAddrRwOpts(addr, nil, fn)
+}
+
+// withAddrRwOpts is withAddrRw honoring the context and timeout of o,
+// which may be nil.
+func (c *Client) withAddrRwOpts(addr net.Addr, o *getOptions, fn func(*bufio.ReadWriter) error) (err error) {
+    return c.withAddrConnOpts(addr, o, func(cn *conn) error {
+        return fn(cn.rw)
+    })
+}
+
+// withAddrRwWrite is withAddrRw for commands that change the server.
+func (c *Client) withAddrRwWrite(addr net.Addr, fn func(*bufio.ReadWriter) error) error {
+    return c.withAddrRwOpts(addr, &getOptions{ctx: context.Background(), write: true}, fn)
+}
+
+// withAddrConnOpts is withAddrRwOpts for operations that need the
+// connection itself. It is the funnel of every command sent to a
+// server; under DryRun, those of operations that change it are
+// answered by a dryRunConn instead.
+func (c *Client) withAddrConnOpts(addr net.Addr, o *getOptions, fn func(*conn) error) (err error) {
+    if c.MaxLatency > 0 {
+        defer c.recordLatency(addr, time.Now())
+    }
+    if c.FailureLimit > 0 {
+        defer func() { c.recordHealth(addr, err) }()
+    }
+    defer func() { c.metrics.recordError(err) }()
+    ctx := context.Background()
+    if o != nil {
+        ctx = o.ctx
+    }
+    var cn *conn
+    if o != nil && o.write && c.DryRun {
+        var dc *dryRunConn
+        cn, dc = c.newDryRunConn(ctx, addr)
+        defer dc.release(&err)
+    } else {
+        cn, err = c.getConn(ctx, addr)
+        if err != nil {
+            return err
+        }
+        defer cn.condRelease(&err)
+    }
+    if o == nil {
+        return fn(cn)
+    }
+    if o.timeout > 0 {
+        cn.setDeadline(time.Now().Add(o.timeout))
+    }
+    if d, ok := ctx.Deadline(); ok {
+        cn.limitDeadline(d)
+    }
+    if ctx.Done() == nil {
+        return fn(cn)
+    }
+    // Unblock any I/O in progress when ctx is done.
+    stop := context.AfterFunc(ctx, func() { cn.nc.SetDeadline(time.Now()) })
+    err = fn(cn)
+    stop()
+    if err != nil {
+        if ctxErr := ctx.Err(); ctxErr != nil {
+            err = ctxErr
+        } else if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+            // The connection deadline taken from ctx fired first.
+            err = context.DeadlineExceeded
+        }
+    }
+    return err
+}
+
+func (c *Client) withKeyRw(key string, fn func(*bufio.ReadWriter) error) error {
+    return c.withKeyRwContext(context.Background(), key, fn)
+}
+
+func (c *Client) withKeyRwContext(ctx context.Context, key string, fn func(*bufio.ReadWriter) error) error {
+    return c.withKeyAddr(key, func(addr net.Addr) error {
+        return c.retry(ctx, func() error {
+            return c.withAddrRwOpts(addr, &getOptions{ctx: ctx}, fn)
+        })
+    })
+}
+
+// withReadKeyRw is withKeyRw for reads, which go to the server
+// pickReadServer picks.
+func (c *Client) withReadKeyRw(key string, fn func(*bufio.ReadWriter) error) error {
+    return c.withReadKeyAddr(key, func(addr net.Addr) error {
+        return c.retry(context.Background(), func() error {
+            return c.withAddrRw(addr, fn)
+        })
+    })
+}
+
+// withKeyRwWrite is withKeyRwContext for commands that change the
+// server.
+func (c *Client) withKeyRwWrite(ctx context.Context, key string, fn func(*bufio.ReadWriter) error) error {
+    return c.withKeyAddr(key, func(addr net.Addr) error {
+        return c.retry(ctx, func() error {
+            return c.withAddrRwOpts(addr, &getOptions{ctx: ctx, write: true}, fn)
+        })
+    })
+}
+
+// getFromAddr fetches keys from the server at addr, passing each item
+// found to cb. o holds the settings of the call; nil means the client's.
+func (c *Client) getFromAddr(addr net.Addr, keys []string, o *getOptions, cb func(*Item)) (err error) {
+    if o == nil {
+        o = c.getOptions(nil)
+    }
+    atomic.AddUint64(&c.metrics.gets, uint64(len(keys)))
+    var hits uint64
+    defer func() {
+        atomic.AddUint64(&c.metrics.hits, hits)
+        if err == nil {
+            atomic.AddUint64(&c.metrics.misses, uint64(len(keys))-hits)
+        }
+    }()
+    var requested map[string]bool
+    var unexpected string
+    if c.StrictProtocol {
+        requested = make(map[string]bool, len(keys))
+        for _, key := range keys {
+            requested[key] = true
+        }
+    }
+    userCb := cb
+    cb = func(it *Item) {
+        if requested != nil && !requested[it.Key] {
+            unexpected = it.Key
+            return
+        }
+        hits++
+        userCb(it)
+    }
+    checkKeys := func() error {
+        if unexpected != "" {
+            return fmt.Errorf("%w: %s returned unrequested key %q", ErrProtocol, addr, unexpected)
+        }
+        return nil
+    }
+    verb := "gets"
+    if o.noCAS {
+        verb = "get"
+    }
+    if c.Multiplex {
+        if err := c.getMultiplexed(addr, o, verb+" "+strings.Join(keys, " ")+"\r\n", len(keys), cb); err != nil {
+            return err
+        }
+        return checkKeys()
+    }
+    err = c.withAddrConnOpts(addr, o, func(cn *conn) error {
+        rw := cn.rw
+        if _, err := rw.Write(appendGetCommand(rw.AvailableBuffer(), verb, keys)); err != nil {
+            return err
+        }
+        if err := rw.Flush(); err != nil {
+            return err
+        }
+        if err := c.parseGetResponseConn(rw.Reader, cn, len(keys), cb); err != nil {
+            return err
+        }
+        return checkKeys()
+    })
+    if err == errMissingEnd {
+        // The items were all delivered; only the connection, whose
+        // END may yet arrive, had to go.
+        err = checkKeys()
+    }
+    return err
+}
+
+// GetMulti is a batch version of Get. The returned map from keys to
+// items may have fewer elements than the input slice, due to memcache
+// cache misses. Each key must be at most 250 bytes in length.
+// Options, if any, override the client's settings for this call.
+// The returned map is never nil, even when an error is returned.
+func (c *Client) GetMulti(keys []string, opts ...GetOption) (map[string]*Item, error) {
+    return c.GetMultiContext(context.Background(), keys, opts...)
+}
+
+// GetMultiContext is like GetMulti, but gives up when ctx is done. It
+// then returns ctx's error along with the items of the servers that
+// had already answered, without waiting for the others.
+func (c *Client) GetMultiContext(ctx context.Context, keys []string, opts ...GetOption) (map[string]*Item, error) {
+    return c.getMulti(keys, c.getOptionsContext(ctx, opts), nil)
+}
+
+// FanoutStats describes how a GetMulti was spread over the servers.
+// Maps are keyed by server address.
+type FanoutStats struct {
+    // Servers is the number of servers queried.
+    Servers int
+
+    // Keys is the number of keys sent to each server.
+    Keys map[string]int
+
+    // Latency is how long each server took to answer, including
+    // waiting for a connection.
+    Latency map[string]time.Duration
+}
+
+// GetMultiStats is like GetMulti, but also reports how the keys were
+// spread over the servers. A batch spread over many servers for few
+// keys each is a sign of poor key locality; see ServerList.HashTags.
+func (c *Client) GetMultiStats(keys []string) (map[string]*Item, FanoutStats, error) {
+    stats := FanoutStats{
+        Keys:    make(map[string]int),
+        Latency: make(map[string]time.Duration),
+    }
+    m, err := c.getMulti(keys, c.getOptions(nil), &stats)
+    return m, stats, err
+}
+
+// getMulti implements GetMulti, filling in stats if it is non-nil.
+func (c *Client) getMulti(keys []string, o *getOptions, stats *FanoutStats) (map[string]*Item, error) {
+    var lk sync.Mutex
+    m := make(map[string]*Item)
+    addItemToMap := func(it *Item) {
+        lk.Lock()
+        defer lk.Unlock()
+        m[it.Key] = it
+    }
+
+    keyMap := make(map[net.Addr][]string)
+    for _, key := range keys {
+        if !c.validKey(key) {
+            return m, ErrMalformedKey
+        }
+        addr, err := c.pickReadServer(key)
+        if err != nil {
+            return m, err
+        }
+        keyMap[addr] = append(keyMap[addr], key)
+    }
+
+    type addrErr struct {
+        addr net.Addr
+        err  error
+        d    time.Duration
+    }
+    // ch holds a result for every server, so that none is left blocked
+    // if ctx is done before all have answered.
+    ch := make(chan addrErr, len(keyMap))
+    for addr, keys := range keyMap {
+        go func(addr net.Addr, keys []string) {
+            start := time.Now()
+            err := c.retry(o.context(), func() error {
+                return c.getFromAddr(addr, keys, o, addItemToMap)
+            })
+            ch <- addrErr{addr, err, time.Since(start)}
+        }(addr, keys)
+    }
+
+    if stats != nil {
+        stats.Servers = len(keyMap)
+        for addr, keys := range keyMap {
+            stats.Keys[addr.String()] = len(keys)
+        }
+    }
+    var err error
+    var pending []net.Addr
+    for _ = range keyMap {
+        var ge addrErr
+        select {
+        case ge = <-ch:
+        case <-o.ctx.Done():
+            // The remaining servers may still add items to m.
+            lk.Lock()
+            defer lk.Unlock()
+            got := make(map[string]*Item, len(m))
+            for key, it := range m {
+                got[key] = it
+            }
+            return got, o.ctx.Err()
+        }
+        if stats != nil {
+            stats.Latency[ge.addr.String()] = ge.d
+        }
+        if ge.err != nil {
+            err = ge.err
+            if IsTimeout(ge.err) {
+                pending = append(pending, ge.addr)
+            }
+        }
+    }
+    if len(pending) > 0 {
+        return m, &PartialError{Pending: pending, Err: err}
+    }
+    return m, err
+}
+
+// PartialError is returned by GetMulti when some servers did not answer
+// in time. The returned map still holds the items of the servers that
+// did. The keys of the pending servers may be retried, for instance
+// with a longer timeout, or treated as misses.
+type PartialError struct {
+    // Pending lists the servers that timed out.
+    Pending []net.Addr
+
+    // Err is the error GetMulti would otherwise have returned.
+    Err error
+}
+
+func (e *PartialError) Error() string {
+    addrs := make([]string, len(e.Pending))
+    for i, addr := range e.Pending {
+        addrs[i] = addr.String()
+    }
+    return fmt.Sprintf("memcache: %d servers pending (%s): %v", len(addrs), strings.Join(addrs, ", "), e.Err)
+}
+
+func (e *PartialError) Unwrap() error {
+    return e.Err
+}
+
+// GetMultiStream is a streaming version of GetMulti. Each server's
+// items are sent on the returned item channel as they are read, rather
+// than collected into one map, so peak memory does not grow with the
+// size of the whole batch. The item channel is closed once every
+// server has been queried. Errors are sent on the error channel, which
+// is closed at the same time. The caller must receive from the item
+// channel until it is closed; queries stall while it is not drained.
+func (c *Client) GetMultiStream(keys []string) (<-chan *Item, <-chan error) {
+    items := make(chan *Item, buffered)
+
+    keyMap := make(map[net.Addr][]string)
+    for _, key := range keys {
+        var err error
+        if !c.validKey(key) {
+            err = ErrMalformedKey
+        }
+        var addr net.Addr
+        if err == nil {
+            addr, err = c.pickReadServer(key)
+        }
+        if err != nil {
+            errs := make(chan error, 1)
+            errs <- err
+            close(errs)
+            close(items)
+            return items, errs
+        }
+        keyMap[addr] = append(keyMap[addr], key)
+    }
+
+    errs := make(chan error, len(keyMap))
+    var wg sync.WaitGroup
+    for addr, keys := range keyMap {
+        wg.Add(1)
+        go func(addr net.Addr, keys []string) {
+            defer wg.Done()
+            err := c.getFromAddr(addr, keys, nil, func(it *Item) { items <- it })
+            if err != nil {
+                errs <- err
+            }
+        }(addr, keys)
+    }
+    go func() {
+        wg.Wait()
+        close(items)
+        close(errs)
+    }()
+    return items, errs
+}
+
+// GetMultiSkipMalformed is like GetMulti, but rather than failing the
+// whole call on a malformed key, it leaves such keys out of the fetch
+// and reports each in badKeys with ErrMalformedKey. The valid keys are
+// fetched as GetMulti would, and err reports any failure doing so.
+func (c *Client) GetMultiSkipMalformed(keys []string) (items map[string]*Item, badKeys map[string]error, err error) {
+    valid := make([]string, 0, len(keys))
+    for _, key := range keys {
+        if !c.validKey(key) {
+            if badKeys == nil {
+                badKeys = make(map[string]error)
+            }
+            badKeys[key] = ErrMalformedKey
+            continue
+        }
+        valid = append(valid, key)
+    }
+    items, err = c.GetMulti(valid)
+    return items, badKeys, err
+}
+
+// GetRange returns length bytes of the value of the item for key,
+// starting at offset off. The bytes outside the range are read from
+// the connection and discarded rather than buffered, so only the range
+// itself is allocated. A compressed value, when the client decompresses
+// values, is instead read and decompressed in full, and the range taken
+// from the decompressed value. ErrInvalidRange is returned if the range
+// does not lie within the value.
+func (c *Client) GetRange(key string, off, length int) (value []byte, err error) {
+    if off < 0 || length < 0 {
+        return nil, ErrInvalidRange
+    }
+    err = c.withReadKeyRw(key, func(rw *bufio.ReadWriter) error {
+        if _, err := fmt.Fprintf(rw, "get %s\r\n", key); err != nil {
+            return err
         }
         if err := rw.Flush(); err != nil {
             return err
         }
-        if err := parseGetResponse(rw.Reader, cb); err != nil {
+        line, err := readLine(rw.Reader)
+        if err != nil {
+            return err
+        }
+        if bytes.Equal(line, resultEnd) {
+            return ErrCacheMiss
+        }
+        it := &Item{Key: key}
+        size, err := scanGetResponseLine(line, it)
+        if err != nil {
             return err
         }
+        var inRange bool
+        if c.decompresses() && it.Flags&FlagCompressionMask != 0 {
+            if c.MaxReadValueSize > 0 && size > c.MaxReadValueSize {
+                return ErrResponseTooLarge
+            }
+            it.Value = make([]byte, size+2)
+            if err := readFull(rw, it.Value); err != nil {
+                return err
+            }
+            if !bytes.HasSuffix(it.Value, crlf) {
+                return fmt.Errorf("memcache: corrupt get result read")
+            }
+            it.Value = it.Value[:size]
+            if err := c.decompressItem(it); err != nil {
+                return err
+            }
+            if inRange = off+length <= len(it.Value); inRange {
+                value = append([]byte(nil), it.Value[off:off+length]...)
+            }
+        } else {
+            inRange = off+length <= size
+            if inRange {
+                if _, err := rw.Discard(off); err != nil {
+                    return err
+                }
+                value = make([]byte, length)
+                if err := readFull(rw, value); err != nil {
+                    return err
+                }
+                if _, err := rw.Discard(size - off - length); err != nil {
+                    return err
+                }
+            } else if _, err := rw.Discard(size); err != nil {
+                return err
+            }
+            tail := make([]byte, 2)
+            if err := readFull(rw, tail); err != nil {
+                return err
+            }
+            if !bytes.Equal(tail, crlf) {
+                return fmt.Errorf("memcache: corrupt get result read")
+            }
+        }
+        if line, err = readLine(rw.Reader); err != nil {
+            return err
+        }
+        if !bytes.Equal(line, resultEnd) {
+            return fmt.Errorf("memcache: unexpected line in get response: %q", line)
+        }
+        if !inRange {
+            return ErrInvalidRange
+        }
         return nil
     })
+    if err != nil {
+        return nil, err
+    }
+    return value, nil
+}
+
+// GetMultiFirst is like GetMulti, but is meant for deployments where
+// every server holds a full replica of the data. Rather than sharding
+// keys, it asks each server in the selector's order for the keys not
+// yet found, and stops as soon as every key has been found, so later
+// servers are only queried for what earlier ones were missing.
+//
+// An error from one server does not stop the search; it is returned
+// only if some keys were still missing after all servers were asked.
+func (c *Client) GetMultiFirst(keys []string) (map[string]*Item, error) {
+    for _, key := range keys {
+        if !c.validKey(key) {
+            return nil, ErrMalformedKey
+        }
+    }
+    addrs, err := c.selector.GetServers()
+    if err != nil {
+        return nil, err
+    }
+    if len(addrs) == 0 {
+        return nil, ErrNoServers
+    }
+
+    m := make(map[string]*Item)
+    missing := keys
+    seen := make(map[string]bool)
+    var lastErr error
+    for _, addr := range addrs {
+        if len(missing) == 0 {
+            break
+        }
+        if seen[addr.String()] {
+            continue
+        }
+        seen[addr.String()] = true
+        err := c.getFromAddr(addr, missing, nil, func(it *Item) { m[it.Key] = it })
+        if err != nil {
+            lastErr = err
+        }
+        var still []string
+        for _, key := range missing {
+            if _, ok := m[key]; !ok {
+                still = append(still, key)
+            }
+        }
+        missing = still
+    }
+    if len(missing) == 0 {
+        lastErr = nil
+    }
+    return m, lastErr
+}
+
+// parseGetResponse reads a GET response from r and calls cb for each
+// read and allocated Item. A response holding more than maxItems items
+// is rejected with ErrResponseTooLong.
+func (c *Client) parseGetResponse(r *bufio.Reader, maxItems int, cb func(*Item)) error {
+    return c.parseGetResponseConn(r, nil, maxItems, cb)
+}
+
+// parseGetResponseConn is parseGetResponse for a response read from cn,
+// which may be nil. With a connection, MissingEndTimeout applies.
+func (c *Client) parseGetResponseConn(r *bufio.Reader, cn *conn, maxItems int, cb func(*Item)) error {
+    var read int
+    defer func() { atomic.AddUint64(&c.metrics.bytesRead, uint64(read)) }()
+    for n := 0; n <= maxItems; n++ {
+        line, err := c.readGetLine(r, cn, n)
+        if err != nil {
+            return err
+        }
+        read += len(line)
+        if bytes.Equal(line, resultEnd) {
+            return nil
+        }
+        if n == maxItems {
+            break
+        }
+        it := new(Item)
+        size, err := scanGetResponseLine(line, it)
+        if err != nil {
+            return err
+        }
+        if c.MaxReadValueSize > 0 && size > c.MaxReadValueSize {
+            return ErrResponseTooLarge
+        }
+        read += size + len(crlf)
+        if c.LenientLineEndings {
+            it.Value, err = readValueLenient(r, size)
+            if err != nil {
+                return err
+            }
+        } else {
+            it.Value = make([]byte, size+2)
+            if err := readFull(r, it.Value); err != nil {
+                return err
+            }
+            if !bytes.HasSuffix(it.Value, crlf) {
+                return fmt.Errorf("memcache: corrupt get result read")
+            }
+            it.Value = it.Value[:size]
+        }
+        if c.decompresses() {
+            if err := c.decompressItem(it); err != nil {
+                return err
+            }
+        }
+        cb(it)
+    }
+    return ErrResponseTooLong
+}
+
+// errMissingEnd is returned by parseGetResponseConn when a get response
+// is taken to have ended without its END line. See MissingEndTimeout.
+var errMissingEnd = errors.New("memcache: get response ended without END")
+
+// readGetLine reads the line of a get response that follows n values.
+// Under MissingEndTimeout, once a value has been read and no more data
+// is buffered, a line that does not arrive in time is taken to be a
+// missing END, and errMissingEnd is returned.
+func (c *Client) readGetLine(r *bufio.Reader, cn *conn, n int) ([]byte, error) {
+    if cn == nil || c.MissingEndTimeout <= 0 || n == 0 || r.Buffered() > 0 {
+        return readLine(r)
+    }
+    grace := time.Now().Add(c.MissingEndTimeout)
+    if cn.readDeadline.Before(grace) {
+        return readLine(r)
+    }
+    cn.nc.SetReadDeadline(grace)
+    line, err := readLine(r)
+    cn.nc.SetReadDeadline(cn.readDeadline)
+    if IsTimeout(err) {
+        return nil, errMissingEnd
+    }
+    return line, err
+}
+
+// readLine reads a response line from r. A connection closed before
+// the line is complete is reported as ErrUnexpectedEOF.
+func readLine(r *bufio.Reader) ([]byte, error) {
+    line, err := r.ReadSlice('\n')
+    if err == io.EOF {
+        err = ErrUnexpectedEOF
+    }
+    return line, err
+}
+
+// readFull fills buf from r. A connection closed before buf is full is
+// reported as ErrUnexpectedEOF.
+func readFull(r io.Reader, buf []byte) error {
+    _, err := io.ReadFull(r, buf)
+    if err == io.EOF || err == io.ErrUnexpectedEOF {
+        err = ErrUnexpectedEOF
+    }
+    return err
+}
+
+// readValueLenient reads a value of the given size followed by either
+// "\r\n" or a bare "\n".
+func readValueLenient(r *bufio.Reader, size int) ([]byte, error) {
+    buf := make([]byte, size+1)
+    if err := readFull(r, buf); err != nil {
+        return nil, err
+    }
+    switch buf[size] {
+    case '\n':
+        return buf[:size], nil
+    case '\r':
+        b, err := r.ReadByte()
+        if err == io.EOF {
+            err = ErrUnexpectedEOF
+        }
+        if err != nil {
+            return nil, err
+        }
+        if b == '\n' {
+            return buf[:size], nil
+        }
+    }
+    return nil, fmt.Errorf("memcache: corrupt get result read")
+}
+
+// ParseError is returned when a line of a server response does not
+// have the expected form.
+type ParseError struct {
+    // Parser names the response being parsed, such as "get" or
+    // "stats items".
+    Parser string
+
+    // Pattern is the form the line was expected to have, as a
+    // fmt.Sscanf format.
+    Pattern string
+
+    // Line is the offending line, as received.
+    Line []byte
+}
+
+func (e *ParseError) Error() string {
+    return fmt.Sprintf("memcache: unexpected line in %s response: %q", e.Parser, e.Line)
+}
+
+// scanGetResponseLine populates it and returns the declared size of the item.
+// It does not read the bytes of the item.
+func scanGetResponseLine(line []byte, it *Item) (size int, err error) {
+    pattern := "VALUE %s %d %d %d\r\n"
+    dest := []interface{}{&it.Key, &it.Flags, &size, &it.casid}
+    if bytes.Count(line, space) == 3 {
+        pattern = "VALUE %s %d %d\r\n"
+        dest = dest[:3]
+    }
+    n, err := fmt.Sscanf(string(line), pattern, dest...)
+    if err != nil || n != len(dest) {
+        return -1, &ParseError{Parser: "get", Pattern: pattern, Line: line}
+    }
+    return size, nil
+}
+
+// Set writes the given item, unconditionally.
+func (c *Client) Set(item *Item) error {
+    return c.SetContext(context.Background(), item)
+}
+
+// SetContext is like Set, but gives up when ctx is done, returning
+// ctx's error.
+func (c *Client) SetContext(ctx context.Context, item *Item) error {
+    return c.storeOp(ctx, "set", item, (*Client).set)
+}
+
+func (c *Client) set(rw *bufio.ReadWriter, item *Item) error {
+    return c.populateOne(rw, "set", item)
+}
+
+// Add writes the given item, if no value already exists for its
+// key. ErrNotStored is returned if that condition is not met.
+func (c *Client) Add(item *Item) error {
+    return c.AddContext(context.Background(), item)
+}
+
+// AddContext is like Add, but gives up when ctx is done, returning
+// ctx's error.
+func (c *Client) AddContext(ctx context.Context, item *Item) error {
+    return c.storeOp(ctx, "add", item, (*Client).add)
+}
+
+func (c *Client) add(rw *bufio.ReadWriter, item *Item) error {
+    return c.populateOne(rw, "add", item)
+}
+
+// Replace writes the given item, but only if the server already holds
+// an item for its key. ErrNotStored is returned if that condition is
+// not met.
+func (c *Client) Replace(item *Item) error {
+    return c.storeOp(context.Background(), "replace", item, (*Client).replace)
+}
+
+func (c *Client) replace(rw *bufio.ReadWriter, item *Item) error {
+    return c.populateOne(rw, "replace", item)
+}
+
+// Append appends item.Value to the value of the existing item for its
+// key. The item's Flags and Expiration are ignored. ErrNotStored is
+// returned if the server holds no item for the key.
+func (c *Client) Append(item *Item) error {
+    return c.storeOp(context.Background(), "append", item, (*Client).append)
+}
+
+func (c *Client) append(rw *bufio.ReadWriter, item *Item) error {
+    return c.populateOne(rw, "append", item)
+}
+
+// Prepend is like Append, but prepends item.Value to the value of the
+// existing item.
+func (c *Client) Prepend(item *Item) error {
+    return c.storeOp(context.Background(), "prepend", item, (*Client).prepend)
+}
+
+func (c *Client) prepend(rw *bufio.ReadWriter, item *Item) error {
+    return c.populateOne(rw, "prepend", item)
+}
+
+// CompareAndSwap writes the given item that was previously returned
+// by Get, if the value was neither modified or evicted between the
+// Get and the CompareAndSwap calls. The item's Key should not change
+// between calls but all other item fields may differ. ErrCASConflict
+// is returned if the value was modified in between the
+// calls. ErrNotStored is returned if the value was evicted in between
+// the calls.
+func (c *Client) CompareAndSwap(item *Item) error {
+    return c.CompareAndSwapContext(context.Background(), item)
+}
+
+// CompareAndSwapContext is like CompareAndSwap, but gives up when ctx
+// is done, returning ctx's error.
+func (c *Client) CompareAndSwapContext(ctx context.Context, item *Item) error {
+    return c.storeOp(ctx, "cas", item, (*Client).cas)
+}
+
+func (c *Client) cas(rw *bufio.ReadWriter, item *Item) error {
+    return c.populateOne(rw, "cas", item)
+}
+
+func (c *Client) populateOne(rw *bufio.ReadWriter, verb string, item *Item) error {
+    if !c.validKey(item.Key) {
+        return ErrMalformedKey
+    }
+    if err := c.writeStorage(rw.Writer, verb, item); err != nil {
+        return err
+    }
+    if err := rw.Flush(); err != nil {
+        return err
+    }
+    line, err := readLine(rw.Reader)
+    if err != nil {
+        return err
+    }
+    return storeResult(verb, line)
+}
+
+// writeStorage writes a storage command for item, including its data
+// block, to w without flushing it.
+func (c *Client) writeStorage(w *bufio.Writer, verb string, item *Item) error {
+    value, flags := item.Value, item.Flags
+    if verb != "append" && verb != "prepend" {
+        var err error
+        if value, flags, err = c.compress(value, flags); err != nil {
+            return err
+        }
+    }
+    return c.writeStorageValue(w, verb, item, value, flags)
+}
+
+// writeStorageValue is writeStorage for a value and flags that are
+// written as they are, without compression.
+func (c *Client) writeStorageValue(w *bufio.Writer, verb string, item *Item, value []byte, flags uint32) error {
+    atomic.AddUint64(&c.metrics.sets, 1)
+    cmd := appendStorageCommand(w.AvailableBuffer(), verb, item, flags, c.expiration(item.Expiration), len(value))
+    atomic.AddUint64(&c.metrics.bytesWritten, uint64(len(cmd)+len(value)+len(crlf)))
+    _, err := w.Write(cmd)
+    if err != nil {
+        return err
+    }
+    if _, err = w.Write(value); err != nil {
+        return err
+    }
+    _, err = w.Write(crlf)
+    return err
+}
+
+// expiration returns the expiration time to send to the server for an
+// item whose Expiration is exp.
+func (c *Client) expiration(exp int32) int32 {
+    switch exp {
+    case 0:
+        return c.DefaultExpiration
+    case NoExpiration:
+        return 0
+    }
+    return exp
+}
+
+// storeResult maps the response line of a storage command to an error.
+func storeResult(verb string, line []byte) error {
+    switch {
+    case bytes.Equal(line, resultStored):
+        return nil
+    case bytes.Equal(line, resultNotStored):
+        return ErrNotStored
+    case bytes.Equal(line, resultExists):
+        return ErrCASConflict
+    case bytes.Equal(line, resultNotFound):
+        return ErrCacheMiss
+    case serverBusy(line):
+        return ErrServerBusy
+    }
+    return fmt.Errorf("memcache: unexpected response line from %q: %q", verb, string(line))
 }
 
-// GetMulti is a batch version of Get. The returned map from keys to
-// items may have fewer elements than the input slice, due to memcache
-// cache misses. Each key must be at most 250 bytes in length.
-// If no error is returned, the returned map will also be non-nil.
-func (c *Client) GetMulti(keys []string) (map[string]*Item, error) {
+// serverBusy reports whether line is a server error reporting a
+// temporary failure, as sent by overloaded proxies.
+func serverBusy(line []byte) bool {
+    return bytes.HasPrefix(line, resultServerErrorPrefix) &&
+        bytes.Contains(line[len(resultServerErrorPrefix):], resultTemporaryFailure)
+}
+
+// SetSameValue writes value under each of the given keys,
+// unconditionally. Keys are grouped by server and the set commands for
+// each server are pipelined over a single connection. The returned map
+// holds an error for every key that could not be stored; it is empty
+// if all keys were stored.
+func (c *Client) SetSameValue(keys []string, value []byte, flags uint32, exp int32) map[string]error {
     var lk sync.Mutex
-    m := make(map[string]*Item)
-    addItemToMap := func(it *Item) {
+    errs := make(map[string]error)
+    setErr := func(key string, err error) {
         lk.Lock()
         defer lk.Unlock()
-        m[it.Key] = it
+        errs[key] = err
     }
 
     keyMap := make(map[net.Addr][]string)
     for _, key := range keys {
-        if !legalKey(key) {
-            return nil, ErrMalformedKey
+        if !c.validKey(key) {
+            setErr(key, ErrMalformedKey)
+            continue
         }
         addr, err := c.selector.PickServer(key)
         if err != nil {
-            return nil, err
+            setErr(key, err)
+            continue
         }
         keyMap[addr] = append(keyMap[addr], key)
     }
 
-    ch := make(chan error, buffered)
+    var wg sync.WaitGroup
     for addr, keys := range keyMap {
+        wg.Add(1)
         go func(addr net.Addr, keys []string) {
-            ch <- c.getFromAddr(addr, keys, addItemToMap)
+            defer wg.Done()
+            c.setSameValueToAddr(addr, keys, value, flags, exp, setErr)
         }(addr, keys)
     }
-
-    var err error
-    for _ = range keyMap {
-        if ge := <-ch; ge != nil {
-            err = ge
-        }
-    }
-    return m, err
+    wg.Wait()
+    return errs
 }
 
-// parseGetResponse reads a GET response from r and calls cb for each
-// read and allocated Item
-func parseGetResponse(r *bufio.Reader, cb func(*Item)) error {
-    for {
-        line, err := r.ReadSlice('\n')
-        if err != nil {
-            return err
+func (c *Client) setSameValueToAddr(addr net.Addr, keys []string, value []byte, flags uint32, exp int32, setErr func(string, error)) {
+    value, flags, err := c.compress(value, flags)
+    if err != nil {
+        for _, key := range keys {
+            setErr(key, err)
         }
-        if bytes.Equal(line, resultEnd) {
-            return nil
+        return
+    }
+    done := 0
+    err = c.withAddrRwWrite(addr, func(rw *bufio.ReadWriter) error {
+        for _, key := range keys {
+            item := &Item{Key: key, Expiration: exp}
+            if err := c.writeStorageValue(rw.Writer, "set", item, value, flags); err != nil {
+                return err
+            }
         }
-        it := new(Item)
-        size, err := scanGetResponseLine(line, it)
-        if err != nil {
+        if err := rw.Flush(); err != nil {
             return err
         }
-        it.Value, err = ioutil.ReadAll(io.LimitReader(r, int64(size)+2))
-        if err != nil {
-            return err
+        for _, key := range keys {
+            line, err := readLine(rw.Reader)
+            if err != nil {
+                return err
+            }
+            err = storeResult("set", line)
+            if err != nil && !resumableError(err) {
+                return err
+            }
+            if err != nil {
+                setErr(key, err)
+            }
+            done++
         }
-        if !bytes.HasSuffix(it.Value, crlf) {
-            return fmt.Errorf("memcache: corrupt get result read")
+        return nil
+    })
+    if err != nil {
+        for _, key := range keys[done:] {
+            setErr(key, err)
         }
-        it.Value = it.Value[:size]
-        cb(it)
     }
-    panic("unreached")
 }
 
-// scanGetResponseLine populates it and returns the declared size of the item.
-// It does not read the bytes of the item.
-func scanGetResponseLine(line []byte, it *Item) (size int, err error) {
-    pattern := "VALUE %s %d %d %d\r\n"
-    dest := []interface{}{&it.Key, &it.Flags, &size, &it.casid}
-    if bytes.Count(line, space) == 3 {
-        pattern = "VALUE %s %d %d\r\n"
-        dest = dest[:3]
+// SetMulti writes each of the given items, unconditionally. Items are
+// grouped by server and the set commands for each server are pipelined
+// over a single connection. The returned map holds every item's
+// result, keyed by its key, nil if it was stored. The error is nil
+// unless some item failed, in which case it is one of their errors.
+func (c *Client) SetMulti(items []*Item) (map[string]error, error) {
+    var lk sync.Mutex
+    results := make(map[string]error, len(items))
+    setResult := func(key string, err error) {
+        lk.Lock()
+        defer lk.Unlock()
+        results[key] = err
     }
-    n, err := fmt.Sscanf(string(line), pattern, dest...)
-    if err != nil || n != len(dest) {
-        return -1, fmt.Errorf("memcache: unexpected line in get response: %q", line)
+
+    itemMap := make(map[net.Addr][]*Item)
+    for _, item := range items {
+        if !c.validKey(item.Key) {
+            setResult(item.Key, ErrMalformedKey)
+            continue
+        }
+        if err := c.checkFlags("set", item.Flags); err != nil {
+            setResult(item.Key, err)
+            continue
+        }
+        addr, err := c.selector.PickServer(item.Key)
+        if err != nil {
+            setResult(item.Key, err)
+            continue
+        }
+        itemMap[addr] = append(itemMap[addr], item)
     }
-    return size, nil
-}
 
-// Set writes the given item, unconditionally.
-func (c *Client) Set(item *Item) error {
-    return c.onItem(item, (*Client).set)
+    var wg sync.WaitGroup
+    for addr, items := range itemMap {
+        wg.Add(1)
+        go func(addr net.Addr, items []*Item) {
+            defer wg.Done()
+            c.setMultiToAddr(addr, items, setResult)
+        }(addr, items)
+    }
+    wg.Wait()
+
+    var err error
+    for _, kerr := range results {
+        if kerr != nil {
+            err = kerr
+        }
+    }
+    return results, err
 }
 
-func (c *Client) set(rw *bufio.ReadWriter, item *Item) error {
-    return c.populateOne(rw, "set", item)
+func (c *Client) setMultiToAddr(addr net.Addr, items []*Item, setResult func(string, error)) {
+    done := 0
+    err := c.withAddrRwWrite(addr, func(rw *bufio.ReadWriter) error {
+        for _, item := range items {
+            if err := c.writeStorage(rw.Writer, "set", item); err != nil {
+                return err
+            }
+        }
+        if err := rw.Flush(); err != nil {
+            return err
+        }
+        for _, item := range items {
+            line, err := readLine(rw.Reader)
+            if err != nil {
+                return err
+            }
+            err = storeResult("set", line)
+            if err != nil && !resumableError(err) {
+                return err
+            }
+            if err == nil {
+                c.rememberStale(item.Key, item)
+            }
+            setResult(item.Key, err)
+            done++
+        }
+        return nil
+    })
+    if err != nil {
+        for _, item := range items[done:] {
+            setResult(item.Key, err)
+        }
+    }
 }
 
-// Add writes the given item, if no value already exists for its
-// key. ErrNotStored is returned if that condition is not met.
-func (c *Client) Add(item *Item) error {
-    return c.onItem(item, (*Client).add)
+// Sweep touches each of the keep keys, setting their expiration to
+// seconds as Touch does, and deletes each of the drop keys. The commands for
+// each server are pipelined over a single connection. The returned maps
+// hold the result of every key's command, nil on success and
+// ErrCacheMiss if the item was not present.
+func (c *Client) Sweep(keep []string, drop []string, seconds int32) (kept, dropped map[string]error) {
+    var lk sync.Mutex
+    kept = make(map[string]error)
+    dropped = make(map[string]error)
+    setResult := func(op sweepOp, err error) {
+        lk.Lock()
+        defer lk.Unlock()
+        if op.drop {
+            dropped[op.key] = err
+        } else {
+            kept[op.key] = err
+        }
+    }
+
+    opMap := make(map[net.Addr][]sweepOp)
+    addOps := func(keys []string, drop bool) {
+        for _, key := range keys {
+            op := sweepOp{key, drop}
+            if !c.validKey(key) {
+                setResult(op, ErrMalformedKey)
+                continue
+            }
+            addr, err := c.selector.PickServer(key)
+            if err != nil {
+                setResult(op, err)
+                continue
+            }
+            opMap[addr] = append(opMap[addr], op)
+        }
+    }
+    addOps(keep, false)
+    addOps(drop, true)
+
+    var wg sync.WaitGroup
+    for addr, ops := range opMap {
+        wg.Add(1)
+        go func(addr net.Addr, ops []sweepOp) {
+            defer wg.Done()
+            c.sweepAddr(addr, ops, seconds, setResult)
+        }(addr, ops)
+    }
+    wg.Wait()
+    return kept, dropped
 }
 
-func (c *Client) add(rw *bufio.ReadWriter, item *Item) error {
-    return c.populateOne(rw, "add", item)
+// DeleteMulti deletes the items with the given keys. As with Sweep,
+// the deletes for each server are pipelined over a single connection.
+// The returned map holds every key's result, nil if its item was
+// deleted and ErrCacheMiss if it was not present. The error is nil
+// unless some key failed otherwise, in which case it is one of their
+// errors.
+func (c *Client) DeleteMulti(keys []string) (map[string]error, error) {
+    _, results := c.Sweep(nil, keys, 0)
+    var err error
+    for _, kerr := range results {
+        if kerr != nil && kerr != ErrCacheMiss {
+            err = kerr
+        }
+    }
+    return results, err
 }
 
-// CompareAndSwap writes the given item that was previously returned
-// by Get, if the value was neither modified or evicted between the
-// Get and the CompareAndSwap calls. The item's Key should not change
-// between calls but all other item fields may differ. ErrCASConflict
-// is returned if the value was modified in between the
-// calls. ErrNotStored is returned if the value was evicted in between
-// the calls.
-func (c *Client) CompareAndSwap(item *Item) error {
-    return c.onItem(item, (*Client).cas)
+// sweepOp is a touch, or a delete if drop is set, of key.
+type sweepOp struct {
+    key  string
+    drop bool
 }
 
-func (c *Client) cas(rw *bufio.ReadWriter, item *Item) error {
-    return c.populateOne(rw, "cas", item)
+func (c *Client) sweepAddr(addr net.Addr, ops []sweepOp, seconds int32, setResult func(sweepOp, error)) {
+    done := 0
+    exp := c.expiration(seconds)
+    err := c.withAddrRwWrite(addr, func(rw *bufio.ReadWriter) error {
+        for _, op := range ops {
+            var cmd []byte
+            if op.drop {
+                c.rememberStale(op.key, nil)
+                atomic.AddUint64(&c.metrics.deletes, 1)
+                cmd = appendKeyCommand(rw.AvailableBuffer(), "delete", op.key)
+            } else {
+                cmd = appendTouchCommand(rw.AvailableBuffer(), op.key, exp)
+            }
+            if _, err := rw.Write(cmd); err != nil {
+                return err
+            }
+        }
+        if err := rw.Flush(); err != nil {
+            return err
+        }
+        for _, op := range ops {
+            line, err := readLine(rw.Reader)
+            if err != nil {
+                return err
+            }
+            expect := resultTouched
+            if op.drop {
+                expect = resultDeleted
+            }
+            err = expectResult(line, expect)
+            if err != nil && !resumableError(err) {
+                return err
+            }
+            setResult(op, err)
+            done++
+        }
+        return nil
+    })
+    if err != nil {
+        for _, op := range ops[done:] {
+            setResult(op, err)
+        }
+    }
 }
 
-func (c *Client) populateOne(rw *bufio.ReadWriter, verb string, item *Item) error {
-    if !legalKey(item.Key) {
-        return ErrMalformedKey
+// maxProbeValueSize bounds the value sizes tried by ProbeMaxValueSize.
+const maxProbeValueSize = 128 << 20
+
+// ProbeMaxValueSize finds the largest value that the server at addr,
+// and any proxy in front of it, will store. It does so by storing
+// values of increasing size under a temporary key until one is
+// rejected, then binary-searching between the largest accepted and
+// smallest rejected sizes. The temporary key is deleted after every
+// successful store.
+//
+// ProbeMaxValueSize writes to the server and may evict other items.
+// Sizes above 128 MiB are not tried.
+func (c *Client) ProbeMaxValueSize(addr net.Addr) (int, error) {
+    key := fmt.Sprintf("memcache:probe:%d", time.Now().UnixNano())
+    store := func(size int) error {
+        item := &Item{Key: key, Value: make([]byte, size)}
+        err := c.withAddrRwWrite(addr, func(rw *bufio.ReadWriter) error {
+            // The zeros are written uncompressed, as compressing them
+            // would let far larger values through.
+            if err := c.writeStorageValue(rw.Writer, "set", item, item.Value, 0); err != nil {
+                return err
+            }
+            if err := rw.Flush(); err != nil {
+                return err
+            }
+            line, err := readLine(rw.Reader)
+            if err != nil {
+                return err
+            }
+            return storeResult("set", line)
+        })
+        if err == nil {
+            c.withAddrRwWrite(addr, func(rw *bufio.ReadWriter) error {
+                return writeExpectf(rw, resultDeleted, "delete %s\r\n", key)
+            })
+        }
+        return err
     }
-    var err error
-    if verb == "cas" {
-        _, err = fmt.Fprintf(rw, "%s %s %d %d %d %d\r\n",
-            verb, item.Key, item.Flags, item.Expiration, len(item.Value), item.casid)
-    } else {
-        _, err = fmt.Fprintf(rw, "%s %s %d %d %d\r\n",
-            verb, item.Key, item.Flags, item.Expiration, len(item.Value))
+
+    if err := store(1); err != nil {
+        return 0, err
     }
-    if err != nil {
-        return err
+    good, bad := 1, 0
+    for size := 1024; size <= maxProbeValueSize; size *= 2 {
+        if store(size) != nil {
+            bad = size
+            break
+        }
+        good = size
     }
-    if _, err = rw.Write(item.Value); err != nil {
-        return err
+    if bad == 0 {
+        return good, nil
     }
-    if _, err := rw.Write(crlf); err != nil {
-        return err
+    for bad-good > 1 {
+        mid := good + (bad-good)/2
+        if store(mid) == nil {
+            good = mid
+        } else {
+            bad = mid
+        }
+    }
+    return good, nil
+}
+
+func writeReadLine(rw *bufio.ReadWriter, format string, args ...interface{}) ([]byte, error) {
+    _, err := fmt.Fprintf(rw, format, args...)
+    if err != nil {
+        return nil, err
     }
     if err := rw.Flush(); err != nil {
-        return err
+        return nil, err
     }
-    line, err := rw.ReadSlice('\n')
+    line, err := readLine(rw.Reader)
+    return line, err
+}
+
+func writeExpectf(rw *bufio.ReadWriter, expect []byte, format string, args ...interface{}) error {
+    line, err := writeReadLine(rw, format, args...)
     if err != nil {
         return err
     }
+    return expectResult(line, expect)
+}
+
+// expectResult maps a response line to nil if it is expect, or to the
+// matching error otherwise.
+func expectResult(line, expect []byte) error {
     switch {
-    case bytes.Equal(line, resultStored):
+    case bytes.Equal(line, expect):
         return nil
     case bytes.Equal(line, resultNotStored):
         return ErrNotStored
@@ -766,46 +2926,235 @@ func (c *Client) populateOne(rw *bufio.ReadWriter, verb string, item *Item) erro
         return ErrCASConflict
     case bytes.Equal(line, resultNotFound):
         return ErrCacheMiss
+    case serverBusy(line):
+        return ErrServerBusy
+    }
+    return fmt.Errorf("memcache: unexpected response line: %q", string(line))
+}
+
+// Delete deletes the item with the provided key. The error ErrCacheMiss is
+// returned if the item didn't already exist in the cache.
+func (c *Client) Delete(key string) error {
+    return c.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is like Delete, but gives up when ctx is done,
+// returning ctx's error.
+func (c *Client) DeleteContext(ctx context.Context, key string) error {
+    return c.intercept(&Op{Name: "delete", Key: key}, func(op *Op) error {
+        key := op.Key
+        c.rememberStale(key, nil)
+        atomic.AddUint64(&c.metrics.deletes, 1)
+        return c.withKeyRwWrite(ctx, key, func(rw *bufio.ReadWriter) error {
+            line, err := writeCommand(rw, appendKeyCommand(rw.AvailableBuffer(), "delete", key))
+            if err != nil {
+                return err
+            }
+            return expectResult(line, resultDeleted)
+        })
+    })
+}
+
+// Touch updates the expiration time of the item with the provided key
+// without fetching or changing its value. seconds is interpreted like
+// Item.Expiration, including DefaultExpiration and NoExpiration.
+// ErrCacheMiss is returned if the item is not present.
+func (c *Client) Touch(key string, seconds int32) error {
+    return c.TouchContext(context.Background(), key, seconds)
+}
+
+// TouchContext is like Touch, but gives up when ctx is done, returning
+// ctx's error.
+func (c *Client) TouchContext(ctx context.Context, key string, seconds int32) error {
+    return c.withKeyRwWrite(ctx, key, func(rw *bufio.ReadWriter) error {
+        return writeExpectf(rw, resultTouched, "touch %s %d\r\n", key, c.expiration(seconds))
+    })
+}
+
+// GetAndTouch gets the item for the provided key and updates its
+// expiration time in the same round trip, like Get followed by Touch.
+// The returned item carries its CAS id. ErrCacheMiss is returned for
+// a memcache cache miss.
+func (c *Client) GetAndTouch(key string, seconds int32) (item *Item, err error) {
+    err = c.withKeyRwWrite(context.Background(), key, func(rw *bufio.ReadWriter) error {
+        if _, err := fmt.Fprintf(rw, "gats %d %s\r\n", c.expiration(seconds), key); err != nil {
+            return err
+        }
+        if err := rw.Flush(); err != nil {
+            return err
+        }
+        return c.parseGetResponse(rw.Reader, 1, func(it *Item) { item = it })
+    })
+    if err == nil && item == nil {
+        err = ErrCacheMiss
+    }
+    return
+}
+
+// GetAndTouchMulti is a batch version of GetAndTouch. Keys are grouped
+// by server and each server is sent a single gats command for its
+// keys, the servers being queried concurrently. The returned map omits
+// keys that were not found; it is never nil, even when an error is
+// returned.
+func (c *Client) GetAndTouchMulti(keys []string, seconds int32) (map[string]*Item, error) {
+    var lk sync.Mutex
+    m := make(map[string]*Item)
+    addItemToMap := func(it *Item) {
+        lk.Lock()
+        defer lk.Unlock()
+        m[it.Key] = it
+    }
+
+    keyMap := make(map[net.Addr][]string)
+    for _, key := range keys {
+        if !c.validKey(key) {
+            return m, ErrMalformedKey
+        }
+        addr, err := c.selector.PickServer(key)
+        if err != nil {
+            return m, err
+        }
+        keyMap[addr] = append(keyMap[addr], key)
+    }
+
+    exp := c.expiration(seconds)
+    ch := make(chan error, buffered)
+    for addr, keys := range keyMap {
+        go func(addr net.Addr, keys []string) {
+            ch <- c.withAddrRwWrite(addr, func(rw *bufio.ReadWriter) error {
+                if _, err := fmt.Fprintf(rw, "gats %d %s\r\n", exp, strings.Join(keys, " ")); err != nil {
+                    return err
+                }
+                if err := rw.Flush(); err != nil {
+                    return err
+                }
+                return c.parseGetResponse(rw.Reader, len(keys), addItemToMap)
+            })
+        }(addr, keys)
+    }
+
+    var err error
+    for _ = range keyMap {
+        if ge := <-ch; ge != nil {
+            err = ge
+        }
+    }
+    return m, err
+}
+
+// ensureAttempts bounds the adds tried by EnsureWithTTL.
+const ensureAttempts = 3
+
+// EnsureWithTTL makes sure an item exists for item's key, for keys such
+// as presence or heartbeat markers whose value is fixed but whose
+// lifetime should roll forward. If the key is absent, item is added;
+// otherwise the existing item's expiration is set to item's
+// Expiration and its value is left untouched. If the item keeps
+// vanishing between the add and the touch, ErrNotStored is returned
+// after three attempts.
+func (c *Client) EnsureWithTTL(item *Item) error {
+    for i := 0; i < ensureAttempts; i++ {
+        err := c.Add(item)
+        if err != ErrNotStored {
+            return err
+        }
+        err = c.Touch(item.Key, item.Expiration)
+        if err != ErrCacheMiss {
+            return err
+        }
+        // The item expired or was deleted in between; add it again.
     }
-    return fmt.Errorf("memcache: unexpected response line from %q: %q", verb, string(line))
+    return ErrNotStored
 }
 
-func writeReadLine(rw *bufio.ReadWriter, format string, args ...interface{}) ([]byte, error) {
-    _, err := fmt.Fprintf(rw, format, args...)
-    if err != nil {
-        return nil, err
+// DeleteWithDelay deletes the item with the provided key and keeps it
+// from being added again for the given number of seconds. Only
+// memcached releases before 1.4.0, and some proxies and forks, accept
+// the lock time; the server's capabilities are checked first, and
+// ErrNotSupported is returned if it does not. They are cached, see
+// CapabilitiesTTL.
+func (c *Client) DeleteWithDelay(key string, seconds int) error {
+    return c.withKeyAddr(key, func(addr net.Addr) error {
+        caps, err := c.cachedCapabilities(addr)
+        if err != nil {
+            return err
+        }
+        if !caps.SupportsDelayedDelete {
+            return ErrNotSupported
+        }
+        c.rememberStale(key, nil)
+        atomic.AddUint64(&c.metrics.deletes, 1)
+        return c.withAddrRwWrite(addr, func(rw *bufio.ReadWriter) error {
+            return writeExpectf(rw, resultDeleted, "delete %s %d\r\n", key, seconds)
+        })
+    })
+}
+
+// FlushError is returned by FlushAll when some servers could not be
+// flushed.
+type FlushError struct {
+    // Errors maps the address of each server that failed to its error.
+    Errors map[string]error
+}
+
+func (e *FlushError) Error() string {
+    addrs := make([]string, 0, len(e.Errors))
+    for addr := range e.Errors {
+        addrs = append(addrs, addr)
     }
-    if err := rw.Flush(); err != nil {
-        return nil, err
+    sort.Strings(addrs)
+    msgs := make([]string, len(addrs))
+    for i, addr := range addrs {
+        msgs[i] = fmt.Sprintf("%s: %v", addr, e.Errors[addr])
     }
-    line, err := rw.ReadSlice('\n')
-    return line, err
+    return fmt.Sprintf("memcache: flush_all failed on %d servers (%s)", len(addrs), strings.Join(msgs, "; "))
 }
 
-func writeExpectf(rw *bufio.ReadWriter, expect []byte, format string, args ...interface{}) error {
-    line, err := writeReadLine(rw, format, args...)
+// FlushAll invalidates every item on every server, concurrently. If
+// delay is positive, the servers invalidate their items after that
+// many seconds instead of at once. If any server fails, a *FlushError
+// describing the failures is returned; the other servers are flushed
+// regardless.
+func (c *Client) FlushAll(delay int32) error {
+    cmd := "flush_all\r\n"
+    if delay > 0 {
+        cmd = fmt.Sprintf("flush_all %d\r\n", delay)
+    }
+    addrs, err := c.selector.GetServers()
     if err != nil {
         return err
     }
-    switch {
-    case bytes.Equal(line, expect):
-        return nil
-    case bytes.Equal(line, resultNotStored):
-        return ErrNotStored
-    case bytes.Equal(line, resultExists):
-        return ErrCASConflict
-    case bytes.Equal(line, resultNotFound):
-        return ErrCacheMiss
+    seen := make(map[string]bool, len(addrs))
+    var unique []net.Addr
+    for _, addr := range addrs {
+        if !seen[addr.String()] {
+            seen[addr.String()] = true
+            unique = append(unique, addr)
+        }
     }
-    return fmt.Errorf("memcache: unexpected response line: %q", string(line))
-}
 
-// Delete deletes the item with the provided key. The error ErrCacheMiss is
-// returned if the item didn't already exist in the cache.
-func (c *Client) Delete(key string) error {
-    return c.withKeyRw(key, func(rw *bufio.ReadWriter) error {
-        return writeExpectf(rw, resultDeleted, "delete %s\r\n", key)
-    })
+    var lk sync.Mutex
+    ferr := &FlushError{Errors: make(map[string]error)}
+    var wg sync.WaitGroup
+    for _, addr := range unique {
+        wg.Add(1)
+        go func(addr net.Addr) {
+            defer wg.Done()
+            err := c.withAddrRwWrite(addr, func(rw *bufio.ReadWriter) error {
+                return writeExpectf(rw, resultOK, "%s", cmd)
+            })
+            if err != nil {
+                lk.Lock()
+                defer lk.Unlock()
+                ferr.Errors[addr.String()] = err
+            }
+        }(addr)
+    }
+    wg.Wait()
+    if len(ferr.Errors) > 0 {
+        return ferr
+    }
+    return nil
 }
 
 // Increment atomically increments key by delta. The return value is
@@ -814,7 +3163,13 @@ func (c *Client) Delete(key string) error {
 // memcached must be an decimal number, or an error will be returned.
 // On 64-bit overflow, the new value wraps around.
 func (c *Client) Increment(key string, delta uint64) (newValue uint64, err error) {
-    return c.incrDecr("incr", key, delta)
+    return c.incrDecr(context.Background(), "incr", key, delta)
+}
+
+// IncrementContext is like Increment, but gives up when ctx is done,
+// returning ctx's error.
+func (c *Client) IncrementContext(ctx context.Context, key string, delta uint64) (newValue uint64, err error) {
+    return c.incrDecr(ctx, "incr", key, delta)
 }
 
 // Decrement atomically decrements key by delta. The return value is
@@ -824,30 +3179,245 @@ func (c *Client) Increment(key string, delta uint64) (newValue uint64, err error
 // On underflow, the new value is capped at zero and does not wrap
 // around.
 func (c *Client) Decrement(key string, delta uint64) (newValue uint64, err error) {
-    return c.incrDecr("decr", key, delta)
+    return c.incrDecr(context.Background(), "decr", key, delta)
+}
+
+// DecrementContext is like Decrement, but gives up when ctx is done,
+// returning ctx's error.
+func (c *Client) DecrementContext(ctx context.Context, key string, delta uint64) (newValue uint64, err error) {
+    return c.incrDecr(ctx, "decr", key, delta)
+}
+
+func (c *Client) incrDecr(ctx context.Context, verb, key string, delta uint64) (uint64, error) {
+    var val uint64
+    err := c.intercept(&Op{Name: verb, Key: key}, func(op *Op) (err error) {
+        val, err = c.incrDecrKey(ctx, verb, op.Key, delta)
+        return err
+    })
+    return val, err
 }
 
-func (c *Client) incrDecr(verb, key string, delta uint64) (uint64, error) {
+func (c *Client) incrDecrKey(ctx context.Context, verb, key string, delta uint64) (uint64, error) {
     var val uint64
-    err := c.withKeyRw(key, func(rw *bufio.ReadWriter) error {
-        line, err := writeReadLine(rw, "%s %s %d\r\n", verb, key, delta)
+    err := c.withKeyRwWrite(ctx, key, func(rw *bufio.ReadWriter) error {
+        line, err := writeCommand(rw, appendIncrDecrCommand(rw.AvailableBuffer(), verb, key, delta))
         if err != nil {
             return err
         }
-        switch {
-        case bytes.Equal(line, resultNotFound):
-            return ErrCacheMiss
-        case bytes.HasPrefix(line, resultClientErrorPrefix):
-            errMsg := line[len(resultClientErrorPrefix) : len(line)-2]
-            return errors.New("memcache: client error: " + string(errMsg))
+        val, err = incrDecrResult(line)
+        return err
+    })
+    return val, err
+}
+
+// incrDecrResult parses the response line of an incr or decr command.
+func incrDecrResult(line []byte) (uint64, error) {
+    switch {
+    case bytes.Equal(line, resultNotFound):
+        return 0, ErrCacheMiss
+    case bytes.HasPrefix(line, resultClientErrorPrefix):
+        errMsg := line[len(resultClientErrorPrefix) : len(line)-2]
+        return 0, errors.New("memcache: client error: " + string(errMsg))
+    }
+    return strconv.ParseUint(string(line[:len(line)-2]), 10, 64)
+}
+
+// IncrementMulti is a batch version of Increment: it increments each
+// key of deltas by its delta. Keys are grouped by server, the servers
+// are queried concurrently and the incr commands for each server are
+// pipelined over a single connection. The new values of the keys that
+// were incremented are returned in values, and the errors of the others
+// in errs, with ErrCacheMiss for keys that were not present.
+func (c *Client) IncrementMulti(deltas map[string]uint64) (values map[string]uint64, errs map[string]error) {
+    return c.incrDecrMulti("incr", deltas)
+}
+
+// DecrementMulti is a batch version of Decrement, working as
+// IncrementMulti does.
+func (c *Client) DecrementMulti(deltas map[string]uint64) (values map[string]uint64, errs map[string]error) {
+    return c.incrDecrMulti("decr", deltas)
+}
+
+func (c *Client) incrDecrMulti(verb string, deltas map[string]uint64) (values map[string]uint64, errs map[string]error) {
+    var lk sync.Mutex
+    values = make(map[string]uint64)
+    errs = make(map[string]error)
+    setResult := func(key string, val uint64, err error) {
+        lk.Lock()
+        defer lk.Unlock()
+        if err != nil {
+            errs[key] = err
+        } else {
+            values[key] = val
+        }
+    }
+
+    keyMap := make(map[net.Addr][]string)
+    for key := range deltas {
+        if !c.validKey(key) {
+            setResult(key, 0, ErrMalformedKey)
+            continue
         }
-        val, err = strconv.ParseUint(string(line[:len(line)-2]), 10, 64)
+        addr, err := c.selector.PickServer(key)
         if err != nil {
+            setResult(key, 0, err)
+            continue
+        }
+        keyMap[addr] = append(keyMap[addr], key)
+    }
+
+    var wg sync.WaitGroup
+    for addr, keys := range keyMap {
+        wg.Add(1)
+        go func(addr net.Addr, keys []string) {
+            defer wg.Done()
+            c.incrDecrAddr(addr, verb, keys, deltas, setResult)
+        }(addr, keys)
+    }
+    wg.Wait()
+    return values, errs
+}
+
+func (c *Client) incrDecrAddr(addr net.Addr, verb string, keys []string, deltas map[string]uint64, setResult func(string, uint64, error)) {
+    done := 0
+    err := c.withAddrRwWrite(addr, func(rw *bufio.ReadWriter) error {
+        for _, key := range keys {
+            if _, err := rw.Write(appendIncrDecrCommand(rw.AvailableBuffer(), verb, key, deltas[key])); err != nil {
+                return err
+            }
+        }
+        if err := rw.Flush(); err != nil {
             return err
         }
+        for _, key := range keys {
+            line, err := readLine(rw.Reader)
+            if err != nil {
+                return err
+            }
+            val, err := incrDecrResult(line)
+            if err != nil && err != ErrCacheMiss && !bytes.HasPrefix(line, resultClientErrorPrefix) {
+                // Not a response to incr or decr; the stream is out of
+                // step.
+                return fmt.Errorf("memcache: unexpected response line from %s: %q", verb, line)
+            }
+            setResult(key, val, err)
+            done++
+        }
         return nil
     })
-    return val, err
+    if err != nil {
+        for _, key := range keys[done:] {
+            setResult(key, 0, err)
+        }
+    }
+}
+
+// RefreshOrSet extends the expiration of each item's key to seconds
+// and stores the items whose keys are missing, for warming a cache
+// whose existing entries should be kept. Per server, touch commands
+// for all its keys are pipelined first and a set, with Expiration
+// replaced by seconds, is then pipelined for every key that was not
+// found. The returned map holds an error for each key that could be
+// neither touched nor set.
+func (c *Client) RefreshOrSet(items []*Item, seconds int32) map[string]error {
+    var lk sync.Mutex
+    errs := make(map[string]error)
+    setErr := func(key string, err error) {
+        if err == nil {
+            return
+        }
+        lk.Lock()
+        defer lk.Unlock()
+        errs[key] = err
+    }
+
+    itemMap := make(map[net.Addr][]*Item)
+    for _, item := range items {
+        if !c.validKey(item.Key) {
+            setErr(item.Key, ErrMalformedKey)
+            continue
+        }
+        if err := c.checkFlags("set", item.Flags); err != nil {
+            setErr(item.Key, err)
+            continue
+        }
+        addr, err := c.selector.PickServer(item.Key)
+        if err != nil {
+            setErr(item.Key, err)
+            continue
+        }
+        itemMap[addr] = append(itemMap[addr], item)
+    }
+
+    var wg sync.WaitGroup
+    for addr, items := range itemMap {
+        wg.Add(1)
+        go func(addr net.Addr, items []*Item) {
+            defer wg.Done()
+            c.refreshOrSetAddr(addr, items, seconds, setErr)
+        }(addr, items)
+    }
+    wg.Wait()
+    return errs
+}
+
+func (c *Client) refreshOrSetAddr(addr net.Addr, items []*Item, seconds int32, setErr func(string, error)) {
+    var missing []*Item
+    done := 0
+    err := c.withAddrRwWrite(addr, func(rw *bufio.ReadWriter) error {
+        exp := c.expiration(seconds)
+        for _, item := range items {
+            if _, err := fmt.Fprintf(rw, "touch %s %d\r\n", item.Key, exp); err != nil {
+                return err
+            }
+        }
+        if err := rw.Flush(); err != nil {
+            return err
+        }
+        for _, item := range items {
+            line, err := readLine(rw.Reader)
+            if err != nil {
+                return err
+            }
+            switch {
+            case bytes.Equal(line, resultTouched):
+            case bytes.Equal(line, resultNotFound):
+                it := *item
+                it.Expiration = seconds
+                missing = append(missing, &it)
+            default:
+                return fmt.Errorf("memcache: unexpected response line from touch: %q", line)
+            }
+            done++
+        }
+        if len(missing) == 0 {
+            return nil
+        }
+
+        items, done = missing, 0
+        for _, item := range items {
+            if err := c.writeStorage(rw.Writer, "set", item); err != nil {
+                return err
+            }
+        }
+        if err := rw.Flush(); err != nil {
+            return err
+        }
+        for _, item := range items {
+            line, err := readLine(rw.Reader)
+            if err != nil {
+                return err
+            }
+            setErr(item.Key, storeResult("set", line))
+            done++
+        }
+        return nil
+    })
+    if err != nil {
+        for _, item := range items[done:] {
+            setErr(item.Key, err)
+        }
+    }
 }
 
 func (c *Client) statsFromAddr(argument string, addr net.Addr, fn func(*bufio.Reader) error) error {
@@ -871,8 +3441,8 @@ func parseStatsResponse(r *bufio.Reader, stats *GeneralStats) (error) {
         key string
         value []byte
     )
-    for {
-        line, err := r.ReadSlice('\n')
+    for n := 0; n < maxStatsLines; n++ {
+        line, err := readLine(r)
         if err != nil {
             return err
         }
@@ -882,14 +3452,14 @@ func parseStatsResponse(r *bufio.Reader, stats *GeneralStats) (error) {
 
         n, err := fmt.Sscanf(string(line), pattern, &key, &value)
         if err != nil || n != 2 {
-            return fmt.Errorf("memcache: unexpected line in stats response: %q", line)
+            return &ParseError{Parser: "stats", Pattern: pattern, Line: line}
         }
         err = stats.Set(key, value)
         if err != nil && err != ErrInvalidStatsKey {
             return err
         }
     }
-    panic("unreached")
+    return ErrResponseTooLong
 }
 
 // Retrieve general-purpose statistics and settings.
@@ -910,14 +3480,47 @@ func (c *Client) Stats(addr net.Addr) (*GeneralStats, error) {
     return generalStats, nil
 }
 
+// StatsMulti returns the general statistics of each of addrs, keyed by
+// address string. The servers are queried concurrently. Servers that
+// could not be queried are absent from the stats map and have their
+// error in the error map instead.
+func (c *Client) StatsMulti(addrs []net.Addr) (map[string]*GeneralStats, map[string]error) {
+    var lk sync.Mutex
+    stats := make(map[string]*GeneralStats)
+    errs := make(map[string]error)
+
+    var wg sync.WaitGroup
+    sem := make(chan struct{}, maxStatsQueries)
+    for _, addr := range addrs {
+        wg.Add(1)
+        sem <- struct{}{}
+        go func(addr net.Addr) {
+            defer func() {
+                <-sem
+                wg.Done()
+            }()
+            s, err := c.Stats(addr)
+            lk.Lock()
+            defer lk.Unlock()
+            if err != nil {
+                errs[addr.String()] = err
+            } else {
+                stats[addr.String()] = s
+            }
+        }(addr)
+    }
+    wg.Wait()
+    return stats, errs
+}
+
 func parseStatsSettingsResponse(r *bufio.Reader, stats *SettingsStats) (error) {
     pattern := "STAT %s %s\r\n"
     var (
         key string
         value []byte
     )
-    for {
-        line, err := r.ReadSlice('\n')
+    for n := 0; n < maxStatsLines; n++ {
+        line, err := readLine(r)
         if err != nil {
             return err
         }
@@ -927,14 +3530,14 @@ func parseStatsSettingsResponse(r *bufio.Reader, stats *SettingsStats) (error) {
 
         n, err := fmt.Sscanf(string(line), pattern, &key, &value)
         if err != nil || n != 2 {
-            return fmt.Errorf("memcache: unexpected line in stats response: %q", line)
+            return &ParseError{Parser: "stats", Pattern: pattern, Line: line}
         }
         err = stats.Set(key, value)
         if err != nil && err != ErrInvalidStatsKey {
             return err
         }
     }
-    panic("unreached")
+    return ErrResponseTooLong
 }
 
 // Retrieve settings details of memcached.
@@ -962,8 +3565,8 @@ func parseStatsItemsResponse(r *bufio.Reader, slabMap map[int]*ItemStats) error
         key string
         value []byte
     )
-    for {
-        line, err := r.ReadSlice('\n')
+    for n := 0; n < maxStatsLines; n++ {
+        line, err := readLine(r)
         if err != nil {
             return err
         }
@@ -973,7 +3576,7 @@ func parseStatsItemsResponse(r *bufio.Reader, slabMap map[int]*ItemStats) error
 
         n, err := fmt.Sscanf(string(line), pattern, &slabIndex, &key, &value)
         if err != nil || n != 3 {
-            return fmt.Errorf("memcache: unexpected line in stats items response: %q", line)
+            return &ParseError{Parser: "stats items", Pattern: pattern, Line: line}
         }
 
         _, ok := slabMap[slabIndex]
@@ -985,7 +3588,7 @@ func parseStatsItemsResponse(r *bufio.Reader, slabMap map[int]*ItemStats) error
             return err
         }
     }
-    panic("unreached")
+    return ErrResponseTooLong
 }
 
 // Retrieve information about item storage per slab class.
@@ -1006,6 +3609,21 @@ func (c *Client) StatsItems(addr net.Addr) (map[int]*ItemStats, error) {
     return slabMap, nil
 }
 
+// LRUAges returns, per slab class, the age of the oldest item in the
+// class's LRU, as reported by "stats items" on the server at addr. It
+// is a measure of how long items survive before being evicted.
+func (c *Client) LRUAges(addr net.Addr) (map[int]time.Duration, error) {
+    items, err := c.StatsItems(addr)
+    if err != nil {
+        return nil, err
+    }
+    ages := make(map[int]time.Duration, len(items))
+    for class, st := range items {
+        ages[class] = time.Duration(st.Age) * time.Second
+    }
+    return ages, nil
+}
+
 func parseStatsSlabsResponse(r *bufio.Reader, slabMap map[int]*SlabStats) error {
     pattern := "STAT %d:%s %s\r\n"
     var (
@@ -1013,8 +3631,8 @@ func parseStatsSlabsResponse(r *bufio.Reader, slabMap map[int]*SlabStats) error
         key string
         value []byte
     )
-    for {
-        line, err := r.ReadSlice('\n')
+    for n := 0; n < maxStatsLines; n++ {
+        line, err := readLine(r)
         if err != nil {
             return err
         }
@@ -1028,7 +3646,7 @@ func parseStatsSlabsResponse(r *bufio.Reader, slabMap map[int]*SlabStats) error
 
         n, err := fmt.Sscanf(string(line), pattern, &slabIndex, &key, &value)
         if err != nil || n != 3 {
-            return fmt.Errorf("memcache: unexpected line in stats slabs response: %q", line)
+            return &ParseError{Parser: "stats slabs", Pattern: pattern, Line: line}
         }
 
         _, ok := slabMap[slabIndex]
@@ -1040,7 +3658,7 @@ func parseStatsSlabsResponse(r *bufio.Reader, slabMap map[int]*SlabStats) error
             return err
         }
     }
-    panic("unreached")
+    return ErrResponseTooLong
 }
 
 // Retrieve slabs information.
@@ -1060,3 +3678,232 @@ func (c *Client) StatsSlabs(addr net.Addr) (map[int]*SlabStats, error) {
 
     return slabMap, nil
 }
+
+// StatsOrdered returns the raw response to "stats <subcommand>" from
+// the server at addr, in the order the server sent it. An empty
+// subcommand requests the general statistics.
+func (c *Client) StatsOrdered(addr net.Addr, subcommand string) ([]StatKV, error) {
+    var stats []StatKV
+    parseResponse := func(r *bufio.Reader) error {
+        for n := 0; n < maxStatsLines; n++ {
+            line, err := readLine(r)
+            if err != nil {
+                return err
+            }
+            if bytes.Equal(line, resultEnd) {
+                return nil
+            }
+            fields := bytes.SplitN(bytes.TrimSuffix(line, crlf), space, 3)
+            if len(fields) != 3 || string(fields[0]) != "STAT" {
+                return &ParseError{Parser: "stats", Pattern: "STAT %s %s\r\n", Line: line}
+            }
+            stats = append(stats, StatKV{Key: string(fields[1]), Value: fields[2]})
+        }
+        return ErrResponseTooLong
+    }
+    if err := c.statsFromAddr(subcommand, addr, parseResponse); err != nil {
+        return nil, err
+    }
+    return stats, nil
+}
+
+// StatsSizes returns the histogram of item sizes reported by
+// "stats sizes" on the server at addr: the number of items stored in
+// each size bucket, keyed by the bucket's upper bound in bytes. Servers
+// that track sizes only when started with -o track_sizes report no
+// buckets otherwise.
+func (c *Client) StatsSizes(addr net.Addr) (map[int]uint64, error) {
+    stats, err := c.StatsOrdered(addr, "sizes")
+    if err != nil {
+        return nil, err
+    }
+    sizes := make(map[int]uint64)
+    for _, kv := range stats {
+        size, err := strconv.Atoi(kv.Key)
+        if err != nil {
+            // Such as "sizes_status disabled".
+            continue
+        }
+        n, err := strconv.ParseUint(string(kv.Value), 10, 64)
+        if err != nil {
+            line := []byte("STAT " + kv.Key + " " + string(kv.Value) + "\r\n")
+            return nil, &ParseError{Parser: "stats sizes", Pattern: "STAT %d %d\r\n", Line: line}
+        }
+        sizes[size] = n
+    }
+    return sizes, nil
+}
+
+// StatsReset resets the general statistics counters of the server at
+// addr.
+func (c *Client) StatsReset(addr net.Addr) error {
+    return c.withAddrRwWrite(addr, func(rw *bufio.ReadWriter) error {
+        return writeExpectf(rw, resultReset, "stats reset\r\n")
+    })
+}
+
+// StatsResetSnapshot is like StatsReset, but first returns the general
+// statistics as they stood just before the reset. Both commands are
+// sent over the same connection, the reset as soon as the snapshot has
+// been read, so the snapshot covers all but a round trip of the window
+// that the reset ends.
+func (c *Client) StatsResetSnapshot(addr net.Addr) (*GeneralStats, error) {
+    generalStats := new(GeneralStats)
+    err := c.withAddrRwWrite(addr, func(rw *bufio.ReadWriter) error {
+        if _, err := fmt.Fprintf(rw, "stats\r\n"); err != nil {
+            return err
+        }
+        if err := rw.Flush(); err != nil {
+            return err
+        }
+        if err := parseStatsResponse(rw.Reader, generalStats); err != nil {
+            return err
+        }
+        return writeExpectf(rw, resultReset, "stats reset\r\n")
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    return generalStats, nil
+}
+
+// EvictionRisk scores, for each slab class of the server at addr, how
+// likely storing more items of that class is to evict others, from 0
+// (no risk) to 1. The score is the average of two ratios:
+//
+//   - fullness: the fraction of the class's chunks in use, that is
+//     1 - (free_chunks + free_chunks_end) / total_chunks;
+//   - eviction pressure: evicted / (evicted + number), the share of
+//     the items that went through the class and were evicted rather
+//     than still being held.
+//
+// A class that is full and has been evicting scores close to 1; a class
+// that has free chunks and has never evicted scores close to 0.
+func (c *Client) EvictionRisk(addr net.Addr) (map[int]float64, error) {
+    slabs, err := c.StatsSlabs(addr)
+    if err != nil {
+        return nil, err
+    }
+    items, err := c.StatsItems(addr)
+    if err != nil {
+        return nil, err
+    }
+    risk := make(map[int]float64, len(slabs))
+    for id, slab := range slabs {
+        var fullness, pressure float64
+        if slab.TotalChunks > 0 {
+            free := slab.FreeChunks + slab.FreeChunksEnd
+            if free > slab.TotalChunks {
+                free = slab.TotalChunks
+            }
+            fullness = 1 - float64(free)/float64(slab.TotalChunks)
+        }
+        if it := items[id]; it != nil && it.Evicted+it.Number > 0 {
+            pressure = float64(it.Evicted) / float64(it.Evicted+it.Number)
+        }
+        risk[id] = (fullness + pressure) / 2
+    }
+    return risk, nil
+}
+
+const (
+    // slabItemHeaderSize is the size of memcached's per-item header on
+    // 64-bit builds, which the smallest slab class is sized to hold in
+    // addition to the chunk_size setting.
+    slabItemHeaderSize = 48
+
+    // slabChunkAlign is the alignment of slab class chunk sizes.
+    slabChunkAlign = 8
+
+    // maxSlabClasses is the number of slab classes memcached supports.
+    maxSlabClasses = 63
+)
+
+// SlabFit reports which slab class of the server at addr an item of
+// itemSize bytes would be stored in, the chunk size of that class and
+// how many bytes of the chunk would be wasted. The classes are derived
+// from the server's growth factor, chunk size and maximum item size the
+// way memcached lays them out at startup. itemSize should include the
+// item's overhead: its key, flags and a header of about 50 bytes.
+func (c *Client) SlabFit(addr net.Addr, itemSize int) (classID int, chunkSize int, waste int, err error) {
+    settings, err := c.StatsSettings(addr)
+    if err != nil {
+        return 0, 0, 0, err
+    }
+    for i, size := range slabClassSizes(settings) {
+        if itemSize <= size {
+            return i + 1, size, size - itemSize, nil
+        }
+    }
+    return 0, 0, 0, fmt.Errorf("memcache: item of %d bytes exceeds the server's maximum item size %d",
+        itemSize, settings.ItemSizeMax)
+}
+
+// RecommendGrowthFactor suggests a slab growth factor (memcached's -f
+// option) for the server at addr, based on the sizes of the items it
+// currently stores as reported by StatsSizes. It tries factors from
+// 1.05 to 2 and returns the one whose slab classes would waste the
+// fewest bytes storing those items, keeping the server's other
+// settings. The result is advisory: it ignores how items are spread
+// over slab pages, and a workload whose sizes shift will be served
+// less well by a factor tuned too closely to the current mix.
+func (c *Client) RecommendGrowthFactor(addr net.Addr) (float64, error) {
+    settings, err := c.StatsSettings(addr)
+    if err != nil {
+        return 0, err
+    }
+    sizes, err := c.StatsSizes(addr)
+    if err != nil {
+        return 0, err
+    }
+    if len(sizes) == 0 {
+        return 0, errors.New("memcache: server reports no item sizes")
+    }
+    best, bestWaste := 0.0, uint64(0)
+    for f := 105; f <= 200; f++ {
+        s := *settings
+        s.GrowthFactor = float64(f) / 100
+        if waste := slabWaste(&s, sizes); best == 0 || waste < bestWaste {
+            best, bestWaste = s.GrowthFactor, waste
+        }
+    }
+    return best, nil
+}
+
+// slabWaste returns the bytes that the slab classes for settings would
+// waste storing items of the given sizes, keyed by size with their
+// counts. Items too large for any class are ignored.
+func slabWaste(settings *SettingsStats, sizes map[int]uint64) uint64 {
+    classes := slabClassSizes(settings)
+    var waste uint64
+    for size, n := range sizes {
+        for _, chunk := range classes {
+            if size <= chunk {
+                waste += uint64(chunk-size) * n
+                break
+            }
+        }
+    }
+    return waste
+}
+
+// slabClassSizes returns the chunk sizes of the slab classes, smallest
+// first, that memcached creates for the given settings.
+func slabClassSizes(settings *SettingsStats) []int {
+    factor := settings.GrowthFactor
+    if factor <= 1 {
+        factor = 1.25
+    }
+    max := int(settings.ItemSizeMax)
+    var sizes []int
+    size := slabItemHeaderSize + int(settings.ChunkSize)
+    for len(sizes) < maxSlabClasses-1 && float64(size) <= float64(max)/factor {
+        if size%slabChunkAlign != 0 {
+            size += slabChunkAlign - size%slabChunkAlign
+        }
+        sizes = append(sizes, size)
+        size = int(float64(size) * factor)
+    }
+    return append(sizes, max)
+}
@@ -18,15 +18,21 @@ limitations under the License.
 package memcache
 
 import (
+    "bufio"
+    "context"
     "fmt"
     "net"
     "os"
     "os/exec"
     "bytes"
     "strings"
+    "sync"
+    "sync/atomic"
+    "syscall"
     "testing"
     "time"
     "encoding/json"
+    "errors"
 )
 
 const testServer = "localhost:11211"
@@ -175,7 +181,7 @@ func testWithClient(t *testing.T, c *Client) {
         if err != nil {
             t.Fatalf("failed to stats %s: %v", addr, err)
         } else if jsonStr, err := json.Marshal(stats); err == nil {
-            t.Logf(string(jsonStr))
+            t.Logf("%s", jsonStr)
         }
     }
 
@@ -185,7 +191,7 @@ func testWithClient(t *testing.T, c *Client) {
         if err != nil {
             t.Fatalf("failed to stats settings %s: %v", addr, err)
         } else if jsonStr, err := json.Marshal(settings); err == nil {
-            t.Logf(string(jsonStr))
+            t.Logf("%s", jsonStr)
         }
     }
 
@@ -218,3 +224,2974 @@ func testWithClient(t *testing.T, c *Client) {
     }
 
 }
+
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string   { return "i/o timeout" }
+func (timeoutErr) Timeout() bool   { return true }
+func (timeoutErr) Temporary() bool { return true }
+
+func TestErrorClassification(t *testing.T) {
+    wrap := func(err error) error {
+        return fmt.Errorf("memcache: retry failed: %w", err)
+    }
+    tests := []struct {
+        name string
+        fn   func(error) bool
+        err  error
+        want bool
+    }{
+        {"IsCacheMiss", IsCacheMiss, ErrCacheMiss, true},
+        {"IsCacheMiss wrapped", IsCacheMiss, wrap(ErrCacheMiss), true},
+        {"IsCacheMiss other", IsCacheMiss, ErrNotStored, false},
+        {"IsCacheMiss nil", IsCacheMiss, nil, false},
+        {"IsCASConflict", IsCASConflict, ErrCASConflict, true},
+        {"IsCASConflict wrapped", IsCASConflict, wrap(ErrCASConflict), true},
+        {"IsCASConflict other", IsCASConflict, ErrCacheMiss, false},
+        {"IsNotStored", IsNotStored, ErrNotStored, true},
+        {"IsNotStored wrapped", IsNotStored, wrap(wrap(ErrNotStored)), true},
+        {"IsNotStored other", IsNotStored, ErrCASConflict, false},
+        {"IsTimeout connect", IsTimeout, &ConnectTimeoutError{&net.TCPAddr{}}, true},
+        {"IsTimeout connect wrapped", IsTimeout, wrap(&ConnectTimeoutError{&net.TCPAddr{}}), true},
+        {"IsTimeout net", IsTimeout, &net.OpError{Op: "read", Err: timeoutErr{}}, true},
+        {"IsTimeout net wrapped", IsTimeout, wrap(&net.OpError{Op: "read", Err: timeoutErr{}}), true},
+        {"IsTimeout other", IsTimeout, ErrCacheMiss, false},
+        {"IsTimeout nil", IsTimeout, nil, false},
+    }
+    for _, tt := range tests {
+        if got := tt.fn(tt.err); got != tt.want {
+            t.Errorf("%s(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+        }
+    }
+}
+
+// waitForConnWaiters blocks until n goroutines are queued for a
+// connection to addr.
+func waitForConnWaiters(t *testing.T, c *Client, addr net.Addr, n int) {
+    deadline := time.Now().Add(5 * time.Second)
+    for time.Now().Before(deadline) {
+        c.lk.Lock()
+        got := len(c.connReqs[addr.String()])
+        c.lk.Unlock()
+        if got >= n {
+            return
+        }
+        time.Sleep(time.Millisecond)
+    }
+    t.Fatalf("timed out waiting for %d connection waiters", n)
+}
+
+func TestMaxOpenConnsFIFO(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    c.MaxOpenConns = 1
+    addr, _ := c.selector.PickServer("")
+
+    held, err := c.getConn(context.Background(), addr)
+    if err != nil {
+        t.Fatalf("getConn: %v", err)
+    }
+
+    const waiters = 20
+    var (
+        mu    sync.Mutex
+        order []int
+        wg    sync.WaitGroup
+    )
+    for i := 0; i < waiters; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            cn, err := c.getConn(context.Background(), addr)
+            if err != nil {
+                t.Errorf("waiter %d: getConn: %v", i, err)
+                return
+            }
+            mu.Lock()
+            order = append(order, i)
+            mu.Unlock()
+            cn.release()
+        }(i)
+        waitForConnWaiters(t, c, addr, i+1)
+    }
+    held.release()
+    wg.Wait()
+
+    for i, got := range order {
+        if got != i {
+            t.Fatalf("waiters served out of order: %v", order)
+        }
+    }
+    if g := fs.numDials(); g != 1 {
+        t.Errorf("dials = %d, want 1", g)
+    }
+}
+
+func TestMaxOpenConnsNoStarvation(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    c.MaxOpenConns = 2
+    if err := c.Set(&Item{Key: "foo", Value: []byte("fooval")}); err != nil {
+        t.Fatalf("Set: %v", err)
+    }
+
+    var wg sync.WaitGroup
+    for i := 0; i < 50; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for j := 0; j < 20; j++ {
+                if _, err := c.Get("foo"); err != nil {
+                    t.Errorf("Get: %v", err)
+                    return
+                }
+            }
+        }()
+    }
+    done := make(chan bool)
+    go func() {
+        wg.Wait()
+        close(done)
+    }()
+    select {
+    case <-done:
+    case <-time.After(10 * time.Second):
+        t.Fatal("goroutines starved waiting for a connection")
+    }
+    if g := fs.numDials(); g > c.MaxOpenConns {
+        t.Errorf("dials = %d, want at most %d", g, c.MaxOpenConns)
+    }
+}
+
+func TestMaxOpenConnsWaitCancel(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    c.MaxOpenConns = 1
+    addr, _ := c.selector.PickServer("")
+
+    held, err := c.getConn(context.Background(), addr)
+    if err != nil {
+        t.Fatalf("getConn: %v", err)
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+    defer cancel()
+    if _, err := c.getConn(ctx, addr); err != context.DeadlineExceeded {
+        t.Fatalf("getConn with expired context = %v, want %v", err, context.DeadlineExceeded)
+    }
+    c.lk.Lock()
+    n := len(c.connReqs[addr.String()])
+    c.lk.Unlock()
+    if n != 0 {
+        t.Errorf("cancelled waiter still queued; %d waiters", n)
+    }
+    held.release()
+    if cn, err := c.getConn(context.Background(), addr); err != nil {
+        t.Errorf("getConn after release: %v", err)
+    } else {
+        cn.release()
+    }
+}
+
+func TestAcquireTimeout(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    c.MaxOpenConns = 1
+    c.AcquireTimeout = 20 * time.Millisecond
+    c.Timeout = time.Second
+    addr, _ := c.selector.PickServer("")
+
+    held, err := c.getConn(context.Background(), addr)
+    if err != nil {
+        t.Fatalf("getConn: %v", err)
+    }
+    start := time.Now()
+    if _, err := c.Get("k"); err != ErrAcquireTimeout {
+        t.Fatalf("Get with saturated pool = %v, want ErrAcquireTimeout", err)
+    }
+    if d := time.Since(start); d >= c.Timeout {
+        t.Errorf("Get waited %v; want AcquireTimeout, not Timeout, to apply", d)
+    }
+    c.lk.Lock()
+    n := len(c.connReqs[addr.String()])
+    c.lk.Unlock()
+    if n != 0 {
+        t.Errorf("timed out waiter still queued; %d waiters", n)
+    }
+
+    held.release()
+    if _, err := c.Get("k"); err != ErrCacheMiss {
+        t.Errorf("Get after release = %v, want ErrCacheMiss", err)
+    }
+}
+
+func TestDisableCAS(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    c.DisableCAS = true
+    if err := c.Set(&Item{Key: "foo", Value: []byte("fooval"), Flags: 7}); err != nil {
+        t.Fatalf("Set: %v", err)
+    }
+    it, err := c.Get("foo")
+    if err != nil {
+        t.Fatalf("Get: %v", err)
+    }
+    if string(it.Value) != "fooval" || it.Flags != 7 || it.casid != 0 {
+        t.Errorf("Get = %q flags %d casid %d, want \"fooval\" flags 7 casid 0", it.Value, it.Flags, it.casid)
+    }
+    m, err := c.GetMulti([]string{"foo", "bar"})
+    if err != nil {
+        t.Fatalf("GetMulti: %v", err)
+    }
+    if len(m) != 1 || string(m["foo"].Value) != "fooval" {
+        t.Errorf("GetMulti = %v, want only foo", m)
+    }
+    cmds := fs.commands()
+    if g, e := cmds[1], "get foo"; g != e {
+        t.Errorf("Get sent %q, want %q", g, e)
+    }
+    if g, e := cmds[2], "get foo bar"; g != e {
+        t.Errorf("GetMulti sent %q, want %q", g, e)
+    }
+
+    c.DisableCAS = false
+    if _, err := c.Get("foo"); err != nil {
+        t.Fatalf("Get: %v", err)
+    }
+    if g, e := fs.commands()[3], "gets foo"; g != e {
+        t.Errorf("default Get sent %q, want %q", g, e)
+    }
+}
+
+func TestSetSameValue(t *testing.T) {
+    fs1, fs2 := newFakeServer(t), newFakeServer(t)
+    c := New(fs1.Addr(), fs2.Addr())
+
+    keys := []string{"flag:a", "flag:b", "flag:c", "flag:d", "flag:e", "flag:f", "bad key"}
+    errs := c.SetSameValue(keys, []byte("on"), 3, 0)
+    if len(errs) != 1 || errs["bad key"] != ErrMalformedKey {
+        t.Fatalf("SetSameValue errors = %v, want only ErrMalformedKey for %q", errs, "bad key")
+    }
+    var wantBytes uint64
+    for _, key := range keys[:len(keys)-1] {
+        wantBytes += uint64(len("set " + key + " 3 0 2\r\non\r\n"))
+    }
+    if m := c.Metrics(); m.Sets != 6 || m.BytesWritten != wantBytes {
+        t.Errorf("Metrics Sets, BytesWritten = %d, %d; want 6, %d", m.Sets, m.BytesWritten, wantBytes)
+    }
+    for _, key := range keys[:len(keys)-1] {
+        it, err := c.Get(key)
+        if err != nil {
+            t.Fatalf("Get(%q): %v", key, err)
+        }
+        if string(it.Value) != "on" || it.Flags != 3 {
+            t.Errorf("Get(%q) = %q flags %d, want \"on\" flags 3", key, it.Value, it.Flags)
+        }
+    }
+    for i, fs := range []*fakeServer{fs1, fs2} {
+        fs.mu.Lock()
+        n := len(fs.items)
+        fs.mu.Unlock()
+        if n == 0 {
+            t.Errorf("server %d received no keys", i)
+        }
+    }
+}
+
+func TestConnHealthHooks(t *testing.T) {
+    fs := newFakeServer(t)
+    fs.handler = func(line string, rw *bufio.ReadWriter) bool {
+        if line == "gets garbled" {
+            rw.WriteString("GARBAGE\r\n")
+            return true
+        }
+        return false
+    }
+
+    type dialEvent struct {
+        addr string
+        err  error
+    }
+    var (
+        mu     sync.Mutex
+        dials  []dialEvent
+        closes []string
+    )
+    hooked := func(c *Client) *Client {
+        c.OnDial = func(addr net.Addr, err error, d time.Duration) {
+            mu.Lock()
+            defer mu.Unlock()
+            dials = append(dials, dialEvent{addr.String(), err})
+        }
+        c.OnConnClose = func(addr net.Addr, reason string) {
+            mu.Lock()
+            defer mu.Unlock()
+            closes = append(closes, reason)
+        }
+        return c
+    }
+
+    c := hooked(New(fs.Addr()))
+    if _, err := c.Get("foo"); err != ErrCacheMiss {
+        t.Fatalf("Get(foo) = %v, want ErrCacheMiss", err)
+    }
+    if len(dials) != 1 || dials[0].addr != fs.Addr() || dials[0].err != nil {
+        t.Fatalf("dial events after successful dial = %v", dials)
+    }
+    if len(closes) != 0 {
+        t.Fatalf("connection closed after cache miss: %v", closes)
+    }
+
+    if _, err := c.Get("garbled"); err == nil {
+        t.Fatal("Get(garbled) succeeded, want protocol error")
+    }
+    if len(closes) != 1 || !strings.Contains(closes[0], "unexpected line") {
+        t.Fatalf("close reasons = %q, want one mentioning the protocol error", closes)
+    }
+
+    // Find an address with nothing listening on it.
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    deadAddr := ln.Addr().String()
+    ln.Close()
+    dials = nil
+    c = hooked(New(deadAddr))
+    if _, err := c.Get("foo"); err == nil {
+        t.Fatal("Get against closed port succeeded")
+    }
+    if len(dials) != 1 || dials[0].err == nil {
+        t.Fatalf("dial events after failed dial = %v, want one with an error", dials)
+    }
+}
+
+func TestGetMultiFirst(t *testing.T) {
+    fs1, fs2 := newFakeServer(t), newFakeServer(t)
+    c1, c2 := New(fs1.Addr()), New(fs2.Addr())
+    for _, key := range []string{"a", "b", "c"} {
+        if err := c1.Set(&Item{Key: key, Value: []byte("v1-" + key)}); err != nil {
+            t.Fatal(err)
+        }
+        if err := c2.Set(&Item{Key: key, Value: []byte("v2-" + key)}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := c2.Set(&Item{Key: "d", Value: []byte("v2-d")}); err != nil {
+        t.Fatal(err)
+    }
+
+    c := New(fs1.Addr(), fs2.Addr())
+    m, err := c.GetMultiFirst([]string{"a", "b", "c"})
+    if err != nil {
+        t.Fatalf("GetMultiFirst: %v", err)
+    }
+    if len(m) != 3 || string(m["b"].Value) != "v1-b" {
+        t.Errorf("GetMultiFirst = %v, want all keys from the first server", m)
+    }
+    for _, cmd := range fs2.commands() {
+        if strings.HasPrefix(cmd, "get") {
+            t.Errorf("second server was queried (%q) although the first had every key", cmd)
+        }
+    }
+
+    m, err = c.GetMultiFirst([]string{"a", "d"})
+    if err != nil {
+        t.Fatalf("GetMultiFirst: %v", err)
+    }
+    if string(m["a"].Value) != "v1-a" || string(m["d"].Value) != "v2-d" {
+        t.Errorf("GetMultiFirst = %v, want a from first server and d from second", m)
+    }
+    cmds := fs2.commands()
+    if g, e := cmds[len(cmds)-1], "gets d"; g != e {
+        t.Errorf("second server got %q, want %q", g, e)
+    }
+}
+
+func TestLenientLineEndings(t *testing.T) {
+    const resp = "VALUE foo 0 3\r\nbar\nVALUE baz 0 3 9\r\nqux\r\nEND\r\n"
+    parse := func(c *Client) (map[string]string, error) {
+        m := make(map[string]string)
+        err := c.parseGetResponse(bufio.NewReader(strings.NewReader(resp)), 2, func(it *Item) {
+            m[it.Key] = string(it.Value)
+        })
+        return m, err
+    }
+
+    if _, err := parse(&Client{}); err == nil || !strings.Contains(err.Error(), "corrupt") {
+        t.Errorf("strict parse error = %v, want corrupt get result", err)
+    }
+
+    m, err := parse(&Client{LenientLineEndings: true})
+    if err != nil {
+        t.Fatalf("lenient parse: %v", err)
+    }
+    if m["foo"] != "bar" || m["baz"] != "qux" {
+        t.Errorf("lenient parse = %v, want foo=bar baz=qux", m)
+    }
+}
+
+func TestSingleFlight(t *testing.T) {
+    const callers = 20
+    fs := newFakeServer(t)
+    seen := make(chan struct{}, callers)
+    release := make(chan struct{})
+    fs.handler = func(line string, rw *bufio.ReadWriter) bool {
+        if line == "gets foo" {
+            seen <- struct{}{}
+            <-release
+        }
+        return false
+    }
+    c := New(fs.Addr())
+    c.SingleFlight = true
+
+    var wg sync.WaitGroup
+    errs := make(chan error, callers)
+    for i := 0; i < callers; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            _, err := c.Get("foo")
+            errs <- err
+        }()
+    }
+    // Hold the server's answer until the request has arrived and every
+    // other caller is waiting on the shared flight.
+    <-seen
+    waitFor(t, func() bool {
+        c.flightLk.Lock()
+        defer c.flightLk.Unlock()
+        f := c.flights["foo"]
+        return f != nil && f.waiters == callers-1
+    })
+    close(release)
+    wg.Wait()
+    close(errs)
+    for err := range errs {
+        if err != ErrCacheMiss {
+            t.Errorf("Get = %v, want ErrCacheMiss", err)
+        }
+    }
+    if n := len(fs.commands()); n != 1 {
+        t.Errorf("server saw %d requests, want 1", n)
+    }
+
+    c.flightLk.Lock()
+    n := len(c.flights)
+    c.flightLk.Unlock()
+    if n != 0 {
+        t.Errorf("%d flights left after completion", n)
+    }
+
+    if err := c.Set(&Item{Key: "foo", Value: []byte("fooval")}); err != nil {
+        t.Fatal(err)
+    }
+    it, err := c.Get("foo")
+    if err != nil || string(it.Value) != "fooval" {
+        t.Errorf("Get after Set = %v, %v", it, err)
+    }
+}
+
+func TestProbeMaxValueSize(t *testing.T) {
+    for _, limit := range []int{1, 1000, 1024, 5000, 70001} {
+        fs := newFakeServer(t)
+        fs.maxValueSize = limit
+        c := New(fs.Addr())
+        c.Compression = CompressionGzip
+        addr, _ := c.selector.PickServer("")
+        got, err := c.ProbeMaxValueSize(addr)
+        if err != nil {
+            t.Fatalf("limit %d: ProbeMaxValueSize: %v", limit, err)
+        }
+        if got != limit {
+            t.Errorf("ProbeMaxValueSize = %d, want %d", got, limit)
+        }
+        fs.mu.Lock()
+        n := len(fs.items)
+        fs.mu.Unlock()
+        if n != 0 {
+            t.Errorf("limit %d: probe left %d items behind", limit, n)
+        }
+    }
+}
+
+type countingConn struct {
+    net.Conn
+    mu      sync.Mutex
+    read    int
+    written int
+}
+
+func (cc *countingConn) Read(p []byte) (int, error) {
+    n, err := cc.Conn.Read(p)
+    cc.mu.Lock()
+    cc.read += n
+    cc.mu.Unlock()
+    return n, err
+}
+
+func (cc *countingConn) Write(p []byte) (int, error) {
+    n, err := cc.Conn.Write(p)
+    cc.mu.Lock()
+    cc.written += n
+    cc.mu.Unlock()
+    return n, err
+}
+
+func TestWrapConn(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    var wrapped []*countingConn
+    c.WrapConn = func(nc net.Conn) net.Conn {
+        cc := &countingConn{Conn: nc}
+        wrapped = append(wrapped, cc)
+        return cc
+    }
+
+    if err := c.Set(&Item{Key: "foo", Value: []byte("fooval")}); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := c.Get("foo"); err != nil {
+        t.Fatal(err)
+    }
+    if len(wrapped) != 1 {
+        t.Fatalf("WrapConn called %d times, want 1", len(wrapped))
+    }
+    cc := wrapped[0]
+    wantWritten := len("set foo 0 0 6\r\nfooval\r\n") + len("gets foo\r\n")
+    wantRead := len("STORED\r\n") + len("VALUE foo 0 6 1\r\nfooval\r\nEND\r\n")
+    cc.mu.Lock()
+    defer cc.mu.Unlock()
+    if cc.written != wantWritten {
+        t.Errorf("bytes written = %d, want %d", cc.written, wantWritten)
+    }
+    if cc.read != wantRead {
+        t.Errorf("bytes read = %d, want %d", cc.read, wantRead)
+    }
+}
+
+// repeatReader yields its line over and over, forever.
+type repeatReader struct {
+    line string
+    off  int
+}
+
+func (rr *repeatReader) Read(p []byte) (int, error) {
+    n := 0
+    for n < len(p) {
+        c := copy(p[n:], rr.line[rr.off:])
+        n += c
+        rr.off = (rr.off + c) % len(rr.line)
+    }
+    return n, nil
+}
+
+func TestUnterminatedResponses(t *testing.T) {
+    c := &Client{}
+    r := bufio.NewReader(&repeatReader{line: "VALUE foo 0 3\r\nbar\r\n"})
+    items := 0
+    err := c.parseGetResponse(r, 3, func(*Item) { items++ })
+    if err != ErrResponseTooLong {
+        t.Errorf("unterminated get response: err = %v, want ErrResponseTooLong", err)
+    }
+    if items != 3 {
+        t.Errorf("unterminated get response: got %d items before giving up, want 3", items)
+    }
+
+    r = bufio.NewReader(&repeatReader{line: "STAT pid 1\r\n"})
+    if err := parseStatsResponse(r, new(GeneralStats)); err != ErrResponseTooLong {
+        t.Errorf("unterminated stats response: err = %v, want ErrResponseTooLong", err)
+    }
+    r = bufio.NewReader(&repeatReader{line: "STAT items:1:number 1\r\n"})
+    if err := parseStatsItemsResponse(r, make(map[int]*ItemStats)); err != ErrResponseTooLong {
+        t.Errorf("unterminated stats items response: err = %v, want ErrResponseTooLong", err)
+    }
+}
+
+func TestServerHangupMidResponse(t *testing.T) {
+    fs := newFakeServer(t)
+    fs.hangup = true
+    fs.handler = func(line string, rw *bufio.ReadWriter) bool {
+        switch line {
+        case "gets value":
+            rw.WriteString("VALUE value 0 10\r\nabc")
+        case "gets line":
+            rw.WriteString("VALUE li")
+        default:
+            return false
+        }
+        return true
+    }
+    c := New(fs.Addr())
+    addr, _ := c.selector.PickServer("")
+
+    for i, key := range []string{"value", "line"} {
+        _, err := c.Get(key)
+        if err != ErrUnexpectedEOF {
+            t.Errorf("Get(%q) = %v, want ErrUnexpectedEOF", key, err)
+        }
+        c.lk.Lock()
+        pooled := len(c.freeconn[addr.String()])
+        c.lk.Unlock()
+        if pooled != 0 {
+            t.Errorf("connection pooled after server hung up")
+        }
+        if g, e := fs.numDials(), i+1; g != e {
+            t.Errorf("dials = %d, want %d", g, e)
+        }
+    }
+}
+
+func TestMaxConcurrentDials(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    c.MaxConcurrentDials = 2
+
+    // OnDial runs before the dial is counted as finished, so slowing it
+    // down stretches every dial and makes concurrent ones overlap.
+    var mu sync.Mutex
+    inflight, peak := 0, 0
+    c.OnDial = func(addr net.Addr, err error, d time.Duration) {
+        mu.Lock()
+        inflight++
+        if inflight > peak {
+            peak = inflight
+        }
+        mu.Unlock()
+        time.Sleep(20 * time.Millisecond)
+        mu.Lock()
+        inflight--
+        mu.Unlock()
+    }
+
+    var wg sync.WaitGroup
+    for i := 0; i < 50; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            if _, err := c.Get("foo"); err != ErrCacheMiss {
+                t.Errorf("Get = %v, want ErrCacheMiss", err)
+            }
+        }()
+    }
+    wg.Wait()
+
+    if peak > c.MaxConcurrentDials {
+        t.Errorf("peak concurrent dials = %d, want at most %d", peak, c.MaxConcurrentDials)
+    }
+    if n := fs.numDials(); n >= 50 {
+        t.Errorf("%d dials for 50 requests; want connections to be shared", n)
+    }
+}
+
+func TestGetRange(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    value := make([]byte, 100000)
+    for i := range value {
+        value[i] = byte(i % 251)
+    }
+    if err := c.Set(&Item{Key: "blob", Value: value}); err != nil {
+        t.Fatal(err)
+    }
+
+    got, err := c.GetRange("blob", 40000, 1234)
+    if err != nil {
+        t.Fatalf("GetRange: %v", err)
+    }
+    if !bytes.Equal(got, value[40000:41234]) {
+        t.Errorf("GetRange returned the wrong bytes")
+    }
+    if got, err := c.GetRange("blob", 99990, 10); err != nil || !bytes.Equal(got, value[99990:]) {
+        t.Errorf("GetRange of tail = %v, %v", got, err)
+    }
+    if got, err := c.GetRange("blob", 0, 0); err != nil || len(got) != 0 {
+        t.Errorf("GetRange of empty range = %v, %v", got, err)
+    }
+
+    for _, r := range [][2]int{{99990, 11}, {100001, 0}, {-1, 5}, {5, -1}} {
+        if _, err := c.GetRange("blob", r[0], r[1]); err != ErrInvalidRange {
+            t.Errorf("GetRange(%d, %d) = %v, want ErrInvalidRange", r[0], r[1], err)
+        }
+    }
+    if _, err := c.GetRange("missing", 0, 1); err != ErrCacheMiss {
+        t.Errorf("GetRange(missing) = %v, want ErrCacheMiss", err)
+    }
+    if n := fs.numDials(); n != 1 {
+        t.Errorf("dials = %d, want 1; out-of-range reads should leave the connection usable", n)
+    }
+}
+
+func TestDefaultExpiration(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    c.DefaultExpiration = 300
+
+    for _, it := range []*Item{
+        {Key: "default", Value: []byte("v")},
+        {Key: "explicit", Value: []byte("v"), Expiration: 60},
+        {Key: "forever", Value: []byte("v"), Expiration: NoExpiration},
+    } {
+        if err := c.Set(it); err != nil {
+            t.Fatalf("Set(%q): %v", it.Key, err)
+        }
+    }
+    c.SetSameValue([]string{"same"}, []byte("v"), 0, 0)
+    c.NewBatch().Add(&Item{Key: "batched", Value: []byte("v")}).Exec()
+
+    want := []string{
+        "set default 0 300 1",
+        "set explicit 0 60 1",
+        "set forever 0 0 1",
+        "set same 0 300 1",
+        "add batched 0 300 1",
+    }
+    var got []string
+    for _, cmd := range fs.commands() {
+        if strings.HasPrefix(cmd, "set ") || strings.HasPrefix(cmd, "add ") {
+            got = append(got, cmd)
+        }
+    }
+    if strings.Join(got, "\n") != strings.Join(want, "\n") {
+        t.Errorf("storage commands = %q, want %q", got, want)
+    }
+}
+
+type deadlineCountingConn struct {
+    net.Conn
+    calls int
+}
+
+func (dc *deadlineCountingConn) SetDeadline(t time.Time) error {
+    dc.calls++
+    return nil
+}
+
+func TestExtendDeadlineSkipsRedundantCalls(t *testing.T) {
+    dc := &deadlineCountingConn{}
+    cn := &conn{nc: dc, c: &Client{Timeout: time.Hour}}
+    for i := 0; i < 100; i++ {
+        cn.extendDeadline()
+    }
+    if dc.calls != 1 {
+        t.Errorf("SetDeadline called %d times for 100 back-to-back extensions, want 1", dc.calls)
+    }
+
+    // A shorter timeout brings the deadline forward and must be applied.
+    cn.c.Timeout = time.Minute
+    cn.extendDeadline()
+    if dc.calls != 2 {
+        t.Errorf("SetDeadline not called after shortening the timeout")
+    }
+}
+
+func (dc *deadlineCountingConn) SetReadDeadline(t time.Time) error {
+    dc.calls++
+    return nil
+}
+
+func (dc *deadlineCountingConn) SetWriteDeadline(t time.Time) error {
+    dc.calls++
+    return nil
+}
+
+func TestExtendDeadlineSeparateTimeouts(t *testing.T) {
+    dc := &deadlineCountingConn{}
+    cn := &conn{nc: dc, c: &Client{Timeout: time.Hour, WriteTimeout: time.Minute}}
+    start := time.Now()
+    for i := 0; i < 100; i++ {
+        cn.extendDeadline()
+    }
+    if dc.calls != 2 {
+        t.Errorf("deadline set %d times for 100 back-to-back extensions, want 2", dc.calls)
+    }
+    if d := cn.readDeadline.Sub(start); d < time.Hour || d > time.Hour+time.Minute {
+        t.Errorf("read deadline %v from now, want the 1h Timeout", d)
+    }
+    if d := cn.writeDeadline.Sub(start); d < time.Minute || d > 2*time.Minute {
+        t.Errorf("write deadline %v from now, want the 1m WriteTimeout", d)
+    }
+}
+
+func TestReadAndConnectTimeouts(t *testing.T) {
+    fs := newFakeServer(t)
+    fs.handler = func(line string, rw *bufio.ReadWriter) bool {
+        if line == "gets slow" {
+            time.Sleep(500 * time.Millisecond)
+            return true
+        }
+        return false
+    }
+    c := New(fs.Addr())
+    c.Timeout = time.Hour
+    c.ReadTimeout = 50 * time.Millisecond
+    start := time.Now()
+    if _, err := c.Get("slow"); !IsTimeout(err) {
+        t.Fatalf("Get(slow) = %v, want a timeout", err)
+    }
+    if d := time.Since(start); d > 300*time.Millisecond {
+        t.Errorf("Get(slow) took %v to time out with a 50ms ReadTimeout", d)
+    }
+
+    c = New(fs.Addr())
+    c.Timeout = time.Hour
+    c.ConnectTimeout = 50 * time.Millisecond
+    c.DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+        <-ctx.Done()
+        return nil, ctx.Err()
+    }
+    start = time.Now()
+    var cte *ConnectTimeoutError
+    if _, err := c.Get("k"); !errors.As(err, &cte) {
+        t.Fatalf("Get with a hanging dial = %v, want a ConnectTimeoutError", err)
+    }
+    if d := time.Since(start); d > 300*time.Millisecond {
+        t.Errorf("dial took %v to time out with a 50ms ConnectTimeout", d)
+    }
+}
+
+func TestDeadlineStillFires(t *testing.T) {
+    fs := newFakeServer(t)
+    fs.handler = func(line string, rw *bufio.ReadWriter) bool {
+        if line == "gets slow" {
+            time.Sleep(500 * time.Millisecond)
+            return true
+        }
+        return false
+    }
+    c := New(fs.Addr())
+    c.Timeout = 50 * time.Millisecond
+    for i := 0; i < 10; i++ {
+        if _, err := c.Get("fast"); err != ErrCacheMiss {
+            t.Fatalf("Get(fast) = %v", err)
+        }
+    }
+    start := time.Now()
+    _, err := c.Get("slow")
+    if !IsTimeout(err) {
+        t.Fatalf("Get(slow) = %v, want a timeout", err)
+    }
+    if d := time.Since(start); d > 200*time.Millisecond {
+        t.Errorf("Get(slow) took %v to time out with a 50ms timeout", d)
+    }
+}
+
+func BenchmarkExtendDeadline(b *testing.B) {
+    dc := &deadlineCountingConn{}
+    cn := &conn{nc: dc, c: &Client{}}
+    for i := 0; i < b.N; i++ {
+        cn.extendDeadline()
+    }
+    b.ReportMetric(float64(dc.calls)/float64(b.N), "SetDeadline/op")
+}
+
+func TestStaleOnError(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    c.StaleOnError = 3
+
+    if err := c.Set(&Item{Key: "set", Value: []byte("v1"), Flags: 7}); err != nil {
+        t.Fatal(err)
+    }
+    fs.mu.Lock()
+    fs.items["fetched"] = &fakeItem{value: []byte("v2"), setAt: time.Now()}
+    fs.mu.Unlock()
+    if _, err := c.Get("fetched"); err != nil {
+        t.Fatal(err)
+    }
+    if err := c.Set(&Item{Key: "deleted", Value: []byte("v3")}); err != nil {
+        t.Fatal(err)
+    }
+    if err := c.Delete("deleted"); err != nil {
+        t.Fatal(err)
+    }
+
+    fs.Close()
+    c.selector.(*ServerList).SetServers("127.0.0.1:1")
+
+    for key, want := range map[string]string{"set": "v1", "fetched": "v2"} {
+        it, err := c.Get(key)
+        if err != nil {
+            t.Fatalf("Get(%q) with server down: %v", key, err)
+        }
+        if !it.Stale || string(it.Value) != want {
+            t.Errorf("Get(%q) = %q, stale %v; want %q, stale", key, it.Value, it.Stale, want)
+        }
+    }
+    if it, _ := c.Get("set"); it.Flags != 7 {
+        t.Errorf("stale flags = %d, want 7", it.Flags)
+    }
+    if _, err := c.Get("deleted"); err == nil || IsCacheMiss(err) {
+        t.Errorf("Get of deleted key with server down = %v, want server error", err)
+    }
+}
+
+func TestStatsMulti(t *testing.T) {
+    var addrs []net.Addr
+    var release sync.WaitGroup
+    release.Add(1)
+    var started sync.WaitGroup
+    for i := 0; i < 3; i++ {
+        fs := newFakeServer(t)
+        fs.stats = map[string][]string{"": {fmt.Sprintf("pid %d", 100+i)}}
+        started.Add(1)
+        fs.handler = func(line string, rw *bufio.ReadWriter) bool {
+            if line == "stats " {
+                // Every server must be reached before any answers,
+                // which only happens if they are queried concurrently.
+                started.Done()
+                release.Wait()
+            }
+            return false
+        }
+        addr, _ := net.ResolveTCPAddr("tcp", fs.Addr())
+        addrs = append(addrs, addr)
+    }
+    go func() {
+        started.Wait()
+        release.Done()
+    }()
+    down, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:1")
+    addrs = append(addrs, down)
+
+    stats, errs := New().StatsMulti(addrs)
+    if len(stats) != 3 || len(errs) != 1 {
+        t.Fatalf("got %d stats and %d errors, want 3 and 1", len(stats), len(errs))
+    }
+    for i, addr := range addrs[:3] {
+        if s := stats[addr.String()]; s == nil || s.Pid != uint32(100+i) {
+            t.Errorf("stats for %v = %+v, want pid %d", addr, s, 100+i)
+        }
+    }
+    if errs[down.String()] == nil {
+        t.Errorf("no error for unreachable %v", down)
+    }
+}
+
+func TestVerifyWrites(t *testing.T) {
+    fs := newFakeServer(t)
+    fs.handler = func(line string, rw *bufio.ReadWriter) bool {
+        if !strings.HasPrefix(line, "set dropped ") {
+            return false
+        }
+        // Accept the write but forget it, as if evicted at once.
+        rw.ReadString('\n')
+        rw.WriteString("STORED\r\n")
+        return true
+    }
+    c := New(fs.Addr())
+    c.VerifyWrites = true
+
+    if err := c.Set(&Item{Key: "kept", Value: []byte("v")}); err != nil {
+        t.Errorf("Set(kept) = %v", err)
+    }
+    if err := c.Add(&Item{Key: "added", Value: []byte("v")}); err != nil {
+        t.Errorf("Add(added) = %v", err)
+    }
+    if err := c.Set(&Item{Key: "dropped", Value: []byte("v")}); err != ErrWriteVerifyFailed {
+        t.Errorf("Set(dropped) = %v, want ErrWriteVerifyFailed", err)
+    }
+
+    c.VerifyWrites = false
+    if err := c.Set(&Item{Key: "dropped", Value: []byte("v")}); err != nil {
+        t.Errorf("Set(dropped) without verify = %v", err)
+    }
+}
+
+// blockingGetServer returns a fake server whose responses to "get slow"
+// are held back until the returned release channel is closed. Each
+// such command is announced on the returned seen channel first.
+func blockingGetServer(t *testing.T) (fs *fakeServer, seen, release chan struct{}) {
+    fs = newFakeServer(t)
+    seen = make(chan struct{}, 10)
+    release = make(chan struct{})
+    fs.handler = func(line string, rw *bufio.ReadWriter) bool {
+        if strings.HasSuffix(line, " slow") {
+            seen <- struct{}{}
+            <-release
+        }
+        return false
+    }
+    return fs, seen, release
+}
+
+func TestShutdownWaitsForInFlight(t *testing.T) {
+    fs, seen, release := blockingGetServer(t)
+    c := New(fs.Addr())
+    c.Timeout = 5 * time.Second
+    if err := c.Set(&Item{Key: "slow", Value: []byte("v")}); err != nil {
+        t.Fatal(err)
+    }
+
+    getErr := make(chan error, 1)
+    go func() {
+        _, err := c.Get("slow")
+        getErr <- err
+    }()
+    <-seen
+
+    shutdownErr := make(chan error, 1)
+    go func() {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        shutdownErr <- c.Shutdown(ctx)
+    }()
+    select {
+    case err := <-shutdownErr:
+        t.Fatalf("Shutdown returned %v before the in-flight Get finished", err)
+    case <-time.After(50 * time.Millisecond):
+    }
+    if _, err := c.Get("other"); err != ErrClientClosed {
+        t.Errorf("Get during shutdown = %v, want ErrClientClosed", err)
+    }
+
+    close(release)
+    if err := <-getErr; err != nil {
+        t.Errorf("in-flight Get = %v", err)
+    }
+    if err := <-shutdownErr; err != nil {
+        t.Errorf("Shutdown = %v", err)
+    }
+}
+
+func TestShutdownAfterConnClosed(t *testing.T) {
+    fs := newFakeServer(t)
+    fs.hangup = true
+    fs.handler = func(line string, rw *bufio.ReadWriter) bool {
+        return true
+    }
+    c := New(fs.Addr())
+    if _, err := c.Get("k"); err == nil || err == ErrCacheMiss {
+        t.Fatalf("Get on a dropped connection = %v, want a network error", err)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+    defer cancel()
+    start := time.Now()
+    if err := c.Shutdown(ctx); err != nil {
+        t.Errorf("Shutdown with no open connections = %v", err)
+    }
+    if d := time.Since(start); d > 100*time.Millisecond {
+        t.Errorf("Shutdown with no open connections took %v", d)
+    }
+}
+
+func TestShutdownTimeoutForceCloses(t *testing.T) {
+    fs, seen, release := blockingGetServer(t)
+    defer close(release)
+    c := New(fs.Addr())
+    c.Timeout = 5 * time.Second
+
+    getErr := make(chan error, 1)
+    go func() {
+        _, err := c.Get("slow")
+        getErr <- err
+    }()
+    <-seen
+
+    ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+    defer cancel()
+    if err := c.Shutdown(ctx); err != context.DeadlineExceeded {
+        t.Errorf("Shutdown = %v, want context.DeadlineExceeded", err)
+    }
+    select {
+    case err := <-getErr:
+        if err == nil || IsCacheMiss(err) {
+            t.Errorf("force-closed Get = %v, want a connection error", err)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("in-flight Get was not interrupted by forced shutdown")
+    }
+}
+
+func TestStatsResetSnapshot(t *testing.T) {
+    fs := newFakeServer(t)
+    fs.stats = map[string][]string{"": {"get_hits 42", "cmd_get 50"}}
+    addr, _ := net.ResolveTCPAddr("tcp", fs.Addr())
+    c := New(fs.Addr())
+
+    snap, err := c.StatsResetSnapshot(addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if snap.GetHits != 42 || snap.CmdGet != 50 {
+        t.Errorf("snapshot = %d hits of %d gets, want 42 of 50", snap.GetHits, snap.CmdGet)
+    }
+    if g, e := strings.Join(fs.commands(), "; "), "stats; stats reset"; g != e {
+        t.Errorf("commands = %q, want %q", g, e)
+    }
+    after, err := c.Stats(addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if after.GetHits != 0 {
+        t.Errorf("GetHits after reset = %d, want 0", after.GetHits)
+    }
+    if err := c.StatsReset(addr); err != nil {
+        t.Errorf("StatsReset = %v", err)
+    }
+}
+
+func TestGetMultiSkipMalformed(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    for _, key := range []string{"a", "b"} {
+        if err := c.Set(&Item{Key: key, Value: []byte(key)}); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    keys := []string{"a", "bad key", "b", "missing", strings.Repeat("x", 251)}
+    if _, err := c.GetMulti(keys); err != ErrMalformedKey {
+        t.Fatalf("GetMulti = %v, want ErrMalformedKey", err)
+    }
+    items, badKeys, err := c.GetMultiSkipMalformed(keys)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(items) != 2 || items["a"] == nil || items["b"] == nil {
+        t.Errorf("items = %v, want a and b", items)
+    }
+    if len(badKeys) != 2 || badKeys["bad key"] != ErrMalformedKey || badKeys[keys[4]] != ErrMalformedKey {
+        t.Errorf("badKeys = %v, want the two malformed keys", badKeys)
+    }
+}
+
+func TestGetMultiStream(t *testing.T) {
+    fast := newFakeServer(t)
+    slow, seen, release := blockingGetServer(t)
+    ss := new(ServerList)
+    if err := ss.SetServers(fast.Addr(), slow.Addr()); err != nil {
+        t.Fatal(err)
+    }
+    c := NewFromSelector(ss)
+    c.Timeout = 5 * time.Second
+
+    // Find keys on the fast server; the slow server holds "slow".
+    var keys []string
+    for i := 0; len(keys) < 3; i++ {
+        key := fmt.Sprintf("k%d", i)
+        if addr, _ := ss.PickServer(key); addr.String() == fast.Addr() {
+            keys = append(keys, key)
+        }
+    }
+    if addr, _ := ss.PickServer("slow"); addr.String() != slow.Addr() {
+        t.Skip("key \"slow\" does not map to the slow server")
+    }
+    for _, key := range append(keys, "slow") {
+        if err := c.Set(&Item{Key: key, Value: []byte(key)}); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    items, errs := c.GetMultiStream(append(keys, "slow"))
+    <-seen
+    got := make(map[string]bool)
+    for len(got) < len(keys) {
+        select {
+        case it := <-items:
+            got[it.Key] = true
+        case <-time.After(time.Second):
+            t.Fatalf("fast server's items not streamed while slow server is stalled; got %v", got)
+        }
+    }
+    close(release)
+    for it := range items {
+        got[it.Key] = true
+    }
+    if len(got) != len(keys)+1 || !got["slow"] {
+        t.Errorf("streamed keys = %v, want %v and slow", got, keys)
+    }
+    for err := range errs {
+        t.Errorf("GetMultiStream error: %v", err)
+    }
+
+    items, errs = c.GetMultiStream([]string{"ok", "bad key"})
+    if _, ok := <-items; ok {
+        t.Error("items streamed despite a malformed key")
+    }
+    if err := <-errs; err != ErrMalformedKey {
+        t.Errorf("error = %v, want ErrMalformedKey", err)
+    }
+}
+
+func TestSlabFit(t *testing.T) {
+    fs := newFakeServer(t)
+    fs.stats = map[string][]string{"settings": {
+        "growth_factor 2.00",
+        "chunk_size 48",
+        "item_size_max 1024",
+    }}
+    addr, _ := net.ResolveTCPAddr("tcp", fs.Addr())
+    c := New(fs.Addr())
+
+    // Classes are 96, 192, 384 and finally item_size_max.
+    tests := []struct {
+        size, class, chunk, waste int
+    }{
+        {10, 1, 96, 86},
+        {96, 1, 96, 0},
+        {100, 2, 192, 92},
+        {500, 4, 1024, 524},
+    }
+    for _, tt := range tests {
+        class, chunk, waste, err := c.SlabFit(addr, tt.size)
+        if err != nil {
+            t.Errorf("SlabFit(%d) = %v", tt.size, err)
+            continue
+        }
+        if class != tt.class || chunk != tt.chunk || waste != tt.waste {
+            t.Errorf("SlabFit(%d) = class %d, chunk %d, waste %d; want %d, %d, %d",
+                tt.size, class, chunk, waste, tt.class, tt.chunk, tt.waste)
+        }
+    }
+    if _, _, _, err := c.SlabFit(addr, 2000); err == nil {
+        t.Error("SlabFit of an item larger than item_size_max succeeded")
+    }
+}
+
+func TestDeleteWithDelay(t *testing.T) {
+    fs := newFakeServer(t)
+    fs.version = "1.2.8"
+    c := New(fs.Addr())
+    if err := c.Set(&Item{Key: "locked", Value: []byte("v")}); err != nil {
+        t.Fatal(err)
+    }
+    if err := c.DeleteWithDelay("locked", 30); err != nil {
+        t.Fatalf("DeleteWithDelay on 1.2.8 = %v", err)
+    }
+    cmds := fs.commands()
+    if g, e := cmds[len(cmds)-1], "delete locked 30"; g != e {
+        t.Errorf("last command = %q, want %q", g, e)
+    }
+
+    fs.mu.Lock()
+    fs.version = "1.6.21"
+    fs.mu.Unlock()
+    // A new client, as the old one has the server's capabilities cached.
+    c = New(fs.Addr())
+    if err := c.DeleteWithDelay("locked", 30); err != ErrNotSupported {
+        t.Errorf("DeleteWithDelay on 1.6.21 = %v, want ErrNotSupported", err)
+    }
+    cmds = fs.commands()
+    if g := cmds[len(cmds)-1]; strings.HasPrefix(g, "delete") {
+        t.Errorf("delete sent to a server without delayed delete: %q", g)
+    }
+}
+
+func TestSweep(t *testing.T) {
+    fs1, fs2 := newFakeServer(t), newFakeServer(t)
+    c := New(fs1.Addr(), fs2.Addr())
+    for _, key := range []string{"k1", "k2", "k3", "d1", "d2", "d3"} {
+        if err := c.Set(&Item{Key: key, Value: []byte("v"), Expiration: 10}); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    kept, dropped := c.Sweep([]string{"k1", "k2", "k3", "gone"}, []string{"d1", "d2", "d3", "gone"}, 500)
+    for _, key := range []string{"k1", "k2", "k3"} {
+        if err, ok := kept[key]; !ok || err != nil {
+            t.Errorf("kept[%q] = %v, %v; want nil", key, err, ok)
+        }
+    }
+    for _, key := range []string{"d1", "d2", "d3"} {
+        if err, ok := dropped[key]; !ok || err != nil {
+            t.Errorf("dropped[%q] = %v, %v; want nil", key, err, ok)
+        }
+    }
+    if kept["gone"] != ErrCacheMiss || dropped["gone"] != ErrCacheMiss {
+        t.Errorf("results for missing key = %v, %v; want ErrCacheMiss", kept["gone"], dropped["gone"])
+    }
+
+    for _, fs := range []*fakeServer{fs1, fs2} {
+        fs.mu.Lock()
+        for key, it := range fs.items {
+            if key[0] == 'd' {
+                t.Errorf("%s still on %s after Sweep", key, fs.Addr())
+            } else if it.exp != 500 {
+                t.Errorf("%s expiration = %d, want 500", key, it.exp)
+            }
+        }
+        for _, cmd := range fs.cmds {
+            if strings.HasPrefix(cmd, "touch d") || strings.HasPrefix(cmd, "delete k") {
+                t.Errorf("unexpected command %q", cmd)
+            }
+        }
+        fs.mu.Unlock()
+    }
+}
+
+func TestSweepExpiration(t *testing.T) {
+    for _, tt := range []struct {
+        seconds, defaultExp int32
+        want                string
+    }{
+        {NoExpiration, 0, "touch k 0"},
+        {0, 300, "touch k 300"},
+        {60, 300, "touch k 60"},
+    } {
+        fs := newFakeServer(t)
+        c := New(fs.Addr())
+        c.DefaultExpiration = tt.defaultExp
+        c.Sweep([]string{"k"}, nil, tt.seconds)
+        if cmds := fs.commands(); len(cmds) != 1 || cmds[0] != tt.want {
+            t.Errorf("Sweep with %d seconds sent %q, want %q", tt.seconds, cmds, tt.want)
+        }
+    }
+}
+
+func TestMultiplex(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    const nkeys = 50
+    for i := 0; i < nkeys; i++ {
+        key := fmt.Sprintf("k%d", i)
+        if err := c.Set(&Item{Key: key, Value: []byte("value of " + key)}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    dials := fs.numDials()
+
+    c.Multiplex = true
+    var wg sync.WaitGroup
+    errc := make(chan error, 1000)
+    for g := 0; g < 100; g++ {
+        wg.Add(1)
+        go func(g int) {
+            defer wg.Done()
+            for i := 0; i < 10; i++ {
+                key := fmt.Sprintf("k%d", (g*7+i)%nkeys)
+                if i%3 == 0 {
+                    key2 := fmt.Sprintf("k%d", (g+i)%nkeys)
+                    m, err := c.GetMulti([]string{key, key2, "missing"})
+                    if err != nil {
+                        errc <- err
+                        continue
+                    }
+                    for _, k := range []string{key, key2} {
+                        if it := m[k]; it == nil || string(it.Value) != "value of "+k {
+                            errc <- fmt.Errorf("GetMulti got %v for %s", it, k)
+                        }
+                    }
+                    continue
+                }
+                it, err := c.Get(key)
+                if err != nil {
+                    errc <- err
+                } else if it.Key != key || string(it.Value) != "value of "+key {
+                    errc <- fmt.Errorf("Get(%s) = %s: %q", key, it.Key, it.Value)
+                }
+            }
+        }(g)
+    }
+    wg.Wait()
+    close(errc)
+    for err := range errc {
+        t.Error(err)
+    }
+    // The shared connection may be an idle one taken from the pool.
+    if g := fs.numDials() - dials; g > 1 {
+        t.Errorf("multiplexed Gets dialed %d connections, want at most 1", g)
+    }
+    if _, err := c.Get("missing"); err != ErrCacheMiss {
+        t.Errorf("multiplexed Get(missing) = %v, want ErrCacheMiss", err)
+    }
+}
+
+func TestMultiplexTeardown(t *testing.T) {
+    fs := newFakeServer(t)
+    fs.handler = func(line string, rw *bufio.ReadWriter) bool {
+        if line == "gets broken" {
+            rw.WriteString("garbage\r\n")
+            return true
+        }
+        return false
+    }
+    c := New(fs.Addr())
+    c.Multiplex = true
+    if err := c.Set(&Item{Key: "ok", Value: []byte("v")}); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := c.Get("ok"); err != nil {
+        t.Fatal(err)
+    }
+    dials := fs.numDials()
+    if _, err := c.Get("broken"); err == nil || IsCacheMiss(err) {
+        t.Fatalf("Get(broken) = %v, want a protocol error", err)
+    }
+    if _, err := c.Get("ok"); err != nil {
+        t.Fatalf("Get after teardown = %v", err)
+    }
+    if g := fs.numDials() - dials; g != 1 {
+        t.Errorf("redialed %d times after teardown, want 1", g)
+    }
+}
+
+func TestMultiplexContext(t *testing.T) {
+    fs, seen, release := blockingGetServer(t)
+    c := New(fs.Addr())
+    c.Timeout = 5 * time.Second
+    for _, key := range []string{"k", "slow"} {
+        if err := c.Set(&Item{Key: key, Value: []byte("v")}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    c.Multiplex = true
+
+    ctx, cancel := context.WithCancel(context.Background())
+    getErr := make(chan error, 1)
+    go func() {
+        _, err := c.GetContext(ctx, "slow")
+        getErr <- err
+    }()
+    <-seen
+    cancel()
+    select {
+    case err := <-getErr:
+        if err != context.Canceled {
+            t.Errorf("multiplexed GetContext = %v, want context.Canceled", err)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("multiplexed GetContext did not return after its context was cancelled")
+    }
+
+    start := time.Now()
+    if _, err := c.Get("slow", WithTimeout(50*time.Millisecond)); !IsTimeout(err) {
+        t.Errorf("multiplexed Get with a timeout = %v, want a timeout", err)
+    }
+    if d := time.Since(start); d > time.Second {
+        t.Errorf("multiplexed Get with a 50ms timeout took %v", d)
+    }
+
+    close(release)
+    if it, err := c.Get("k"); err != nil || string(it.Value) != "v" {
+        t.Errorf("multiplexed Get after abandoned requests = %v, %v", it, err)
+    }
+}
+
+func TestMultiplexDial(t *testing.T) {
+    fast, slow := newFakeServer(t), newFakeServer(t)
+    c := New(fast.Addr(), slow.Addr())
+    c.Multiplex = true
+    c.Timeout = 5 * time.Second
+    dialing := make(chan struct{}, 10)
+    c.DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+        if addr == slow.Addr() {
+            dialing <- struct{}{}
+            <-ctx.Done()
+            return nil, ctx.Err()
+        }
+        var d net.Dialer
+        return d.DialContext(ctx, network, addr)
+    }
+    var closed []string
+    var mu sync.Mutex
+    c.OnConnClose = func(addr net.Addr, reason string) {
+        mu.Lock()
+        defer mu.Unlock()
+        closed = append(closed, reason)
+    }
+    keyOn := func(want string) string {
+        for i := 0; ; i++ {
+            key := fmt.Sprintf("k%d", i)
+            if addr, err := c.selector.PickServer(key); err == nil && addr.String() == want {
+                return key
+            }
+        }
+    }
+    fastKey, slowKey := keyOn(fast.Addr()), keyOn(slow.Addr())
+
+    // Requests to an address that is slow to dial share its dial and
+    // give up when their own context is done.
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    getErr := make(chan error, 2)
+    for i := 0; i < 2; i++ {
+        go func() {
+            _, err := c.GetContext(ctx, slowKey)
+            getErr <- err
+        }()
+    }
+    <-dialing
+    if _, err := c.Get(fastKey, WithTimeout(time.Second)); err != ErrCacheMiss {
+        t.Errorf("Get from another server while dialing = %v, want ErrCacheMiss", err)
+    }
+    start := time.Now()
+    if _, err := c.Get(slowKey, WithTimeout(50*time.Millisecond)); !IsTimeout(err) {
+        t.Errorf("Get with a timeout while dialing = %v, want a timeout", err)
+    }
+    if d := time.Since(start); d > time.Second {
+        t.Errorf("Get with a 50ms timeout while dialing took %v", d)
+    }
+    cancel()
+    for i := 0; i < 2; i++ {
+        if err := <-getErr; err != context.Canceled {
+            t.Errorf("GetContext while dialing = %v, want context.Canceled", err)
+        }
+    }
+    if n := len(dialing); n != 0 {
+        t.Errorf("concurrent requests dialed %d more times, want 0", n)
+    }
+
+    // The multiplexed connection counts as open until it is closed.
+    shutCtx, shutCancel := context.WithTimeout(context.Background(), time.Second)
+    defer shutCancel()
+    if err := c.Shutdown(shutCtx); err != nil {
+        t.Fatalf("Shutdown = %v", err)
+    }
+    mu.Lock()
+    defer mu.Unlock()
+    if len(closed) != 1 {
+        t.Errorf("OnConnClose reasons = %q, want one for the multiplexed connection", closed)
+    }
+}
+
+func TestMaxPipelineDepth(t *testing.T) {
+    fs := newFakeServer(t)
+    release := make(chan struct{})
+    fs.handler = func(line string, rw *bufio.ReadWriter) bool {
+        <-release
+        return false
+    }
+    c := New(fs.Addr())
+    c.Multiplex = true
+    c.MaxPipelineDepth = 2
+    c.Timeout = 5 * time.Second
+    cc := new(countingConn)
+    c.WrapConn = func(nc net.Conn) net.Conn {
+        cc.Conn = nc
+        return cc
+    }
+    // Each request is "gets kN\r\n", written and flushed on its own.
+    requests := func() int {
+        cc.mu.Lock()
+        defer cc.mu.Unlock()
+        return cc.written / len("gets k0\r\n")
+    }
+
+    var wg sync.WaitGroup
+    for i := 0; i < 3; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            if _, err := c.Get(fmt.Sprintf("k%d", i)); err != ErrCacheMiss {
+                t.Errorf("Get = %v, want ErrCacheMiss", err)
+            }
+        }(i)
+    }
+    waitFor(t, func() bool { return requests() == 2 })
+    time.Sleep(50 * time.Millisecond)
+    if n := requests(); n != 2 {
+        t.Fatalf("%d requests written with a pipeline depth of 2", n)
+    }
+
+    release <- struct{}{}
+    waitFor(t, func() bool { return requests() == 3 })
+    close(release)
+    wg.Wait()
+}
+
+func TestMaxPipelineDepthAbandoned(t *testing.T) {
+    fs, seen, release := blockingGetServer(t)
+    c := New(fs.Addr())
+    c.Multiplex = true
+    c.MaxPipelineDepth = 1
+    c.AcquireTimeout = 50 * time.Millisecond
+    c.Timeout = 5 * time.Second
+
+    // A request given up on is still outstanding on the connection,
+    // so it keeps its slot until its response has been read.
+    if _, err := c.Get("slow", WithTimeout(50*time.Millisecond)); !IsTimeout(err) {
+        t.Fatalf("Get with a timeout = %v, want a timeout", err)
+    }
+    <-seen
+    if _, err := c.Get("k"); err != ErrAcquireTimeout {
+        t.Errorf("Get while the slot is held by an abandoned request = %v, want ErrAcquireTimeout", err)
+    }
+
+    close(release)
+    waitFor(t, func() bool {
+        _, err := c.Get("k")
+        return err == ErrCacheMiss
+    })
+}
+
+func TestEvictionRisk(t *testing.T) {
+    fs := newFakeServer(t)
+    fs.stats = map[string][]string{
+        "slabs": {
+            "1:chunk_size 96", "1:total_chunks 100", "1:free_chunks 0", "1:free_chunks_end 0",
+            "2:chunk_size 192", "2:total_chunks 100", "2:free_chunks 60", "2:free_chunks_end 30",
+            "active_slabs 2",
+        },
+        "items": {
+            "items:1:number 100", "items:1:evicted 900",
+            "items:2:number 10", "items:2:evicted 0",
+        },
+    }
+    addr, _ := net.ResolveTCPAddr("tcp", fs.Addr())
+    risk, err := New(fs.Addr()).EvictionRisk(addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if r := risk[1]; r < 0.9 {
+        t.Errorf("risk of full, evicting class = %v, want at least 0.9", r)
+    }
+    if r := risk[2]; r > 0.1 {
+        t.Errorf("risk of mostly free class = %v, want at most 0.1", r)
+    }
+}
+
+func TestServerBusy(t *testing.T) {
+    fs := newFakeServer(t)
+    var busy int32
+    fs.handler = func(line string, rw *bufio.ReadWriter) bool {
+        if atomic.AddInt32(&busy, -1) < 0 {
+            return false
+        }
+        if strings.HasPrefix(line, "set ") {
+            rw.ReadString('\n')
+        }
+        rw.WriteString("SERVER_ERROR temporary failure, try again\r\n")
+        return true
+    }
+    c := New(fs.Addr())
+
+    atomic.StoreInt32(&busy, 1)
+    if err := c.Set(&Item{Key: "k", Value: []byte("v")}); err != ErrServerBusy {
+        t.Fatalf("Set = %v, want ErrServerBusy", err)
+    }
+    atomic.StoreInt32(&busy, 1)
+    if err := c.Delete("k"); err != ErrServerBusy {
+        t.Fatalf("Delete = %v, want ErrServerBusy", err)
+    }
+
+    c.BusyRetries = 2
+    c.BusyBackoff = 30 * time.Millisecond
+    atomic.StoreInt32(&busy, 2)
+    start := time.Now()
+    if err := c.Set(&Item{Key: "k", Value: []byte("v")}); err != nil {
+        t.Fatalf("Set with retries = %v", err)
+    }
+    if d := time.Since(start); d < 60*time.Millisecond {
+        t.Errorf("two retries took %v, want at least two 30ms backoffs", d)
+    }
+    if g := fs.numDials(); g != 1 {
+        t.Errorf("busy responses caused %d dials, want the connection reused", g)
+    }
+}
+
+func TestMaxRetries(t *testing.T) {
+    fs := newFakeServer(t)
+    fs.hangup = true
+    var drops int32
+    fs.handler = func(line string, rw *bufio.ReadWriter) bool {
+        if atomic.AddInt32(&drops, -1) < 0 {
+            return false
+        }
+        if strings.HasPrefix(line, "set ") {
+            rw.ReadString('\n')
+        }
+        return true
+    }
+    c := New(fs.Addr())
+    if err := c.Set(&Item{Key: "k", Value: []byte("v")}); err != nil {
+        t.Fatal(err)
+    }
+
+    atomic.StoreInt32(&drops, 1)
+    if _, err := c.Get("k"); !IsRetryable(err) {
+        t.Fatalf("Get on a dropped connection = %v, want a retryable error", err)
+    }
+
+    c.MaxRetries = 2
+    c.RetryBackoff = 20 * time.Millisecond
+    atomic.StoreInt32(&drops, 2)
+    dials := fs.numDials()
+    start := time.Now()
+    if it, err := c.Get("k"); err != nil || string(it.Value) != "v" {
+        t.Fatalf("Get with retries = %v, %v", it, err)
+    }
+    if d := time.Since(start); d < 60*time.Millisecond {
+        t.Errorf("two retries took %v, want backoffs of 20ms and 40ms", d)
+    }
+    if g := fs.numDials() - dials; g != 3 {
+        t.Errorf("retries dialed %d connections, want 3", g)
+    }
+
+    atomic.StoreInt32(&drops, 3)
+    if err := c.Set(&Item{Key: "k", Value: []byte("w")}); !IsRetryable(err) {
+        t.Errorf("Set after exhausting retries = %v, want a retryable error", err)
+    }
+
+    c.RetryableError = func(error) bool { return false }
+    atomic.StoreInt32(&drops, 1)
+    if err := c.Delete("k"); err == nil {
+        t.Errorf("Delete was retried although RetryableError rejects every error")
+    }
+}
+
+func TestRetryBackoff(t *testing.T) {
+    for _, tt := range []struct {
+        base time.Duration
+        n    int
+        want time.Duration
+    }{
+        {0, 0, defaultRetryBackoff},
+        {20 * time.Millisecond, 0, 20 * time.Millisecond},
+        {20 * time.Millisecond, 2, 80 * time.Millisecond},
+        {time.Second, 3, maxRetryBackoff},
+        {time.Second, 100, maxRetryBackoff},
+        {time.Minute, 2, time.Minute},
+    } {
+        if got := retryBackoff(tt.base, tt.n); got != tt.want {
+            t.Errorf("retryBackoff(%v, %d) = %v, want %v", tt.base, tt.n, got, tt.want)
+        }
+    }
+}
+
+func TestRetryStopsWhenContextDone(t *testing.T) {
+    fs := newFakeServer(t)
+    fs.hangup = true
+    fs.handler = func(line string, rw *bufio.ReadWriter) bool { return true }
+    c := New(fs.Addr())
+    c.MaxRetries = 5
+    c.RetryBackoff = time.Hour
+
+    ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+    defer cancel()
+    start := time.Now()
+    if _, err := c.Get("k", WithContext(ctx)); err != context.DeadlineExceeded {
+        t.Errorf("Get = %v, want context.DeadlineExceeded", err)
+    }
+    if d := time.Since(start); d > time.Second {
+        t.Errorf("Get took %v; the backoff ignored ctx", d)
+    }
+    if n := fs.numDials(); n != 1 {
+        t.Errorf("server dialed %d times, want 1", n)
+    }
+}
+
+func TestIsRetryable(t *testing.T) {
+    for _, tt := range []struct {
+        err  error
+        want bool
+    }{
+        {nil, false},
+        {ErrCacheMiss, false},
+        {ErrUnexpectedEOF, true},
+        {&ConnectTimeoutError{&net.TCPAddr{}}, true},
+        {fmt.Errorf("write: %w", syscall.ECONNRESET), true},
+        {context.DeadlineExceeded, false},
+        {context.Canceled, false},
+    } {
+        if got := IsRetryable(tt.err); got != tt.want {
+            t.Errorf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+        }
+    }
+}
+
+func TestGetOptions(t *testing.T) {
+    fs, seen, release := blockingGetServer(t)
+    c := New(fs.Addr())
+    c.Timeout = 5 * time.Second
+    for _, key := range []string{"k", "slow"} {
+        if err := c.Set(&Item{Key: key, Value: []byte("v")}); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    lastCmd := func() string {
+        cmds := fs.commands()
+        return cmds[len(cmds)-1]
+    }
+    if _, err := c.Get("k"); err != nil || lastCmd() != "gets k" {
+        t.Errorf("default Get = %v, sent %q; want gets", err, lastCmd())
+    }
+    it, err := c.Get("k", WithNoCAS())
+    if err != nil || lastCmd() != "get k" {
+        t.Errorf("Get WithNoCAS = %v, sent %q; want get", err, lastCmd())
+    }
+    if it != nil && it.casid != 0 {
+        t.Errorf("Get WithNoCAS returned CAS id %d", it.casid)
+    }
+    if _, err := c.GetMulti([]string{"k"}, WithNoCAS()); err != nil || lastCmd() != "get k" {
+        t.Errorf("GetMulti WithNoCAS = %v, sent %q; want get", err, lastCmd())
+    }
+
+    start := time.Now()
+    if _, err := c.Get("slow", WithTimeout(20*time.Millisecond)); !IsTimeout(err) {
+        t.Errorf("Get WithTimeout = %v, want a timeout", err)
+    }
+    if d := time.Since(start); d > time.Second {
+        t.Errorf("Get WithTimeout took %v, want about 20ms", d)
+    }
+    <-seen
+
+    ctx, cancel := context.WithCancel(context.Background())
+    go func() {
+        <-seen
+        cancel()
+    }()
+    if _, err := c.Get("slow", WithContext(ctx)); err != context.Canceled {
+        t.Errorf("Get WithContext = %v, want context.Canceled", err)
+    }
+    close(release)
+
+    if _, err := c.Get("slow"); err != nil {
+        t.Errorf("Get after per-call options = %v; client defaults should be unchanged", err)
+    }
+}
+
+func TestSkipKeyValidation(t *testing.T) {
+    fs := newFakeServer(t)
+    long := strings.Repeat("x", 300)
+    fs.handler = func(line string, rw *bufio.ReadWriter) bool {
+        if !strings.Contains(line, long) {
+            return false
+        }
+        if strings.HasPrefix(line, "set ") {
+            rw.ReadString('\n')
+        }
+        rw.WriteString("CLIENT_ERROR key too long\r\n")
+        return true
+    }
+    c := New(fs.Addr())
+    unicodeKey := "clé-ünïcode"
+
+    if err := c.Set(&Item{Key: unicodeKey, Value: []byte("v")}); err != ErrMalformedKey {
+        t.Fatalf("Set with validation = %v, want ErrMalformedKey", err)
+    }
+    if len(fs.commands()) != 0 {
+        t.Fatalf("illegal key sent to server with validation on: %q", fs.commands())
+    }
+
+    c.SkipKeyValidation = true
+    if err := c.Set(&Item{Key: unicodeKey, Value: []byte("v")}); err != nil {
+        t.Fatalf("Set without validation = %v", err)
+    }
+    if it, err := c.Get(unicodeKey); err != nil || string(it.Value) != "v" {
+        t.Errorf("Get without validation = %v, %v", it, err)
+    }
+    err := c.Set(&Item{Key: long, Value: []byte("v")})
+    if err == nil || !strings.Contains(err.Error(), "CLIENT_ERROR key too long") {
+        t.Errorf("Set of key the server rejects = %v, want the server's error", err)
+    }
+}
+
+func TestIncrementMulti(t *testing.T) {
+    fs1, fs2 := newFakeServer(t), newFakeServer(t)
+    c := New(fs1.Addr(), fs2.Addr())
+    deltas := make(map[string]uint64)
+    for i := 0; i < 6; i++ {
+        key := fmt.Sprintf("counter%d", i)
+        if i%2 == 0 {
+            if err := c.Set(&Item{Key: key, Value: []byte(fmt.Sprint(i * 10))}); err != nil {
+                t.Fatal(err)
+            }
+        }
+        deltas[key] = uint64(i + 1)
+    }
+    if err := c.Set(&Item{Key: "text", Value: []byte("abc")}); err != nil {
+        t.Fatal(err)
+    }
+    deltas["text"] = 1
+
+    values, errs := c.IncrementMulti(deltas)
+    for i := 0; i < 6; i++ {
+        key := fmt.Sprintf("counter%d", i)
+        if i%2 == 0 {
+            if want := uint64(i*10 + i + 1); values[key] != want || errs[key] != nil {
+                t.Errorf("%s = %d, %v; want %d", key, values[key], errs[key], want)
+            }
+        } else if errs[key] != ErrCacheMiss {
+            t.Errorf("%s error = %v, want ErrCacheMiss", key, errs[key])
+        }
+    }
+    if errs["text"] == nil || IsCacheMiss(errs["text"]) {
+        t.Errorf("non-numeric counter error = %v, want a client error", errs["text"])
+    }
+    for _, fs := range []*fakeServer{fs1, fs2} {
+        if len(fs.commands()) < 2 {
+            t.Errorf("server %s received %d commands; keys should span both servers", fs.Addr(), len(fs.commands()))
+        }
+    }
+}
+
+func TestDecrementMulti(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    if err := c.Set(&Item{Key: "a", Value: []byte("10")}); err != nil {
+        t.Fatal(err)
+    }
+    if err := c.Set(&Item{Key: "b", Value: []byte("1")}); err != nil {
+        t.Fatal(err)
+    }
+
+    values, errs := c.DecrementMulti(map[string]uint64{"a": 3, "b": 5, "missing": 1})
+    if values["a"] != 7 || values["b"] != 0 || len(values) != 2 {
+        t.Errorf("values = %v, want a=7 and b=0", values)
+    }
+    if len(errs) != 1 || errs["missing"] != ErrCacheMiss {
+        t.Errorf("errs = %v, want ErrCacheMiss for missing only", errs)
+    }
+}
+
+func TestGetMultiReportsPendingServers(t *testing.T) {
+    slow, fast := newFakeServer(t), newFakeServer(t)
+    release := make(chan struct{})
+    defer close(release)
+    slow.handler = func(line string, rw *bufio.ReadWriter) bool {
+        if strings.HasPrefix(line, "get") {
+            <-release
+        }
+        return false
+    }
+    c := New(slow.Addr(), fast.Addr())
+
+    var keys []string
+    var fastKeys int
+    for i := 0; i < 10; i++ {
+        key := fmt.Sprintf("key%d", i)
+        if err := c.Set(&Item{Key: key, Value: []byte("v")}); err != nil {
+            t.Fatal(err)
+        }
+        if addr, _ := c.selector.PickServer(key); addr.String() == fast.Addr() {
+            fastKeys++
+        }
+        keys = append(keys, key)
+    }
+    if fastKeys == 0 || fastKeys == len(keys) {
+        t.Fatalf("%d of %d keys on the fast server; want both servers used", fastKeys, len(keys))
+    }
+
+    m, err := c.GetMulti(keys, WithTimeout(100*time.Millisecond))
+    var pe *PartialError
+    if !errors.As(err, &pe) {
+        t.Fatalf("GetMulti error = %v, want *PartialError", err)
+    }
+    if len(pe.Pending) != 1 || pe.Pending[0].String() != slow.Addr() {
+        t.Errorf("Pending = %v, want [%s]", pe.Pending, slow.Addr())
+    }
+    if !IsTimeout(err) {
+        t.Errorf("IsTimeout(%v) = false, want true", err)
+    }
+    if len(m) != fastKeys {
+        t.Errorf("GetMulti returned %d items, want the %d from the fast server", len(m), fastKeys)
+    }
+}
+
+func TestStrictProtocolRejectsUnrequestedKey(t *testing.T) {
+    fs := newFakeServer(t)
+    fs.handler = func(line string, rw *bufio.ReadWriter) bool {
+        if !strings.HasPrefix(line, "get") {
+            return false
+        }
+        rw.WriteString("VALUE other 0 1 1\r\nv\r\nEND\r\n")
+        return true
+    }
+    c := New(fs.Addr())
+
+    m, err := c.GetMulti([]string{"k1"})
+    if err != nil || m["other"] == nil {
+        t.Fatalf("lenient GetMulti = %v, %v; want the item trusted", m, err)
+    }
+
+    c.StrictProtocol = true
+    if _, err := c.GetMulti([]string{"k1"}); !errors.Is(err, ErrProtocol) {
+        t.Errorf("strict GetMulti error = %v, want ErrProtocol", err)
+    }
+    if _, err := c.Get("k1"); !errors.Is(err, ErrProtocol) {
+        t.Errorf("strict Get error = %v, want ErrProtocol", err)
+    }
+}
+
+func TestStatsOrdered(t *testing.T) {
+    fs := newFakeServer(t)
+    fs.stats = map[string][]string{
+        "slabs": {"1:chunk_size 96", "2:chunk_size 120", "1:used_chunks 3", "active_slabs 2"},
+        "":      {"pid 42", "libevent 2.1.12-stable"},
+    }
+    c := New(fs.Addr())
+    addr, _ := c.selector.PickServer("")
+
+    for sub, lines := range fs.stats {
+        stats, err := c.StatsOrdered(addr, sub)
+        if err != nil {
+            t.Fatalf("StatsOrdered(%q): %v", sub, err)
+        }
+        got := make([]string, len(stats))
+        for i, kv := range stats {
+            got[i] = kv.Key + " " + string(kv.Value)
+        }
+        if strings.Join(got, "|") != strings.Join(lines, "|") {
+            t.Errorf("StatsOrdered(%q) = %q, want %q", sub, got, lines)
+        }
+    }
+}
+
+func TestCASAcrossSerialization(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    if err := c.Set(&Item{Key: "job", Value: []byte("queued")}); err != nil {
+        t.Fatal(err)
+    }
+    it, err := c.Get("job")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if it.CAS() == 0 {
+        t.Fatal("Get returned an item without a CAS id")
+    }
+
+    // Ship the item to another worker as JSON, CAS id included.
+    msg, err := json.Marshal(map[string]string{"key": it.Key, "cas": string(it.MarshalCAS())})
+    if err != nil {
+        t.Fatal(err)
+    }
+    var got map[string]string
+    if err := json.Unmarshal(msg, &got); err != nil {
+        t.Fatal(err)
+    }
+    var decoded Item
+    if err := decoded.UnmarshalCAS([]byte(got["cas"])); err != nil {
+        t.Fatalf("UnmarshalCAS: %v", err)
+    }
+    if decoded.CAS() != it.CAS() {
+        t.Fatalf("round-tripped CAS id = %d, want %d", decoded.CAS(), it.CAS())
+    }
+
+    if err := c.CompareAndSwap(NewItemWithCAS(got["key"], []byte("done"), decoded.CAS())); err != nil {
+        t.Fatalf("CompareAndSwap with round-tripped CAS id: %v", err)
+    }
+    if err := c.CompareAndSwap(NewItemWithCAS(got["key"], []byte("again"), decoded.CAS())); err != ErrCASConflict {
+        t.Errorf("second CompareAndSwap = %v, want ErrCASConflict", err)
+    }
+    if err := decoded.UnmarshalCAS([]byte("x")); err == nil {
+        t.Error("UnmarshalCAS accepted a non-numeric id")
+    }
+}
+
+func TestMaxReadValueSize(t *testing.T) {
+    fs := newFakeServer(t)
+    fs.handler = func(line string, rw *bufio.ReadWriter) bool {
+        if line != "gets huge" {
+            return false
+        }
+        rw.WriteString("VALUE huge 0 4294967296 1\r\n")
+        return true
+    }
+    c := New(fs.Addr())
+    c.MaxReadValueSize = 1 << 20
+    if err := c.Set(&Item{Key: "small", Value: []byte("v")}); err != nil {
+        t.Fatal(err)
+    }
+
+    if _, err := c.Get("huge"); err != ErrResponseTooLarge {
+        t.Fatalf("Get(huge) error = %v, want ErrResponseTooLarge", err)
+    }
+    if it, err := c.Get("small"); err != nil || string(it.Value) != "v" {
+        t.Fatalf("Get(small) = %v, %v", it, err)
+    }
+    if n := fs.numDials(); n != 2 {
+        t.Errorf("dials = %d, want 2; the connection with the oversized value should be dropped", n)
+    }
+}
+
+func TestGetMultiStats(t *testing.T) {
+    fs1, fs2 := newFakeServer(t), newFakeServer(t)
+    c := New(fs1.Addr(), fs2.Addr())
+    var keys []string
+    want := make(map[string]int)
+    for i := 0; i < 8; i++ {
+        key := fmt.Sprintf("key%d", i)
+        if err := c.Set(&Item{Key: key, Value: []byte("v")}); err != nil {
+            t.Fatal(err)
+        }
+        addr, _ := c.selector.PickServer(key)
+        want[addr.String()]++
+        keys = append(keys, key)
+    }
+    if len(want) != 2 {
+        t.Fatalf("keys landed on %d servers, want 2", len(want))
+    }
+
+    m, stats, err := c.GetMultiStats(keys)
+    if err != nil || len(m) != len(keys) {
+        t.Fatalf("GetMultiStats = %d items, %v; want %d items", len(m), err, len(keys))
+    }
+    if stats.Servers != 2 {
+        t.Errorf("Servers = %d, want 2", stats.Servers)
+    }
+    for addr, n := range want {
+        if stats.Keys[addr] != n {
+            t.Errorf("Keys[%s] = %d, want %d", addr, stats.Keys[addr], n)
+        }
+        if d, ok := stats.Latency[addr]; !ok || d <= 0 {
+            t.Errorf("Latency[%s] = %v, %v; want a positive duration", addr, d, ok)
+        }
+    }
+}
+
+func TestGetMultiNonNilMapOnError(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    m, err := c.GetMulti([]string{"ok", "bad key"})
+    if err != ErrMalformedKey || m == nil {
+        t.Errorf("GetMulti with malformed key = %v, %v; want empty map, ErrMalformedKey", m, err)
+    }
+
+    c = NewFromSelector(new(ServerList))
+    m, err = c.GetMulti([]string{"k"})
+    if err != ErrNoServers || m == nil {
+        t.Errorf("GetMulti without servers = %v, %v; want empty map, ErrNoServers", m, err)
+    }
+}
+
+func TestParseError(t *testing.T) {
+    fs := newFakeServer(t)
+    fs.handler = func(line string, rw *bufio.ReadWriter) bool {
+        switch line {
+        case "gets k":
+            rw.WriteString("VALUE k zero 1\r\nv\r\nEND\r\n")
+        case "stats slabs":
+            rw.WriteString("STAT 1:chunk_size 96\r\nSTAT x:y:z w\r\nEND\r\n")
+        default:
+            return false
+        }
+        return true
+    }
+    c := New(fs.Addr())
+    addr, _ := c.selector.PickServer("")
+
+    var pe *ParseError
+    _, err := c.Get("k")
+    if !errors.As(err, &pe) {
+        t.Fatalf("Get error = %v, want a *ParseError", err)
+    }
+    if pe.Parser != "get" || string(pe.Line) != "VALUE k zero 1\r\n" {
+        t.Errorf("ParseError = %+v, want the raw get line", pe)
+    }
+
+    _, err = c.StatsSlabs(addr)
+    if !errors.As(err, &pe) {
+        t.Fatalf("StatsSlabs error = %v, want a *ParseError", err)
+    }
+    if pe.Parser != "stats slabs" || string(pe.Line) != "STAT x:y:z w\r\n" || pe.Pattern == "" {
+        t.Errorf("ParseError = %+v, want the raw stats slabs line", pe)
+    }
+}
+
+func TestLRUAges(t *testing.T) {
+    fs := newFakeServer(t)
+    fs.stats = map[string][]string{
+        "items": {
+            "items:1:number 10", "items:1:age 3600",
+            "items:5:number 2", "items:5:age 42",
+        },
+    }
+    c := New(fs.Addr())
+    addr, _ := c.selector.PickServer("")
+    ages, err := c.LRUAges(addr)
+    if err != nil {
+        t.Fatalf("LRUAges: %v", err)
+    }
+    if len(ages) != 2 || ages[1] != time.Hour || ages[5] != 42*time.Second {
+        t.Errorf("LRUAges = %v, want 1:1h, 5:42s", ages)
+    }
+}
+
+func TestMissingEndTimeout(t *testing.T) {
+    fs := newFakeServer(t)
+    fs.handler = func(line string, rw *bufio.ReadWriter) bool {
+        if !strings.HasPrefix(line, "gets ") {
+            return false
+        }
+        for _, key := range strings.Fields(line)[1:] {
+            if key != "missing" {
+                fmt.Fprintf(rw, "VALUE %s 0 1 1\r\nv\r\n", key)
+            }
+        }
+        return true
+    }
+    c := New(fs.Addr())
+    c.Timeout = 2 * time.Second
+    c.MissingEndTimeout = 50 * time.Millisecond
+
+    start := time.Now()
+    m, err := c.GetMulti([]string{"a", "missing", "b"})
+    if err != nil || len(m) != 2 {
+        t.Fatalf("GetMulti = %v, %v; want a and b", m, err)
+    }
+    if it, err := c.Get("a"); err != nil || string(it.Value) != "v" {
+        t.Fatalf("Get = %v, %v", it, err)
+    }
+    if d := time.Since(start); d >= c.Timeout {
+        t.Errorf("took %v; want the missing END detected well before Timeout", d)
+    }
+    if n := fs.numDials(); n != 2 {
+        t.Errorf("dials = %d, want 2; a response without END should not be reused", n)
+    }
+    if errs := c.Metrics().Errors; len(errs) != 0 {
+        t.Errorf("Errors = %v, want none", errs)
+    }
+}
+
+func TestRecommendGrowthFactor(t *testing.T) {
+    fs := newFakeServer(t)
+    fs.stats = map[string][]string{
+        "settings": {"growth_factor 1.25", "chunk_size 48", "item_size_max 1048576"},
+        "sizes":    {"sizes_status enabled", "160 5000", "192 3000", "320 4000", "480 1000", "1056 200"},
+    }
+    c := New(fs.Addr())
+    addr, _ := c.selector.PickServer("")
+
+    sizes, err := c.StatsSizes(addr)
+    if err != nil || len(sizes) != 5 || sizes[320] != 4000 {
+        t.Fatalf("StatsSizes = %v, %v", sizes, err)
+    }
+    f, err := c.RecommendGrowthFactor(addr)
+    if err != nil {
+        t.Fatalf("RecommendGrowthFactor: %v", err)
+    }
+    if f < 1.05 || f > 2 {
+        t.Fatalf("RecommendGrowthFactor = %v, want a factor in [1.05, 2]", f)
+    }
+    settings, _ := c.StatsSettings(addr)
+    current := slabWaste(settings, sizes)
+    settings.GrowthFactor = f
+    if waste := slabWaste(settings, sizes); waste > current {
+        t.Errorf("factor %v wastes %d bytes, more than the current 1.25's %d", f, waste, current)
+    }
+
+    fs.mu.Lock()
+    fs.stats["sizes"] = []string{"sizes_status disabled"}
+    fs.mu.Unlock()
+    if _, err := c.RecommendGrowthFactor(addr); err == nil {
+        t.Error("RecommendGrowthFactor without sizes succeeded")
+    }
+}
+
+func TestEnsureWithTTL(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+
+    if err := c.EnsureWithTTL(&Item{Key: "presence", Value: []byte("online"), Expiration: 30}); err != nil {
+        t.Fatalf("EnsureWithTTL on a new key: %v", err)
+    }
+    if err := c.EnsureWithTTL(&Item{Key: "presence", Value: []byte("other"), Expiration: 90}); err != nil {
+        t.Fatalf("EnsureWithTTL on an existing key: %v", err)
+    }
+    it, err := c.Get("presence")
+    if err != nil || string(it.Value) != "online" {
+        t.Errorf("Get = %v, %v; want the original value", it, err)
+    }
+    fs.mu.Lock()
+    exp := fs.items["presence"].exp
+    fs.mu.Unlock()
+    if exp != 90 {
+        t.Errorf("expiration = %d, want 90 after extending", exp)
+    }
+    want := []string{"add presence 0 30 6", "add presence 0 90 5", "touch presence 90"}
+    if got := fs.commands(); strings.Join(got[:3], "|") != strings.Join(want, "|") {
+        t.Errorf("commands = %q, want %q first", got, want)
+    }
+
+    if err := c.Touch("missing", 10); err != ErrCacheMiss {
+        t.Errorf("Touch(missing) = %v, want ErrCacheMiss", err)
+    }
+}
+
+func TestEnsureWithTTLGivesUp(t *testing.T) {
+    fs := newFakeServer(t)
+    // The item is always present for the add and gone for the touch.
+    fs.handler = func(line string, rw *bufio.ReadWriter) bool {
+        switch {
+        case strings.HasPrefix(line, "add "):
+            rw.ReadString('\n') // the data block
+            rw.WriteString("NOT_STORED\r\n")
+        case strings.HasPrefix(line, "touch "):
+            rw.WriteString("NOT_FOUND\r\n")
+        default:
+            return false
+        }
+        return true
+    }
+    c := New(fs.Addr())
+
+    if err := c.EnsureWithTTL(&Item{Key: "flaky", Value: []byte("v"), Expiration: 30}); err != ErrNotStored {
+        t.Fatalf("EnsureWithTTL = %v, want ErrNotStored", err)
+    }
+    adds := 0
+    for _, cmd := range fs.commands() {
+        if strings.HasPrefix(cmd, "add ") {
+            adds++
+        }
+    }
+    if adds != ensureAttempts {
+        t.Errorf("EnsureWithTTL tried %d adds, want %d", adds, ensureAttempts)
+    }
+}
+
+func TestTruncateKey(t *testing.T) {
+    prefix := "user:profile:" + strings.Repeat("x", 300)
+    k1, k2 := prefix+":a", prefix+":b"
+    n1, n2 := TruncateKey(k1, 40), TruncateKey(k2, 40)
+    if n1 == n2 {
+        t.Fatalf("keys differing after the prefix both truncate to %q", n1)
+    }
+    for _, n := range []string{n1, n2} {
+        if !legalKey(n) {
+            t.Errorf("TruncateKey result %q is not a legal key", n)
+        }
+        if !strings.HasPrefix(n, k1[:40]+"#") {
+            t.Errorf("TruncateKey result %q does not keep the readable prefix", n)
+        }
+    }
+    if n := TruncateKey(k1, 1000); len(n) != 250 || !legalKey(n) {
+        t.Errorf("TruncateKey with an oversized prefix gave %d bytes, want 250", len(n))
+    }
+    if got := TruncateKey("short", 40); got != "short" {
+        t.Errorf("TruncateKey(short) = %q, want it unchanged", got)
+    }
+}
+
+func TestRefreshOrSet(t *testing.T) {
+    fs1, fs2 := newFakeServer(t), newFakeServer(t)
+    c := New(fs1.Addr(), fs2.Addr())
+    var items []*Item
+    for i := 0; i < 8; i++ {
+        key := fmt.Sprintf("warm%d", i)
+        if i%2 == 0 {
+            if err := c.Set(&Item{Key: key, Value: []byte("old")}); err != nil {
+                t.Fatal(err)
+            }
+        }
+        items = append(items, &Item{Key: key, Value: []byte("default")})
+    }
+    items = append(items, &Item{Key: "bad key", Value: []byte("x")})
+
+    errs := c.RefreshOrSet(items, 600)
+    if len(errs) != 1 || errs["bad key"] != ErrMalformedKey {
+        t.Errorf("RefreshOrSet errors = %v, want only the malformed key", errs)
+    }
+    for i := 0; i < 8; i++ {
+        key := fmt.Sprintf("warm%d", i)
+        want := "default"
+        if i%2 == 0 {
+            want = "old"
+        }
+        it, err := c.Get(key)
+        if err != nil || string(it.Value) != want {
+            t.Errorf("Get(%s) = %v, %v; want %s", key, it, err, want)
+        }
+    }
+    for _, fs := range []*fakeServer{fs1, fs2} {
+        fs.mu.Lock()
+        for key, it := range fs.items {
+            if it.exp != 600 {
+                t.Errorf("%s expiration = %d, want 600", key, it.exp)
+            }
+        }
+        fs.mu.Unlock()
+        touched := 0
+        for _, cmd := range fs.commands() {
+            if strings.HasPrefix(cmd, "touch ") {
+                touched++
+            }
+        }
+        if touched == 0 {
+            t.Errorf("server %s received no touch commands; keys should span both servers", fs.Addr())
+        }
+    }
+}
+
+func TestConnInfo(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    addr, err := net.ResolveTCPAddr("tcp", fs.Addr())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if infos := c.ConnInfo(addr); len(infos) != 0 {
+        t.Fatalf("ConnInfo before dialing = %v, want none", infos)
+    }
+    if err := c.Set(&Item{Key: "k", Value: []byte("v")}); err != nil {
+        t.Fatal(err)
+    }
+    infos := c.ConnInfo(addr)
+    if len(infos) != 1 {
+        t.Fatalf("ConnInfo returned %d connections, want 1", len(infos))
+    }
+    info := infos[0]
+    if info.RemoteAddr.String() != addr.String() {
+        t.Errorf("RemoteAddr = %v, want %v", info.RemoteAddr, addr)
+    }
+    if tcp, ok := info.LocalAddr.(*net.TCPAddr); !ok || tcp.Port == 0 {
+        t.Errorf("LocalAddr = %v, want a TCP address with a port", info.LocalAddr)
+    }
+    if info.Age < 0 {
+        t.Errorf("Age = %v, want non-negative", info.Age)
+    }
+}
+
+func TestTouchAndGetAndTouch(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    if err := c.Set(&Item{Key: "blob", Value: []byte("big"), Expiration: 10}); err != nil {
+        t.Fatal(err)
+    }
+    expiration := func() int32 {
+        fs.mu.Lock()
+        defer fs.mu.Unlock()
+        return fs.items["blob"].exp
+    }
+
+    if err := c.Touch("blob", 100); err != nil || expiration() != 100 {
+        t.Errorf("Touch = %v, expiration %d; want nil, 100", err, expiration())
+    }
+    it, err := c.GetAndTouch("blob", 200)
+    if err != nil || string(it.Value) != "big" || expiration() != 200 {
+        t.Fatalf("GetAndTouch = %v, %v, expiration %d; want big, 200", it, err, expiration())
+    }
+    it.Value = []byte("bigger")
+    if err := c.CompareAndSwap(it); err != nil {
+        t.Errorf("CompareAndSwap after GetAndTouch = %v", err)
+    }
+
+    if err := c.Touch("missing", 100); err != ErrCacheMiss {
+        t.Errorf("Touch(missing) = %v, want ErrCacheMiss", err)
+    }
+    if _, err := c.GetAndTouch("missing", 100); err != ErrCacheMiss {
+        t.Errorf("GetAndTouch(missing) = %v, want ErrCacheMiss", err)
+    }
+    if err := c.Touch("bad key", 100); err != ErrMalformedKey {
+        t.Errorf("Touch(bad key) = %v, want ErrMalformedKey", err)
+    }
+    if _, err := c.GetAndTouch("bad key", 100); err != ErrMalformedKey {
+        t.Errorf("GetAndTouch(bad key) = %v, want ErrMalformedKey", err)
+    }
+}
+
+func TestGetAndTouchMulti(t *testing.T) {
+    fs1, fs2 := newFakeServer(t), newFakeServer(t)
+    c := New(fs1.Addr(), fs2.Addr())
+    var keys []string
+    for i := 0; i < 10; i++ {
+        key := fmt.Sprintf("gat%d", i)
+        if err := c.Set(&Item{Key: key, Value: []byte(key), Expiration: 10}); err != nil {
+            t.Fatal(err)
+        }
+        keys = append(keys, key)
+    }
+
+    m, err := c.GetAndTouchMulti(append(keys, "missing"), 300)
+    if err != nil {
+        t.Fatalf("GetAndTouchMulti: %v", err)
+    }
+    if len(m) != len(keys) {
+        t.Errorf("GetAndTouchMulti returned %d items, want %d", len(m), len(keys))
+    }
+    for _, key := range keys {
+        if it := m[key]; it == nil || string(it.Value) != key || it.CAS() == 0 {
+            t.Errorf("item %q = %+v, want its value and a CAS id", key, it)
+        }
+        if ttl, err := c.GetTTL(key); err != nil || ttl <= 295*time.Second {
+            t.Errorf("TTL of %q = %v, %v; want about 300s", key, ttl, err)
+        }
+    }
+    for i, fs := range []*fakeServer{fs1, fs2} {
+        n := 0
+        for _, cmd := range fs.commands() {
+            if strings.HasPrefix(cmd, "gats ") {
+                n++
+            }
+        }
+        if n != 1 {
+            t.Errorf("server %d received %d gats commands, want 1", i, n)
+        }
+    }
+    if m, err := c.GetAndTouchMulti([]string{"a", "bad key"}, 10); m == nil || err != ErrMalformedKey {
+        t.Errorf("GetAndTouchMulti with bad key = %v, %v; want an empty map and ErrMalformedKey", m, err)
+    }
+}
+
+func TestMaxIdleConns(t *testing.T) {
+    const n = 6
+    for _, tt := range []struct {
+        maxIdle, wantIdle int
+    }{
+        {0, 2},
+        {n, n},
+    } {
+        fs := newFakeServer(t)
+        c := New(fs.Addr())
+        c.Timeout = time.Second
+        c.MaxIdleConns = tt.maxIdle
+        if err := c.Set(&Item{Key: "k", Value: []byte("v")}); err != nil {
+            t.Fatal(err)
+        }
+
+        // Hold n gets open at once so that n connections are dialed.
+        var arrived sync.WaitGroup
+        arrived.Add(n)
+        all := make(chan struct{})
+        go func() { arrived.Wait(); close(all) }()
+        fs.handler = func(line string, rw *bufio.ReadWriter) bool {
+            if strings.HasPrefix(line, "get") {
+                select {
+                case <-all:
+                default:
+                    arrived.Done()
+                    <-all
+                }
+            }
+            return false
+        }
+        var wg sync.WaitGroup
+        for i := 0; i < n; i++ {
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                if _, err := c.Get("k"); err != nil {
+                    t.Error(err)
+                }
+            }()
+        }
+        wg.Wait()
+
+        c.lk.Lock()
+        idle := len(c.freeconn[fs.Addr()])
+        c.lk.Unlock()
+        if idle != tt.wantIdle {
+            t.Errorf("MaxIdleConns %d: %d idle connections, want %d", tt.maxIdle, idle, tt.wantIdle)
+        }
+        dials := fs.numDials()
+        for i := 0; i < 20; i++ {
+            if _, err := c.Get("k"); err != nil {
+                t.Fatal(err)
+            }
+        }
+        if d := fs.numDials(); d != dials {
+            t.Errorf("MaxIdleConns %d: sequential gets dialed %d new connections, want 0", tt.maxIdle, d-dials)
+        }
+    }
+}
+
+func TestContextVariants(t *testing.T) {
+    fs, seen, release := blockingGetServer(t)
+    defer close(release)
+    c := New(fs.Addr())
+    c.Timeout = 5 * time.Second
+
+    if err := c.SetContext(context.Background(), &Item{Key: "slow", Value: []byte("v")}); err != nil {
+        t.Fatalf("SetContext = %v", err)
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    getErr := make(chan error, 1)
+    go func() {
+        _, err := c.GetContext(ctx, "slow")
+        getErr <- err
+    }()
+    <-seen
+    cancel()
+    if err := <-getErr; err != context.Canceled {
+        t.Errorf("GetContext after cancel = %v, want context.Canceled", err)
+    }
+
+    ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+    defer cancel()
+    if err := c.DeleteContext(ctx, "slow"); err != context.DeadlineExceeded {
+        t.Errorf("DeleteContext past its deadline = %v, want context.DeadlineExceeded", err)
+    }
+    if err := c.SetContext(ctx, &Item{Key: "k", Value: []byte("v")}); err == nil {
+        t.Errorf("SetContext with an expired context succeeded")
+    }
+}
+
+func TestGetMultiContextReturnsPartialResults(t *testing.T) {
+    slow, fast := newFakeServer(t), newFakeServer(t)
+    release := make(chan struct{})
+    defer close(release)
+    slow.handler = func(line string, rw *bufio.ReadWriter) bool {
+        if strings.HasPrefix(line, "get") {
+            <-release
+        }
+        return false
+    }
+    c := New(slow.Addr(), fast.Addr())
+    c.Timeout = 5 * time.Second
+
+    var keys []string
+    var fastKeys int
+    for i := 0; i < 10; i++ {
+        key := fmt.Sprintf("key%d", i)
+        if err := c.Set(&Item{Key: key, Value: []byte("v")}); err != nil {
+            t.Fatal(err)
+        }
+        if addr, _ := c.selector.PickServer(key); addr.String() == fast.Addr() {
+            fastKeys++
+        }
+        keys = append(keys, key)
+    }
+    if fastKeys == 0 || fastKeys == len(keys) {
+        t.Fatalf("%d of %d keys on the fast server; want both servers used", fastKeys, len(keys))
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+    defer cancel()
+    start := time.Now()
+    m, err := c.GetMultiContext(ctx, keys)
+    if !errors.Is(err, context.DeadlineExceeded) {
+        t.Errorf("GetMultiContext error = %v, want context.DeadlineExceeded", err)
+    }
+    if d := time.Since(start); d > time.Second {
+        t.Errorf("GetMultiContext took %v after its deadline", d)
+    }
+    if len(m) != fastKeys {
+        t.Errorf("GetMultiContext returned %d items, want the %d from the fast server", len(m), fastKeys)
+    }
+}
+
+func TestContextVariantsHonorDeadline(t *testing.T) {
+    fs := newFakeServer(t)
+    release := make(chan struct{})
+    defer close(release)
+    var blocking atomic.Bool
+    fs.handler = func(line string, rw *bufio.ReadWriter) bool {
+        if blocking.Load() && strings.Contains(line, " slow") {
+            <-release
+        }
+        return false
+    }
+    c := New(fs.Addr())
+    c.Timeout = 5 * time.Second
+    bg := context.Background()
+    if err := c.AddContext(bg, &Item{Key: "slow", Value: []byte("1")}); err != nil {
+        t.Fatalf("AddContext = %v", err)
+    }
+    if v, err := c.IncrementContext(bg, "slow", 2); err != nil || v != 3 {
+        t.Fatalf("IncrementContext = %d, %v; want 3", v, err)
+    }
+    if v, err := c.DecrementContext(bg, "slow", 1); err != nil || v != 2 {
+        t.Fatalf("DecrementContext = %d, %v; want 2", v, err)
+    }
+    if err := c.TouchContext(bg, "slow", 60); err != nil {
+        t.Fatalf("TouchContext = %v", err)
+    }
+    it, err := c.Get("slow")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := c.CompareAndSwapContext(bg, it); err != nil {
+        t.Fatalf("CompareAndSwapContext = %v", err)
+    }
+
+    blocking.Store(true)
+    for name, call := range map[string]func(context.Context) error{
+        "AddContext": func(ctx context.Context) error {
+            return c.AddContext(ctx, &Item{Key: "slow", Value: []byte("1")})
+        },
+        "CompareAndSwapContext": func(ctx context.Context) error {
+            return c.CompareAndSwapContext(ctx, it)
+        },
+        "TouchContext": func(ctx context.Context) error {
+            return c.TouchContext(ctx, "slow", 60)
+        },
+        "IncrementContext": func(ctx context.Context) error {
+            _, err := c.IncrementContext(ctx, "slow", 1)
+            return err
+        },
+        "DecrementContext": func(ctx context.Context) error {
+            _, err := c.DecrementContext(ctx, "slow", 1)
+            return err
+        },
+    } {
+        ctx, cancel := context.WithTimeout(bg, 20*time.Millisecond)
+        if err := call(ctx); err != context.DeadlineExceeded {
+            t.Errorf("%s past its deadline = %v, want context.DeadlineExceeded", name, err)
+        }
+        cancel()
+    }
+}
+
+func TestIdleConnTimeout(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    c.IdleConnTimeout = 50 * time.Millisecond
+    var mu sync.Mutex
+    var reasons []string
+    c.OnConnClose = func(_ net.Addr, reason string) {
+        mu.Lock()
+        defer mu.Unlock()
+        reasons = append(reasons, reason)
+    }
+    idle := func() int {
+        c.lk.Lock()
+        defer c.lk.Unlock()
+        return len(c.freeconn[fs.Addr()])
+    }
+
+    if err := c.Set(&Item{Key: "k", Value: []byte("v")}); err != nil {
+        t.Fatal(err)
+    }
+    if n := idle(); n != 1 {
+        t.Fatalf("%d idle connections after Set, want 1", n)
+    }
+    waitFor(t, func() bool { return idle() == 0 })
+    mu.Lock()
+    if len(reasons) != 1 || reasons[0] != "idle timeout" {
+        t.Errorf("closed connections for %q, want one idle timeout", reasons)
+    }
+    mu.Unlock()
+    waitFor(t, func() bool {
+        c.lk.Lock()
+        defer c.lk.Unlock()
+        return !c.reaping
+    })
+
+    // The reaper starts again once connections are idle again.
+    if _, err := c.Get("k"); err != nil {
+        t.Fatal(err)
+    }
+    waitFor(t, func() bool { return idle() == 0 })
+    if n := fs.numDials(); n != 2 {
+        t.Errorf("dialed %d connections, want 2", n)
+    }
+}
+
+func TestTouchExpiration(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    c.DefaultExpiration = 300
+    if err := c.Set(&Item{Key: "k", Value: []byte("v")}); err != nil {
+        t.Fatal(err)
+    }
+    for _, seconds := range []int32{0, 60, NoExpiration} {
+        if err := c.Touch("k", seconds); err != nil {
+            t.Fatalf("Touch(k, %d) = %v", seconds, err)
+        }
+    }
+    want := []string{"touch k 300", "touch k 60", "touch k 0"}
+    var got []string
+    for _, cmd := range fs.commands() {
+        if strings.HasPrefix(cmd, "touch ") {
+            got = append(got, cmd)
+        }
+    }
+    if strings.Join(got, "\n") != strings.Join(want, "\n") {
+        t.Errorf("touch commands = %q, want %q", got, want)
+    }
+}
+
+func TestGetWithCAS(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    c.DisableCAS = true
+    if err := c.Set(&Item{Key: "k", Value: []byte("v")}); err != nil {
+        t.Fatal(err)
+    }
+    it, cas, err := c.GetWithCAS("k")
+    if err != nil || cas == 0 || it.CAS() != cas {
+        t.Fatalf("GetWithCAS = %v, %d, %v; want the item and its CAS id", it, cas, err)
+    }
+    if cmds := fs.commands(); cmds[len(cmds)-1] != "gets k" {
+        t.Errorf("GetWithCAS sent %q, want gets despite DisableCAS", cmds[len(cmds)-1])
+    }
+
+    // The CAS id is enough to swap the item from elsewhere.
+    if err := c.CompareAndSwap(NewItemWithCAS("k", []byte("w"), cas)); err != nil {
+        t.Errorf("CompareAndSwap with the returned CAS id = %v", err)
+    }
+    if _, _, err := c.GetWithCAS("missing"); err != ErrCacheMiss {
+        t.Errorf("GetWithCAS(missing) = %v, want ErrCacheMiss", err)
+    }
+}
+
+func TestReplaceAppendPrepend(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+
+    for name, fn := range map[string]func(*Item) error{
+        "Replace": c.Replace,
+        "Append":  c.Append,
+        "Prepend": c.Prepend,
+    } {
+        if err := fn(&Item{Key: "missing", Value: []byte("x")}); err != ErrNotStored {
+            t.Errorf("%s(missing) = %v, want ErrNotStored", name, err)
+        }
+    }
+
+    if err := c.Set(&Item{Key: "k", Value: []byte("b")}); err != nil {
+        t.Fatal(err)
+    }
+    if err := c.Replace(&Item{Key: "k", Value: []byte("c"), Flags: 5}); err != nil {
+        t.Fatalf("Replace = %v", err)
+    }
+    if err := c.Append(&Item{Key: "k", Value: []byte("d")}); err != nil {
+        t.Fatalf("Append = %v", err)
+    }
+    if err := c.Prepend(&Item{Key: "k", Value: []byte("a")}); err != nil {
+        t.Fatalf("Prepend = %v", err)
+    }
+    it, err := c.Get("k")
+    if err != nil || string(it.Value) != "acd" || it.Flags != 5 {
+        t.Errorf("Get = %v, %v; want acd with flags 5", it, err)
+    }
+    if err := c.Append(&Item{Key: "bad key", Value: []byte("x")}); err != ErrMalformedKey {
+        t.Errorf("Append(bad key) = %v, want ErrMalformedKey", err)
+    }
+}
+
+func TestFlushAll(t *testing.T) {
+    fs1, fs2, down := newFakeServer(t), newFakeServer(t), newFakeServer(t)
+    c := New(fs1.Addr(), fs2.Addr(), fs1.Addr())
+    for i := 0; i < 10; i++ {
+        if err := c.Set(&Item{Key: fmt.Sprintf("k%d", i), Value: []byte("v")}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := c.FlushAll(0); err != nil {
+        t.Fatalf("FlushAll = %v", err)
+    }
+    for i := 0; i < 10; i++ {
+        if _, err := c.Get(fmt.Sprintf("k%d", i)); err != ErrCacheMiss {
+            t.Errorf("Get(k%d) after FlushAll = %v, want ErrCacheMiss", i, err)
+        }
+    }
+    if err := c.FlushAll(30); err != nil {
+        t.Fatalf("FlushAll(30) = %v", err)
+    }
+    var flushes []string
+    for _, fs := range []*fakeServer{fs1, fs2} {
+        for _, cmd := range fs.commands() {
+            if strings.HasPrefix(cmd, "flush_all") {
+                flushes = append(flushes, cmd)
+            }
+        }
+    }
+    if want := "flush_all|flush_all 30|flush_all|flush_all 30"; strings.Join(flushes, "|") != want {
+        t.Errorf("flush commands = %q, want each server flushed once per call", flushes)
+    }
+
+    downAddr := down.Addr()
+    down.Close()
+    c = New(fs1.Addr(), downAddr)
+    err := c.FlushAll(0)
+    var ferr *FlushError
+    if !errors.As(err, &ferr) || len(ferr.Errors) != 1 || ferr.Errors[downAddr] == nil {
+        t.Errorf("FlushAll with a server down = %v, want a FlushError for %s", err, downAddr)
+    }
+}
+
+func TestDeleteMulti(t *testing.T) {
+    fs1, fs2 := newFakeServer(t), newFakeServer(t)
+    c := New(fs1.Addr(), fs2.Addr())
+    var keys []string
+    for i := 0; i < 8; i++ {
+        key := fmt.Sprintf("del%d", i)
+        if i%2 == 0 {
+            if err := c.Set(&Item{Key: key, Value: []byte("v")}); err != nil {
+                t.Fatal(err)
+            }
+        }
+        keys = append(keys, key)
+    }
+    dials := fs1.numDials() + fs2.numDials()
+
+    results, err := c.DeleteMulti(keys)
+    if err != nil {
+        t.Fatalf("DeleteMulti = %v", err)
+    }
+    for i, key := range keys {
+        want := error(nil)
+        if i%2 == 1 {
+            want = ErrCacheMiss
+        }
+        if got, ok := results[key]; !ok || got != want {
+            t.Errorf("result for %s = %v, want %v", key, got, want)
+        }
+        if _, err := c.Get(key); err != ErrCacheMiss {
+            t.Errorf("Get(%s) after DeleteMulti = %v, want ErrCacheMiss", key, err)
+        }
+    }
+    if n := fs1.numDials() + fs2.numDials(); n != dials {
+        t.Errorf("DeleteMulti dialed %d new connections, want 0", n-dials)
+    }
+
+    results, err = c.DeleteMulti([]string{"bad key"})
+    if err != ErrMalformedKey || results["bad key"] != ErrMalformedKey {
+        t.Errorf("DeleteMulti(bad key) = %v, %v; want ErrMalformedKey", results, err)
+    }
+}
+
+func TestSetMulti(t *testing.T) {
+    fs1, fs2 := newFakeServer(t), newFakeServer(t)
+    fs1.maxValueSize, fs2.maxValueSize = 4, 4
+    c := New(fs1.Addr(), fs2.Addr())
+    var items []*Item
+    for i := 0; i < 8; i++ {
+        items = append(items, &Item{Key: fmt.Sprintf("warm%d", i), Value: []byte(fmt.Sprint(i)), Flags: uint32(i)})
+    }
+    items = append(items, &Item{Key: "huge", Value: []byte("too large")})
+
+    results, err := c.SetMulti(items)
+    for _, fs := range []*fakeServer{fs1, fs2} {
+        if n := fs.numDials(); n != 1 {
+            t.Errorf("SetMulti dialed server %s %d times, want 1", fs.Addr(), n)
+        }
+    }
+    if err == nil {
+        t.Errorf("SetMulti error = %v, want the oversized item's error", err)
+    }
+    if len(results) != len(items) || results["huge"] == nil {
+        t.Errorf("SetMulti results = %v, want one per item and an error for huge", results)
+    }
+    for i := 0; i < 8; i++ {
+        key := fmt.Sprintf("warm%d", i)
+        if results[key] != nil {
+            t.Errorf("result for %s = %v, want nil", key, results[key])
+        }
+        it, err := c.Get(key)
+        if err != nil || string(it.Value) != fmt.Sprint(i) || it.Flags != uint32(i) {
+            t.Errorf("Get(%s) = %v, %v", key, it, err)
+        }
+    }
+}
+
+func TestDialFunc(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    var dialed []string
+    c.DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+        dialed = append(dialed, network+" "+addr)
+        var d net.Dialer
+        return d.DialContext(ctx, network, addr)
+    }
+    if err := c.Set(&Item{Key: "k", Value: []byte("v")}); err != nil {
+        t.Fatal(err)
+    }
+    if len(dialed) != 1 || dialed[0] != "tcp "+fs.Addr() {
+        t.Errorf("DialFunc called with %q, want one dial of tcp %s", dialed, fs.Addr())
+    }
+
+    // A dial that never completes is bounded by Timeout and by the
+    // caller's context.
+    c = New(fs.Addr())
+    c.Timeout = 50 * time.Millisecond
+    c.DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+        <-ctx.Done()
+        return nil, ctx.Err()
+    }
+    var cte *ConnectTimeoutError
+    if _, err := c.Get("k"); !errors.As(err, &cte) {
+        t.Errorf("Get with a hanging dial = %v, want *ConnectTimeoutError", err)
+    }
+    c.Timeout = 5 * time.Second
+    ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+    defer cancel()
+    if _, err := c.GetContext(ctx, "k"); err != context.DeadlineExceeded {
+        t.Errorf("GetContext with a hanging dial = %v, want context.DeadlineExceeded", err)
+    }
+}
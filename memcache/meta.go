@@ -0,0 +1,701 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "fmt"
+    "net"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Support for the meta text protocol introduced in memcached 1.6:
+// https://github.com/memcached/memcached/blob/master/doc/protocol.txt
+
+// resultMetaNoop is the response to the mn command, which marks the end
+// of a pipeline of quiet meta commands.
+var resultMetaNoop = []byte("MN\r\n")
+
+// NeverExpires is the TTL reported for items stored without an
+// expiration time.
+const NeverExpires = time.Duration(-1)
+
+// metaResponse is the parsed header line of a meta command response.
+type metaResponse struct {
+    // status is the two letter return code, e.g. "HD", "VA" or "EN".
+    status string
+
+    // size is the length of the data block that follows a "VA" line.
+    size int
+
+    // flags holds the returned flags, each one a flag letter followed
+    // by its token, e.g. "t300".
+    flags [][]byte
+}
+
+// flag returns the token of the returned flag f.
+func (mr *metaResponse) flag(f byte) (string, bool) {
+    for _, fl := range mr.flags {
+        if fl[0] == f {
+            return string(fl[1:]), true
+        }
+    }
+    return "", false
+}
+
+// parseMetaResponse parses the header line of a meta response.
+func parseMetaResponse(line []byte) (*metaResponse, error) {
+    fields := bytes.Fields(line)
+    if len(fields) == 0 || len(fields[0]) != 2 {
+        return nil, fmt.Errorf("memcache: unexpected meta response line: %q", line)
+    }
+    mr := &metaResponse{status: string(fields[0])}
+    fields = fields[1:]
+    if mr.status == "VA" {
+        if len(fields) == 0 {
+            return nil, fmt.Errorf("memcache: unexpected meta response line: %q", line)
+        }
+        size, err := strconv.Atoi(string(fields[0]))
+        if err != nil || size < 0 {
+            return nil, fmt.Errorf("memcache: unexpected meta response line: %q", line)
+        }
+        mr.size = size
+        fields = fields[1:]
+    }
+    mr.flags = fields
+    return mr, nil
+}
+
+// opaque returns the opaque token echoed by the returned O flag, which
+// metaOpaque set to the index of a request in its pipeline.
+func (mr *metaResponse) opaque(n int) (int, error) {
+    token, ok := mr.flag('O')
+    if !ok {
+        return 0, fmt.Errorf("memcache: meta response without opaque token")
+    }
+    i, err := strconv.Atoi(token)
+    if err != nil || i < 0 || i >= n {
+        return 0, fmt.Errorf("memcache: unknown opaque token in meta response: %q", token)
+    }
+    return i, nil
+}
+
+// metaOpaque returns the O flag tagging the i'th request of a pipeline.
+func metaOpaque(i int) string {
+    return "O" + strconv.Itoa(i)
+}
+
+// ttl converts a returned "t" flag token to a duration.
+func metaTTL(token string) (time.Duration, error) {
+    secs, err := strconv.ParseInt(token, 10, 64)
+    if err != nil {
+        return 0, fmt.Errorf("memcache: bad ttl in meta response: %q", token)
+    }
+    if secs < 0 {
+        return NeverExpires, nil
+    }
+    return time.Duration(secs) * time.Second, nil
+}
+
+// GetTTL returns the remaining time to live of the item with the given
+// key, or NeverExpires if it has no expiration time. ErrCacheMiss is
+// returned if the item is not present. It requires a server that
+// supports the meta protocol; the server's capabilities are checked
+// first, and ErrNotSupported is returned if it does not. They are
+// cached, see CapabilitiesTTL.
+func (c *Client) GetTTL(key string) (time.Duration, error) {
+    m, err := c.GetTTLMulti([]string{key})
+    if err != nil {
+        return 0, err
+    }
+    ttl, ok := m[key]
+    if !ok {
+        return 0, ErrCacheMiss
+    }
+    return ttl, nil
+}
+
+// VerifyExpiration reports whether the item with the given key expires
+// within tolerance of expected, judging by its remaining TTL as read
+// with GetTTL. The server reports TTLs in whole seconds, so tolerance
+// should be at least a second. An item without an expiration time
+// matches only a zero expected time. ErrCacheMiss is returned if the
+// item is not present.
+func (c *Client) VerifyExpiration(key string, expected time.Time, tolerance time.Duration) (bool, error) {
+    ttl, err := c.GetTTL(key)
+    if err != nil {
+        return false, err
+    }
+    if ttl == NeverExpires {
+        return expected.IsZero(), nil
+    }
+    diff := time.Now().Add(ttl).Sub(expected)
+    if diff < 0 {
+        diff = -diff
+    }
+    return diff <= tolerance, nil
+}
+
+// GetTTLMulti is a batch version of GetTTL. Keys are grouped by server
+// and the lookups for each server are pipelined over one connection.
+// The returned map omits keys that were not found; it is never nil,
+// even when an error is returned. Servers without the meta protocol
+// fail their keys with ErrNotSupported.
+//
+// The lookups are sent in quiet mode, so misses produce no response,
+// and tagged with opaque tokens so that each response is matched to
+// its key; a final mn command marks the end of the responses.
+func (c *Client) GetTTLMulti(keys []string) (map[string]time.Duration, error) {
+    var lk sync.Mutex
+    m := make(map[string]time.Duration)
+
+    keyMap := make(map[net.Addr][]string)
+    for _, key := range keys {
+        if !c.validKey(key) {
+            return m, ErrMalformedKey
+        }
+        addr, err := c.pickReadServer(key)
+        if err != nil {
+            return m, err
+        }
+        keyMap[addr] = append(keyMap[addr], key)
+    }
+
+    ch := make(chan error, buffered)
+    for addr, keys := range keyMap {
+        go func(addr net.Addr, keys []string) {
+            caps, err := c.cachedCapabilities(addr)
+            if err != nil {
+                ch <- err
+                return
+            }
+            if !caps.SupportsMeta {
+                ch <- ErrNotSupported
+                return
+            }
+            ch <- c.withAddrRw(addr, func(rw *bufio.ReadWriter) error {
+                for i, key := range keys {
+                    if _, err := fmt.Fprintf(rw, "mg %s t q %s\r\n", key, metaOpaque(i)); err != nil {
+                        return err
+                    }
+                }
+                if _, err := rw.WriteString("mn\r\n"); err != nil {
+                    return err
+                }
+                if err := rw.Flush(); err != nil {
+                    return err
+                }
+                for n := 0; ; n++ {
+                    line, err := readLine(rw.Reader)
+                    if err != nil {
+                        return err
+                    }
+                    if bytes.Equal(line, resultMetaNoop) {
+                        return nil
+                    }
+                    if n == len(keys) {
+                        return ErrResponseTooLong
+                    }
+                    mr, err := parseMetaResponse(line)
+                    if err != nil {
+                        return err
+                    }
+                    if mr.status != "HD" {
+                        return fmt.Errorf("memcache: unexpected meta response line: %q", line)
+                    }
+                    i, err := mr.opaque(len(keys))
+                    if err != nil {
+                        return err
+                    }
+                    key := keys[i]
+                    token, ok := mr.flag('t')
+                    if !ok {
+                        return fmt.Errorf("memcache: meta response without ttl: %q", line)
+                    }
+                    ttl, err := metaTTL(token)
+                    if err != nil {
+                        return err
+                    }
+                    lk.Lock()
+                    m[key] = ttl
+                    lk.Unlock()
+                }
+            })
+        }(addr, keys)
+    }
+
+    var err error
+    for _ = range keyMap {
+        if ge := <-ch; ge != nil {
+            err = ge
+        }
+    }
+    return m, err
+}
+
+// AppendCAS appends item.Value to the value of the existing item, but
+// only if the item has not been modified since it was fetched, as
+// CompareAndSwap would. item must have been returned by Get or
+// GetMulti. ErrCASConflict is returned if the item was modified,
+// ErrCacheMiss if it no longer exists. It requires a server that
+// supports the meta protocol.
+func (c *Client) AppendCAS(item *Item) error {
+    return c.onItem(item, func(c *Client, rw *bufio.ReadWriter, item *Item) error {
+        return c.metaSetMode(rw, 'A', item)
+    })
+}
+
+// PrependCAS is like AppendCAS, but prepends item.Value to the value
+// of the existing item.
+func (c *Client) PrependCAS(item *Item) error {
+    return c.onItem(item, func(c *Client, rw *bufio.ReadWriter, item *Item) error {
+        return c.metaSetMode(rw, 'P', item)
+    })
+}
+
+// metaSetMode issues a meta set of item in the given mode, guarded by
+// the item's CAS id.
+func (c *Client) metaSetMode(rw *bufio.ReadWriter, mode byte, item *Item) error {
+    if !c.validKey(item.Key) {
+        return ErrMalformedKey
+    }
+    if _, err := fmt.Fprintf(rw, "ms %s %d M%c C%d\r\n", item.Key, len(item.Value), mode, item.casid); err != nil {
+        return err
+    }
+    if _, err := rw.Write(item.Value); err != nil {
+        return err
+    }
+    if _, err := rw.Write(crlf); err != nil {
+        return err
+    }
+    atomic.AddUint64(&c.metrics.sets, 1)
+    if err := rw.Flush(); err != nil {
+        return err
+    }
+    line, err := readLine(rw.Reader)
+    if err != nil {
+        return err
+    }
+    return metaStoreResult(line)
+}
+
+// metaStoreResult maps the response line of a meta set to an error.
+func metaStoreResult(line []byte) error {
+    mr, err := parseMetaResponse(line)
+    if err != nil {
+        return err
+    }
+    switch mr.status {
+    case "HD":
+        return nil
+    case "NS":
+        return ErrNotStored
+    case "EX":
+        return ErrCASConflict
+    case "NF":
+        return ErrCacheMiss
+    }
+    return fmt.Errorf("memcache: unexpected meta response line: %q", line)
+}
+
+// MetaSetMode selects how MetaSet stores an item's value.
+type MetaSetMode byte
+
+const (
+    MetaModeSet     MetaSetMode = 'S' // store unconditionally
+    MetaModeAdd     MetaSetMode = 'E' // store only if not already present
+    MetaModeReplace MetaSetMode = 'R' // store only if already present
+    MetaModeAppend  MetaSetMode = 'A' // append to the existing value
+    MetaModePrepend MetaSetMode = 'P' // prepend to the existing value
+)
+
+// MetaGetFlags selects what MetaGet returns and how the lookup affects
+// the item.
+type MetaGetFlags struct {
+    // Value, CAS, Flags, TTL, LastAccess and HitBefore request the
+    // corresponding fields of MetaResult.
+    Value      bool
+    CAS        bool
+    Flags      bool
+    TTL        bool
+    LastAccess bool
+    HitBefore  bool
+
+    // Touch, if non-zero, updates the item's expiration time, which
+    // may be NoExpiration.
+    Touch int32
+
+    // NoBump leaves the item's position in the LRU and its access
+    // statistics untouched.
+    NoBump bool
+
+    // Vivify, if non-zero, makes a miss create an empty item that
+    // expires after Vivify seconds. The first client to miss is told
+    // that it Won and should recache the value; others see the empty
+    // item until it is replaced.
+    Vivify int32
+
+    // Recache, if non-zero, makes the lookup win the right to recache
+    // the item when its remaining TTL drops below Recache seconds.
+    Recache int32
+}
+
+// MetaResult is the result of MetaGet. Fields that were not requested
+// are left zero.
+type MetaResult struct {
+    Key   string
+    Value []byte
+    Flags uint32
+    CAS   uint64
+
+    // TTL is the remaining time to live of the item, or NeverExpires.
+    TTL time.Duration
+
+    // LastAccess is the time since the item was last accessed.
+    LastAccess time.Duration
+
+    // HitBefore reports whether the item had been fetched before.
+    HitBefore bool
+
+    // Won reports that this client should recache the item, having
+    // vivified it on a miss or found it due for recaching. Stale
+    // reports that the item was invalidated by MetaDelete, and
+    // Recaching that another client has already won the recache.
+    Won       bool
+    Stale     bool
+    Recaching bool
+}
+
+// Item returns the result as an Item carrying its CAS id, so that it
+// can be passed to CompareAndSwap.
+func (r *MetaResult) Item() *Item {
+    return &Item{Key: r.Key, Value: r.Value, Flags: r.Flags, casid: r.CAS}
+}
+
+// MetaGet looks up key with the meta get command, returning the fields
+// selected by flags. ErrCacheMiss is returned if the item is not
+// present and Vivify is not set. It requires a server that supports the
+// meta protocol.
+func (c *Client) MetaGet(key string, flags MetaGetFlags) (*MetaResult, error) {
+    cmd := []byte("mg " + key)
+    for _, f := range []struct {
+        set  bool
+        flag string
+    }{
+        {flags.Value, " v"},
+        {flags.CAS, " c"},
+        {flags.Flags, " f"},
+        {flags.TTL, " t"},
+        {flags.LastAccess, " l"},
+        {flags.HitBefore, " h"},
+        {flags.NoBump, " u"},
+    } {
+        if f.set {
+            cmd = append(cmd, f.flag...)
+        }
+    }
+    if flags.Touch != 0 {
+        cmd = appendMetaInt(cmd, 'T', int64(c.expiration(flags.Touch)))
+    }
+    if flags.Vivify != 0 {
+        cmd = appendMetaInt(cmd, 'N', int64(flags.Vivify))
+    }
+    if flags.Recache != 0 {
+        cmd = appendMetaInt(cmd, 'R', int64(flags.Recache))
+    }
+    cmd = append(cmd, crlf...)
+
+    atomic.AddUint64(&c.metrics.gets, 1)
+    var res *MetaResult
+    with := c.withKeyRwContext
+    if flags.Touch != 0 || flags.Vivify != 0 {
+        // Touching or creating the item changes the server.
+        with = c.withKeyRwWrite
+    }
+    err := with(context.Background(), key, func(rw *bufio.ReadWriter) error {
+        line, err := writeCommand(rw, cmd)
+        if err != nil {
+            return err
+        }
+        mr, err := parseMetaResponse(line)
+        if err != nil {
+            return err
+        }
+        switch mr.status {
+        case "EN":
+            return ErrCacheMiss
+        case "HD", "VA":
+        default:
+            return fmt.Errorf("memcache: unexpected meta response line: %q", line)
+        }
+        if res, err = mr.result(key); err != nil {
+            return err
+        }
+        if mr.status == "VA" {
+            buf := make([]byte, mr.size+2)
+            if err := readFull(rw, buf); err != nil {
+                return err
+            }
+            if !bytes.HasSuffix(buf, crlf) {
+                return fmt.Errorf("memcache: corrupt meta get result read")
+            }
+            res.Value = buf[:mr.size]
+        }
+        return nil
+    })
+    if err == nil {
+        atomic.AddUint64(&c.metrics.hits, 1)
+    } else if err == ErrCacheMiss {
+        atomic.AddUint64(&c.metrics.misses, 1)
+    }
+    return res, err
+}
+
+// result converts the flags returned by a meta get into a MetaResult.
+func (mr *metaResponse) result(key string) (*MetaResult, error) {
+    res := &MetaResult{Key: key}
+    for _, fl := range mr.flags {
+        token := string(fl[1:])
+        var err error
+        switch fl[0] {
+        case 'c':
+            res.CAS, err = strconv.ParseUint(token, 10, 64)
+        case 'f':
+            var n uint64
+            n, err = strconv.ParseUint(token, 10, 32)
+            res.Flags = uint32(n)
+        case 't':
+            res.TTL, err = metaTTL(token)
+        case 'l':
+            var n int64
+            n, err = strconv.ParseInt(token, 10, 64)
+            res.LastAccess = time.Duration(n) * time.Second
+        case 'h':
+            res.HitBefore = token == "1"
+        case 'W':
+            res.Won = true
+        case 'X':
+            res.Stale = true
+        case 'Z':
+            res.Recaching = true
+        }
+        if err != nil {
+            return nil, fmt.Errorf("memcache: bad %c flag in meta response: %q", fl[0], token)
+        }
+    }
+    return res, nil
+}
+
+// MetaSetFlags modifies how MetaSet stores an item.
+type MetaSetFlags struct {
+    // Mode selects how the value is stored; zero means MetaModeSet.
+    Mode MetaSetMode
+
+    // CAS, if non-zero, stores the item only if its CAS id still
+    // matches, as CompareAndSwap would.
+    CAS uint64
+
+    // Invalidate, together with CAS, stores the item even if its CAS id
+    // is older than the current one, but marks it stale.
+    Invalidate bool
+}
+
+// MetaSet stores item with the meta set command, using its Flags and
+// Expiration, and records the item's new CAS id in item so it can be
+// passed to CompareAndSwap. ErrNotStored is returned if Mode's
+// condition did not hold, ErrCASConflict if CAS did not match and
+// ErrCacheMiss if CAS was given but the item is gone. It requires a
+// server that supports the meta protocol.
+func (c *Client) MetaSet(item *Item, flags MetaSetFlags) error {
+    if !c.validKey(item.Key) {
+        return ErrMalformedKey
+    }
+    mode := flags.Mode
+    if mode == 0 {
+        mode = MetaModeSet
+    }
+    cmd := []byte("ms " + item.Key)
+    cmd = strconv.AppendInt(append(cmd, ' '), int64(len(item.Value)), 10)
+    cmd = append(cmd, " c M"...)
+    cmd = append(cmd, byte(mode))
+    cmd = appendMetaInt(cmd, 'F', int64(item.Flags))
+    cmd = appendMetaInt(cmd, 'T', int64(c.expiration(item.Expiration)))
+    if flags.CAS != 0 {
+        cmd = append(cmd, " C"...)
+        cmd = strconv.AppendUint(cmd, flags.CAS, 10)
+    }
+    if flags.Invalidate {
+        cmd = append(cmd, " I"...)
+    }
+    cmd = append(cmd, crlf...)
+    cmd = append(cmd, item.Value...)
+    cmd = append(cmd, crlf...)
+
+    atomic.AddUint64(&c.metrics.sets, 1)
+    return c.withKeyRwWrite(context.Background(), item.Key, func(rw *bufio.ReadWriter) error {
+        line, err := writeCommand(rw, cmd)
+        if err != nil {
+            return err
+        }
+        if err := metaStoreResult(line); err != nil {
+            return err
+        }
+        mr, err := parseMetaResponse(line)
+        if err != nil {
+            return err
+        }
+        if token, ok := mr.flag('c'); ok {
+            cas, err := strconv.ParseUint(token, 10, 64)
+            if err != nil {
+                return fmt.Errorf("memcache: bad c flag in meta response: %q", token)
+            }
+            item.casid = cas
+        }
+        return nil
+    })
+}
+
+// MetaDeleteFlags modifies how MetaDelete removes an item.
+type MetaDeleteFlags struct {
+    // CAS, if non-zero, deletes the item only if its CAS id still
+    // matches.
+    CAS uint64
+
+    // Invalidate marks the item stale instead of removing it, so that
+    // MetaGet with Recache hands the recache to a single client while
+    // others keep being served the stale value.
+    Invalidate bool
+
+    // TTL, if non-zero, updates the expiration time of an invalidated
+    // item.
+    TTL int32
+}
+
+// MetaDelete deletes or invalidates the item for key with the meta
+// delete command. ErrCacheMiss is returned if the item is not present
+// and ErrCASConflict if CAS did not match. It requires a server that
+// supports the meta protocol.
+func (c *Client) MetaDelete(key string, flags MetaDeleteFlags) error {
+    cmd := []byte("md " + key)
+    if flags.CAS != 0 {
+        cmd = append(cmd, " C"...)
+        cmd = strconv.AppendUint(cmd, flags.CAS, 10)
+    }
+    if flags.Invalidate {
+        cmd = append(cmd, " I"...)
+    }
+    if flags.TTL != 0 {
+        cmd = appendMetaInt(cmd, 'T', int64(c.expiration(flags.TTL)))
+    }
+    cmd = append(cmd, crlf...)
+
+    atomic.AddUint64(&c.metrics.deletes, 1)
+    return c.withKeyRwWrite(context.Background(), key, func(rw *bufio.ReadWriter) error {
+        line, err := writeCommand(rw, cmd)
+        if err != nil {
+            return err
+        }
+        return metaStoreResult(line)
+    })
+}
+
+// MetaArithmeticFlags modifies how MetaArithmetic changes a counter.
+type MetaArithmeticFlags struct {
+    // Decrement decrements the counter instead of incrementing it.
+    // Like Decrement, the value does not wrap below zero.
+    Decrement bool
+
+    // Delta is the amount to change the counter by.
+    Delta uint64
+
+    // Vivify, if non-zero, makes a miss create the counter with value
+    // Initial, expiring after Vivify seconds.
+    Vivify  int32
+    Initial uint64
+
+    // TTL, if non-zero, updates the counter's expiration time.
+    TTL int32
+
+    // CAS, if non-zero, changes the counter only if its CAS id still
+    // matches.
+    CAS uint64
+}
+
+// MetaArithmetic increments or decrements the counter for key with the
+// meta arithmetic command and returns its new value. ErrCacheMiss is
+// returned if the counter is not present and Vivify is not set, and
+// ErrCASConflict if CAS did not match. It requires a server that
+// supports the meta protocol.
+func (c *Client) MetaArithmetic(key string, flags MetaArithmeticFlags) (uint64, error) {
+    cmd := []byte("ma " + key + " v D")
+    cmd = strconv.AppendUint(cmd, flags.Delta, 10)
+    if flags.Decrement {
+        cmd = append(cmd, " MD"...)
+    }
+    if flags.Vivify != 0 {
+        cmd = appendMetaInt(cmd, 'N', int64(flags.Vivify))
+        cmd = append(cmd, " J"...)
+        cmd = strconv.AppendUint(cmd, flags.Initial, 10)
+    }
+    if flags.TTL != 0 {
+        cmd = appendMetaInt(cmd, 'T', int64(c.expiration(flags.TTL)))
+    }
+    if flags.CAS != 0 {
+        cmd = append(cmd, " C"...)
+        cmd = strconv.AppendUint(cmd, flags.CAS, 10)
+    }
+    cmd = append(cmd, crlf...)
+
+    var val uint64
+    err := c.withKeyRwWrite(context.Background(), key, func(rw *bufio.ReadWriter) error {
+        line, err := writeCommand(rw, cmd)
+        if err != nil {
+            return err
+        }
+        if bytes.HasPrefix(line, resultClientErrorPrefix) {
+            _, err := incrDecrResult(line)
+            return err
+        }
+        mr, err := parseMetaResponse(line)
+        if err != nil {
+            return err
+        }
+        if mr.status != "VA" {
+            if err := metaStoreResult(line); err != nil {
+                return err
+            }
+            return fmt.Errorf("memcache: unexpected meta response line: %q", line)
+        }
+        buf := make([]byte, mr.size+2)
+        if err := readFull(rw, buf); err != nil {
+            return err
+        }
+        val, err = strconv.ParseUint(string(bytes.TrimSuffix(buf, crlf)), 10, 64)
+        return err
+    })
+    return val, err
+}
+
+// appendMetaInt appends the meta flag f with the integer token n.
+func appendMetaInt(b []byte, f byte, n int64) []byte {
+    return strconv.AppendInt(append(b, ' ', f), n, 10)
+}
@@ -0,0 +1,349 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "bufio"
+    "fmt"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestGetTTLMulti(t *testing.T) {
+    fs1, fs2 := newFakeServer(t), newFakeServer(t)
+    c := New(fs1.Addr(), fs2.Addr())
+
+    want := make(map[string]time.Duration)
+    var keys []string
+    for i := 0; i < 10; i++ {
+        key := fmt.Sprintf("ttl%d", i)
+        exp := int32(100 * (i + 1))
+        if i == 0 {
+            exp = 0
+        }
+        if err := c.Set(&Item{Key: key, Value: []byte("v"), Expiration: exp}); err != nil {
+            t.Fatal(err)
+        }
+        keys = append(keys, key)
+        if exp == 0 {
+            want[key] = NeverExpires
+        } else {
+            want[key] = time.Duration(exp) * time.Second
+        }
+    }
+    keys = append(keys, "missing")
+
+    m, err := c.GetTTLMulti(keys)
+    if err != nil {
+        t.Fatalf("GetTTLMulti: %v", err)
+    }
+    if len(m) != len(want) {
+        t.Errorf("GetTTLMulti returned %d entries, want %d", len(m), len(want))
+    }
+    for key, ttl := range want {
+        if m[key] != ttl {
+            t.Errorf("TTL of %q = %v, want %v", key, m[key], ttl)
+        }
+    }
+    if _, ok := m["missing"]; ok {
+        t.Errorf("missing key present in result")
+    }
+    for i, fs := range []*fakeServer{fs1, fs2} {
+        n := 0
+        for _, cmd := range fs.commands() {
+            if strings.HasPrefix(cmd, "mg ") {
+                n++
+            }
+        }
+        if n == 0 {
+            t.Errorf("server %d received no mg commands", i)
+        }
+    }
+
+    if ttl, err := c.GetTTL("ttl0"); err != nil || ttl != NeverExpires {
+        t.Errorf("GetTTL(ttl0) = %v, %v; want NeverExpires", ttl, err)
+    }
+    if _, err := c.GetTTL("missing"); err != ErrCacheMiss {
+        t.Errorf("GetTTL(missing) = %v, want ErrCacheMiss", err)
+    }
+    if m, err := c.GetTTLMulti([]string{"ttl1", "bad key"}); m == nil || err != ErrMalformedKey {
+        t.Errorf("GetTTLMulti with bad key = %v, %v; want an empty map and ErrMalformedKey", m, err)
+    }
+}
+
+func TestAppendPrependCAS(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    if err := c.Set(&Item{Key: "log", Value: []byte("b")}); err != nil {
+        t.Fatal(err)
+    }
+    it, err := c.Get("log")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    it.Value = []byte("c")
+    if err := c.AppendCAS(it); err != nil {
+        t.Fatalf("AppendCAS = %v", err)
+    }
+    it.Value = []byte("a")
+    if err := c.PrependCAS(it); err != ErrCASConflict {
+        t.Errorf("PrependCAS with stale CAS id = %v, want ErrCASConflict", err)
+    }
+
+    it, err = c.Get("log")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(it.Value) != "bc" {
+        t.Errorf("value after AppendCAS = %q, want %q", it.Value, "bc")
+    }
+    it.Value = []byte("a")
+    if err := c.PrependCAS(it); err != nil {
+        t.Fatalf("PrependCAS = %v", err)
+    }
+    if it, err = c.Get("log"); err != nil || string(it.Value) != "abc" {
+        t.Errorf("Get after PrependCAS = %q, %v; want %q", it.Value, err, "abc")
+    }
+
+    if err := c.Delete("log"); err != nil {
+        t.Fatal(err)
+    }
+    if err := c.AppendCAS(it); err != ErrCacheMiss {
+        t.Errorf("AppendCAS of deleted item = %v, want ErrCacheMiss", err)
+    }
+}
+
+func TestGetTTLMultiOpaque(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    ttls := map[string]int32{"a": 100, "b": 200, "c": 300}
+    for key, exp := range ttls {
+        if err := c.Set(&Item{Key: key, Value: []byte("v"), Expiration: exp}); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    // Answer the pipelined lookups in reverse order, so that only the
+    // opaque tokens can match responses to keys.
+    var held []string
+    fs.handler = func(line string, rw *bufio.ReadWriter) bool {
+        if strings.HasPrefix(line, "mg ") {
+            held = append(held, line)
+            return true
+        }
+        if line != "mn" {
+            return false
+        }
+        for i := len(held) - 1; i >= 0; i-- {
+            fs.handle(held[i], rw)
+        }
+        held = nil
+        rw.WriteString("MN\r\n")
+        return true
+    }
+
+    m, err := c.GetTTLMulti([]string{"a", "missing", "b", "c"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(m) != 3 {
+        t.Errorf("GetTTLMulti returned %d ttls, want 3: %v", len(m), m)
+    }
+    for key, exp := range ttls {
+        if d := m[key]; d <= time.Duration(exp-5)*time.Second || d > time.Duration(exp)*time.Second {
+            t.Errorf("ttl of %s = %v, want about %ds", key, d, exp)
+        }
+    }
+}
+
+func TestGetTTLWithoutMeta(t *testing.T) {
+    fs := newFakeServer(t)
+    fs.version = "1.5.10"
+    c := New(fs.Addr())
+    if err := c.Set(&Item{Key: "k", Value: []byte("v"), Expiration: 100}); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := c.GetTTL("k"); err != ErrNotSupported {
+        t.Errorf("GetTTL from a server without meta commands = %v, want ErrNotSupported", err)
+    }
+    for _, cmd := range fs.commands() {
+        if strings.HasPrefix(cmd, "mg ") {
+            t.Errorf("meta command %q sent to a server without meta commands", cmd)
+        }
+    }
+}
+
+func TestNoExpirationIgnoresDefaultTTL(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    c.DefaultExpiration = 300
+    if err := c.Set(&Item{Key: "forever", Value: []byte("v"), Expiration: NoExpiration}); err != nil {
+        t.Fatal(err)
+    }
+    if err := c.Set(&Item{Key: "default", Value: []byte("v")}); err != nil {
+        t.Fatal(err)
+    }
+
+    if ttl, err := c.GetTTL("forever"); err != nil || ttl != NeverExpires {
+        t.Errorf("GetTTL(forever) = %v, %v; want NeverExpires", ttl, err)
+    }
+    if ttl, err := c.GetTTL("default"); err != nil || ttl <= 0 || ttl > 300*time.Second {
+        t.Errorf("GetTTL(default) = %v, %v; want the 300s default", ttl, err)
+    }
+}
+
+func TestVerifyExpiration(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    expires := time.Now().Add(time.Hour)
+    if err := c.Set(&Item{Key: "abs", Value: []byte("v"), Expiration: int32(expires.Unix())}); err != nil {
+        t.Fatal(err)
+    }
+    if err := c.Set(&Item{Key: "forever", Value: []byte("v")}); err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        key      string
+        expected time.Time
+        want     bool
+    }{
+        {"abs", expires, true},
+        {"abs", expires.Add(10 * time.Minute), false},
+        {"abs", time.Time{}, false},
+        {"forever", time.Time{}, true},
+        {"forever", expires, false},
+    }
+    for _, tt := range tests {
+        ok, err := c.VerifyExpiration(tt.key, tt.expected, 2*time.Second)
+        if err != nil || ok != tt.want {
+            t.Errorf("VerifyExpiration(%q, %v) = %v, %v; want %v", tt.key, tt.expected, ok, err, tt.want)
+        }
+    }
+    if _, err := c.VerifyExpiration("missing", expires, time.Second); err != ErrCacheMiss {
+        t.Errorf("VerifyExpiration(missing) error = %v, want ErrCacheMiss", err)
+    }
+}
+
+func TestMetaGet(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    if err := c.Set(&Item{Key: "k", Value: []byte("hello"), Flags: 7, Expiration: 300}); err != nil {
+        t.Fatal(err)
+    }
+
+    res, err := c.MetaGet("k", MetaGetFlags{Value: true, CAS: true, Flags: true, TTL: true, HitBefore: true})
+    if err != nil {
+        t.Fatalf("MetaGet: %v", err)
+    }
+    if string(res.Value) != "hello" || res.Flags != 7 || res.CAS == 0 || res.HitBefore {
+        t.Errorf("MetaGet = %+v; want value hello, flags 7, a CAS id and no earlier hit", res)
+    }
+    if res.TTL <= 295*time.Second || res.TTL > 300*time.Second {
+        t.Errorf("TTL = %v, want about 300s", res.TTL)
+    }
+    if res, err = c.MetaGet("k", MetaGetFlags{HitBefore: true, Touch: NoExpiration}); err != nil || !res.HitBefore || res.Value != nil {
+        t.Errorf("second MetaGet = %+v, %v; want a hit before and no value", res, err)
+    }
+    if ttl, err := c.GetTTL("k"); err != nil || ttl != NeverExpires {
+        t.Errorf("TTL after Touch: NoExpiration = %v, %v; want NeverExpires", ttl, err)
+    }
+
+    if _, err := c.MetaGet("missing", MetaGetFlags{Value: true}); err != ErrCacheMiss {
+        t.Errorf("MetaGet(missing) = %v, want ErrCacheMiss", err)
+    }
+    res, err = c.MetaGet("missing", MetaGetFlags{Value: true, Vivify: 30})
+    if err != nil || !res.Won || len(res.Value) != 0 {
+        t.Errorf("MetaGet(missing) with Vivify = %+v, %v; want an empty value and Won", res, err)
+    }
+    if res, err = c.MetaGet("missing", MetaGetFlags{Vivify: 30}); err != nil || res.Won {
+        t.Errorf("second vivifying MetaGet = %+v, %v; want not Won", res, err)
+    }
+    if want := "mg k v c f t h"; fs.commands()[1] != want {
+        t.Errorf("command = %q, want %q", fs.commands()[1], want)
+    }
+}
+
+func TestMetaSetAndDelete(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    it := &Item{Key: "k", Value: []byte("a"), Flags: 3}
+    if err := c.MetaSet(it, MetaSetFlags{}); err != nil {
+        t.Fatalf("MetaSet: %v", err)
+    }
+    if it.CAS() == 0 {
+        t.Fatalf("MetaSet did not record the CAS id")
+    }
+    if err := c.MetaSet(&Item{Key: "k", Value: []byte("x")}, MetaSetFlags{Mode: MetaModeAdd}); err != ErrNotStored {
+        t.Errorf("MetaSet in add mode of existing item = %v, want ErrNotStored", err)
+    }
+    if err := c.MetaSet(&Item{Key: "k", Value: []byte("b")}, MetaSetFlags{Mode: MetaModeAppend, CAS: it.CAS()}); err != nil {
+        t.Errorf("MetaSet in append mode = %v", err)
+    }
+    if err := c.MetaSet(&Item{Key: "k", Value: []byte("x")}, MetaSetFlags{CAS: it.CAS()}); err != ErrCASConflict {
+        t.Errorf("MetaSet with stale CAS = %v, want ErrCASConflict", err)
+    }
+    if got, err := c.Get("k"); err != nil || string(got.Value) != "ab" || got.Flags != 3 {
+        t.Errorf("Get = %+v, %v; want value ab with flags 3", got, err)
+    }
+
+    if err := c.MetaDelete("k", MetaDeleteFlags{CAS: it.CAS()}); err != ErrCASConflict {
+        t.Errorf("MetaDelete with stale CAS = %v, want ErrCASConflict", err)
+    }
+    if err := c.MetaDelete("k", MetaDeleteFlags{Invalidate: true, TTL: 30}); err != nil {
+        t.Fatalf("MetaDelete with Invalidate: %v", err)
+    }
+    if res, err := c.MetaGet("k", MetaGetFlags{Value: true}); err != nil || !res.Stale || string(res.Value) != "ab" {
+        t.Errorf("MetaGet of invalidated item = %+v, %v; want the stale value", res, err)
+    }
+    if err := c.MetaDelete("k", MetaDeleteFlags{}); err != nil {
+        t.Fatalf("MetaDelete: %v", err)
+    }
+    if err := c.MetaDelete("k", MetaDeleteFlags{}); err != ErrCacheMiss {
+        t.Errorf("MetaDelete of deleted item = %v, want ErrCacheMiss", err)
+    }
+}
+
+func TestMetaArithmetic(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    if _, err := c.MetaArithmetic("n", MetaArithmeticFlags{Delta: 1}); err != ErrCacheMiss {
+        t.Errorf("MetaArithmetic of missing counter = %v, want ErrCacheMiss", err)
+    }
+    tests := []struct {
+        flags MetaArithmeticFlags
+        want  uint64
+    }{
+        {MetaArithmeticFlags{Delta: 1, Vivify: 60, Initial: 10}, 10},
+        {MetaArithmeticFlags{Delta: 5}, 15},
+        {MetaArithmeticFlags{Delta: 3, Decrement: true}, 12},
+        {MetaArithmeticFlags{Delta: 100, Decrement: true}, 0},
+    }
+    for _, tt := range tests {
+        if n, err := c.MetaArithmetic("n", tt.flags); err != nil || n != tt.want {
+            t.Errorf("MetaArithmetic(%+v) = %d, %v; want %d", tt.flags, n, err, tt.want)
+        }
+    }
+    if err := c.Set(&Item{Key: "s", Value: []byte("text")}); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := c.MetaArithmetic("s", MetaArithmeticFlags{Delta: 1}); err == nil {
+        t.Errorf("MetaArithmetic of non-numeric value succeeded")
+    }
+}
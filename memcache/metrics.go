@@ -0,0 +1,140 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "errors"
+    "net"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Metrics is a snapshot of a client's operation counters and pool
+// state, as returned by Client.Metrics. Counters start at zero when the
+// client is created and only grow.
+type Metrics struct {
+    // Gets is the number of keys requested by get operations, and Hits
+    // and Misses how many of them were found and not found. Keys of a
+    // request that failed count towards neither.
+    Gets, Hits, Misses uint64
+
+    // Sets is the number of storage commands (set, add, cas and meta
+    // set) sent, and Deletes the number of delete commands.
+    Sets, Deletes uint64
+
+    // BytesRead is the number of bytes of get responses read, values
+    // and protocol framing included, and BytesWritten the number of
+    // bytes of storage commands written, data blocks included.
+    BytesRead, BytesWritten uint64
+
+    // Errors counts failed operations by kind: "timeout", "busy" for
+    // ErrServerBusy, "closed" for ErrClientClosed, "network" for other
+    // network errors and "other" for anything else. Cache misses and
+    // other cache-level outcomes are not errors.
+    Errors map[string]uint64
+
+    // Dials and DialErrors count connection attempts and failed ones.
+    // DialTime is the total time spent dialing.
+    Dials, DialErrors uint64
+    DialTime          time.Duration
+
+    // OpenConns is the number of connections currently open or being
+    // dialed, in use or idle, across all servers, and IdleConns the
+    // number of those idle in the pool.
+    OpenConns, IdleConns int
+}
+
+// clientMetrics holds a client's live counters.
+type clientMetrics struct {
+    gets, hits, misses uint64
+    sets, deletes      uint64
+    bytesRead          uint64
+    bytesWritten       uint64
+    dials, dialErrors  uint64
+    dialNanos          int64
+
+    errLk  sync.Mutex
+    errors map[string]uint64
+}
+
+func (m *clientMetrics) dialDone(err error, d time.Duration) {
+    atomic.AddUint64(&m.dials, 1)
+    atomic.AddInt64(&m.dialNanos, int64(d))
+    if err != nil {
+        atomic.AddUint64(&m.dialErrors, 1)
+    }
+}
+
+// recordError counts err if it is an operation failure rather than a
+// cache-level outcome.
+func (m *clientMetrics) recordError(err error) {
+    if err == nil || err == errMissingEnd || err != ErrServerBusy && resumableError(err) {
+        return
+    }
+    kind := "other"
+    var ne net.Error
+    switch {
+    case IsTimeout(err):
+        kind = "timeout"
+    case err == ErrServerBusy:
+        kind = "busy"
+    case err == ErrClientClosed:
+        kind = "closed"
+    case errors.As(err, &ne):
+        kind = "network"
+    }
+    m.errLk.Lock()
+    defer m.errLk.Unlock()
+    if m.errors == nil {
+        m.errors = make(map[string]uint64)
+    }
+    m.errors[kind]++
+}
+
+// Metrics returns a snapshot of the client's counters and pool state.
+func (c *Client) Metrics() Metrics {
+    m := &c.metrics
+    s := Metrics{
+        Gets:         atomic.LoadUint64(&m.gets),
+        Hits:         atomic.LoadUint64(&m.hits),
+        Misses:       atomic.LoadUint64(&m.misses),
+        Sets:         atomic.LoadUint64(&m.sets),
+        Deletes:      atomic.LoadUint64(&m.deletes),
+        BytesRead:    atomic.LoadUint64(&m.bytesRead),
+        BytesWritten: atomic.LoadUint64(&m.bytesWritten),
+        Dials:        atomic.LoadUint64(&m.dials),
+        DialErrors:   atomic.LoadUint64(&m.dialErrors),
+        DialTime:     time.Duration(atomic.LoadInt64(&m.dialNanos)),
+        Errors:       make(map[string]uint64),
+    }
+    m.errLk.Lock()
+    for kind, n := range m.errors {
+        s.Errors[kind] = n
+    }
+    m.errLk.Unlock()
+
+    c.lk.Lock()
+    for _, n := range c.numOpen {
+        s.OpenConns += n
+    }
+    for _, freelist := range c.freeconn {
+        s.IdleConns += len(freelist)
+    }
+    c.lk.Unlock()
+    return s
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "testing"
+)
+
+func TestMetrics(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+
+    if err := c.Set(&Item{Key: "a", Value: []byte("1")}); err != nil {
+        t.Fatal(err)
+    }
+    if err := c.Set(&Item{Key: "b", Value: []byte("2")}); err != nil {
+        t.Fatal(err)
+    }
+    c.Get("a")
+    c.Get("missing")
+    c.GetMulti([]string{"a", "b", "missing"})
+    c.Delete("a")
+    c.Delete("a")
+
+    m := c.Metrics()
+    if m.Sets != 2 || m.Deletes != 2 {
+        t.Errorf("Sets, Deletes = %d, %d; want 2, 2", m.Sets, m.Deletes)
+    }
+    if m.Gets != 5 || m.Hits != 3 || m.Misses != 2 {
+        t.Errorf("Gets, Hits, Misses = %d, %d, %d; want 5, 3, 2", m.Gets, m.Hits, m.Misses)
+    }
+    if len(m.Errors) != 0 {
+        t.Errorf("Errors = %v after only cache-level failures, want none", m.Errors)
+    }
+    if m.Dials != 1 || m.DialErrors != 0 || m.DialTime <= 0 {
+        t.Errorf("Dials = %d, DialErrors = %d, DialTime = %v; want one successful dial", m.Dials, m.DialErrors, m.DialTime)
+    }
+    if m.OpenConns != 1 || m.IdleConns != 1 {
+        t.Errorf("OpenConns, IdleConns = %d, %d; want 1, 1", m.OpenConns, m.IdleConns)
+    }
+
+    fs.Close()
+    c.selector.(*ServerList).SetServers("127.0.0.1:1")
+    if _, err := c.Get("a"); err == nil {
+        t.Fatal("Get from a down server succeeded")
+    }
+    m = c.Metrics()
+    if m.Dials != 2 || m.DialErrors != 1 {
+        t.Errorf("Dials, DialErrors = %d, %d; want 2, 1", m.Dials, m.DialErrors)
+    }
+    if m.Errors["network"] != 1 {
+        t.Errorf("Errors = %v, want one network error", m.Errors)
+    }
+    if m.Gets != 6 || m.Hits != 3 || m.Misses != 2 {
+        t.Errorf("failed Get changed Gets, Hits, Misses to %d, %d, %d; want 6, 3, 2", m.Gets, m.Hits, m.Misses)
+    }
+}
+
+func TestMetricsBytes(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+
+    if err := c.Set(&Item{Key: "k", Value: []byte("hello")}); err != nil {
+        t.Fatal(err)
+    }
+    // "set k 0 0 5\r\n" followed by "hello\r\n".
+    if got, want := c.Metrics().BytesWritten, uint64(13+7); got != want {
+        t.Errorf("BytesWritten = %d, want %d", got, want)
+    }
+
+    if _, err := c.Get("k", WithNoCAS()); err != nil {
+        t.Fatal(err)
+    }
+    // "VALUE k 0 5\r\n", "hello\r\n" and "END\r\n".
+    if got, want := c.Metrics().BytesRead, uint64(13+7+5); got != want {
+        t.Errorf("BytesRead = %d, want %d", got, want)
+    }
+    c.Get("missing", WithNoCAS())
+    if got, want := c.Metrics().BytesRead, uint64(25+5); got != want {
+        t.Errorf("BytesRead after a miss = %d, want %d", got, want)
+    }
+}
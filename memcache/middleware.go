@@ -0,0 +1,61 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+// Op describes an operation passed through the middleware chain.
+type Op struct {
+    // Name is the protocol verb of the operation: "get", "set", "add",
+    // "cas", "delete", "incr" or "decr".
+    Name string
+
+    // Key is the key the operation applies to.
+    Key string
+
+    // Item is the item being stored, for storage operations. For get it
+    // is nil on the way in and holds the item found, if any, once the
+    // operation has run.
+    Item *Item
+}
+
+// OpFunc performs an operation.
+type OpFunc func(op *Op) error
+
+// Middleware wraps an OpFunc with extra behavior, such as logging,
+// tracing or retries. It may inspect or change op before calling next,
+// inspect the result afterwards, or not call next at all.
+type Middleware func(next OpFunc) OpFunc
+
+// Use appends middleware to the chain that Get, Set, Add,
+// CompareAndSwap, Delete, Increment and Decrement run through. The
+// first middleware added is the outermost: it sees each operation
+// first and its result last.
+func (c *Client) Use(mw ...Middleware) {
+    c.mwLk.Lock()
+    defer c.mwLk.Unlock()
+    c.middleware = append(c.middleware, mw...)
+}
+
+// intercept runs fn for op, wrapped in the middleware chain.
+func (c *Client) intercept(op *Op, fn OpFunc) error {
+    c.mwLk.RLock()
+    mws := c.middleware
+    c.mwLk.RUnlock()
+    for i := len(mws) - 1; i >= 0; i-- {
+        fn = mws[i](fn)
+    }
+    return fn(op)
+}
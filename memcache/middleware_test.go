@@ -0,0 +1,72 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestMiddlewareOrder(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    var trace []string
+    tracer := func(name string) Middleware {
+        return func(next OpFunc) OpFunc {
+            return func(op *Op) error {
+                trace = append(trace, name+">"+op.Name+" "+op.Key)
+                err := next(op)
+                trace = append(trace, name+"<"+op.Name)
+                return err
+            }
+        }
+    }
+    c.Use(tracer("a"), tracer("b"))
+
+    if err := c.Set(&Item{Key: "k", Value: []byte("v")}); err != nil {
+        t.Fatal(err)
+    }
+    it, err := c.Get("k")
+    if err != nil || string(it.Value) != "v" {
+        t.Fatalf("Get = %v, %v", it, err)
+    }
+    want := "a>set k,b>set k,b<set,a<set,a>get k,b>get k,b<get,a<get"
+    if got := strings.Join(trace, ","); got != want {
+        t.Errorf("trace = %s, want %s", got, want)
+    }
+}
+
+func TestMiddlewareShortCircuit(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    c.Use(func(next OpFunc) OpFunc {
+        return func(op *Op) error {
+            if op.Name == "get" {
+                op.Item = &Item{Key: op.Key, Value: []byte("mocked")}
+                return nil
+            }
+            return next(op)
+        }
+    })
+    it, err := c.Get("k")
+    if err != nil || string(it.Value) != "mocked" {
+        t.Fatalf("Get = %v, %v; want the mocked item", it, err)
+    }
+    if d := fs.numDials(); d != 0 {
+        t.Errorf("mocked Get dialed the server %d times", d)
+    }
+}
@@ -0,0 +1,408 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "bufio"
+    "context"
+    "errors"
+    "net"
+    "sync"
+    "time"
+)
+
+// errMuxDrained is the error of a multiplexed connection closed by
+// drain. A request that finds its connection drained is sent again on
+// a new one.
+var errMuxDrained = errors.New("memcache: multiplexed connection retired")
+
+// muxQueueLen is the number of requests that may be awaiting their
+// response on a multiplexed connection before writers block.
+const muxQueueLen = 256
+
+// muxConn is a connection shared by concurrent get requests when
+// Client.Multiplex is set. Requests are written under wmu and queued
+// in the same order, and a reader goroutine reads the responses off
+// the connection in that order, handing each to its request.
+type muxConn struct {
+    c       *Client
+    cn      *conn
+    nc      net.Conn
+    r       *bufio.Reader
+    authGen int // the client's authGen when nc was authenticated
+
+    wmu     sync.Mutex // guards w and the order of pending
+    w       *bufio.Writer
+    pending chan *muxRequest
+
+    // slots, if non-nil, holds a token for every request written and
+    // not yet answered, bounding them to Client.MaxPipelineDepth.
+    slots chan struct{}
+
+    mu       sync.Mutex
+    err      error         // why the connection died
+    dead     chan struct{} // closed when the connection dies
+    inflight int           // requests written and not yet answered
+    draining bool          // close once inflight drops to zero
+}
+
+// muxDial is a multiplexed connection being dialed. Requests for the
+// same address wait for it rather than dialing their own.
+type muxDial struct {
+    done chan struct{} // closed once mc or err is set
+    mc   *muxConn
+    err  error
+}
+
+// muxRequest is a get request awaiting its response.
+type muxRequest struct {
+    nkeys int
+    done  chan error
+
+    mu sync.Mutex // guards cb
+    cb func(*Item)
+}
+
+// deliver passes it to the request's callback, unless the request has
+// been abandoned.
+func (req *muxRequest) deliver(it *Item) {
+    req.mu.Lock()
+    defer req.mu.Unlock()
+    if req.cb != nil {
+        req.cb(it)
+    }
+}
+
+// abandon stops the items of the request's response, which is still
+// to be read off the connection, from reaching its callback.
+func (req *muxRequest) abandon() {
+    req.mu.Lock()
+    defer req.mu.Unlock()
+    req.cb = nil
+}
+
+// getMultiplexed is getFromAddr for Multiplex mode. The wait for the
+// response ends early when o's context is done or its timeout passes.
+func (c *Client) getMultiplexed(addr net.Addr, o *getOptions, line string, nkeys int, cb func(*Item)) (err error) {
+    if c.MaxLatency > 0 {
+        defer c.recordLatency(addr, time.Now())
+    }
+    if c.FailureLimit > 0 {
+        defer func() { c.recordHealth(addr, err) }()
+    }
+    defer func() { c.metrics.recordError(err) }()
+    ctx := o.ctx
+    if o.timeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, o.timeout)
+        defer cancel()
+    }
+    for {
+        mc, err := c.getMuxConn(ctx, addr)
+        if err != nil {
+            return err
+        }
+        if err := mc.do(ctx, line, nkeys, cb); err != errMuxDrained {
+            return err
+        }
+    }
+}
+
+// getMuxConn returns the live multiplexed connection to addr, dialing
+// a new one if there is none or if it was authenticated with
+// credentials SetAuth has since replaced. Only one dial to an address
+// is in progress at a time; other requests for it wait on that dial,
+// or until ctx is done.
+func (c *Client) getMuxConn(ctx context.Context, addr net.Addr) (*muxConn, error) {
+    key := addr.String()
+    for {
+        if err := ctx.Err(); err != nil {
+            return nil, err
+        }
+        c.lk.Lock()
+        authGen := c.authGen
+        c.lk.Unlock()
+
+        c.muxLk.Lock()
+        if mc := c.muxConns[key]; mc != nil && !mc.isDead() {
+            if mc.authGen == authGen {
+                c.muxLk.Unlock()
+                return mc, nil
+            }
+            delete(c.muxConns, key)
+            mc.drain()
+        }
+        if d := c.muxDials[key]; d != nil {
+            c.muxLk.Unlock()
+            select {
+            case <-d.done:
+            case <-ctx.Done():
+                return nil, ctx.Err()
+            }
+            // A dial that failed only because its caller gave up
+            // says nothing about the server; try again.
+            if d.err != nil && !errors.Is(d.err, context.Canceled) && !errors.Is(d.err, context.DeadlineExceeded) {
+                return nil, d.err
+            }
+            continue
+        }
+        d := &muxDial{done: make(chan struct{})}
+        if c.muxDials == nil {
+            c.muxDials = make(map[string]*muxDial)
+        }
+        c.muxDials[key] = d
+        c.muxLk.Unlock()
+
+        d.mc, d.err = c.newMuxConn(ctx, addr)
+        c.muxLk.Lock()
+        delete(c.muxDials, key)
+        if d.err == nil {
+            if c.muxConns == nil {
+                c.muxConns = make(map[string]*muxConn)
+            }
+            c.muxConns[key] = d.mc
+        }
+        c.muxLk.Unlock()
+        close(d.done)
+        return d.mc, d.err
+    }
+}
+
+// newMuxConn takes a connection to addr for multiplexing and starts
+// its reader. The connection counts against MaxOpenConns like any
+// other until it dies.
+func (c *Client) newMuxConn(ctx context.Context, addr net.Addr) (*muxConn, error) {
+    cn, err := c.getConn(ctx, addr)
+    if err != nil {
+        return nil, err
+    }
+    mc := &muxConn{
+        c:       c,
+        cn:      cn,
+        nc:      cn.nc,
+        r:       cn.rw.Reader,
+        w:       cn.rw.Writer,
+        authGen: cn.authGen,
+        pending: make(chan *muxRequest, muxQueueLen),
+        dead:    make(chan struct{}),
+    }
+    if c.MaxPipelineDepth > 0 {
+        mc.slots = make(chan struct{}, c.MaxPipelineDepth)
+    }
+    go mc.readLoop()
+    return mc, nil
+}
+
+// drainMuxConns retires all multiplexed connections, so that later
+// requests dial new ones. Each is closed once the requests already
+// written to it have been answered.
+func (c *Client) drainMuxConns() {
+    c.muxLk.Lock()
+    conns := c.muxConns
+    c.muxConns = nil
+    c.muxLk.Unlock()
+    for _, mc := range conns {
+        mc.drain()
+    }
+}
+
+// closeMuxConns closes all multiplexed connections.
+func (c *Client) closeMuxConns() {
+    c.muxLk.Lock()
+    defer c.muxLk.Unlock()
+    for key, mc := range c.muxConns {
+        mc.fail(ErrClientClosed)
+        delete(c.muxConns, key)
+    }
+}
+
+// do writes a request line expecting a get response for up to nkeys
+// items, and waits for its response to be read or for ctx to be done.
+// A request given up on is left for the reader to consume, but its
+// items are no longer passed to cb, and it holds its pipeline slot
+// until its response has been read.
+func (mc *muxConn) do(ctx context.Context, line string, nkeys int, cb func(*Item)) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    if mc.slots != nil {
+        if err := mc.acquireSlot(ctx); err != nil {
+            return err
+        }
+    }
+    req := &muxRequest{nkeys: nkeys, cb: cb, done: make(chan error, 1)}
+    mc.wmu.Lock()
+    mc.mu.Lock()
+    dead := mc.err != nil
+    if !dead {
+        mc.inflight++
+    }
+    mc.mu.Unlock()
+    if dead {
+        mc.wmu.Unlock()
+        mc.releaseSlot()
+        return mc.deadErr()
+    }
+    mc.nc.SetWriteDeadline(time.Now().Add(mc.c.writeTimeout()))
+    _, err := mc.w.WriteString(line)
+    if err == nil {
+        err = mc.w.Flush()
+    }
+    if err != nil {
+        mc.wmu.Unlock()
+        mc.fail(err)
+        mc.releaseSlot()
+        return err
+    }
+    select {
+    case mc.pending <- req:
+    case <-mc.dead:
+        mc.wmu.Unlock()
+        mc.releaseSlot()
+        return mc.deadErr()
+    }
+    mc.wmu.Unlock()
+
+    select {
+    case err := <-req.done:
+        return err
+    case <-ctx.Done():
+        req.abandon()
+        return ctx.Err()
+    case <-mc.dead:
+        // The reader may have answered us just before it died.
+        select {
+        case err := <-req.done:
+            return err
+        default:
+            return mc.deadErr()
+        }
+    }
+}
+
+// acquireSlot waits until fewer than MaxPipelineDepth requests are
+// outstanding, or AcquireTimeout passes, or ctx is done.
+func (mc *muxConn) acquireSlot(ctx context.Context) error {
+    var timeout <-chan time.Time
+    if mc.c.AcquireTimeout > 0 {
+        t := time.NewTimer(mc.c.AcquireTimeout)
+        defer t.Stop()
+        timeout = t.C
+    }
+    select {
+    case mc.slots <- struct{}{}:
+        return nil
+    case <-mc.dead:
+        return mc.deadErr()
+    case <-timeout:
+        return ErrAcquireTimeout
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+// releaseSlot frees the pipeline slot of a request that has been
+// answered or was never sent. Once the connection dies its slots no
+// longer matter, as acquireSlot fails on a dead connection.
+func (mc *muxConn) releaseSlot() {
+    if mc.slots != nil {
+        <-mc.slots
+    }
+}
+
+// readLoop reads responses in request order until the connection
+// dies. A response that cannot be parsed leaves the stream out of
+// step, so any error other than a cache-level one kills the connection
+// and fails every request still waiting on it.
+func (mc *muxConn) readLoop() {
+    for {
+        var req *muxRequest
+        select {
+        case req = <-mc.pending:
+        case <-mc.dead:
+            return
+        }
+        mc.nc.SetReadDeadline(time.Now().Add(mc.c.readTimeout()))
+        err := mc.c.parseGetResponse(mc.r, req.nkeys, req.deliver)
+        mc.releaseSlot()
+        req.done <- err
+        if err != nil && !resumableError(err) {
+            mc.fail(err)
+            return
+        }
+        mc.answered()
+    }
+}
+
+// answered records that a request has been answered, closing a
+// draining connection once none is left.
+func (mc *muxConn) answered() {
+    mc.mu.Lock()
+    mc.inflight--
+    idle := mc.draining && mc.inflight == 0
+    mc.mu.Unlock()
+    if idle {
+        mc.fail(errMuxDrained)
+    }
+}
+
+// drain makes mc close once the requests written to it have been
+// answered. Requests that find it closed are retried elsewhere.
+func (mc *muxConn) drain() {
+    mc.mu.Lock()
+    mc.draining = true
+    idle := mc.inflight == 0
+    mc.mu.Unlock()
+    if idle {
+        mc.fail(errMuxDrained)
+    }
+}
+
+// fail kills the connection with the given error, if it is not dead
+// already.
+func (mc *muxConn) fail(err error) {
+    mc.mu.Lock()
+    defer mc.mu.Unlock()
+    if mc.err != nil {
+        return
+    }
+    mc.err = err
+    switch err {
+    case ErrClientClosed:
+        mc.cn.close("client shut down")
+    case errMuxDrained:
+        mc.cn.close("retired")
+    default:
+        mc.cn.close("error: " + err.Error())
+    }
+    close(mc.dead)
+}
+
+func (mc *muxConn) isDead() bool {
+    select {
+    case <-mc.dead:
+        return true
+    default:
+        return false
+    }
+}
+
+func (mc *muxConn) deadErr() error {
+    mc.mu.Lock()
+    defer mc.mu.Unlock()
+    return mc.err
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Namespace is a view of a Client whose keys are scoped to a named
+// namespace. Every key is prefixed with the namespace's name and
+// current version, which is kept in the counter item "ns:<name>", so
+// InvalidateNamespace makes every item in the namespace unreachable
+// at once, without a flush. The orphaned items age out of the cache
+// on their own.
+//
+// The version is read from the server on every operation, so that an
+// invalidation by any client is seen at once; each operation therefore
+// costs an extra round trip.
+type Namespace struct {
+    c    *Client
+    name string
+}
+
+// Namespace returns a view of c scoped to the namespace name.
+func (c *Client) Namespace(name string) *Namespace {
+    return &Namespace{c: c, name: name}
+}
+
+// InvalidateNamespace makes every item stored through Namespace(name)
+// unreachable by bumping the namespace's version.
+func (c *Client) InvalidateNamespace(name string) error {
+    _, err := c.Increment(namespaceKey(name), 1)
+    if err == ErrCacheMiss {
+        // The next use starts a fresh version anyway.
+        return nil
+    }
+    return err
+}
+
+func namespaceKey(name string) string {
+    return "ns:" + name
+}
+
+// version returns the namespace's current version, creating it if
+// needed. A new version starts from the current time, so that a
+// counter lost to eviction does not bring back the items of an
+// earlier version.
+func (ns *Namespace) version() (string, error) {
+    key := namespaceKey(ns.name)
+    for {
+        it, err := ns.c.Get(key)
+        if err == nil {
+            return string(it.Value), nil
+        }
+        if err != ErrCacheMiss {
+            return "", err
+        }
+        v := strconv.FormatInt(time.Now().UnixNano(), 10)
+        err = ns.c.Add(&Item{Key: key, Value: []byte(v), Expiration: NoExpiration})
+        if err == nil {
+            return v, nil
+        }
+        if err != ErrNotStored {
+            return "", err
+        }
+        // Another client created it first; read theirs.
+    }
+}
+
+// prefix returns the prefix of the namespace's keys at its current
+// version.
+func (ns *Namespace) prefix() (string, error) {
+    v, err := ns.version()
+    if err != nil {
+        return "", err
+    }
+    return ns.name + ":" + v + ":", nil
+}
+
+// Get gets the item for the given key in the namespace. The returned
+// item's Key is the unprefixed key.
+func (ns *Namespace) Get(key string) (*Item, error) {
+    prefix, err := ns.prefix()
+    if err != nil {
+        return nil, err
+    }
+    it, err := ns.c.Get(prefix + key)
+    if err != nil {
+        return nil, err
+    }
+    it.Key = key
+    return it, nil
+}
+
+// GetMulti is a batch version of Get.
+func (ns *Namespace) GetMulti(keys []string) (map[string]*Item, error) {
+    prefix, err := ns.prefix()
+    if err != nil {
+        return nil, err
+    }
+    full := make([]string, len(keys))
+    for i, key := range keys {
+        full[i] = prefix + key
+    }
+    m, err := ns.c.GetMulti(full)
+    items := make(map[string]*Item, len(m))
+    for _, it := range m {
+        it.Key = strings.TrimPrefix(it.Key, prefix)
+        items[it.Key] = it
+    }
+    return items, err
+}
+
+// Set writes the given item in the namespace, unconditionally.
+func (ns *Namespace) Set(item *Item) error {
+    return ns.store(item, ns.c.Set)
+}
+
+// Add writes the given item in the namespace, if no value already
+// exists for its key.
+func (ns *Namespace) Add(item *Item) error {
+    return ns.store(item, ns.c.Add)
+}
+
+func (ns *Namespace) store(item *Item, fn func(*Item) error) error {
+    prefix, err := ns.prefix()
+    if err != nil {
+        return err
+    }
+    scoped := *item
+    scoped.Key = prefix + item.Key
+    return fn(&scoped)
+}
+
+// Delete deletes the item with the given key in the namespace.
+func (ns *Namespace) Delete(key string) error {
+    prefix, err := ns.prefix()
+    if err != nil {
+        return err
+    }
+    return ns.c.Delete(prefix + key)
+}
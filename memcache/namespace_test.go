@@ -0,0 +1,56 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "testing"
+)
+
+func TestNamespaceInvalidation(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    users := c.Namespace("users")
+    other := c.Namespace("other")
+
+    for _, ns := range []*Namespace{users, other} {
+        if err := ns.Set(&Item{Key: "alice", Value: []byte("v1")}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    it, err := users.Get("alice")
+    if err != nil || it.Key != "alice" || string(it.Value) != "v1" {
+        t.Fatalf("Get = %+v, %v; want alice=v1", it, err)
+    }
+
+    if err := c.InvalidateNamespace("users"); err != nil {
+        t.Fatalf("InvalidateNamespace: %v", err)
+    }
+    if _, err := users.Get("alice"); err != ErrCacheMiss {
+        t.Errorf("Get after invalidation error = %v, want ErrCacheMiss", err)
+    }
+    if _, err := other.Get("alice"); err != nil {
+        t.Errorf("Get in another namespace = %v, want it untouched", err)
+    }
+
+    if err := users.Set(&Item{Key: "alice", Value: []byte("v2")}); err != nil {
+        t.Fatal(err)
+    }
+    m, err := users.GetMulti([]string{"alice", "bob"})
+    if err != nil || len(m) != 1 || string(m["alice"].Value) != "v2" {
+        t.Errorf("GetMulti = %v, %v; want alice=v2 only", m, err)
+    }
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "context"
+    "time"
+)
+
+// GetOption customizes a single Get or GetMulti call, overriding the
+// client's settings for that call only.
+type GetOption func(*getOptions)
+
+// getOptions are the settings in effect for one call. Calls other than
+// gets only use ctx.
+type getOptions struct {
+    ctx     context.Context
+    timeout time.Duration // zero means the client's timeout
+    noCAS   bool
+    write   bool // the call changes the server; see DryRun
+}
+
+// WithTimeout sets the socket read/write timeout for the call in place
+// of the client's Timeout.
+func WithTimeout(d time.Duration) GetOption {
+    return func(o *getOptions) { o.timeout = d }
+}
+
+// WithContext makes the call give up when ctx is done, whether it is
+// waiting for a connection or for the server, returning ctx's error.
+func WithContext(ctx context.Context) GetOption {
+    return func(o *getOptions) { o.ctx = ctx }
+}
+
+// WithNoCAS makes the call fetch items without their CAS ids, as if
+// the client's DisableCAS were set.
+func WithNoCAS() GetOption {
+    return func(o *getOptions) { o.noCAS = true }
+}
+
+// context returns the context of the call o holds the settings of,
+// which is the background context if o is nil.
+func (o *getOptions) context() context.Context {
+    if o == nil {
+        return context.Background()
+    }
+    return o.ctx
+}
+
+// getOptions returns the settings for a get call given its options.
+// With Multiplex set, only WithNoCAS applies.
+func (c *Client) getOptions(opts []GetOption) *getOptions {
+    return c.getOptionsContext(context.Background(), opts)
+}
+
+// getOptionsContext is getOptions for a call made with ctx, which a
+// WithContext option overrides.
+func (c *Client) getOptionsContext(ctx context.Context, opts []GetOption) *getOptions {
+    o := &getOptions{ctx: ctx, noCAS: c.DisableCAS}
+    for _, opt := range opts {
+        opt(o)
+    }
+    return o
+}
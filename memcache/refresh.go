@@ -0,0 +1,82 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "sync"
+    "time"
+)
+
+// RefreshAhead configures the refreshing of items that Get finds close
+// to expiring. See Client.RefreshAhead.
+type RefreshAhead struct {
+    // Threshold is the remaining time to live below which an item is
+    // refreshed.
+    Threshold time.Duration
+
+    // Loader returns a fresh item for key, typically from the
+    // backing store. The item is stored with Set; its Key is set to
+    // key. If Loader fails, the item is left to expire.
+    Loader func(key string) (*Item, error)
+}
+
+// refresher tracks the refreshes in progress, so that each key has at
+// most one.
+type refresher struct {
+    lk      sync.Mutex
+    running map[string]bool
+}
+
+// refreshAhead is called after Get found key. If RefreshAhead is
+// configured, it checks the item's remaining time to live in the
+// background and, if it is below the threshold, loads and stores a
+// fresh item. Get itself does not wait for either.
+func (c *Client) refreshAhead(key string) {
+    ra := c.RefreshAhead
+    if ra == nil || ra.Loader == nil {
+        return
+    }
+    r := &c.refresher
+    r.lk.Lock()
+    if r.running[key] {
+        r.lk.Unlock()
+        return
+    }
+    if r.running == nil {
+        r.running = make(map[string]bool)
+    }
+    r.running[key] = true
+    r.lk.Unlock()
+
+    go func() {
+        defer func() {
+            r.lk.Lock()
+            delete(r.running, key)
+            r.lk.Unlock()
+        }()
+        ttl, err := c.GetTTL(key)
+        if err != nil || ttl == NeverExpires || ttl >= ra.Threshold {
+            return
+        }
+        it, err := ra.Loader(key)
+        if err != nil || it == nil {
+            return
+        }
+        it.Key = key
+        c.Set(it)
+    }()
+}
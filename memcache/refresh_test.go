@@ -0,0 +1,75 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func TestRefreshAhead(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr())
+    var loads int32
+    release := make(chan struct{})
+    c.RefreshAhead = &RefreshAhead{
+        Threshold: time.Minute,
+        Loader: func(key string) (*Item, error) {
+            atomic.AddInt32(&loads, 1)
+            <-release
+            return &Item{Value: []byte("fresh"), Expiration: 3600}, nil
+        },
+    }
+    if err := c.Set(&Item{Key: "k", Value: []byte("old"), Expiration: 30}); err != nil {
+        t.Fatal(err)
+    }
+    if err := c.Set(&Item{Key: "far", Value: []byte("v"), Expiration: 3600}); err != nil {
+        t.Fatal(err)
+    }
+
+    for i := 0; i < 5; i++ {
+        it, err := c.Get("k")
+        if err != nil || string(it.Value) != "old" {
+            t.Fatalf("Get = %v, %v; want the current value while refreshing", it, err)
+        }
+        if _, err := c.Get("far"); err != nil {
+            t.Fatal(err)
+        }
+    }
+    waitFor(t, func() bool { return atomic.LoadInt32(&loads) > 0 })
+    close(release)
+    waitFor(t, func() bool {
+        it, err := c.Get("k")
+        return err == nil && string(it.Value) == "fresh"
+    })
+    if n := atomic.LoadInt32(&loads); n != 1 {
+        t.Errorf("loader called %d times, want once", n)
+    }
+}
+
+// waitFor polls cond until it holds, failing the test after a second.
+func waitFor(t *testing.T, cond func() bool) {
+    t.Helper()
+    for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+        if cond() {
+            return
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+    t.Fatal("timed out waiting for condition")
+}
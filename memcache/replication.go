@@ -0,0 +1,139 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "net"
+    "sort"
+    "strings"
+)
+
+// ErrNoReplicas is returned by SetReplicated and GetReplicated when the
+// client's selector cannot pick several servers for a key.
+var ErrNoReplicas = errors.New("memcache: server selector does not support replicas")
+
+// ReplicationError is returned by SetReplicated when fewer than a
+// quorum of the replicas stored the item.
+type ReplicationError struct {
+    // Stored and Quorum are the number of replicas that stored the
+    // item and the number that needed to.
+    Stored, Quorum int
+
+    // Errors maps the address of each replica that failed to its error.
+    Errors map[string]error
+}
+
+func (e *ReplicationError) Error() string {
+    addrs := make([]string, 0, len(e.Errors))
+    for addr := range e.Errors {
+        addrs = append(addrs, addr)
+    }
+    sort.Strings(addrs)
+    msgs := make([]string, len(addrs))
+    for i, addr := range addrs {
+        msgs[i] = fmt.Sprintf("%s: %v", addr, e.Errors[addr])
+    }
+    return fmt.Sprintf("memcache: item stored on %d of %d required replicas (%s)",
+        e.Stored, e.Quorum, strings.Join(msgs, "; "))
+}
+
+func (c *Client) pickReplicas(key string, n int) ([]net.Addr, error) {
+    if !c.validKey(key) {
+        return nil, ErrMalformedKey
+    }
+    rs, ok := c.selector.(ReplicaSelector)
+    if !ok {
+        return nil, ErrNoReplicas
+    }
+    return rs.PickServers(key, n)
+}
+
+// SetReplicated writes item to n distinct servers concurrently. The
+// write succeeds if a quorum of them, half of the replicas picked
+// rounded up, store it; otherwise a *ReplicationError describing the
+// failures is returned. If fewer than n servers are configured, every
+// server holds a replica and the quorum is computed from their number.
+func (c *Client) SetReplicated(item *Item, n int) error {
+    addrs, err := c.pickReplicas(item.Key, n)
+    if err != nil {
+        return err
+    }
+    type result struct {
+        addr net.Addr
+        err  error
+    }
+    ch := make(chan result, len(addrs))
+    for _, addr := range addrs {
+        go func(addr net.Addr) {
+            err := c.withAddrRwWrite(addr, func(rw *bufio.ReadWriter) error {
+                return c.populateOne(rw, "set", item)
+            })
+            ch <- result{addr, err}
+        }(addr)
+    }
+    rerr := &ReplicationError{Quorum: (len(addrs) + 1) / 2, Errors: make(map[string]error)}
+    for range addrs {
+        r := <-ch
+        if r.err != nil {
+            rerr.Errors[r.addr.String()] = r.err
+        } else {
+            rerr.Stored++
+        }
+    }
+    if rerr.Stored < rerr.Quorum {
+        return rerr
+    }
+    return nil
+}
+
+// GetReplicated gets the item for key from the n servers SetReplicated
+// would write it to. All replicas are asked concurrently and the first
+// one to return the item wins. ErrCacheMiss is returned if every
+// replica answers without the item; if none has it and some failed,
+// one of their errors is returned instead.
+func (c *Client) GetReplicated(key string, n int) (*Item, error) {
+    addrs, err := c.pickReplicas(key, n)
+    if err != nil {
+        return nil, err
+    }
+    type result struct {
+        item *Item
+        err  error
+    }
+    ch := make(chan result, len(addrs))
+    for _, addr := range addrs {
+        go func(addr net.Addr) {
+            var item *Item
+            err := c.getFromAddr(addr, []string{key}, nil, func(it *Item) { item = it })
+            ch <- result{item, err}
+        }(addr)
+    }
+    err = ErrCacheMiss
+    for range addrs {
+        r := <-ch
+        if r.err == nil && r.item != nil {
+            return r.item, nil
+        }
+        if r.err != nil {
+            err = r.err
+        }
+    }
+    return nil, err
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "testing"
+)
+
+func TestPickServersDistinct(t *testing.T) {
+    var ss ServerList
+    if err := ss.SetServers("127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:1", "127.0.0.1:3"); err != nil {
+        t.Fatal(err)
+    }
+    for _, key := range []string{"a", "b", "c", "d"} {
+        addrs, err := ss.PickServers(key, 5)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if len(addrs) != 3 {
+            t.Errorf("PickServers(%q, 5) returned %d addrs, want the 3 distinct servers", key, len(addrs))
+        }
+        first, _ := ss.PickServer(key)
+        if addrs[0].String() != first.String() {
+            t.Errorf("PickServers(%q)[0] = %v, want PickServer's %v", key, addrs[0], first)
+        }
+    }
+}
+
+func TestReplicatedSurvivesFailedReplica(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr(), "127.0.0.1:1")
+
+    if err := c.SetReplicated(&Item{Key: "k", Value: []byte("v")}, 2); err != nil {
+        t.Fatalf("SetReplicated with one of two replicas down = %v", err)
+    }
+    it, err := c.GetReplicated("k", 2)
+    if err != nil {
+        t.Fatalf("GetReplicated = %v", err)
+    }
+    if string(it.Value) != "v" {
+        t.Errorf("GetReplicated value = %q, want %q", it.Value, "v")
+    }
+
+    if _, err := c.GetReplicated("missing", 2); err == nil || IsCacheMiss(err) {
+        t.Errorf("GetReplicated(missing) = %v, want the down replica's error", err)
+    }
+}
+
+func TestSetReplicatedNoQuorum(t *testing.T) {
+    fs := newFakeServer(t)
+    c := New(fs.Addr(), "127.0.0.1:1", "127.0.0.1:2")
+
+    err := c.SetReplicated(&Item{Key: "k", Value: []byte("v")}, 3)
+    rerr, ok := err.(*ReplicationError)
+    if !ok {
+        t.Fatalf("SetReplicated = %v, want *ReplicationError", err)
+    }
+    if rerr.Stored != 1 || rerr.Quorum != 2 || len(rerr.Errors) != 2 {
+        t.Errorf("ReplicationError = %+v, want 1 stored of quorum 2 with 2 errors", rerr)
+    }
+}
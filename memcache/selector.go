@@ -17,8 +17,10 @@ limitations under the License.
 package memcache
 
 import (
+    "fmt"
     "hash/crc32"
     "net"
+    "sort"
     "strings"
     "sync"
 )
@@ -36,10 +38,94 @@ type ServerSelector interface {
     GetServers() ([]net.Addr, error)
 }
 
+// ReplicaSelector is a ServerSelector that can also pick several
+// distinct servers for a key, for storing replicas of it.
+type ReplicaSelector interface {
+    ServerSelector
+
+    // PickServers returns up to n distinct server addresses for key.
+    // The first is the address PickServer returns for key.
+    PickServers(key string, n int) ([]net.Addr, error)
+}
+
+// HealthSelector is a ServerSelector whose servers can be temporarily
+// taken out of selection, for instance while they are too slow. Keys
+// of a server that is down are spread over the remaining servers.
+type HealthSelector interface {
+    ServerSelector
+
+    // MarkDown takes the server at addr out of selection.
+    MarkDown(addr net.Addr)
+
+    // MarkUp returns the server at addr to selection.
+    MarkUp(addr net.Addr)
+}
+
+// RoleSelector is a ServerSelector that sends reads to different
+// servers than writes. PickServer picks the server to write a key to,
+// and PickReadServer the one to read it from.
+type RoleSelector interface {
+    ServerSelector
+
+    // PickReadServer returns the server address that a given item
+    // should be read from.
+    PickReadServer(key string) (net.Addr, error)
+}
+
+// ReadWriteSelector is a RoleSelector for deployments with separate
+// write and read tiers: storage commands, deletes and increments go to
+// the servers of Writers, while Get, GetMulti and GetTTL go to those of
+// Readers. Replication from the write tier to the read tier is up to
+// the deployment, so reads may briefly lag writes.
+type ReadWriteSelector struct {
+    Writers, Readers ServerSelector
+}
+
+func (s *ReadWriteSelector) PickServer(key string) (net.Addr, error) {
+    return s.Writers.PickServer(key)
+}
+
+func (s *ReadWriteSelector) PickReadServer(key string) (net.Addr, error) {
+    return s.Readers.PickServer(key)
+}
+
+// GetServers returns the servers of Writers followed by those of
+// Readers.
+func (s *ReadWriteSelector) GetServers() ([]net.Addr, error) {
+    writers, err := s.Writers.GetServers()
+    if err != nil {
+        return nil, err
+    }
+    readers, err := s.Readers.GetServers()
+    if err != nil {
+        return nil, err
+    }
+    return append(append([]net.Addr(nil), writers...), readers...), nil
+}
+
+// WatchableSelector is a ServerSelector whose set of servers may change
+// at runtime and that reports the changes.
+type WatchableSelector interface {
+    ServerSelector
+
+    // Watch registers fn to be called after every change to the set
+    // of servers, with the addresses added and removed by the change.
+    Watch(fn func(added, removed []string))
+}
+
 // ServerList is a simple ServerSelector. Its zero value is usable.
 type ServerList struct {
-    lk    sync.RWMutex
-    addrs []net.Addr
+    // HashTags enables hash tags: if a key contains a non-empty
+    // substring enclosed in braces, such as "{user42}:name", only the
+    // part inside the first pair of braces is hashed. Keys sharing a
+    // tag are thus stored on the same server, so a GetMulti of them
+    // only has to query one server.
+    HashTags bool
+
+    lk       sync.RWMutex
+    addrs    []net.Addr
+    down     map[string]bool
+    watchers []func(added, removed []string)
 }
 
 // SetServers changes a ServerList's set of servers at runtime and is
@@ -52,27 +138,110 @@ type ServerList struct {
 // resolve. No attempt is made to connect to the server. If any error
 // is returned, no changes are made to the ServerList.
 func (ss *ServerList) SetServers(servers ...string) error {
+    naddr, err := resolveServers(servers)
+    if err != nil {
+        return err
+    }
+    ss.setAddrs(naddr)
+    return nil
+}
+
+// SetServersStrict is like SetServers, but treats a server listed more
+// than once as a configuration mistake rather than as extra weight: it
+// returns an error wrapping ErrDuplicateServer if any two servers
+// resolve to the same address.
+func (ss *ServerList) SetServersStrict(servers ...string) error {
+    naddr, err := resolveServers(servers)
+    if err != nil {
+        return err
+    }
+    seen := make(map[string]bool, len(naddr))
+    for i, addr := range naddr {
+        key := addr.Network() + ":" + addr.String()
+        if seen[key] {
+            return fmt.Errorf("%w: %s", ErrDuplicateServer, servers[i])
+        }
+        seen[key] = true
+    }
+    ss.setAddrs(naddr)
+    return nil
+}
+
+// setAddrs replaces the ServerList's servers and notifies the watchers
+// of the change, if any.
+func (ss *ServerList) setAddrs(naddr []net.Addr) {
+    ss.lk.Lock()
+    added, removed := diffAddrs(ss.addrs, naddr)
+    ss.addrs = naddr
+    watchers := ss.watchers
+    ss.lk.Unlock()
+    if len(added) == 0 && len(removed) == 0 {
+        return
+    }
+    for _, fn := range watchers {
+        fn(added, removed)
+    }
+}
+
+// Watch registers fn to be called, after SetServers or
+// SetServersStrict returns, whenever they change the set of distinct
+// server addresses. Changes to weights alone are not reported.
+func (ss *ServerList) Watch(fn func(added, removed []string)) {
+    ss.lk.Lock()
+    defer ss.lk.Unlock()
+    ss.watchers = append(ss.watchers, fn)
+}
+
+// diffAddrs returns the sorted addresses that are in to but not from,
+// and in from but not to.
+func diffAddrs(from, to []net.Addr) (added, removed []string) {
+    before := make(map[string]bool, len(from))
+    for _, addr := range from {
+        before[addr.String()] = true
+    }
+    after := make(map[string]bool, len(to))
+    for _, addr := range to {
+        after[addr.String()] = true
+    }
+    for addr := range after {
+        if !before[addr] {
+            added = append(added, addr)
+        }
+    }
+    for addr := range before {
+        if !after[addr] {
+            removed = append(removed, addr)
+        }
+    }
+    sort.Strings(added)
+    sort.Strings(removed)
+    return added, removed
+}
+
+// resolveServers resolves server names to addresses. A name starting
+// with "unix://", such as "unix:///var/run/memcached.sock" or
+// "unix://memcached.sock", is followed by the path of a Unix domain
+// socket, as is a name containing a slash, such as
+// "/var/run/memcached.sock"; any other is a TCP "host:port".
+func resolveServers(servers []string) ([]net.Addr, error) {
     naddr := make([]net.Addr, len(servers))
     for i, server := range servers {
-        if strings.Contains(server, "/") {
-            addr, err := net.ResolveUnixAddr("unix", server)
+        path, isUnix := strings.CutPrefix(server, "unix://")
+        if isUnix || strings.Contains(server, "/") {
+            addr, err := net.ResolveUnixAddr("unix", path)
             if err != nil {
-                return err
+                return nil, err
             }
             naddr[i] = addr
         } else {
             tcpaddr, err := net.ResolveTCPAddr("tcp", server)
             if err != nil {
-                return err
+                return nil, err
             }
             naddr[i] = tcpaddr
         }
     }
-
-    ss.lk.Lock()
-    defer ss.lk.Unlock()
-    ss.addrs = naddr
-    return nil
+    return naddr, nil
 }
 
 func (ss *ServerList) PickServer(key string) (net.Addr, error) {
@@ -84,11 +253,128 @@ func (ss *ServerList) PickServer(key string) (net.Addr, error) {
     if len(ss.addrs) == 1 {
         return ss.addrs[0], nil
     }
+    if ss.HashTags {
+        key = hashTag(key)
+    }
     // TODO-GO: remove this copy
     cs := crc32.ChecksumIEEE([]byte(key))
-    return ss.addrs[cs%uint32(len(ss.addrs))], nil
+    addr := ss.addrs[cs%uint32(len(ss.addrs))]
+    if len(ss.down) == 0 || !ss.down[addr.String()] {
+        return addr, nil
+    }
+    live := make([]net.Addr, 0, len(ss.addrs))
+    for _, a := range ss.addrs {
+        if !ss.down[a.String()] {
+            live = append(live, a)
+        }
+    }
+    if len(live) == 0 {
+        return addr, nil
+    }
+    return live[cs%uint32(len(live))], nil
+}
+
+// MarkDown takes the server at addr out of selection: keys that would
+// map to it are spread over the other servers instead, until MarkUp is
+// called. If every server is down, keys map as if none were.
+func (ss *ServerList) MarkDown(addr net.Addr) {
+    ss.lk.Lock()
+    defer ss.lk.Unlock()
+    if ss.down == nil {
+        ss.down = make(map[string]bool)
+    }
+    ss.down[addr.String()] = true
+}
+
+// MarkUp returns the server at addr to selection.
+func (ss *ServerList) MarkUp(addr net.Addr) {
+    ss.lk.Lock()
+    defer ss.lk.Unlock()
+    delete(ss.down, addr.String())
+}
+
+// PickServers returns up to n distinct servers for key: the one
+// PickServer returns, followed by the next distinct servers in the
+// order they were listed, wrapping around. Fewer than n addresses are
+// returned if fewer distinct servers are configured.
+func (ss *ServerList) PickServers(key string, n int) ([]net.Addr, error) {
+    ss.lk.RLock()
+    defer ss.lk.RUnlock()
+    if len(ss.addrs) == 0 {
+        return nil, ErrNoServers
+    }
+    if ss.HashTags {
+        key = hashTag(key)
+    }
+    start := int(crc32.ChecksumIEEE([]byte(key)) % uint32(len(ss.addrs)))
+    var addrs []net.Addr
+    seen := make(map[string]bool)
+    for i := 0; i < len(ss.addrs) && len(addrs) < n; i++ {
+        addr := ss.addrs[(start+i)%len(ss.addrs)]
+        if k := addr.Network() + ":" + addr.String(); !seen[k] {
+            seen[k] = true
+            addrs = append(addrs, addr)
+        }
+    }
+    return addrs, nil
+}
+
+// hashTag returns the part of key that should be hashed when hash tags
+// are enabled: the text between the first "{" and the next "}", or the
+// whole key if there is no such non-empty text.
+func hashTag(key string) string {
+    start := strings.IndexByte(key, '{')
+    if start < 0 {
+        return key
+    }
+    end := strings.IndexByte(key[start+1:], '}')
+    if end <= 0 {
+        return key
+    }
+    return key[start+1 : start+1+end]
 }
 
 func (ss *ServerList) GetServers() ([]net.Addr, error) {
+    ss.lk.RLock()
+    defer ss.lk.RUnlock()
     return ss.addrs, nil
 }
+
+// RingPoint is one point of a selector's key space. Keys whose hash
+// maps to Hash are assigned to Addr.
+type RingPoint struct {
+    Hash uint32
+    Addr net.Addr
+}
+
+// Ring returns the ServerList's key space for diagnostics. A ServerList
+// places keys by their CRC-32 modulo the number of servers, so there is
+// one point per configured server, in order, whose Hash is that slot's
+// remainder. A server listed several times owns several points.
+func (ss *ServerList) Ring() []RingPoint {
+    ss.lk.RLock()
+    defer ss.lk.RUnlock()
+    points := make([]RingPoint, len(ss.addrs))
+    for i, addr := range ss.addrs {
+        points[i] = RingPoint{Hash: uint32(i), Addr: addr}
+    }
+    return points
+}
+
+// PreviewKeys reports the server each of the given keys would be
+// stored on, keyed by key. Keys that cannot be placed are omitted.
+func (ss *ServerList) PreviewKeys(keys []string) map[string]string {
+    return previewKeys(ss, keys)
+}
+
+func previewKeys(ss ServerSelector, keys []string) map[string]string {
+    m := make(map[string]string, len(keys))
+    for _, key := range keys {
+        addr, err := ss.PickServer(key)
+        if err != nil {
+            continue
+        }
+        m[key] = addr.String()
+    }
+    return m
+}
@@ -0,0 +1,246 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "errors"
+    "fmt"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestServerListRing(t *testing.T) {
+    ss := new(ServerList)
+    servers := []string{"127.0.0.1:11211", "127.0.0.1:11212", "127.0.0.1:11211"}
+    if err := ss.SetServers(servers...); err != nil {
+        t.Fatal(err)
+    }
+    ring := ss.Ring()
+    if len(ring) != len(servers) {
+        t.Fatalf("len(Ring()) = %d, want %d", len(ring), len(servers))
+    }
+    perServer := make(map[string]int)
+    for i, p := range ring {
+        if p.Hash != uint32(i) {
+            t.Errorf("point %d has Hash %d", i, p.Hash)
+        }
+        perServer[p.Addr.String()]++
+    }
+    if perServer["127.0.0.1:11211"] != 2 || perServer["127.0.0.1:11212"] != 1 {
+        t.Errorf("points per server = %v, want 2 for :11211 and 1 for :11212", perServer)
+    }
+
+    keys := make([]string, 50)
+    for i := range keys {
+        keys[i] = fmt.Sprintf("key%d", i)
+    }
+    preview := ss.PreviewKeys(keys)
+    if len(preview) != len(keys) {
+        t.Fatalf("PreviewKeys returned %d keys, want %d", len(preview), len(keys))
+    }
+    for _, key := range keys {
+        addr, _ := ss.PickServer(key)
+        if preview[key] != addr.String() {
+            t.Errorf("PreviewKeys[%q] = %q, PickServer says %q", key, preview[key], addr)
+        }
+    }
+}
+
+func TestHashTag(t *testing.T) {
+    tests := []struct{ key, want string }{
+        {"plain", "plain"},
+        {"{user42}:name", "user42"},
+        {"session:{user42}", "user42"},
+        {"{}empty", "{}empty"},
+        {"{unclosed", "{unclosed"},
+        {"a{b}c{d}", "b"},
+    }
+    for _, tt := range tests {
+        if got := hashTag(tt.key); got != tt.want {
+            t.Errorf("hashTag(%q) = %q, want %q", tt.key, got, tt.want)
+        }
+    }
+}
+
+func TestHashTagsColocateGetMulti(t *testing.T) {
+    servers := []*fakeServer{newFakeServer(t), newFakeServer(t), newFakeServer(t)}
+    ss := &ServerList{HashTags: true}
+    if err := ss.SetServers(servers[0].Addr(), servers[1].Addr(), servers[2].Addr()); err != nil {
+        t.Fatal(err)
+    }
+    c := NewFromSelector(ss)
+
+    var keys []string
+    for i := 0; i < 20; i++ {
+        key := fmt.Sprintf("{user42}:field%d", i)
+        keys = append(keys, key)
+        if err := c.Set(&Item{Key: key, Value: []byte("v")}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    m, err := c.GetMulti(keys)
+    if err != nil {
+        t.Fatalf("GetMulti: %v", err)
+    }
+    if len(m) != len(keys) {
+        t.Errorf("GetMulti returned %d items, want %d", len(m), len(keys))
+    }
+
+    var gets []string
+    for _, fs := range servers {
+        for _, cmd := range fs.commands() {
+            if strings.HasPrefix(cmd, "gets ") {
+                gets = append(gets, cmd)
+            }
+        }
+    }
+    if len(gets) != 1 {
+        t.Errorf("GetMulti issued %d gets commands, want 1: %q", len(gets), gets)
+    }
+}
+
+func TestSetServersDuplicates(t *testing.T) {
+    ss := new(ServerList)
+    if err := ss.SetServers("127.0.0.1:11211"); err != nil {
+        t.Fatal(err)
+    }
+    err := ss.SetServersStrict("127.0.0.1:11211", "127.0.0.1:11212", "127.0.0.1:11211")
+    if !errors.Is(err, ErrDuplicateServer) {
+        t.Fatalf("SetServersStrict with duplicate = %v, want ErrDuplicateServer", err)
+    }
+    if addrs, _ := ss.GetServers(); len(addrs) != 1 {
+        t.Errorf("failed SetServersStrict changed the server list to %v", addrs)
+    }
+    if err := ss.SetServersStrict("127.0.0.1:11211", "127.0.0.1:11212"); err != nil {
+        t.Errorf("SetServersStrict without duplicates = %v", err)
+    }
+
+    // The permissive form keeps treating duplicates as weight.
+    if err := ss.SetServers("127.0.0.1:11211", "127.0.0.1:11212", "127.0.0.1:11211"); err != nil {
+        t.Fatalf("SetServers with duplicate = %v", err)
+    }
+    counts := make(map[string]int)
+    for i := 0; i < 3000; i++ {
+        addr, err := ss.PickServer(fmt.Sprintf("key%d", i))
+        if err != nil {
+            t.Fatal(err)
+        }
+        counts[addr.String()]++
+    }
+    if a, b := counts["127.0.0.1:11211"], counts["127.0.0.1:11212"]; a < 3*b/2 {
+        t.Errorf("duplicated server got %d keys vs %d for the other; want about twice as many", a, b)
+    }
+}
+
+func TestReadWriteSelector(t *testing.T) {
+    writer, reader := newFakeServer(t), newFakeServer(t)
+    var writers, readers ServerList
+    writers.SetServers(writer.Addr())
+    readers.SetServers(reader.Addr())
+    c := NewFromSelector(&ReadWriteSelector{Writers: &writers, Readers: &readers})
+
+    if err := c.Set(&Item{Key: "k", Value: []byte("written")}); err != nil {
+        t.Fatal(err)
+    }
+    // Stand in for replication to the read tier.
+    reader.mu.Lock()
+    reader.items["k"] = &fakeItem{value: []byte("replica")}
+    reader.mu.Unlock()
+
+    it, err := c.Get("k")
+    if err != nil || string(it.Value) != "replica" {
+        t.Fatalf("Get = %v, %v; want the reader's item", it, err)
+    }
+    if m, err := c.GetMulti([]string{"k"}); err != nil || string(m["k"].Value) != "replica" {
+        t.Fatalf("GetMulti = %v, %v; want the reader's item", m, err)
+    }
+    if b, err := c.GetRange("k", 1, 3); err != nil || string(b) != "epl" {
+        t.Fatalf("GetRange = %q, %v; want the reader's bytes", b, err)
+    }
+    if got := strings.Join(writer.commands(), "|"); got != "set k 0 0 7" {
+        t.Errorf("writer commands = %q, want only the set", got)
+    }
+    if got := strings.Join(reader.commands(), "|"); got != "gets k|gets k|get k" {
+        t.Errorf("reader commands = %q, want only the gets", got)
+    }
+}
+
+func TestOnServersChanged(t *testing.T) {
+    ss := new(ServerList)
+    if err := ss.SetServers("127.0.0.1:11211", "127.0.0.1:11212"); err != nil {
+        t.Fatal(err)
+    }
+    c := NewFromSelector(ss)
+    var events []string
+    c.OnServersChanged = func(added, removed []string) {
+        events = append(events, fmt.Sprintf("+%v -%v", added, removed))
+    }
+
+    steps := [][]string{
+        {"127.0.0.1:11212", "127.0.0.1:11213", "127.0.0.1:11214"},
+        {"127.0.0.1:11212", "127.0.0.1:11213", "127.0.0.1:11214", "127.0.0.1:11214"},
+        {"127.0.0.1:11214"},
+    }
+    for _, servers := range steps {
+        if err := ss.SetServers(servers...); err != nil {
+            t.Fatal(err)
+        }
+    }
+    want := []string{
+        "+[127.0.0.1:11213 127.0.0.1:11214] -[127.0.0.1:11211]",
+        "+[] -[127.0.0.1:11212 127.0.0.1:11213]",
+    }
+    if strings.Join(events, "\n") != strings.Join(want, "\n") {
+        t.Errorf("events = %q, want %q", events, want)
+    }
+}
+
+func TestUnixSocketServers(t *testing.T) {
+    sock := filepath.Join(t.TempDir(), "memcached.sock")
+    fs := newFakeServerOn(t, "unix", sock)
+    for _, server := range []string{sock, "unix://" + sock} {
+        c := New(server)
+        addr, err := c.selector.PickServer("k")
+        if err != nil {
+            t.Fatalf("PickServer for %q: %v", server, err)
+        }
+        if addr.Network() != "unix" || addr.String() != sock {
+            t.Errorf("server %q resolved to %s %s, want unix %s", server, addr.Network(), addr, sock)
+        }
+        if err := c.Set(&Item{Key: "k", Value: []byte("v")}); err != nil {
+            t.Errorf("Set through %q: %v", server, err)
+        }
+    }
+    if n := fs.numDials(); n != 2 {
+        t.Errorf("server accepted %d connections, want 2", n)
+    }
+}
+
+func TestRelativeUnixSocketServer(t *testing.T) {
+    ss := new(ServerList)
+    if err := ss.SetServers("unix://memcached.sock"); err != nil {
+        t.Fatal(err)
+    }
+    addr, err := ss.PickServer("k")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if addr.Network() != "unix" || addr.String() != "memcached.sock" {
+        t.Errorf("unix://memcached.sock resolved to %s %s, want unix memcached.sock", addr.Network(), addr)
+    }
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "container/list"
+    "sync"
+)
+
+// staleCache is a small LRU of the last value seen for each key, used
+// to answer Get when StaleOnError is set and the server fails.
+type staleCache struct {
+    mu    sync.Mutex
+    ll    *list.List
+    items map[string]*list.Element
+}
+
+func (sc *staleCache) put(it *Item, max int) {
+    cp := *it
+    cp.Value = append([]byte(nil), it.Value...)
+    cp.Stale = false
+    sc.mu.Lock()
+    defer sc.mu.Unlock()
+    if sc.items == nil {
+        sc.ll = list.New()
+        sc.items = make(map[string]*list.Element)
+    }
+    if e, ok := sc.items[it.Key]; ok {
+        e.Value = &cp
+        sc.ll.MoveToFront(e)
+        return
+    }
+    sc.items[it.Key] = sc.ll.PushFront(&cp)
+    for sc.ll.Len() > max {
+        e := sc.ll.Back()
+        sc.ll.Remove(e)
+        delete(sc.items, e.Value.(*Item).Key)
+    }
+}
+
+// get returns a copy of the last value stored for key, marked stale.
+func (sc *staleCache) get(key string) (*Item, bool) {
+    sc.mu.Lock()
+    defer sc.mu.Unlock()
+    e, ok := sc.items[key]
+    if !ok {
+        return nil, false
+    }
+    it := *e.Value.(*Item)
+    it.Value = append([]byte(nil), it.Value...)
+    it.Stale = true
+    return &it, true
+}
+
+func (sc *staleCache) remove(key string) {
+    sc.mu.Lock()
+    defer sc.mu.Unlock()
+    if e, ok := sc.items[key]; ok {
+        sc.ll.Remove(e)
+        delete(sc.items, key)
+    }
+}
+
+// rememberStale records the outcome of a Get or store of item for use
+// by StaleOnError. A nil item means key is known to be absent.
+func (c *Client) rememberStale(key string, item *Item) {
+    if c.StaleOnError <= 0 {
+        return
+    }
+    if item == nil {
+        c.stale.remove(key)
+        return
+    }
+    c.stale.put(item, c.StaleOnError)
+}
+
+// staleOnError returns the stale value for key if StaleOnError is set
+// and err means the server could not answer.
+func (c *Client) staleOnError(key string, err error) (*Item, bool) {
+    if c.StaleOnError <= 0 || err == nil || resumableError(err) {
+        return nil, false
+    }
+    return c.stale.get(key)
+}
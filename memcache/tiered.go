@@ -0,0 +1,88 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+// TieredClient is a two-tier memcache client, for running a small,
+// fast primary tier of servers in front of a larger, slower secondary
+// tier. It is safe for concurrent use as long as its fields are not
+// changed.
+type TieredClient struct {
+    // Primary and Secondary are the clients of the two tiers.
+    Primary, Secondary *Client
+
+    // PrimaryOnly makes Set write only to the primary tier. By
+    // default it writes to both.
+    PrimaryOnly bool
+}
+
+// NewTiered returns a TieredClient whose tiers use the given selectors.
+func NewTiered(primary, secondary ServerSelector) *TieredClient {
+    return &TieredClient{
+        Primary:   NewFromSelector(primary),
+        Secondary: NewFromSelector(secondary),
+    }
+}
+
+// Get gets the item for the given key from the primary tier or, if it
+// misses or fails there, from the secondary tier. An item found only
+// in the secondary tier is promoted: it is stored in the primary tier
+// before being returned, with the primary client's DefaultExpiration
+// since its remaining lifetime is not known. If both tiers miss,
+// ErrCacheMiss is returned; otherwise the secondary tier's error is.
+func (tc *TieredClient) Get(key string) (*Item, error) {
+    if it, err := tc.Primary.Get(key); err == nil {
+        return it, nil
+    }
+    it, err := tc.Secondary.Get(key)
+    if err != nil {
+        return nil, err
+    }
+    // A failed promotion only costs a later trip to the secondary.
+    tc.Primary.Set(&Item{Key: it.Key, Value: it.Value, Flags: it.Flags})
+    return it, nil
+}
+
+// Set writes the given item, unconditionally, to the primary tier and,
+// unless PrimaryOnly is set, to the secondary tier. Both writes are
+// attempted; the primary's error is returned in preference to the
+// secondary's.
+func (tc *TieredClient) Set(item *Item) error {
+    err := tc.Primary.Set(item)
+    if !tc.PrimaryOnly {
+        if serr := tc.Secondary.Set(item); err == nil {
+            err = serr
+        }
+    }
+    return err
+}
+
+// Delete deletes the item with the given key from both tiers. It
+// returns ErrCacheMiss only if neither tier had the item.
+func (tc *TieredClient) Delete(key string) error {
+    perr := tc.Primary.Delete(key)
+    serr := tc.Secondary.Delete(key)
+    switch {
+    case perr == nil:
+        if serr == ErrCacheMiss {
+            return nil
+        }
+        return serr
+    case perr == ErrCacheMiss:
+        return serr
+    }
+    return perr
+}
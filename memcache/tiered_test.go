@@ -0,0 +1,86 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+    "testing"
+)
+
+func newTestTiered(t *testing.T) (tc *TieredClient, l1, l2 *fakeServer) {
+    l1, l2 = newFakeServer(t), newFakeServer(t)
+    var ss1, ss2 ServerList
+    if err := ss1.SetServers(l1.Addr()); err != nil {
+        t.Fatal(err)
+    }
+    if err := ss2.SetServers(l2.Addr()); err != nil {
+        t.Fatal(err)
+    }
+    return NewTiered(&ss1, &ss2), l1, l2
+}
+
+func TestTieredPromotesSecondaryHit(t *testing.T) {
+    tc, l1, _ := newTestTiered(t)
+    if err := tc.Secondary.Set(&Item{Key: "k", Value: []byte("v"), Flags: 3}); err != nil {
+        t.Fatal(err)
+    }
+
+    it, err := tc.Get("k")
+    if err != nil {
+        t.Fatalf("Get = %v", err)
+    }
+    if string(it.Value) != "v" || it.Flags != 3 {
+        t.Errorf("Get = %q flags %d, want %q flags 3", it.Value, it.Flags, "v")
+    }
+    l1.mu.Lock()
+    promoted := l1.items["k"]
+    l1.mu.Unlock()
+    if promoted == nil || string(promoted.value) != "v" || promoted.flags != 3 {
+        t.Errorf("item not promoted to the primary tier: %+v", promoted)
+    }
+
+    if _, err := tc.Get("missing"); err != ErrCacheMiss {
+        t.Errorf("Get(missing) = %v, want ErrCacheMiss", err)
+    }
+}
+
+func TestTieredSet(t *testing.T) {
+    tc, l1, l2 := newTestTiered(t)
+    if err := tc.Set(&Item{Key: "both", Value: []byte("v")}); err != nil {
+        t.Fatal(err)
+    }
+    tc.PrimaryOnly = true
+    if err := tc.Set(&Item{Key: "l1", Value: []byte("v")}); err != nil {
+        t.Fatal(err)
+    }
+    l1.mu.Lock()
+    n1 := len(l1.items)
+    l1.mu.Unlock()
+    l2.mu.Lock()
+    _, both := l2.items["both"]
+    n2 := len(l2.items)
+    l2.mu.Unlock()
+    if n1 != 2 || n2 != 1 || !both {
+        t.Errorf("primary holds %d items and secondary %d, want 2 and 1", n1, n2)
+    }
+
+    if err := tc.Delete("l1"); err != nil {
+        t.Errorf("Delete(l1) = %v", err)
+    }
+    if err := tc.Delete("l1"); err != ErrCacheMiss {
+        t.Errorf("second Delete(l1) = %v, want ErrCacheMiss", err)
+    }
+}